@@ -0,0 +1,316 @@
+//go:build linux
+
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"sync"
+	"time"
+
+	"diy-parca-agent/symbol"
+)
+
+// DefaultInterval is how often the agent uploads a profile by default.
+const DefaultInterval = 10 * time.Second
+
+// collectInterval is how often the agent flushes the samples between the uploads,
+// so the metadata of the sampled processes is cached before they exit, see ProcessCache.
+const collectInterval = time.Second
+
+// Agent continuously profiles and uploads CPU profiles, see Start.
+type Agent struct {
+	profiler   *Profiler
+	kernel     *KernelSymbols
+	symbolizer *symbol.Symbolizer
+	sanitizer  *Sanitizer
+	metrics    *Metrics
+	guessFuncs bool
+	perfMaps   *PerfMaps
+	focus      *regexp.Regexp
+	ignore     *regexp.Regexp
+	minCount   uint64
+	// stripGoRuntime drops the Go runtime scheduling frames, see ProfileOptions.StripGoRuntime.
+	stripGoRuntime bool
+	interval       time.Duration
+	align          time.Duration
+	sink           Sink
+	labels         Labels
+	providers      []LabelProvider
+	// symbols loads the symbol tables in the background if symbolizeBudget is set.
+	symbols         *symbolQueue
+	symbolizeBudget time.Duration
+	// procs caches the metadata of the processes sampled since the last upload,
+	// and pending are their samples.
+	procs   *ProcessCache
+	pending []Sample
+	// windowStart is when the profiling window of the next upload started.
+	windowStart time.Time
+	// uploadErr is the last failed upload, it's returned by Stop.
+	uploadErr error
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// Start starts profiling in the background and passes a CPU profile to c.Sinks every c.Interval.
+// For example, a Go service can profile itself
+// including cgo and kernel frames which runtime/pprof misses:
+//
+//	a, err := agent.Start(agent.Config{
+//		SelfPID: true,
+//		Sinks: []agent.Sink{agent.SinkFunc(func(ctx context.Context, p *agent.EncodedProfile, labels agent.Labels) error {
+//			return p.Write(w, agent.Compression{})
+//		})},
+//	})
+//	...
+//	defer a.Stop()
+//
+// The process must run as root or with CAP_BPF and CAP_PERFMON to load the BPF program, see Privileges.
+func Start(c Config) (*Agent, error) {
+	if len(c.Sinks) == 0 {
+		return nil, errors.New("at least one sink is required")
+	}
+
+	var perfMaps *PerfMaps
+	if c.PerfMaps {
+		var err error
+		perfMaps, err = NewPerfMaps(PerfMapsOptions{
+			JVMRefresh: c.JVMPerfMaps,
+			Dotnet:     c.DotnetPerfMaps,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	p, err := NewProfiler(c)
+	if err != nil {
+		if perfMaps != nil {
+			perfMaps.Close()
+		}
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	a := Agent{
+		profiler:       p,
+		symbolizer:     c.Symbolizer,
+		sanitizer:      c.Sanitizer,
+		metrics:        c.Metrics,
+		guessFuncs:     c.GuessFuncs,
+		perfMaps:       perfMaps,
+		focus:          c.Focus,
+		ignore:         c.Ignore,
+		minCount:       c.MinCount,
+		stripGoRuntime: c.StripGoRuntime,
+		interval:       c.Interval,
+		align:          c.Align,
+		sink:           c.Sinks[0],
+		labels:         c.Labels,
+		providers:      c.LabelProviders,
+		procs:          NewProcessCache(c.Symbolizer),
+		windowStart:    time.Now(),
+		cancel:         cancel,
+	}
+	if a.interval == 0 {
+		a.interval = DefaultInterval
+	}
+	if c.Symbolizer != nil && c.SymbolizeBudget > 0 {
+		a.symbols = newSymbolQueue(c.Symbolizer, c.Metrics)
+		a.symbolizeBudget = c.SymbolizeBudget
+		a.procs.queue = a.symbols
+	}
+	if len(c.Sinks) > 1 {
+		a.sink = MultiSink(c.Sinks)
+	}
+	// Kernel frames are left unsymbolized if the kernel symbols are unavailable.
+	if a.kernel, err = LoadKernelSymbols(); err != nil {
+		log.Printf("kernel frames won't be symbolized: %v", err)
+	}
+
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		a.run(ctx)
+	}()
+
+	return &a, nil
+}
+
+// Profiler returns the underlying profiler, e.g., to change its frequency.
+func (a *Agent) Profiler() *Profiler {
+	return a.profiler
+}
+
+// run uploads a profile every interval (or on every alignment boundary) until the context is cancelled.
+// The samples are collected more often in between, see collectInterval.
+func (a *Agent) run(ctx context.Context) {
+	next := a.windowStart.Add(a.interval)
+	if a.align > 0 {
+		next = a.windowStart.Truncate(a.align).Add(a.align)
+	}
+	timer := time.NewTimer(time.Until(next))
+	defer timer.Stop()
+	collect := time.NewTicker(collectInterval)
+	defer collect.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-collect.C:
+			if err := a.collect(); err != nil {
+				log.Print(err)
+			}
+		case <-timer.C:
+			// The window ends on the boundary rather than when the timer fired,
+			// unless the wall clock was set back past the window's start.
+			end := next
+			if a.align == 0 || !end.After(a.windowStart) {
+				end = time.Now()
+			}
+			if err := a.flush(ctx, end); err != nil {
+				log.Print(err)
+				if Reason(err) == FailureUploadFailed {
+					a.uploadErr = err
+				}
+			}
+
+			// The next upload is scheduled from the planned time, so the uploads don't drift.
+			if a.align > 0 {
+				next = time.Now().Truncate(a.align).Add(a.align)
+			} else {
+				next = next.Add(a.interval)
+			}
+			timer.Reset(time.Until(next))
+		}
+	}
+}
+
+// collect flushes the samples from the profiler and caches the metadata
+// of the processes sampled for the first time while they're still running.
+func (a *Agent) collect() error {
+	samples, err := a.profiler.Flush()
+	if err != nil {
+		return fmt.Errorf("failed to flush samples: %w", err)
+	}
+	a.procs.Add(samples)
+	a.pending = append(a.pending, samples...)
+	return nil
+}
+
+// flush uploads a profile of the samples collected since the previous flush,
+// the profiling window ends at the given time.
+func (a *Agent) flush(ctx context.Context, end time.Time) error {
+	if err := a.collect(); err != nil {
+		return err
+	}
+	samples := a.pending
+	a.pending = nil
+	start := a.windowStart
+	a.windowStart = end
+	defer a.evictCaches()
+	if len(samples) == 0 {
+		return nil
+	}
+
+	mappings := a.procs.Mappings(samples)
+	names := a.procs.Names(samples)
+	if a.metrics != nil {
+		a.metrics.Add(samples, mappings, names)
+	}
+	if a.perfMaps != nil {
+		a.perfMaps.WatchProcesses(mappings)
+	}
+
+	opts := ProfileOptions{
+		Frequency:      a.profiler.Frequency(),
+		Mappings:       mappings,
+		ProcessNames:   names,
+		ProcessLabels:  ProcessLabels(samples, a.providers),
+		Resources:      ProcessResources(samples),
+		Cmdlines:       a.procs.Cmdlines(samples),
+		KernelSymbols:  a.kernel,
+		Symbolizer:     a.symbolizer,
+		GuessFuncs:     a.guessFuncs,
+		PerfMaps:       a.perfMaps,
+		Focus:          a.focus,
+		Ignore:         a.ignore,
+		MinCount:       a.minCount,
+		StripGoRuntime: a.stripGoRuntime,
+		CPUCoverage:    a.profiler.CPUCoverage(),
+		Start:          start,
+		Duration:       end.Sub(start),
+		Sanitizer:      a.sanitizer,
+	}
+	if a.symbols != nil {
+		opts.SymbolizeDeadline = time.Now().Add(a.symbolizeBudget)
+		opts.SymbolizeDeferred = func(pid uint32, m Mapping) {
+			if a.metrics != nil {
+				a.metrics.AddUnsymbolized(1)
+			}
+			a.symbols.add(pid, m)
+		}
+	}
+	// The samples are encoded as they're converted, so the profile graph isn't built for the sinks.
+	prof := EncodeProfile(samples, opts)
+	if err := a.sink.Write(ctx, prof, a.labels); err != nil {
+		return fmt.Errorf("failed to upload profile: %w", err)
+	}
+
+	return nil
+}
+
+// evictCaches forgets the processes which weren't sampled in the window (including the binary paths
+// in their root directories, see Symbolizer.ForgetRoots)
+// and charges the process and perf map caches to the symbol memory budget, see Symbolizer.Reserve.
+func (a *Agent) evictCaches() {
+	evicted := a.procs.Evict()
+
+	s := CacheStats{ProcessBytes: a.procs.Bytes()}
+	if a.perfMaps != nil {
+		s.PerfMapBytes = a.perfMaps.Bytes()
+	}
+	if a.symbolizer != nil {
+		roots := make(map[string]bool, len(evicted))
+		for _, pid := range evicted {
+			roots[procPath(pid, "")] = true
+		}
+		a.symbolizer.ForgetRoots(roots)
+		a.symbolizer.Reserve(s.ProcessBytes + s.PerfMapBytes)
+		s.Symbols = a.symbolizer.Stats()
+	}
+	if a.metrics != nil {
+		a.metrics.SetCacheStats(s)
+	}
+}
+
+// Stop stops profiling, uploads the samples collected since the last upload,
+// and releases the BPF resources.
+// Unless anything else fails, it returns the last failed upload of the run (see FailureUploadFailed),
+// the uploads go on after a failure meanwhile.
+func (a *Agent) Stop() error {
+	a.cancel()
+	a.wg.Wait()
+
+	err := a.flush(context.Background(), time.Now())
+	if err == nil {
+		err = a.uploadErr
+	}
+	if closeErr := a.profiler.Close(); err == nil {
+		err = closeErr
+	}
+	if a.perfMaps != nil {
+		if closeErr := a.perfMaps.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if a.symbols != nil {
+		a.symbols.Close()
+	}
+	return err
+}
@@ -0,0 +1,58 @@
+//go:build linux
+
+package agent
+
+import (
+	"fmt"
+
+	"github.com/cilium/ebpf/link"
+)
+
+// attachMode attaches the BPF programs recording the events of the mode
+// other than CPU samples, e.g., block_rq_issue tracepoint for ModeBlockIO.
+// The caller is responsible for closing the links.
+func attachMode(objs *Objects, mode Mode) ([]link.Link, error) {
+	var links []link.Link
+	switch mode {
+	case ModeBlockIO:
+		l, err := link.Tracepoint("block", "block_rq_issue", objs.objs.OnBlockRqIssue)
+		if err != nil {
+			return nil, fmt.Errorf("failed to attach BPF program to block_rq_issue: %w", err)
+		}
+		links = append(links, l)
+	case ModeTCP:
+		send, err := link.Kprobe("tcp_sendmsg", objs.objs.OnTcpSendmsg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to attach BPF program to tcp_sendmsg: %w", err)
+		}
+		retransmit, err := link.Kprobe("tcp_retransmit_skb", objs.objs.OnTcpRetransmitSkb)
+		if err != nil {
+			send.Close()
+			return nil, fmt.Errorf("failed to attach BPF program to tcp_retransmit_skb: %w", err)
+		}
+		links = append(links, send, retransmit)
+	case ModeRunqueue:
+		wakeup, err := link.Tracepoint("sched", "sched_wakeup", objs.objs.OnSchedWakeup)
+		if err != nil {
+			return nil, fmt.Errorf("failed to attach BPF program to sched_wakeup: %w", err)
+		}
+		switchTask, err := link.Tracepoint("sched", "sched_switch", objs.objs.OnSchedSwitch)
+		if err != nil {
+			wakeup.Close()
+			return nil, fmt.Errorf("failed to attach BPF program to sched_switch: %w", err)
+		}
+		links = append(links, wakeup, switchTask)
+	}
+	return links, nil
+}
+
+// closeLinks detaches the BPF programs.
+func closeLinks(links []link.Link) error {
+	var firstErr error
+	for _, l := range links {
+		if err := l.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
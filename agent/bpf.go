@@ -0,0 +1,638 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/cilium/ebpf"
+)
+
+// The BPF objects for both byte orders are compiled and committed to the repository,
+// so the profiler can be built on a machine without clang.
+// The Go build constraints in the generated files embed the object
+// which matches the byte order of the target architecture.
+//go:generate go run github.com/cilium/ebpf/cmd/bpf2go -cflags $BPF_CFLAGS -cc clang-13 -target bpfel,bpfeb parcaAgent ./bpf/parca-agent.bpf.c -- -I../headers
+
+// flushGracePeriod is how long Flush waits after switching the buffers
+// for the BPF programs which still write to the previously active buffer.
+// The BPF program is short and runs with preemption disabled,
+// so it finishes within microseconds.
+const flushGracePeriod = 10 * time.Millisecond
+
+// Objects are the BPF program and maps loaded into the kernel.
+type Objects struct {
+	objs    parcaAgentObjects
+	buffers [2]Buffer
+	// active is an index of the buffer the BPF program writes to.
+	active uint32
+
+	// targetsMu guards targetPIDs, targetCgroups, deniedPIDs, deniedCgroups, and overriddenTIDs,
+	// the contents of target_pids, target_cgroups, denied_pids, denied_cgroups, and overridden_tids maps.
+	targetsMu      sync.Mutex
+	targetPIDs     map[uint32]bool
+	targetCgroups  map[uint64]bool
+	deniedPIDs     map[uint32]bool
+	deniedCgroups  map[uint64]bool
+	overriddenTIDs map[uint32]bool
+}
+
+// maxTargetUIDs is the max number of users whose processes can be sampled,
+// see MAX_TARGET_UIDS in the BPF program.
+const maxTargetUIDs = 64
+
+// maxTargetPIDs is the max number of processes which can be sampled,
+// see MAX_TARGET_PIDS in the BPF program.
+const maxTargetPIDs = 8192
+
+// maxTargetCgroups is the max number of cgroups whose processes can be sampled,
+// see MAX_TARGET_CGROUPS in the BPF program.
+const maxTargetCgroups = 8192
+
+// maxDeniedComms is the max number of process names which are never sampled,
+// see MAX_DENIED_COMMS in the BPF program.
+const maxDeniedComms = 64
+
+// ObjectsOptions configures the BPF program before it's loaded.
+type ObjectsOptions struct {
+	// UIDs are the users whose processes are sampled (all processes are sampled if empty).
+	// The processes are filtered in the BPF program, so the other processes' stacks aren't even walked.
+	UIDs []uint32
+	// FilterPIDs makes the BPF program sample only the processes added by SetTargetPIDs and AddTargetPID.
+	// The targets can be changed while profiling without reattaching the perf events.
+	FilterPIDs bool
+	// FilterCgroups makes the BPF program sample only the processes in the cgroups added by SetTargetCgroups.
+	// It can be combined with the other filters. It requires Linux 4.18+ and cgroup v2.
+	FilterCgroups bool
+	// DeniedComms are the names of the processes which are never sampled, even if they're targeted.
+	DeniedComms []string
+	// FilterDenied makes the BPF program drop the samples of the processes named DeniedComms
+	// and the processes added by SetDeniedPIDs and AddDeniedPID.
+	FilterDenied bool
+	// FilterDeniedCgroups makes the BPF program drop the samples of the processes in the cgroups
+	// added by SetDeniedCgroups. It requires Linux 4.18+ and cgroup v2.
+	FilterDeniedCgroups bool
+	// TimeBucket splits the samples by the time they were taken into the intervals of this duration
+	// (the samples aren't split if it's zero), see StackCountKey.TimeBucket.
+	TimeBucket time.Duration
+	// WalkDepth makes the BPF program walk the user stacks by following frame pointers
+	// up to this depth (at most MaxWalkDepth) instead of using bpf_get_stackid().
+	// The walked stacks are deeper than StackDepth and don't collide in the StackTraces map.
+	// Only the stacks sampled in user space can be walked, the others fall back to bpf_get_stackid().
+	// It requires Linux 5.5+ for bounded loops and bpf_probe_read_user().
+	WalkDepth int
+	// StackDepth is the max depth of the stacks stored by bpf_get_stackid() (DefaultStackDepth if zero),
+	// the deeper stacks are truncated. The values of the stack maps are resized accordingly,
+	// i.e., every stored stack takes StackDepth*8 bytes (StackDepth*32 bytes in BuildIDStacks maps).
+	// The kernel rejects the depths above kernel.perf_event_max_stack sysctl (127 by default).
+	StackDepth int
+	// BuildIDStacks makes the BPF program also store the user stacks as the build IDs of the binaries
+	// and file offsets (BPF_F_STACK_BUILD_ID), see Sample.UserBuildIDStack.
+	// They are symbolized even if the process exits before its memory mappings are read.
+	// The stacks walked by the program (see WalkDepth) aren't stored. It requires Linux 4.17+.
+	BuildIDStacks bool
+	// TraceContext labels the samples with the trace context of the sampled threads
+	// reported by the instrumented application, see Config.TraceContext.
+	TraceContext bool
+	// IPC makes the BPF program attribute the cycles and instructions counted since the previous sample
+	// on the CPU to the sample, see Sample.Instructions. The program must be attached to the cycles events
+	// whose groups count the instructions, see SetInstructionsCounter. It requires Linux 4.15+.
+	IPC bool
+	// LBR makes UnwinderLBR reconstruct the user stacks from the last branch records,
+	// the program must be attached to the perf events which capture them in call stack mode
+	// (PERF_SAMPLE_BRANCH_CALL_STACK). It requires Linux 5.6+ for bpf_read_branch_records().
+	LBR bool
+	// FrequencyOverrides makes the program attached to the per-CPU perf events (see Program)
+	// skip the threads sampled at their own frequencies by OverrideProgram, see SetOverriddenThreads.
+	FrequencyOverrides bool
+	// TraceContextGoABI tells that the marker function reporting the trace context
+	// uses Go's register-based calling convention.
+	TraceContextGoABI bool
+}
+
+// LoadObjects loads the BPF program and maps into the kernel.
+// The caller is responsible for closing the objects.
+func LoadObjects(opts ObjectsOptions) (*Objects, error) {
+	if len(opts.UIDs) > maxTargetUIDs {
+		return nil, fmt.Errorf("at most %d users can be targeted", maxTargetUIDs)
+	}
+	if len(opts.DeniedComms) > maxDeniedComms {
+		return nil, fmt.Errorf("at most %d process names can be denied", maxDeniedComms)
+	}
+	if opts.WalkDepth < 0 || opts.WalkDepth > MaxWalkDepth {
+		return nil, fmt.Errorf("stack walk depth must be within [0, %d]", MaxWalkDepth)
+	}
+	if opts.StackDepth < 0 {
+		return nil, errors.New("stack depth must not be negative")
+	}
+
+	spec, err := loadSpec()
+	if err != nil {
+		return nil, err
+	}
+	if opts.StackDepth > 0 {
+		resizeStackMaps(spec, opts.StackDepth)
+	}
+	if err = raiseMemlock(spec); err != nil {
+		return nil, err
+	}
+	consts := make(map[string]interface{})
+	if len(opts.UIDs) > 0 {
+		consts["filter_uids"] = true
+	}
+	if opts.FilterPIDs {
+		consts["filter_pids"] = true
+	}
+	if opts.FilterCgroups {
+		consts["filter_cgroups"] = true
+	}
+	if opts.FilterDenied || len(opts.DeniedComms) > 0 {
+		consts["filter_denied"] = true
+	}
+	if opts.FilterDeniedCgroups {
+		consts["filter_denied_cgroups"] = true
+	}
+	if opts.TimeBucket > 0 {
+		consts["time_bucket_ns"] = uint64(opts.TimeBucket.Nanoseconds())
+	}
+	if opts.WalkDepth > 0 {
+		consts["walk_depth"] = uint32(opts.WalkDepth)
+	}
+	if opts.BuildIDStacks {
+		consts["record_build_ids"] = true
+	}
+	if opts.IPC {
+		consts["count_ipc"] = true
+	}
+	if opts.LBR {
+		consts["lbr_call_stacks"] = true
+	}
+	if opts.FrequencyOverrides {
+		consts["frequency_overrides"] = true
+	}
+	if opts.TraceContext {
+		consts["trace_context"] = true
+		consts["trace_context_go_abi"] = opts.TraceContextGoABI
+	}
+	if len(consts) > 0 {
+		if err = spec.RewriteConstants(consts); err != nil {
+			return nil, fmt.Errorf("failed to configure the BPF program: %w", err)
+		}
+	}
+
+	o := Objects{
+		targetPIDs:     make(map[uint32]bool),
+		targetCgroups:  make(map[uint64]bool),
+		deniedPIDs:     make(map[uint32]bool),
+		deniedCgroups:  make(map[uint64]bool),
+		overriddenTIDs: make(map[uint32]bool),
+	}
+	if err = spec.LoadAndAssign(&o.objs, nil); err != nil {
+		return nil, loadError(err)
+	}
+	for _, uid := range opts.UIDs {
+		if err = o.objs.TargetUids.Put(uid, uint8(1)); err != nil {
+			o.Close()
+			return nil, fmt.Errorf("failed to add target UID %d: %w", uid, err)
+		}
+	}
+	for _, name := range opts.DeniedComms {
+		// The key is the null-padded name as returned by bpf_get_current_comm().
+		var comm [maxCommLen + 1]byte
+		copy(comm[:maxCommLen], name)
+		if err = o.objs.DeniedComms.Put(comm, uint8(1)); err != nil {
+			o.Close()
+			return nil, fmt.Errorf("failed to add denied process name %q: %w", name, err)
+		}
+	}
+	if err = o.registerSamplePrograms(); err != nil {
+		o.Close()
+		return nil, err
+	}
+	o.buffers = [2]Buffer{
+		{Counts: o.objs.Counts0, StackTraces: o.objs.StackTraces0, UserStacks: o.objs.UserStacks0, runqStackTraces: o.objs.RunqStackTraces},
+		{Counts: o.objs.Counts1, StackTraces: o.objs.StackTraces1, UserStacks: o.objs.UserStacks1, runqStackTraces: o.objs.RunqStackTraces},
+	}
+	if opts.BuildIDStacks {
+		o.buffers[0].buildIDStacks = o.objs.BuildIdStacks0
+		o.buffers[1].buildIDStacks = o.objs.BuildIdStacks1
+	}
+
+	return &o, nil
+}
+
+// resizeStackMaps sizes the values of the stack trace maps to hold the stacks up to the depth,
+// bpf_get_stackid() stores as many frames as fit.
+func resizeStackMaps(spec *ebpf.CollectionSpec, depth int) {
+	for _, name := range []string{"stack_traces_0", "stack_traces_1", "runq_stack_traces"} {
+		if ms, ok := spec.Maps[name]; ok {
+			ms.ValueSize = uint32(depth * 8)
+		}
+	}
+	for _, name := range []string{"build_id_stacks_0", "build_id_stacks_1"} {
+		if ms, ok := spec.Maps[name]; ok {
+			ms.ValueSize = uint32(depth * buildIDStackFrameSize)
+		}
+	}
+}
+
+// Unwinder is a BPF program which stores the stacks of the CPU samples.
+// It's tail-called by do_sample program and can be selected per process, see SetProcessUnwinder.
+type Unwinder uint32
+
+const (
+	// UnwinderFramePointers stores the stacks using bpf_get_stackid()
+	// or walks the frame pointers, see ObjectsOptions.WalkDepth.
+	// It's used for the processes without an unwinder.
+	UnwinderFramePointers Unwinder = 0
+	// UnwinderLBR reconstructs the user stacks from the last branch records, see ObjectsOptions.LBR.
+	// It falls back to UnwinderFramePointers if LBR isn't enabled.
+	UnwinderLBR Unwinder = 2
+)
+
+// progAggregate is the index of aggregate_sample program in sample_programs map,
+// the last program of the CPU sample chain, see sample_prog_t in the BPF program.
+const progAggregate = 1
+
+// registerSamplePrograms puts the programs tail-called by do_sample into sample_programs map.
+// If a program is missing, the sample is recorded by the calling program instead.
+func (o *Objects) registerSamplePrograms() error {
+	progs := map[uint32]*ebpf.Program{
+		uint32(UnwinderFramePointers): o.objs.UnwindFramePointers,
+		progAggregate:                 o.objs.AggregateSample,
+		uint32(UnwinderLBR):           o.objs.UnwindLbr,
+	}
+	for i, prog := range progs {
+		if err := o.objs.SamplePrograms.Put(i, prog); err != nil {
+			return fmt.Errorf("failed to register sample program %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// SetProcessUnwinder selects the unwinder of the process's CPU samples,
+// UnwinderFramePointers is used by default.
+func (o *Objects) SetProcessUnwinder(pid uint32, u Unwinder) error {
+	switch u {
+	case UnwinderFramePointers:
+		if err := o.objs.ProcessUnwinders.Delete(pid); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return fmt.Errorf("failed to reset unwinder of process %d: %w", pid, err)
+		}
+		return nil
+	case UnwinderLBR:
+		if err := o.objs.ProcessUnwinders.Put(pid, uint32(u)); err != nil {
+			return fmt.Errorf("failed to set unwinder of process %d: %w", pid, err)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown unwinder %d", u)
+}
+
+// loadSpec parses the embedded BPF object.
+// It makes sure the object is present and matches the host's byte order,
+// since a mismatch is otherwise reported by the kernel as an obscure error.
+func loadSpec() (*ebpf.CollectionSpec, error) {
+	if len(_ParcaAgentBytes) == 0 {
+		return nil, errors.New("BPF object is missing from the binary: run go generate ./agent and rebuild the profiler")
+	}
+
+	spec, err := ebpf.LoadCollectionSpecFromReader(bytes.NewReader(_ParcaAgentBytes))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the embedded BPF object: %w", err)
+	}
+	if spec.ByteOrder != nativeEndian {
+		return nil, fmt.Errorf("BPF object byte order %s doesn't match the host's %s", spec.ByteOrder, nativeEndian)
+	}
+
+	return spec, nil
+}
+
+// nativeEndian is the byte order of the host.
+var nativeEndian = func() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+// loadError explains the most common reasons
+// why the kernel rejected the BPF program or maps.
+func loadError(err error) error {
+	switch {
+	case errors.Is(err, os.ErrPermission):
+		return failure(FailurePermissionDenied, fmt.Errorf("kernel denied loading the BPF program, the profiler must run as root or with CAP_BPF and CAP_PERFMON: %w", err))
+	case errors.Is(err, ebpf.ErrNotSupported):
+		return failure(FailureKernelUnsupported, fmt.Errorf("kernel doesn't support the BPF program, Linux 4.9+ is required: %w", err))
+	}
+	return fmt.Errorf("kernel rejected the BPF program: %w", err)
+}
+
+// Program returns the BPF program which should be attached to perf events.
+func (o *Objects) Program() *ebpf.Program {
+	return o.objs.DoSample
+}
+
+// OverrideProgram returns the BPF program which should be attached to the perf events
+// of the threads sampled at their own frequencies, see ObjectsOptions.FrequencyOverrides.
+func (o *Objects) OverrideProgram() *ebpf.Program {
+	return o.objs.DoSampleOverride
+}
+
+// SetOverriddenThreads replaces the threads which are skipped by Program
+// since they're sampled by their own perf events at their processes' frequencies,
+// see ObjectsOptions.FrequencyOverrides.
+// Only the difference with the current threads is written to the overridden_tids map.
+func (o *Objects) SetOverriddenThreads(tids map[uint32]bool) error {
+	if len(tids) > maxTargetPIDs {
+		return fmt.Errorf("at most %d threads can be sampled at their own frequencies, found %d", maxTargetPIDs, len(tids))
+	}
+
+	o.targetsMu.Lock()
+	defer o.targetsMu.Unlock()
+
+	for tid := range o.overriddenTIDs {
+		if tids[tid] {
+			continue
+		}
+		if err := o.objs.OverriddenTids.Delete(tid); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return fmt.Errorf("failed to remove overridden thread %d: %w", tid, err)
+		}
+		delete(o.overriddenTIDs, tid)
+	}
+	for tid := range tids {
+		if o.overriddenTIDs[tid] {
+			continue
+		}
+		if err := o.objs.OverriddenTids.Put(tid, uint8(1)); err != nil {
+			return fmt.Errorf("failed to add overridden thread %d: %w", tid, err)
+		}
+		o.overriddenTIDs[tid] = true
+	}
+	return nil
+}
+
+// SetInstructionsCounter sets the instructions counter of the CPU, see ObjectsOptions.IPC.
+// The counter must be a member of the group led by the cycles event the program is attached to on the CPU.
+func (o *Objects) SetInstructionsCounter(cpu, fd int) error {
+	if err := o.objs.InstructionsCounters.Put(uint32(cpu), uint32(fd)); err != nil {
+		return fmt.Errorf("failed to set instructions counter of cpu %d: %w", cpu, err)
+	}
+	return nil
+}
+
+// SetTargetPIDs replaces the processes sampled by the BPF program, see ObjectsOptions.FilterPIDs.
+// Only the difference with the current targets is written to the target_pids map.
+func (o *Objects) SetTargetPIDs(pids map[uint32]bool) error {
+	if len(pids) > maxTargetPIDs {
+		return fmt.Errorf("at most %d processes can be targeted, found %d", maxTargetPIDs, len(pids))
+	}
+
+	o.targetsMu.Lock()
+	defer o.targetsMu.Unlock()
+
+	// The exited processes are removed first to make room for the new ones.
+	for pid := range o.targetPIDs {
+		if pids[pid] {
+			continue
+		}
+		if err := o.objs.TargetPids.Delete(pid); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return fmt.Errorf("failed to remove target PID %d: %w", pid, err)
+		}
+		delete(o.targetPIDs, pid)
+	}
+	for pid := range pids {
+		if o.targetPIDs[pid] {
+			continue
+		}
+		if err := o.objs.TargetPids.Put(pid, uint8(1)); err != nil {
+			return fmt.Errorf("failed to add target PID %d: %w", pid, err)
+		}
+		o.targetPIDs[pid] = true
+	}
+	return nil
+}
+
+// AddTargetPID makes the BPF program sample the process along with the current targets,
+// e.g., a process which has just exec'ed the target executable.
+func (o *Objects) AddTargetPID(pid uint32) error {
+	o.targetsMu.Lock()
+	defer o.targetsMu.Unlock()
+
+	if o.targetPIDs[pid] {
+		return nil
+	}
+	if err := o.objs.TargetPids.Put(pid, uint8(1)); err != nil {
+		return fmt.Errorf("failed to add target PID %d: %w", pid, err)
+	}
+	o.targetPIDs[pid] = true
+	return nil
+}
+
+// SetTargetCgroups replaces the cgroup IDs whose processes are sampled by the BPF program,
+// see ObjectsOptions.FilterCgroups.
+// Only the difference with the current targets is written to the target_cgroups map.
+func (o *Objects) SetTargetCgroups(ids map[uint64]bool) error {
+	if len(ids) > maxTargetCgroups {
+		return fmt.Errorf("at most %d cgroups can be targeted, found %d", maxTargetCgroups, len(ids))
+	}
+
+	o.targetsMu.Lock()
+	defer o.targetsMu.Unlock()
+
+	// The removed cgroups are deleted first to make room for the new ones.
+	for id := range o.targetCgroups {
+		if ids[id] {
+			continue
+		}
+		if err := o.objs.TargetCgroups.Delete(id); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return fmt.Errorf("failed to remove target cgroup %d: %w", id, err)
+		}
+		delete(o.targetCgroups, id)
+	}
+	for id := range ids {
+		if o.targetCgroups[id] {
+			continue
+		}
+		if err := o.objs.TargetCgroups.Put(id, uint8(1)); err != nil {
+			return fmt.Errorf("failed to add target cgroup %d: %w", id, err)
+		}
+		o.targetCgroups[id] = true
+	}
+	return nil
+}
+
+// SetDeniedPIDs replaces the processes which are never sampled by the BPF program,
+// see ObjectsOptions.FilterDenied.
+// Only the difference with the current processes is written to the denied_pids map.
+func (o *Objects) SetDeniedPIDs(pids map[uint32]bool) error {
+	if len(pids) > maxTargetPIDs {
+		return fmt.Errorf("at most %d processes can be denied, found %d", maxTargetPIDs, len(pids))
+	}
+
+	o.targetsMu.Lock()
+	defer o.targetsMu.Unlock()
+
+	// The new processes are added first, so the processes which are still denied are never sampled.
+	for pid := range pids {
+		if o.deniedPIDs[pid] {
+			continue
+		}
+		if err := o.objs.DeniedPids.Put(pid, uint8(1)); err != nil {
+			return fmt.Errorf("failed to add denied PID %d: %w", pid, err)
+		}
+		o.deniedPIDs[pid] = true
+	}
+	for pid := range o.deniedPIDs {
+		if pids[pid] {
+			continue
+		}
+		if err := o.objs.DeniedPids.Delete(pid); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return fmt.Errorf("failed to remove denied PID %d: %w", pid, err)
+		}
+		delete(o.deniedPIDs, pid)
+	}
+	return nil
+}
+
+// AddDeniedPID makes the BPF program never sample the process,
+// e.g., a process which has just exec'ed a denied executable.
+func (o *Objects) AddDeniedPID(pid uint32) error {
+	o.targetsMu.Lock()
+	defer o.targetsMu.Unlock()
+
+	if o.deniedPIDs[pid] {
+		return nil
+	}
+	if err := o.objs.DeniedPids.Put(pid, uint8(1)); err != nil {
+		return fmt.Errorf("failed to add denied PID %d: %w", pid, err)
+	}
+	o.deniedPIDs[pid] = true
+	return nil
+}
+
+// DeniedPID reports whether the process was added by SetDeniedPIDs or AddDeniedPID.
+func (o *Objects) DeniedPID(pid uint32) bool {
+	o.targetsMu.Lock()
+	defer o.targetsMu.Unlock()
+
+	return o.deniedPIDs[pid]
+}
+
+// SetDeniedCgroups replaces the cgroup IDs whose processes are never sampled by the BPF program,
+// see ObjectsOptions.FilterDeniedCgroups.
+// Only the difference with the current cgroups is written to the denied_cgroups map.
+func (o *Objects) SetDeniedCgroups(ids map[uint64]bool) error {
+	if len(ids) > maxTargetCgroups {
+		return fmt.Errorf("at most %d cgroups can be denied, found %d", maxTargetCgroups, len(ids))
+	}
+
+	o.targetsMu.Lock()
+	defer o.targetsMu.Unlock()
+
+	for id := range ids {
+		if o.deniedCgroups[id] {
+			continue
+		}
+		if err := o.objs.DeniedCgroups.Put(id, uint8(1)); err != nil {
+			return fmt.Errorf("failed to add denied cgroup %d: %w", id, err)
+		}
+		o.deniedCgroups[id] = true
+	}
+	for id := range o.deniedCgroups {
+		if ids[id] {
+			continue
+		}
+		if err := o.objs.DeniedCgroups.Delete(id); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return fmt.Errorf("failed to remove denied cgroup %d: %w", id, err)
+		}
+		delete(o.deniedCgroups, id)
+	}
+	return nil
+}
+
+// CPUUtilization returns the number of CPU samples taken while each CPU was busy and idle
+// since the objects were loaded, see cpu_samples map.
+func (o *Objects) CPUUtilization() ([]CPUUtilization, error) {
+	var busy, idle []uint64
+	if err := o.objs.CpuSamples.Lookup(uint32(0), &busy); err != nil {
+		return nil, fmt.Errorf("failed to read busy CPU samples: %w", err)
+	}
+	if err := o.objs.CpuSamples.Lookup(uint32(1), &idle); err != nil {
+		return nil, fmt.Errorf("failed to read idle CPU samples: %w", err)
+	}
+
+	var cpus []CPUUtilization
+	for cpu := range busy {
+		// The CPUs which were never sampled are likely offline.
+		if busy[cpu] == 0 && idle[cpu] == 0 {
+			continue
+		}
+		cpus = append(cpus, CPUUtilization{CPU: cpu, Busy: busy[cpu], Idle: idle[cpu]})
+	}
+	return cpus, nil
+}
+
+// Flush returns the samples collected since the previous flush.
+// It makes the BPF program write to the other buffer,
+// so the samples are read from a buffer which is no longer modified.
+// The buffer is cleared afterwards to be reused on the next flush.
+func (o *Objects) Flush() ([]Sample, error) {
+	prev := o.active
+	next := 1 - prev
+	if err := o.objs.ActiveBuffer.Put(uint32(0), next); err != nil {
+		return nil, fmt.Errorf("failed to switch the active buffer: %w", err)
+	}
+	o.active = next
+	time.Sleep(flushGracePeriod)
+
+	b := &o.buffers[prev]
+	samples, err := b.Samples()
+	if err != nil {
+		return nil, err
+	}
+	if err = b.clear(); err != nil {
+		return nil, err
+	}
+
+	return samples, nil
+}
+
+// Pin pins the buffers' maps in dir which must reside on the BPF file system,
+// e.g., /sys/fs/bpf/parca-agent.
+// Pinned maps outlive the file descriptors of the process,
+// so another process can attach to them with LoadPinnedBuffers.
+func (o *Objects) Pin(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create pin directory: %w", err)
+	}
+	for i := range o.buffers {
+		if err := o.buffers[i].pin(dir, i); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Unpin removes the pinned maps from the BPF file system.
+func (o *Objects) Unpin() error {
+	for i := range o.buffers {
+		if err := o.buffers[i].unpin(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close removes the BPF program and maps from the kernel
+// unless they are still referenced, e.g., pinned.
+func (o *Objects) Close() error {
+	return o.objs.Close()
+}
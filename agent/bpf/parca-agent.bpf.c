@@ -0,0 +1,1026 @@
+// This file was copied from
+// https://github.com/parca-dev/parca-agent/blob/31253527651ebebb74c6200eb68fe9251479ed6b/parca-agent.bpf.c
+// with minor refactoring.
+
+/* In Linux 5.4 asm_inline was introduced, but it's not supported by clang.
+ * Redefine it to just asm to enable successful compilation.
+ * see
+ * https://github.com/iovisor/bcc/commit/2d1497cde1cc9835f759a707b42dea83bee378b8
+ * for more details
+ */
+#include "vmlinux.h"
+#ifdef asm_inline
+#undef asm_inline
+#define asm_inline asm
+#endif
+
+#define KBUILD_MODNAME "parca-agent"
+
+#undef container_of
+#include <bpf_core_read.h>
+#include <bpf_endian.h>
+#include <bpf_helpers.h>
+#include <bpf_tracing.h>
+#include "maps.bpf.h"
+
+#if defined(bpf_target_x86)
+#define PT_REGS_PARM6(ctx) ((ctx)->r9)
+#elif defined(bpf_target_arm64)
+#define PT_REGS_PARM6(x) (((PT_REGS_ARM64 *)(x))->regs[5])
+#endif
+
+// Max amount of different stack trace addresses to buffer in the map.
+#define MAX_STACK_ADDRESSES 1024
+// Default max depth of each stack trace to track.
+// User space can resize the values of the stack maps at load time to store deeper stacks,
+// since bpf_get_stackid() stores as many frames as fit into the value.
+#define MAX_STACK_DEPTH 127
+// Max number of users whose processes can be sampled, see target_uids.
+#define MAX_TARGET_UIDS 64
+// Max number of processes which can be sampled, see target_pids.
+#define MAX_TARGET_PIDS 8192
+// Max number of cgroups whose processes can be sampled, see target_cgroups.
+#define MAX_TARGET_CGROUPS 8192
+// Max number of process names which are never sampled, see denied_comms.
+#define MAX_DENIED_COMMS 64
+// Length of the process name including the null byte, see include/linux/sched.h.
+#define TASK_COMM_LEN 16
+// Max depth of the user stacks walked by the program itself, see walk_user_stack.
+#define MAX_WALK_DEPTH 512
+// Max number of the last branch records read per sample, e.g., 32 on Intel Skylake and newer, see lbr_user_stack.
+#define MAX_LBR_ENTRIES 32
+// Stack trace value is 1 big byte array of the stack addresses.
+typedef __u64 stack_trace_type[MAX_STACK_DEPTH];
+// Build ID stack trace value is an array of the frames' build IDs and file offsets.
+typedef struct bpf_stack_build_id build_id_stack_trace_type[MAX_STACK_DEPTH];
+
+// Samples are written into one of two buffers while user space reads the other one,
+// so that each read gets a consistent snapshot which is not modified in the meantime.
+// A buffer is a pair of stack_traces and counts maps with the same suffix,
+// and the active_buffer map tells which buffer is currently written to.
+
+// The stack_traces map holds an array of memory addresses,
+// e.g., stack_traces[1253] = [0xdeadbeef, 0x123abcde]
+// where 1253 is a stack ID.
+struct {
+  __uint(type, BPF_MAP_TYPE_STACK_TRACE);
+  __uint(max_entries, MAX_STACK_ADDRESSES);
+  __type(key, u32);
+  __type(value, stack_trace_type);
+} stack_traces_0 SEC(".maps");
+
+struct {
+  __uint(type, BPF_MAP_TYPE_STACK_TRACE);
+  __uint(max_entries, MAX_STACK_ADDRESSES);
+  __type(key, u32);
+  __type(value, stack_trace_type);
+} stack_traces_1 SEC(".maps");
+
+// The build_id_stacks map holds the user stacks as the build IDs of the mapped binaries
+// and the file offsets within them, e.g., build_id_stacks[1253] = [{VALID, 0x9f3c..., 0x1a2b}],
+// so user space can symbolize the stacks of the processes which exited before their mappings were read.
+// It's filled in only when record_build_ids is set.
+struct {
+  __uint(type, BPF_MAP_TYPE_STACK_TRACE);
+  __uint(max_entries, MAX_STACK_ADDRESSES);
+  __uint(map_flags, BPF_F_STACK_BUILD_ID);
+  __type(key, u32);
+  __type(value, build_id_stack_trace_type);
+} build_id_stacks_0 SEC(".maps");
+
+struct {
+  __uint(type, BPF_MAP_TYPE_STACK_TRACE);
+  __uint(max_entries, MAX_STACK_ADDRESSES);
+  __uint(map_flags, BPF_F_STACK_BUILD_ID);
+  __type(key, u32);
+  __type(value, build_id_stack_trace_type);
+} build_id_stacks_1 SEC(".maps");
+
+// record_build_ids is set by user space before loading the program
+// when the user stacks should also be stored in the build_id_stacks map.
+const volatile bool record_build_ids = false;
+
+// Events which are attributed to the stacks, each profiling mode records its own events.
+enum event_t {
+  // STACK_EVENT_CPU is a CPU clock sample.
+  STACK_EVENT_CPU = 0,
+  // STACK_EVENT_BLOCK_IO is a block I/O request issued to a device, its value is the request size in bytes.
+  STACK_EVENT_BLOCK_IO = 1,
+  // STACK_EVENT_TCP_SEND is a tcp_sendmsg call, its value is the message size in bytes.
+  STACK_EVENT_TCP_SEND = 2,
+  // STACK_EVENT_TCP_RETRANSMIT is a retransmitted TCP segment, its value is the segment size in bytes.
+  STACK_EVENT_TCP_RETRANSMIT = 3,
+  // STACK_EVENT_RUNQUEUE is a period the task was runnable but not running,
+  // its value is the duration in nanoseconds.
+  STACK_EVENT_RUNQUEUE = 4,
+};
+
+struct stack_count_key_t {
+  u32 pid;
+  int32 user_stack_id;
+  int32 kernel_stack_id;
+  // time_bucket is the number of time_bucket_ns intervals since boot when the sample was taken.
+  u32 time_bucket;
+  // event is the kind of the event attributed to the stacks, see event_t.
+  u32 event;
+  // user_build_id_stack_id identifies the user stack in the build_id_stacks map
+  // (a negative error if record_build_ids isn't set or the stack wasn't stored).
+  int32 user_build_id_stack_id;
+  // user_stack_hash identifies the user stack in the user_stacks map
+  // when it was walked by the program, user_stack_id is negative then.
+  u64 user_stack_hash;
+  // trace_id_hi, trace_id_lo, and span_id are the trace context of the sampled thread
+  // set by the instrumented application, see on_trace_context.
+  u64 trace_id_hi;
+  u64 trace_id_lo;
+  u64 span_id;
+  // overridden is 1 if the sample was taken by the perf event of a thread sampled at its own frequency,
+  // see do_sample_override. Those samples are weighted by the overridden frequency.
+  u32 overridden;
+  u32 padding;
+};
+
+// user_stack_t is a user stack walked by following frame pointers.
+// It's too big for the BPF stack (512 bytes), so it's assembled in a per-CPU array.
+struct user_stack_t {
+  u64 len;
+  u64 addrs[MAX_WALK_DEPTH];
+};
+
+// The user_stacks map holds the walked user stacks by their hashes,
+// e.g., user_stacks[0x9ae16a3b2f90404f] = {2, [0xdeadbeef, 0x123abcde]}.
+// Unlike stack_traces, the 64-bit hashes practically never collide
+// and the stacks can be deeper than MAX_STACK_DEPTH.
+struct {
+  __uint(type, BPF_MAP_TYPE_HASH);
+  __uint(max_entries, MAX_STACK_ADDRESSES);
+  __type(key, u64);
+  __type(value, struct user_stack_t);
+} user_stacks_0 SEC(".maps");
+
+struct {
+  __uint(type, BPF_MAP_TYPE_HASH);
+  __uint(max_entries, MAX_STACK_ADDRESSES);
+  __type(key, u64);
+  __type(value, struct user_stack_t);
+} user_stacks_1 SEC(".maps");
+
+// The stack_buffer map is the scratch space to walk a user stack.
+struct {
+  __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+  __uint(max_entries, 1);
+  __type(key, u32);
+  __type(value, struct user_stack_t);
+} stack_buffer SEC(".maps");
+
+// walk_depth is set by user space before loading the program
+// to walk the user stacks up to this depth (at most MAX_WALK_DEPTH) instead of using bpf_get_stackid.
+const volatile u32 walk_depth = 0;
+
+// time_bucket_ns is set by user space before loading the program
+// when the samples should be split by time, so a profile can be sliced into sub-intervals.
+// All samples fall into the zero bucket otherwise.
+const volatile u64 time_bucket_ns = 0;
+
+// stack_value_t is how many times the stack trace has been seen
+// and the sum of the events' values, e.g., bytes of block I/O requests.
+// The CPU samples also sum the cycles and instructions attributed to them if count_ipc is set.
+struct stack_value_t {
+  u64 count;
+  u64 value;
+  u64 cycles;
+  u64 instructions;
+};
+
+// The counts map keeps track of how many times a stack trace has been seen,
+// e.g., counts[{10342, 1253, 0234}] = {45, 0}.
+struct {
+  __uint(type, BPF_MAP_TYPE_HASH);
+  __uint(max_entries, 10240);
+  __type(key, struct stack_count_key_t);
+  __type(value, struct stack_value_t);
+} counts_0 SEC(".maps");
+
+struct {
+  __uint(type, BPF_MAP_TYPE_HASH);
+  __uint(max_entries, 10240);
+  __type(key, struct stack_count_key_t);
+  __type(value, struct stack_value_t);
+} counts_1 SEC(".maps");
+
+// The active_buffer map holds a single element: the index (0 or 1) of the buffer
+// the program writes samples to. It is toggled by user space before reading a buffer.
+struct {
+  __uint(type, BPF_MAP_TYPE_ARRAY);
+  __uint(max_entries, 1);
+  __type(key, u32);
+  __type(value, u32);
+} active_buffer SEC(".maps");
+
+// filter_uids is set by user space before loading the program
+// when only the processes owned by target_uids users should be sampled.
+const volatile bool filter_uids = false;
+
+// The target_uids map holds the users whose processes are sampled when filter_uids is set,
+// e.g., target_uids[1000] = 1.
+struct {
+  __uint(type, BPF_MAP_TYPE_HASH);
+  __uint(max_entries, MAX_TARGET_UIDS);
+  __type(key, u32);
+  __type(value, u8);
+} target_uids SEC(".maps");
+
+// filter_pids is set by user space before loading the program
+// when only the target_pids processes should be sampled.
+const volatile bool filter_pids = false;
+
+// The target_pids map holds the processes which are sampled when filter_pids is set,
+// e.g., target_pids[15958] = 1.
+// User space updates it while profiling, e.g., when the target process forks a worker,
+// so the targets change without reattaching the perf events.
+struct {
+  __uint(type, BPF_MAP_TYPE_HASH);
+  __uint(max_entries, MAX_TARGET_PIDS);
+  __type(key, u32);
+  __type(value, u8);
+} target_pids SEC(".maps");
+
+// frequency_overrides is set by user space before loading the program
+// when some processes are sampled at their own frequencies, see do_sample_override.
+const volatile bool frequency_overrides = false;
+
+// The overridden_tids map holds the threads sampled by their own perf events at other frequencies,
+// e.g., overridden_tids[15960] = 1, so the per-CPU events skip them.
+// The threads of the same processes which don't have their own events yet, e.g., the ones created
+// since the last process scan, are still sampled by the per-CPU events.
+struct {
+  __uint(type, BPF_MAP_TYPE_HASH);
+  __uint(max_entries, MAX_TARGET_PIDS);
+  __type(key, u32);
+  __type(value, u8);
+} overridden_tids SEC(".maps");
+
+// filter_cgroups is set by user space before loading the program
+// when only the processes in target_cgroups cgroups should be sampled.
+const volatile bool filter_cgroups = false;
+
+// The target_cgroups map holds the cgroup v2 IDs (inode numbers of the cgroup directories)
+// whose processes are sampled when filter_cgroups is set, e.g., target_cgroups[9562] = 1.
+// A process belongs to its innermost cgroup, so user space adds the descendants of the target cgroups too
+// and updates the map while profiling, e.g., when a container starts.
+struct {
+  __uint(type, BPF_MAP_TYPE_HASH);
+  __uint(max_entries, MAX_TARGET_CGROUPS);
+  __type(key, u64);
+  __type(value, u8);
+} target_cgroups SEC(".maps");
+
+// filter_denied is set by user space before loading the program
+// when the processes in denied_comms and denied_pids maps must never be sampled.
+const volatile bool filter_denied = false;
+
+// filter_denied_cgroups is set by user space before loading the program
+// when the processes in denied_cgroups cgroups must never be sampled.
+const volatile bool filter_denied_cgroups = false;
+
+// The denied_comms map holds the names of the processes which are never sampled,
+// e.g., denied_comms["vault"] = 1. The name is checked on every event,
+// so the processes are skipped as soon as they start without waiting for user space to find them.
+struct {
+  __uint(type, BPF_MAP_TYPE_HASH);
+  __uint(max_entries, MAX_DENIED_COMMS);
+  __type(key, char[TASK_COMM_LEN]);
+  __type(value, u8);
+} denied_comms SEC(".maps");
+
+// The denied_pids map holds the processes which are never sampled, e.g., denied_pids[812] = 1.
+// User space adds the processes matched by executable path or labels while profiling.
+struct {
+  __uint(type, BPF_MAP_TYPE_HASH);
+  __uint(max_entries, MAX_TARGET_PIDS);
+  __type(key, u32);
+  __type(value, u8);
+} denied_pids SEC(".maps");
+
+// The denied_cgroups map holds the cgroup v2 IDs whose processes are never sampled
+// (including the descendant cgroups added by user space), e.g., denied_cgroups[9562] = 1.
+struct {
+  __uint(type, BPF_MAP_TYPE_HASH);
+  __uint(max_entries, MAX_TARGET_CGROUPS);
+  __type(key, u64);
+  __type(value, u8);
+} denied_cgroups SEC(".maps");
+
+// trace_context is set by user space before loading the program
+// when the samples should be labeled with the trace context of the sampled threads.
+const volatile bool trace_context = false;
+
+// trace_context_go_abi is set by user space when the marker function is written in Go,
+// whose register-based calling convention differs from the C one on x86-64.
+const volatile bool trace_context_go_abi = false;
+
+// trace_context_t is the trace context of a thread: 128-bit trace ID and 64-bit span ID.
+struct trace_context_t {
+  u64 trace_id_hi;
+  u64 trace_id_lo;
+  u64 span_id;
+};
+
+// The trace_contexts map holds the current trace context by thread ID,
+// e.g., trace_contexts[10342] = {0x4bf92f3577b34da6, 0xa3ce929d0e0e4736, 0x00f067aa0ba902b7}.
+// The contexts of the exited threads are eventually evicted.
+struct {
+  __uint(type, BPF_MAP_TYPE_LRU_HASH);
+  __uint(max_entries, 10240);
+  __type(key, u32);
+  __type(value, struct trace_context_t);
+} trace_contexts SEC(".maps");
+
+// murmur_mix mixes the stack address into the MurmurHash64A state.
+static __always_inline u64 murmur_mix(u64 h, u64 k) {
+  const u64 m = 0xc6a4a7935bd1e995ULL;
+  k *= m;
+  k ^= k >> 47;
+  k *= m;
+  h ^= k;
+  h *= m;
+  return h;
+}
+
+// in_user_mode tells whether the sample was taken in user space.
+static __always_inline bool in_user_mode(struct pt_regs *regs) {
+#if defined(bpf_target_x86)
+  // The lowest two bits of the code segment selector are the privilege level, 3 is user space.
+  return (regs->cs & 3) == 3;
+#elif defined(bpf_target_arm64)
+  // The exception level bits of pstate are zero in user space.
+  return (((PT_REGS_ARM64 *)regs)->pstate & 0xf) == 0;
+#else
+  return true;
+#endif
+}
+
+// walk_user_stack walks the user stack by following frame pointers
+// and stores it in the user_stacks map by its hash.
+// Each frame record is a pair of the caller's frame pointer and the return address
+// (rbp on x86-64, x29 on arm64).
+// The stack can only be walked if the sample was taken in user space,
+// since the user registers aren't available to the program otherwise.
+// Zero is returned if the stack wasn't walked.
+static __always_inline u64 walk_user_stack(struct bpf_perf_event_data *ctx, void *user_stacks) {
+  struct pt_regs *regs = (struct pt_regs *)&ctx->regs;
+  if (!in_user_mode(regs))
+    return 0;
+
+  u32 zero = 0;
+  struct user_stack_t *stack = bpf_map_lookup_elem(&stack_buffer, &zero);
+  if (!stack)
+    return 0;
+
+  u64 ip = PT_REGS_IP(regs);
+  u64 fp = PT_REGS_FP(regs);
+  u64 hash = 0xcbf29ce484222325ULL;
+  stack->addrs[0] = ip;
+  stack->len = 1;
+  hash = murmur_mix(hash, ip);
+
+  for (int i = 1; i < MAX_WALK_DEPTH; i++) {
+    if (i >= walk_depth || !fp)
+      break;
+    u64 frame[2];
+    if (bpf_probe_read_user(frame, sizeof(frame), (void *)fp))
+      break;
+    if (!frame[1])
+      break;
+    stack->addrs[i] = frame[1];
+    stack->len = i + 1;
+    hash = murmur_mix(hash, frame[1]);
+    fp = frame[0];
+  }
+
+  if (bpf_map_update_elem(user_stacks, &hash, stack, BPF_ANY))
+    return 0;
+  return hash;
+}
+
+// count_event increments the number of times the key has been seen and adds the event's value.
+static __always_inline int count_event(void *counts, struct stack_count_key_t *key, u64 value) {
+  struct stack_value_t zero = {};
+  struct stack_value_t *seen;
+  seen = bpf_map_lookup_or_try_init(counts, key, &zero);
+  if (!seen)
+    return 0;
+  // Atomically increments the seen counter and the sum of values.
+  __sync_fetch_and_add(&seen->count, 1);
+  if (value)
+    __sync_fetch_and_add(&seen->value, value);
+
+  return 0;
+}
+
+// init_key fills in the fields of the stack count key which don't depend on the stacks.
+static __always_inline void init_key(struct stack_count_key_t *key, u32 tgid, u32 event) {
+  key->pid = tgid;
+  key->event = event;
+  if (time_bucket_ns)
+    key->time_bucket = bpf_ktime_get_ns() / time_bucket_ns;
+  if (trace_context) {
+    u32 tid = bpf_get_current_pid_tgid();
+    struct trace_context_t *tc = bpf_map_lookup_elem(&trace_contexts, &tid);
+    if (tc) {
+      key->trace_id_hi = tc->trace_id_hi;
+      key->trace_id_lo = tc->trace_id_lo;
+      key->span_id = tc->span_id;
+    }
+  }
+}
+
+// unwind_stacks stores the current stack traces in the given buffer and sets their IDs in the key.
+// The user stack is walked by the program only for the CPU samples (perf_ctx is set),
+// since the user registers are taken from the perf event context.
+static __always_inline void unwind_stacks(void *ctx, struct bpf_perf_event_data *perf_ctx, struct stack_count_key_t *key, void *stack_traces, void *user_stacks, void *build_id_stacks) {
+  if (walk_depth && perf_ctx)
+    key->user_stack_hash = walk_user_stack(perf_ctx, user_stacks);
+  // Read user-space stack ID and insert memory addresses into stack_traces map.
+  // The positive or null stack id is returned on success,
+  // or a negative error in case of failure.
+  // ENOENT marks the stacks which were walked by the program.
+  if (key->user_stack_hash)
+    key->user_stack_id = -ENOENT;
+  else
+    key->user_stack_id = bpf_get_stackid(ctx, stack_traces, BPF_F_USER_STACK);
+  // Read kernel-space stack ID and insert memory addresses into stack_traces map.
+  key->kernel_stack_id = bpf_get_stackid(ctx, stack_traces, 0);
+  // The same user stack is stored as build IDs and file offsets.
+  // The kernel falls back to the addresses for the frames whose build ID can't be read,
+  // e.g., anonymous mappings, or when mmap_lock can't be taken in NMI context.
+  if (record_build_ids && key->user_stack_id >= 0)
+    key->user_build_id_stack_id = bpf_get_stackid(ctx, build_id_stacks, BPF_F_USER_STACK);
+  else
+    key->user_build_id_stack_id = -ENOENT;
+}
+
+// record_event stores the current stack traces along with the event's value in the given buffer.
+// It is inlined, so the verifier sees constant map pointers passed to the helpers.
+static __always_inline int record_event(void *ctx, struct bpf_perf_event_data *perf_ctx, u32 tgid, u32 event, u64 value, void *stack_traces, void *user_stacks, void *build_id_stacks, void *counts) {
+  struct stack_count_key_t key = {};
+  init_key(&key, tgid, event);
+  unwind_stacks(ctx, perf_ctx, &key, stack_traces, user_stacks, build_id_stacks);
+  return count_event(counts, &key, value);
+}
+
+// is_denied tells whether the current process must never be profiled.
+static __always_inline bool is_denied() {
+  if (filter_denied) {
+    char comm[TASK_COMM_LEN] = {};
+    bpf_get_current_comm(&comm, sizeof(comm));
+    if (bpf_map_lookup_elem(&denied_comms, &comm))
+      return true;
+    u32 tgid = bpf_get_current_pid_tgid() >> 32;
+    if (bpf_map_lookup_elem(&denied_pids, &tgid))
+      return true;
+  }
+  if (filter_denied_cgroups) {
+    u64 cgroup_id = bpf_get_current_cgroup_id();
+    if (bpf_map_lookup_elem(&denied_cgroups, &cgroup_id))
+      return true;
+  }
+  return false;
+}
+
+// is_target tells whether the current process should be profiled.
+// The denied processes are never profiled even if they're targeted.
+static __always_inline bool is_target() {
+  if (is_denied())
+    return false;
+  if (filter_pids) {
+    u32 tgid = bpf_get_current_pid_tgid() >> 32;
+    if (!bpf_map_lookup_elem(&target_pids, &tgid))
+      return false;
+  }
+  if (filter_cgroups) {
+    u64 cgroup_id = bpf_get_current_cgroup_id();
+    if (!bpf_map_lookup_elem(&target_cgroups, &cgroup_id))
+      return false;
+  }
+  if (!filter_uids)
+    return true;
+  // The lower 32 bits hold the user ID.
+  u32 uid = bpf_get_current_uid_gid();
+  return bpf_map_lookup_elem(&target_uids, &uid) != NULL;
+}
+
+// submit_event records the event of the current process in the active buffer
+// unless the process is filtered out.
+static __always_inline int submit_event(void *ctx, struct bpf_perf_event_data *perf_ctx, u32 event, u64 value) {
+  u64 id = bpf_get_current_pid_tgid();
+  u32 tgid = id >> 32;
+  u32 pid = id;
+
+  if (pid == 0)
+    return 0;
+  if (!is_target())
+    return 0;
+
+  u32 zero = 0;
+  u32 *buffer = bpf_map_lookup_elem(&active_buffer, &zero);
+  if (!buffer)
+    return 0;
+
+  if (*buffer == 0)
+    return record_event(ctx, perf_ctx, tgid, event, value, &stack_traces_0, &user_stacks_0, &build_id_stacks_0, &counts_0);
+  return record_event(ctx, perf_ctx, tgid, event, value, &stack_traces_1, &user_stacks_1, &build_id_stacks_1, &counts_1);
+}
+
+// The cpu_samples map counts the CPU samples taken while each CPU was busy (key 0)
+// and idle (key 1), so user space can report the utilization per core in system-wide mode.
+struct {
+  __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+  __uint(max_entries, 2);
+  __type(key, u32);
+  __type(value, u64);
+} cpu_samples SEC(".maps");
+
+// The CPU samples are processed by a chain of tail-called programs:
+// do_sample (the entry) filters the processes and fills in the key,
+// an unwinder selected per process stores the stacks,
+// and aggregate_sample counts the key.
+// The unwinders other than the frame pointer one (e.g., DWARF, Python, JVM)
+// can be added as separate programs without growing the others past the verifier limits.
+enum sample_prog_t {
+  PROG_UNWIND_FRAME_POINTERS = 0,
+  PROG_AGGREGATE = 1,
+  PROG_UNWIND_LBR = 2,
+};
+
+// The sample_programs map holds the programs of the chain by their sample_prog_t index.
+// User space populates it after loading the programs.
+struct {
+  __uint(type, BPF_MAP_TYPE_PROG_ARRAY);
+  __uint(max_entries, 8);
+  __type(key, u32);
+  __type(value, u32);
+} sample_programs SEC(".maps");
+
+// The process_unwinders map selects the unwinder program (sample_programs index) by process,
+// e.g., process_unwinders[15958] = 2 for a Python interpreter.
+// The processes which aren't in the map are unwound by following frame pointers.
+struct {
+  __uint(type, BPF_MAP_TYPE_HASH);
+  __uint(max_entries, 4096);
+  __type(key, u32);
+  __type(value, u32);
+} process_unwinders SEC(".maps");
+
+// count_ipc is set by user space before loading the program
+// when it's attached to the cycles events whose groups also count the instructions,
+// so the samples are annotated with the cycles and instructions since the previous sample on the CPU.
+const volatile bool count_ipc = false;
+
+// The instructions_counters map holds the instructions counters by CPU,
+// they're the members of the cycles event groups the program is attached to.
+struct {
+  __uint(type, BPF_MAP_TYPE_PERF_EVENT_ARRAY);
+  __type(key, u32);
+  __type(value, u32);
+} instructions_counters SEC(".maps");
+
+// counters_t are the values of the cycles and instructions counters.
+struct counters_t {
+  u64 cycles;
+  u64 instructions;
+};
+
+// The last_counters map holds the counters at the previous sample on the CPU.
+struct {
+  __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+  __uint(max_entries, 1);
+  __type(key, u32);
+  __type(value, struct counters_t);
+} last_counters SEC(".maps");
+
+// read_counters sets the cycles and instructions counted since the previous sample on the CPU.
+// The cycles are read from the event the program is attached to (the group leader),
+// and the instructions from the group member.
+// The first sample on the CPU and the samples after the counters were reopened (e.g., CPU hotplug)
+// only set the baseline, so the delta is left zero.
+static __always_inline void read_counters(struct bpf_perf_event_data *ctx, struct counters_t *delta) {
+  struct bpf_perf_event_value cycles = {};
+  struct bpf_perf_event_value instructions = {};
+  if (bpf_perf_prog_read_value(ctx, &cycles, sizeof(cycles)))
+    return;
+  if (bpf_perf_event_read_value(&instructions_counters, BPF_F_CURRENT_CPU, &instructions, sizeof(instructions)))
+    return;
+
+  u32 zero = 0;
+  struct counters_t *last = bpf_map_lookup_elem(&last_counters, &zero);
+  if (!last)
+    return;
+  if (last->cycles && cycles.counter >= last->cycles && instructions.counter >= last->instructions) {
+    delta->cycles = cycles.counter - last->cycles;
+    delta->instructions = instructions.counter - last->instructions;
+  }
+  last->cycles = cycles.counter;
+  last->instructions = instructions.counter;
+}
+
+// sample_state_t is passed between the tail-called programs,
+// since they don't share the BPF stack.
+struct sample_state_t {
+  struct stack_count_key_t key;
+  // buffer is the index of the buffer the sample is written to,
+  // it's read once, so the whole chain writes to the same buffer.
+  u32 buffer;
+  u32 pad;
+  // counters are the cycles and instructions attributed to the sample, see count_ipc.
+  struct counters_t counters;
+};
+
+// The sample_state map holds the sample being processed on the CPU.
+// The programs of the chain run with preemption disabled, so the state isn't overwritten midway.
+struct {
+  __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+  __uint(max_entries, 1);
+  __type(key, u32);
+  __type(value, struct sample_state_t);
+} sample_state SEC(".maps");
+
+// count_sample counts the CPU sample's key in the counts map
+// along with the cycles and instructions attributed to it.
+static __always_inline int count_sample(void *counts, struct sample_state_t *state) {
+  struct stack_value_t zero = {};
+  struct stack_value_t *seen;
+  seen = bpf_map_lookup_or_try_init(counts, &state->key, &zero);
+  if (!seen)
+    return 0;
+  __sync_fetch_and_add(&seen->count, 1);
+  if (state->counters.cycles) {
+    __sync_fetch_and_add(&seen->cycles, state->counters.cycles);
+    __sync_fetch_and_add(&seen->instructions, state->counters.instructions);
+  }
+
+  return 0;
+}
+
+// sample fills in the sample state and tail-calls the unwinder of the process.
+// The per-CPU events (override is false) skip the threads sampled by their own events at other frequencies.
+static __always_inline int sample(struct bpf_perf_event_data *ctx, bool override) {
+  u64 id = bpf_get_current_pid_tgid();
+  u32 tgid = id >> 32;
+  u32 tid = id;
+  // The idle task has zero PID.
+  u32 idle = (u32)id == 0;
+  struct counters_t counters = {};
+  if (!override) {
+    u64 *n = bpf_map_lookup_elem(&cpu_samples, &idle);
+    if (n)
+      *n += 1;
+
+    // The counters are read on every sample, so the delta covers only the time since the previous one.
+    if (count_ipc)
+      read_counters(ctx, &counters);
+  }
+
+  if (idle || !is_target())
+    return 0;
+  if (frequency_overrides && !override && bpf_map_lookup_elem(&overridden_tids, &tid))
+    return 0;
+
+  u32 zero = 0;
+  u32 *buffer = bpf_map_lookup_elem(&active_buffer, &zero);
+  if (!buffer)
+    return 0;
+  struct sample_state_t *state = bpf_map_lookup_elem(&sample_state, &zero);
+  if (!state)
+    return 0;
+  __builtin_memset(&state->key, 0, sizeof(state->key));
+  init_key(&state->key, tgid, STACK_EVENT_CPU);
+  state->key.overridden = override;
+  state->buffer = *buffer;
+  state->counters = counters;
+
+  u32 prog = PROG_UNWIND_FRAME_POINTERS;
+  u32 *unwinder = bpf_map_lookup_elem(&process_unwinders, &tgid);
+  if (unwinder)
+    prog = *unwinder;
+  bpf_tail_call(ctx, &sample_programs, prog);
+
+  // The tail call failed, e.g., the unwinder isn't loaded, so the sample is recorded right away.
+  return submit_event(ctx, ctx, STACK_EVENT_CPU, 0);
+}
+
+SEC("perf_event")
+int do_sample(struct bpf_perf_event_data *ctx) {
+  return sample(ctx, false);
+}
+
+// do_sample_override is attached to the perf events of the threads sampled at their own frequencies,
+// the threads are in the overridden_tids map.
+SEC("perf_event")
+int do_sample_override(struct bpf_perf_event_data *ctx) {
+  return sample(ctx, true);
+}
+
+// unwind_frame_pointers stores the stacks of the sample using bpf_get_stackid()
+// or by walking the frame pointers (see walk_depth), and passes the sample to aggregate_sample.
+SEC("perf_event")
+int unwind_frame_pointers(struct bpf_perf_event_data *ctx) {
+  u32 zero = 0;
+  struct sample_state_t *state = bpf_map_lookup_elem(&sample_state, &zero);
+  if (!state)
+    return 0;
+
+  if (state->buffer == 0)
+    unwind_stacks(ctx, ctx, &state->key, &stack_traces_0, &user_stacks_0, &build_id_stacks_0);
+  else
+    unwind_stacks(ctx, ctx, &state->key, &stack_traces_1, &user_stacks_1, &build_id_stacks_1);
+  bpf_tail_call(ctx, &sample_programs, PROG_AGGREGATE);
+
+  // The tail call failed, so the sample is counted right away.
+  if (state->buffer == 0)
+    return count_sample(&counts_0, state);
+  return count_sample(&counts_1, state);
+}
+
+// lbr_call_stacks is set by user space before loading the program
+// when the perf events capture the last branch records in call stack mode, see unwind_lbr.
+// The program doesn't call bpf_read_branch_records() otherwise, so it loads on the kernels before 5.6.
+const volatile bool lbr_call_stacks = false;
+
+// lbr_entries_t are the last branch records of a sample.
+struct lbr_entries_t {
+  struct perf_branch_entry entries[MAX_LBR_ENTRIES];
+};
+
+// The lbr_buffer map is the scratch space to read the last branch records,
+// they're too big for the BPF stack.
+struct {
+  __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+  __uint(max_entries, 1);
+  __type(key, u32);
+  __type(value, struct lbr_entries_t);
+} lbr_buffer SEC(".maps");
+
+// lbr_user_stack reconstructs the user stack from the last branch records
+// and stores it in the user_stacks map by its hash like walk_user_stack.
+// In call stack mode the LBR keeps the calls which haven't returned yet, the most recent first,
+// so their sources (the call instructions) make up the stack without frame pointers.
+// The stack is as deep as the LBR (MAX_LBR_ENTRIES at most).
+// Zero is returned if the sample was taken in kernel space or has no records.
+static __always_inline u64 lbr_user_stack(struct bpf_perf_event_data *ctx, void *user_stacks) {
+  struct pt_regs *regs = (struct pt_regs *)&ctx->regs;
+  if (!in_user_mode(regs))
+    return 0;
+
+  u32 zero = 0;
+  struct lbr_entries_t *lbr = bpf_map_lookup_elem(&lbr_buffer, &zero);
+  if (!lbr)
+    return 0;
+  struct user_stack_t *stack = bpf_map_lookup_elem(&stack_buffer, &zero);
+  if (!stack)
+    return 0;
+  long size = bpf_read_branch_records(ctx, lbr->entries, sizeof(lbr->entries), 0);
+  if (size <= 0)
+    return 0;
+  u32 n = size / sizeof(struct perf_branch_entry);
+
+  u64 ip = PT_REGS_IP(regs);
+  u64 hash = 0xcbf29ce484222325ULL;
+  stack->addrs[0] = ip;
+  stack->len = 1;
+  hash = murmur_mix(hash, ip);
+
+  for (int i = 0; i < MAX_LBR_ENTRIES; i++) {
+    if (i >= n)
+      break;
+    u64 from = lbr->entries[i].from;
+    if (!from)
+      break;
+    stack->addrs[i + 1] = from;
+    stack->len = i + 2;
+    hash = murmur_mix(hash, from);
+  }
+
+  if (bpf_map_update_elem(user_stacks, &hash, stack, BPF_ANY))
+    return 0;
+  return hash;
+}
+
+// unwind_lbr_stacks stores the kernel stack with bpf_get_stackid() and the user stack reconstructed from LBR,
+// the user stack falls back to bpf_get_stackid() if it can't be reconstructed.
+static __always_inline void unwind_lbr_stacks(struct bpf_perf_event_data *ctx, struct stack_count_key_t *key, void *stack_traces, void *user_stacks) {
+  key->user_stack_hash = lbr_user_stack(ctx, user_stacks);
+  if (key->user_stack_hash)
+    key->user_stack_id = -ENOENT;
+  else
+    key->user_stack_id = bpf_get_stackid(ctx, stack_traces, BPF_F_USER_STACK);
+  key->kernel_stack_id = bpf_get_stackid(ctx, stack_traces, 0);
+  key->user_build_id_stack_id = -ENOENT;
+}
+
+// unwind_lbr stores the stacks of the sample using the last branch records instead of frame pointers,
+// it's selected for the processes whose executables omit frame pointers,
+// and passes the sample to aggregate_sample.
+SEC("perf_event")
+int unwind_lbr(struct bpf_perf_event_data *ctx) {
+  u32 zero = 0;
+  struct sample_state_t *state = bpf_map_lookup_elem(&sample_state, &zero);
+  if (!state)
+    return 0;
+
+  if (!lbr_call_stacks) {
+    bpf_tail_call(ctx, &sample_programs, PROG_UNWIND_FRAME_POINTERS);
+    return 0;
+  }
+  if (state->buffer == 0)
+    unwind_lbr_stacks(ctx, &state->key, &stack_traces_0, &user_stacks_0);
+  else
+    unwind_lbr_stacks(ctx, &state->key, &stack_traces_1, &user_stacks_1);
+  bpf_tail_call(ctx, &sample_programs, PROG_AGGREGATE);
+
+  // The tail call failed, so the sample is counted right away.
+  if (state->buffer == 0)
+    return count_sample(&counts_0, state);
+  return count_sample(&counts_1, state);
+}
+
+// aggregate_sample counts the sample's key in the buffer, it's the last program of the chain.
+SEC("perf_event")
+int aggregate_sample(struct bpf_perf_event_data *ctx) {
+  u32 zero = 0;
+  struct sample_state_t *state = bpf_map_lookup_elem(&sample_state, &zero);
+  if (!state)
+    return 0;
+
+  if (state->buffer == 0)
+    return count_sample(&counts_0, state);
+  return count_sample(&counts_1, state);
+}
+
+// on_block_rq_issue attributes the block I/O request to the stacks of the process issuing it.
+// Note, the requests issued asynchronously, e.g., the writeback of dirty pages,
+// are attributed to the kernel worker threads.
+SEC("tracepoint/block/block_rq_issue")
+int on_block_rq_issue(struct trace_event_raw_block_rq *ctx) {
+  return submit_event(ctx, NULL, STACK_EVENT_BLOCK_IO, ctx->bytes);
+}
+
+// on_tcp_sendmsg attributes the bytes sent over TCP to the stacks of the sending process.
+SEC("kprobe/tcp_sendmsg")
+int BPF_KPROBE(on_tcp_sendmsg, struct sock *sk, struct msghdr *msg, size_t size) {
+  return submit_event(ctx, NULL, STACK_EVENT_TCP_SEND, size);
+}
+
+// on_tcp_retransmit_skb attributes the retransmitted TCP segments to the stacks of the current process.
+// Note, the retransmits on timeout happen in softirq context,
+// so they are attributed to whatever process was interrupted (or dropped if the CPU was idle).
+SEC("kprobe/tcp_retransmit_skb")
+int BPF_KPROBE(on_tcp_retransmit_skb, struct sock *sk, struct sk_buff *skb) {
+  return submit_event(ctx, NULL, STACK_EVENT_TCP_RETRANSMIT, BPF_CORE_READ(skb, len));
+}
+
+// runq_task_t is a task which went off CPU: its stacks at that moment (where it resumes)
+// and when it became runnable (zero while it's sleeping).
+struct runq_task_t {
+  struct stack_count_key_t key;
+  u64 runnable_at;
+};
+
+// The runq_tasks map holds the tasks which are off CPU by thread ID.
+struct {
+  __uint(type, BPF_MAP_TYPE_HASH);
+  __uint(max_entries, 10240);
+  __type(key, u32);
+  __type(value, struct runq_task_t);
+} runq_tasks SEC(".maps");
+
+// The runq_stack_traces map holds the stacks of the tasks which went off CPU.
+// Unlike stack_traces, it isn't double-buffered and cleared on flush,
+// because a task might sleep for a long time before it's attributed the runqueue delay.
+// The stack IDs are reused, so a stack might be replaced by another one in the meantime,
+// hence the map is larger than stack_traces to make that unlikely.
+struct {
+  __uint(type, BPF_MAP_TYPE_STACK_TRACE);
+  __uint(max_entries, MAX_STACK_ADDRESSES * 16);
+  __type(key, u32);
+  __type(value, stack_trace_type);
+} runq_stack_traces SEC(".maps");
+
+// on_sched_switch remembers the stacks of the task going off CPU
+// and attributes the runqueue delay to the task going on CPU.
+// A preempted task stays runnable, so its delay starts right away.
+SEC("tracepoint/sched/sched_switch")
+int on_sched_switch(struct trace_event_raw_sched_switch *ctx) {
+  u64 now = bpf_ktime_get_ns();
+  u32 prev = ctx->prev_pid;
+  u32 next = ctx->next_pid;
+
+  // The current task is still the previous one, so its stacks can be captured.
+  if (prev != 0 && is_target()) {
+    struct runq_task_t t = {};
+    t.key.pid = bpf_get_current_pid_tgid() >> 32;
+    t.key.event = STACK_EVENT_RUNQUEUE;
+    t.key.user_stack_id = bpf_get_stackid(ctx, &runq_stack_traces, BPF_F_USER_STACK | BPF_F_REUSE_STACKID);
+    t.key.kernel_stack_id = bpf_get_stackid(ctx, &runq_stack_traces, BPF_F_REUSE_STACKID);
+    if (trace_context) {
+      struct trace_context_t *tc = bpf_map_lookup_elem(&trace_contexts, &prev);
+      if (tc) {
+        t.key.trace_id_hi = tc->trace_id_hi;
+        t.key.trace_id_lo = tc->trace_id_lo;
+        t.key.span_id = tc->span_id;
+      }
+    }
+    // TASK_RUNNING is zero, the kernels 5.14+ also report preemption as TASK_REPORT_MAX (above the state bits).
+    if ((ctx->prev_state & 0xff) == 0)
+      t.runnable_at = now;
+    bpf_map_update_elem(&runq_tasks, &prev, &t, BPF_ANY);
+  }
+
+  struct runq_task_t *t = bpf_map_lookup_elem(&runq_tasks, &next);
+  if (!t)
+    return 0;
+  if (!t->runnable_at) {
+    bpf_map_delete_elem(&runq_tasks, &next);
+    return 0;
+  }
+  struct stack_count_key_t key = t->key;
+  u64 delay = now - t->runnable_at;
+  bpf_map_delete_elem(&runq_tasks, &next);
+  if (time_bucket_ns)
+    key.time_bucket = now / time_bucket_ns;
+
+  u32 zero = 0;
+  u32 *buffer = bpf_map_lookup_elem(&active_buffer, &zero);
+  if (!buffer)
+    return 0;
+  if (*buffer == 0)
+    return count_event(&counts_0, &key, delay);
+  return count_event(&counts_1, &key, delay);
+}
+
+// on_sched_wakeup marks the sleeping task as runnable, so its runqueue delay starts.
+// The new tasks (sched_wakeup_new) aren't tracked since their stacks aren't known.
+SEC("tracepoint/sched/sched_wakeup")
+int on_sched_wakeup(struct trace_event_raw_sched_wakeup_template *ctx) {
+  u32 tid = ctx->pid;
+  struct runq_task_t *t = bpf_map_lookup_elem(&runq_tasks, &tid);
+  if (t && !t->runnable_at)
+    t->runnable_at = bpf_ktime_get_ns();
+  return 0;
+}
+
+// exec_event_t is sent to user space when a process calls execve,
+// so the newly started processes can be targeted without waiting for a /proc scan.
+struct exec_event_t {
+  u32 pid;
+};
+
+// The exec_events map is a per-CPU ring of exec events read by user space.
+struct {
+  __uint(type, BPF_MAP_TYPE_PERF_EVENT_ARRAY);
+  __uint(key_size, sizeof(u32));
+  __uint(value_size, sizeof(u32));
+} exec_events SEC(".maps");
+
+SEC("tracepoint/sched/sched_process_exec")
+int on_exec(void *ctx) {
+  struct exec_event_t event = {.pid = bpf_get_current_pid_tgid() >> 32};
+  bpf_perf_event_output(ctx, &exec_events, BPF_F_CURRENT_CPU, &event, sizeof(event));
+  return 0;
+}
+
+// on_trace_context is attached as a uprobe to the marker function of the instrumented application,
+// e.g., void parca_set_trace_context(u64 trace_id_hi, u64 trace_id_lo, u64 span_id),
+// which is called whenever the current thread starts or finishes working on a span.
+// The zero context means the thread is no longer working on a span.
+SEC("uprobe/trace_context")
+int on_trace_context(struct pt_regs *ctx) {
+  u32 tid = bpf_get_current_pid_tgid();
+  struct trace_context_t tc = {};
+  // The registers are copied since the verifier rejects the context accesses
+  // at the offsets the compiler selects between the calling conventions.
+  struct pt_regs regs;
+  if (bpf_probe_read_kernel(&regs, sizeof(regs), ctx))
+    return 0;
+#if defined(bpf_target_x86)
+  // Go passes the integer arguments in rax, rbx, rcx.
+  if (trace_context_go_abi) {
+    tc.trace_id_hi = regs.ax;
+    tc.trace_id_lo = regs.bx;
+    tc.span_id = regs.cx;
+  } else
+#endif
+  {
+    tc.trace_id_hi = PT_REGS_PARM1(&regs);
+    tc.trace_id_lo = PT_REGS_PARM2(&regs);
+    tc.span_id = PT_REGS_PARM3(&regs);
+  }
+
+  if (!tc.trace_id_hi && !tc.trace_id_lo && !tc.span_id)
+    bpf_map_delete_elem(&trace_contexts, &tid);
+  else
+    bpf_map_update_elem(&trace_contexts, &tid, &tc, BPF_ANY);
+  return 0;
+}
+
+char LICENSE[] SEC("license") = "GPL";
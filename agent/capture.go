@@ -0,0 +1,200 @@
+package agent
+
+import (
+	"compress/gzip"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/google/pprof/profile"
+
+	"diy-parca-agent/symbol"
+)
+
+// captureVersion is the version of the capture file format.
+// It must be incremented whenever Capture changes incompatibly.
+const captureVersion = 1
+
+// Capture is a raw recording of samples along with everything needed
+// to symbolize them later on another machine, decoupling collection from analysis:
+// the processes' memory mappings with build IDs, the symbol tables of the mapped binaries,
+// and the names of the sampled kernel functions.
+// It's stored as a gzip-compressed gob file, see Write and ReadCapture.
+type Capture struct {
+	Version   int
+	Start     time.Time
+	End       time.Time
+	Frequency uint64
+	Samples   []Sample
+	// Mappings are the executable memory mappings of the sampled processes by PID.
+	// They are read when a process is seen for the first time.
+	Mappings map[uint32][]Mapping
+	// ProcessNames are the names of the sampled processes by PID.
+	ProcessNames map[uint32]string
+	// Cmdlines are the command lines of the sampled processes by PID.
+	Cmdlines map[uint32]string
+	// KernelFuncs are the names of the sampled kernel functions by their addresses.
+	KernelFuncs map[uint64]string
+	// Tables are the symbol tables of the mapped binaries by build ID.
+	Tables map[string]*symbol.Table
+	// Build describes the agent and the kernel which recorded the capture.
+	Build BuildInfo
+	// Host describes the host which recorded the capture.
+	Host HostInfo
+	// Labels are attached to the samples of the profiles converted from the capture,
+	// e.g., env=prod, see ProfileOptions.Labels.
+	Labels Labels
+
+	kernel *KernelSymbols
+}
+
+// NewCapture returns an empty capture of samples collected with the given frequency.
+func NewCapture(frequency uint64) *Capture {
+	c := Capture{
+		Version:      captureVersion,
+		Start:        time.Now(),
+		Frequency:    frequency,
+		Mappings:     make(map[uint32][]Mapping),
+		ProcessNames: make(map[uint32]string),
+		Cmdlines:     make(map[uint32]string),
+		KernelFuncs:  make(map[uint64]string),
+		Tables:       make(map[string]*symbol.Table),
+		Build:        ReadBuildInfo(),
+		Host:         ReadHostInfo(),
+	}
+	// Kernel frames are left unsymbolized if the kernel symbols are unavailable.
+	var err error
+	if c.kernel, err = LoadKernelSymbols(); err != nil {
+		log.Printf("kernel frames won't be symbolized: %v", err)
+	}
+	return &c
+}
+
+// Add records the samples along with the mappings of the processes seen for the first time.
+// It must be called right after the samples are flushed,
+// because the processes might exit soon.
+func (c *Capture) Add(samples []Sample) {
+	c.End = time.Now()
+	c.Samples = append(c.Samples, samples...)
+
+	for _, s := range samples {
+		if _, ok := c.ProcessNames[s.PID]; !ok {
+			if name, err := processName(s.PID); err == nil {
+				c.ProcessNames[s.PID] = name
+			}
+			if cmdline, err := processCmdline(s.PID); err == nil {
+				c.Cmdlines[s.PID] = cmdline
+			}
+		}
+		if c.kernel != nil {
+			for _, addr := range s.KernelStack {
+				if start, name, ok := c.kernel.lookup(addr); ok {
+					c.KernelFuncs[start] = name
+				}
+			}
+		}
+
+		if _, ok := c.Mappings[s.PID]; ok || len(s.UserStack) == 0 {
+			continue
+		}
+		mm, err := ReadMappings(s.PID)
+		if err != nil {
+			mm = nil
+		}
+		for i := range mm {
+			c.addTable(s.PID, &mm[i])
+		}
+		c.Mappings[s.PID] = mm
+	}
+}
+
+// addTable sets the build ID of the mapping and extracts the symbol table of its binary.
+func (c *Capture) addTable(pid uint32, m *Mapping) {
+	if !isFile(m.Path) {
+		return
+	}
+	path := procPath(pid, m.Path)
+	buildID, err := readBuildID(path)
+	if err != nil || buildID == "" {
+		return
+	}
+	m.BuildID = buildID
+	if _, ok := c.Tables[buildID]; ok {
+		return
+	}
+
+	t, err := symbol.Extract(path)
+	if err != nil {
+		log.Printf("failed to extract symbols of %s: %v", m.Path, err)
+		return
+	}
+	c.Tables[buildID] = t
+}
+
+// Write writes the capture as a gzip-compressed gob.
+func (c *Capture) Write(w io.Writer) error {
+	zw := gzip.NewWriter(w)
+	if err := gob.NewEncoder(zw).Encode(c); err != nil {
+		return fmt.Errorf("failed to encode capture: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("failed to compress capture: %w", err)
+	}
+	return nil
+}
+
+// ReadCapture reads the capture written by Write.
+func ReadCapture(r io.Reader) (*Capture, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress capture: %w", err)
+	}
+	var c Capture
+	if err = gob.NewDecoder(zr).Decode(&c); err != nil {
+		return nil, fmt.Errorf("failed to decode capture: %w", err)
+	}
+	if c.Version != captureVersion {
+		return nil, fmt.Errorf("unsupported capture version %d", c.Version)
+	}
+	return &c, nil
+}
+
+// Profile converts the captured samples into a CPU profile.
+// The user space addresses are symbolized using the captured symbol tables,
+// the symbolizer might provide the missing ones, e.g., from its store.
+// Only the binaries without build ID are looked up by path on the current machine.
+func (c *Capture) Profile(s *symbol.Symbolizer) *profile.Profile {
+	return Profile(c.Samples, c.ProfileOptions(s))
+}
+
+// ProfileOptions returns the options to convert the captured samples, see Capture.Profile.
+// The captured symbol tables are added to the symbolizer.
+func (c *Capture) ProfileOptions(s *symbol.Symbolizer) ProfileOptions {
+	for _, t := range c.Tables {
+		s.Add(t)
+	}
+
+	opts := ProfileOptions{
+		Frequency:    c.Frequency,
+		Mappings:     c.Mappings,
+		ProcessNames: c.ProcessNames,
+		Cmdlines:     c.Cmdlines,
+		Symbolizer:   s,
+		Labels:       c.Labels,
+		// The captures recorded by the older agents lack the host info,
+		// then the host comments are left out rather than describing the current host.
+		Host:     &c.Host,
+		Start:    c.Start,
+		Duration: c.End.Sub(c.Start),
+	}
+	// The captures recorded by the older agents lack the build info.
+	if c.Build.Version != "" {
+		opts.Build = &c.Build
+	}
+	if len(c.KernelFuncs) > 0 {
+		opts.KernelSymbols = newKernelSymbols(c.KernelFuncs)
+	}
+	return opts
+}
@@ -0,0 +1,125 @@
+package agent
+
+import (
+	"bufio"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// cgroupRoot is where the cgroup file system is mounted.
+// On the hosts with cgroup v1 systemd keeps its hierarchy in the "systemd" subdirectory.
+const cgroupRoot = "/sys/fs/cgroup"
+
+// cgroupDir returns the directory of the cgroup, e.g., /system.slice/nginx.service.
+func cgroupDir(cgroup string) string {
+	// cgroup.controllers file is present only in the root of cgroup v2 (unified) hierarchy.
+	if _, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers")); err == nil {
+		return filepath.Join(cgroupRoot, cgroup)
+	}
+	return filepath.Join(cgroupRoot, "systemd", cgroup)
+}
+
+// systemdUnitCgroup returns the cgroup of the systemd unit, e.g., nginx.service.
+// The cgroup is empty when the unit isn't running.
+func systemdUnitCgroup(unit string) (string, error) {
+	out, err := exec.Command("systemctl", "show", "--property=LoadState,ControlGroup", unit).Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to show systemd unit %s: %w", unit, err)
+	}
+
+	props := make(map[string]string)
+	for _, line := range strings.Split(string(out), "\n") {
+		if k, v, ok := strings.Cut(line, "="); ok {
+			props[k] = v
+		}
+	}
+	if props["LoadState"] == "not-found" {
+		return "", failure(FailureTargetNotFound, fmt.Errorf("systemd unit %s not found", unit))
+	}
+	return props["ControlGroup"], nil
+}
+
+// systemdUnitPIDs returns the processes of the systemd unit.
+// The unit's cgroup is looked up every time, so the processes are tracked across the unit's restarts.
+func systemdUnitPIDs(unit string) (map[uint32]bool, error) {
+	cgroup, err := systemdUnitCgroup(unit)
+	if err != nil {
+		return nil, err
+	}
+	if cgroup == "" {
+		return nil, nil
+	}
+	return cgroupPIDs(cgroupDir(cgroup))
+}
+
+// cgroupPIDs returns the processes of the cgroup including its descendant cgroups.
+// The cgroup.procs file lists the thread group IDs, i.e., the PIDs as seen in the samples.
+func cgroupPIDs(dir string) (map[uint32]bool, error) {
+	pids := make(map[uint32]bool)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// The cgroup might be removed while it's walked, e.g., the unit is stopped.
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+
+		f, err := os.Open(filepath.Join(path, "cgroup.procs"))
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		defer f.Close()
+
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			pid, err := strconv.ParseUint(sc.Text(), 10, 32)
+			if err != nil {
+				return fmt.Errorf("invalid PID %q in %s", sc.Text(), path)
+			}
+			pids[uint32(pid)] = true
+		}
+		return sc.Err()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cgroup processes: %w", err)
+	}
+	return pids, nil
+}
+
+// containerIDPattern matches 64 hex digit container IDs used by Docker, containerd, and CRI-O
+// in cgroup paths, e.g., /docker/<id>, /kubepods/.../cri-containerd-<id>.scope.
+var containerIDPattern = regexp.MustCompile(`[0-9a-f]{64}`)
+
+// containerID returns the ID of the container the process runs in
+// based on its cgroup path, or an empty string if it's not in a container.
+func containerID(pid uint32) string {
+	b, err := os.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return ""
+	}
+	// Each line looks like hierarchy-ID:controller-list:cgroup-path,
+	// the innermost container ID is the last one in the path.
+	for _, line := range strings.Split(string(b), "\n") {
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		if ids := containerIDPattern.FindAllString(parts[2], -1); len(ids) > 0 {
+			return ids[len(ids)-1]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,80 @@
+//go:build linux
+
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// cgroup2Root returns where the cgroup v2 (unified) hierarchy is mounted.
+// On the hosts in hybrid mode it's mounted next to the cgroup v1 hierarchies.
+func cgroup2Root() (string, error) {
+	for _, dir := range []string{cgroupRoot, filepath.Join(cgroupRoot, "unified")} {
+		// cgroup.controllers file is present only in cgroup v2 hierarchy.
+		if _, err := os.Stat(filepath.Join(dir, "cgroup.controllers")); err == nil {
+			return dir, nil
+		}
+	}
+	return "", errors.New("cgroup v2 hierarchy not found")
+}
+
+// cgroupPath returns the directory of the cgroup v2 cgroup which is either absolute,
+// e.g., /sys/fs/cgroup/system.slice/docker-4f3a.scope,
+// or relative to the hierarchy root, e.g., /system.slice/docker-4f3a.scope.
+func cgroupPath(root, cgroup string) string {
+	if strings.HasPrefix(cgroup, root+"/") {
+		return cgroup
+	}
+	return filepath.Join(root, cgroup)
+}
+
+// cgroupIDs returns the IDs of the cgroups including their descendant cgroups
+// as reported by bpf_get_current_cgroup_id(), i.e., the inode numbers of the cgroup directories.
+func cgroupIDs(cgroups []string) (map[uint64]bool, error) {
+	root, err := cgroup2Root()
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make(map[uint64]bool)
+	for _, cgroup := range cgroups {
+		dir := cgroupPath(root, cgroup)
+		err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				// The cgroup might be removed while it's walked, e.g., the container is stopped.
+				// The target cgroup itself might not exist yet, its processes are sampled once it's created.
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if !d.IsDir() {
+				return nil
+			}
+
+			info, err := d.Info()
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			st, ok := info.Sys().(*syscall.Stat_t)
+			if !ok {
+				return fmt.Errorf("unknown inode of %s", path)
+			}
+			ids[st.Ino] = true
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read cgroup %s: %w", cgroup, err)
+		}
+	}
+	return ids, nil
+}
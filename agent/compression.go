@@ -0,0 +1,133 @@
+package agent
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/google/pprof/profile"
+)
+
+// Compression is how the profiles are compressed when they're written or uploaded.
+// The default gzip level of profile.Write costs measurable CPU at high flush rates,
+// so the size can be traded for speed with a lower level or no compression at all
+// (pprof reads the uncompressed profiles too).
+// The zero value is gzip with the default level.
+type Compression struct {
+	// Level is the gzip level from gzip.BestSpeed (1) to gzip.BestCompression (9),
+	// zero means gzip.DefaultCompression.
+	Level int
+	// None writes the uncompressed protobuf, Level is ignored.
+	None bool
+}
+
+// ParseCompression parses the compression of the form gzip, gzip:<level>, or none, e.g., gzip:1.
+// zstd isn't supported, since pprof only reads the gzipped and uncompressed profiles.
+func ParseCompression(s string) (Compression, error) {
+	name, level, hasLevel := strings.Cut(s, ":")
+	switch name {
+	case "", "gzip":
+		if !hasLevel {
+			return Compression{}, nil
+		}
+		n, err := strconv.Atoi(level)
+		if err != nil || n < gzip.BestSpeed || n > gzip.BestCompression {
+			return Compression{}, fmt.Errorf("gzip level must be within [%d, %d]", gzip.BestSpeed, gzip.BestCompression)
+		}
+		return Compression{Level: n}, nil
+	case "none":
+		if hasLevel {
+			return Compression{}, errors.New("no compression has no level")
+		}
+		return Compression{None: true}, nil
+	case "zstd":
+		return Compression{}, errors.New("zstd isn't supported since pprof can't read it, use gzip:1 or none for less CPU")
+	default:
+		return Compression{}, fmt.Errorf("unknown compression %q", s)
+	}
+}
+
+// String returns the compression in the form accepted by ParseCompression.
+func (c Compression) String() string {
+	switch {
+	case c.None:
+		return "none"
+	case c.Level == 0:
+		return "gzip"
+	default:
+		return "gzip:" + strconv.Itoa(c.Level)
+	}
+}
+
+// Ext returns the file extension of the profiles, i.e., .pb.gz or .pb if they aren't compressed.
+func (c Compression) Ext() string {
+	if c.None {
+		return ".pb"
+	}
+	return ".pb.gz"
+}
+
+// WriteProfile writes the profile in pprof format compressed accordingly.
+func (c Compression) WriteProfile(w io.Writer, p *profile.Profile) error {
+	if c.None {
+		return p.WriteUncompressed(w)
+	}
+	level := c.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	zw, err := gzip.NewWriterLevel(w, level)
+	if err != nil {
+		return err
+	}
+	if err = p.WriteUncompressed(zw); err != nil {
+		zw.Close()
+		return err
+	}
+	return zw.Close()
+}
+
+// write buffers the output of the encoder and compresses it accordingly.
+func (c Compression) write(w io.Writer, encode func(out io.Writer) error) error {
+	bw := bufio.NewWriter(w)
+	var (
+		out io.Writer = bw
+		zw  *gzip.Writer
+		err error
+	)
+	if !c.None {
+		level := c.Level
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		if zw, err = gzip.NewWriterLevel(bw, level); err != nil {
+			return err
+		}
+		out = zw
+	}
+
+	if err = encode(out); err != nil {
+		return err
+	}
+	if zw != nil {
+		if err = zw.Close(); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// compressed is embedded by the sinks which write the profiles in pprof format,
+// so their compression can be configured.
+type compressed struct {
+	compression Compression
+}
+
+// SetCompression sets how the profiles are compressed, gzip with the default level by default.
+func (c *compressed) SetCompression(compression Compression) {
+	c.compression = compression
+}
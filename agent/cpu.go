@@ -0,0 +1,123 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// onlineCPUsPath is a file which lists the CPUs available for scheduling.
+// Note, CPU numbering can be sparse, e.g., "0-3,6,8-11",
+// when some CPUs are offline or were never brought up.
+const onlineCPUsPath = "/sys/devices/system/cpu/online"
+
+// onlineCPUs returns the numbers of the online CPUs.
+func onlineCPUs() ([]int, error) {
+	b, err := os.ReadFile(onlineCPUsPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read online CPUs: %w", err)
+	}
+
+	cpus, err := parseCPUList(strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse online CPUs: %w", err)
+	}
+	return cpus, nil
+}
+
+// parseCPUList parses the CPU list format used in sysfs, e.g., "0-3,6,8-11".
+func parseCPUList(s string) ([]int, error) {
+	var cpus []int
+	if s == "" {
+		return cpus, nil
+	}
+
+	for _, r := range strings.Split(s, ",") {
+		first, last, isRange := strings.Cut(r, "-")
+		from, err := strconv.Atoi(first)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CPU %q", r)
+		}
+		to := from
+		if isRange {
+			if to, err = strconv.Atoi(last); err != nil || to < from {
+				return nil, fmt.Errorf("invalid CPU range %q", r)
+			}
+		}
+
+		for cpu := from; cpu <= to; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+
+	return cpus, nil
+}
+
+// coverageCommentPrefix starts the profile comment describing the sampled CPUs.
+const coverageCommentPrefix = "cpu coverage: "
+
+// CPUCoverage describes which online CPUs are sampled by the perf events, see Profiler.CPUCoverage.
+type CPUCoverage struct {
+	Sampled []int
+	// Skipped are the online CPUs where the perf events couldn't be opened,
+	// e.g., due to cgroup or CPU affinity restrictions.
+	Skipped []int
+	// Groups is the number of CPU groups sampled one at a time (zero if all CPUs are sampled at once),
+	// see Config.CPUGroups.
+	Groups int
+}
+
+// comment returns the profile comment, e.g., "cpu coverage: 6/8 CPUs (skipped 3,5)"
+// or "cpu coverage: 8/8 CPUs (1/4 at a time)",
+// or an empty string if the coverage is unknown.
+func (c CPUCoverage) comment() string {
+	total := len(c.Sampled) + len(c.Skipped)
+	if total == 0 {
+		return ""
+	}
+	s := fmt.Sprintf("%s%d/%d CPUs", coverageCommentPrefix, len(c.Sampled), total)
+	if len(c.Skipped) > 0 {
+		s += fmt.Sprintf(" (skipped %s)", formatCPUList(c.Skipped))
+	}
+	if c.Groups > 1 {
+		s += fmt.Sprintf(" (1/%d at a time)", c.Groups)
+	}
+	return s
+}
+
+// formatCPUList formats the sorted CPU numbers in the sysfs format, e.g., "0-3,6,8-11",
+// see parseCPUList.
+func formatCPUList(cpus []int) string {
+	var ranges []string
+	for i := 0; i < len(cpus); {
+		j := i
+		for j+1 < len(cpus) && cpus[j+1] == cpus[j]+1 {
+			j++
+		}
+		if i == j {
+			ranges = append(ranges, strconv.Itoa(cpus[i]))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%d-%d", cpus[i], cpus[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(ranges, ",")
+}
+
+// CPUUtilization is the number of CPU samples taken while the CPU was busy and idle,
+// see Profiler.CPUUtilization.
+type CPUUtilization struct {
+	CPU  int
+	Busy uint64
+	Idle uint64
+}
+
+// BusyShare returns the share of the samples taken while the CPU was busy.
+func (u CPUUtilization) BusyShare() float64 {
+	total := u.Busy + u.Idle
+	if total == 0 {
+		return 0
+	}
+	return float64(u.Busy) / float64(total)
+}
@@ -0,0 +1,179 @@
+//go:build linux
+
+package agent
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// maxCommLen is the max length of a process name, see TASK_COMM_LEN in the BPF program.
+const maxCommLen = 15
+
+// Denylist describes the processes which must never be sampled, e.g., vault or ssh-agent.
+// The rules take precedence over all targets: the denied processes are excluded
+// when the targets are discovered, and the BPF program drops their samples before their stacks are walked.
+//
+// The names and cgroups are matched by the BPF program on every event, so the processes are never sampled
+// even right after they start. The executables and labels are resolved by user space:
+// the processes are denied as soon as they exec (or by the next /proc scan if the exec events are unavailable),
+// and the samples taken before that are dropped when they're flushed.
+type Denylist struct {
+	// Comms are the process names (at most 15 characters), e.g., vault.
+	// They're also matched against the thread names, see /proc/<pid>/task/<tid>/comm.
+	Comms []string
+	// Exes are the glob patterns of the executable paths, e.g., /usr/bin/ssh-*.
+	Exes []string
+	// Cgroups are the cgroup v2 cgroups including their descendants, e.g., /system.slice/vault.service.
+	Cgroups []string
+	// Labels deny the processes which have all the labels of any of the sets, e.g., {"namespace": "vault"}.
+	// The labels are looked up by LabelProviders (all built-in providers if empty).
+	Labels         []Labels
+	LabelProviders []LabelProvider
+}
+
+// ParseDenylist parses the comma-separated rules of the form kind:value, where the kind is
+// comm, exe, cgroup, or label, e.g., "comm:vault,exe:/usr/bin/ssh-*,label:namespace=vault".
+func ParseDenylist(s string) (Denylist, error) {
+	var d Denylist
+	if s == "" {
+		return d, nil
+	}
+	for _, rule := range strings.Split(s, ",") {
+		kind, value, ok := strings.Cut(rule, ":")
+		if !ok || value == "" {
+			return d, fmt.Errorf("invalid deny rule %q, it must be kind:value", rule)
+		}
+		switch kind {
+		case "comm":
+			if len(value) > maxCommLen {
+				return d, fmt.Errorf("process name %q is longer than %d characters", value, maxCommLen)
+			}
+			d.Comms = append(d.Comms, value)
+		case "exe":
+			if _, err := filepath.Match(value, ""); err != nil {
+				return d, fmt.Errorf("invalid executable pattern %q: %w", value, err)
+			}
+			d.Exes = append(d.Exes, value)
+		case "cgroup":
+			d.Cgroups = append(d.Cgroups, value)
+		case "label":
+			name, v, ok := strings.Cut(value, "=")
+			if !ok || name == "" {
+				return d, fmt.Errorf("invalid deny label %q, it must be name=value", value)
+			}
+			d.Labels = append(d.Labels, Labels{name: v})
+		default:
+			return d, fmt.Errorf("unknown deny rule kind %q", kind)
+		}
+	}
+	return d, nil
+}
+
+// empty reports whether the denylist has no rules.
+func (d Denylist) empty() bool {
+	return len(d.Comms) == 0 && len(d.Cgroups) == 0 && !d.scansProcesses()
+}
+
+// scansProcesses reports whether the denied processes are looked up in /proc
+// and written to denied_pids map. The names are scanned too, since a process might rename
+// its threads, while the program matches the name of the sampled thread.
+func (d Denylist) scansProcesses() bool {
+	return len(d.Comms) > 0 || len(d.Exes) > 0 || len(d.Labels) > 0
+}
+
+// Denies reports whether the process matches any of the rules.
+// The processes which can't be inspected (e.g., they have exited) aren't denied.
+func (d Denylist) Denies(pid uint32) bool {
+	return d.deniesProcess(pid) || d.deniesCgroup(pid)
+}
+
+// deniesProcess reports whether the process matches the name, executable, or label rules.
+func (d Denylist) deniesProcess(pid uint32) bool {
+	if len(d.Comms) > 0 {
+		if name, err := processName(pid); err == nil {
+			for _, comm := range d.Comms {
+				if name == comm {
+					return true
+				}
+			}
+		}
+	}
+	for _, pattern := range d.Exes {
+		if exeMatch(pattern, pid) {
+			return true
+		}
+	}
+	if len(d.Labels) == 0 {
+		return false
+	}
+
+	providers := d.LabelProviders
+	if len(providers) == 0 {
+		for _, p := range LabelProviders {
+			providers = append(providers, p)
+		}
+	}
+	labels := make(Labels)
+	for _, p := range providers {
+		for name, value := range p.Labels(pid) {
+			labels[name] = value
+		}
+	}
+	for _, set := range d.Labels {
+		if hasLabels(labels, set) {
+			return true
+		}
+	}
+	return false
+}
+
+// deniesCgroup reports whether the process belongs to any of the denied cgroups or their descendants.
+func (d Denylist) deniesCgroup(pid uint32) bool {
+	if len(d.Cgroups) == 0 {
+		return false
+	}
+	root, err := cgroup2Root()
+	if err != nil {
+		return false
+	}
+	path, err := processCgroup(pid)
+	if err != nil || path == "" {
+		return false
+	}
+	for _, cgroup := range d.Cgroups {
+		// The cgroup might be given relative to the hierarchy root or as an absolute directory.
+		rel := strings.TrimPrefix(cgroupPath(root, cgroup), root)
+		if path == rel || strings.HasPrefix(path, rel+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// hasLabels reports whether the labels include all the labels of the set.
+func hasLabels(labels, set Labels) bool {
+	for name, value := range set {
+		if v, ok := labels[name]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// deniedPIDs returns the processes matched by the name, executable, or label rules.
+func (d Denylist) deniedPIDs() (map[uint32]bool, error) {
+	all, err := listPIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	pids := make(map[uint32]bool)
+	for _, pid := range all {
+		if d.deniesProcess(pid) {
+			pids[pid] = true
+		}
+	}
+	return pids, nil
+}
@@ -0,0 +1,96 @@
+//go:build linux
+
+package agent
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// dotnetIPCMagic starts the header of the .NET diagnostics IPC messages.
+	dotnetIPCMagic = "DOTNET_IPC_V1\x00"
+	// dotnetIPCHeaderSize is the size of the header: the magic, the message size (uint16),
+	// the command set, the command ID, and two reserved bytes.
+	dotnetIPCHeaderSize = len(dotnetIPCMagic) + 6
+	// dotnetProcessCommandSet groups the commands related to the runtime process.
+	dotnetProcessCommandSet = 0x04
+	// dotnetEnablePerfMapCommand enables the perf map (.NET 8+).
+	dotnetEnablePerfMapCommand = 0x05
+	// dotnetPerfMapOnly tells the runtime to write /tmp/perf-<pid>.map (but no jitdump).
+	dotnetPerfMapOnly = 3
+	// dotnetServerCommandSet and dotnetServerError make up the header of an error response.
+	dotnetServerCommandSet = 0xff
+	dotnetServerError      = 0xff
+	// dotnetIPCTimeout is how long the runtime has to respond to a diagnostics command.
+	dotnetIPCTimeout = 5 * time.Second
+)
+
+// isDotnet reports whether the process runs .NET, i.e., it has the CoreCLR runtime mapped.
+func isDotnet(mm []Mapping) bool {
+	for _, m := range mm {
+		if filepath.Base(m.Path) == "libcoreclr.so" {
+			return true
+		}
+	}
+	return false
+}
+
+// dotnetEnablePerfMap makes the .NET runtime (8+) write its JIT compiled methods
+// to /tmp/perf-<pid>.map as if it was started with DOTNET_PerfMapEnabled=3.
+// The command is sent over the diagnostics IPC socket (as dotnet-trace does),
+// which the runtime creates in /tmp of the process's mount namespace,
+// e.g., /tmp/dotnet-diagnostic-1234-5678-socket.
+func dotnetEnablePerfMap(pid uint32) error {
+	pattern := procPath(pid, fmt.Sprintf("/tmp/dotnet-diagnostic-%d-*-socket", namespacePID(pid)))
+	socks, err := filepath.Glob(pattern)
+	if err != nil {
+		return err
+	}
+	if len(socks) == 0 {
+		return fmt.Errorf("diagnostics socket of .NET process %d not found", pid)
+	}
+	// The socket of the most recent runtime instance goes last, since it has the greatest disambiguation key
+	// (the process start time).
+	conn, err := net.DialTimeout("unix", socks[len(socks)-1], dotnetIPCTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to connect to .NET process %d: %w", pid, err)
+	}
+	defer conn.Close()
+	if err = conn.SetDeadline(time.Now().Add(dotnetIPCTimeout)); err != nil {
+		return err
+	}
+
+	// The payload is the perf map type.
+	msg := make([]byte, dotnetIPCHeaderSize+4)
+	copy(msg, dotnetIPCMagic)
+	i := len(dotnetIPCMagic)
+	binary.LittleEndian.PutUint16(msg[i:], uint16(len(msg)))
+	msg[i+2] = dotnetProcessCommandSet
+	msg[i+3] = dotnetEnablePerfMapCommand
+	binary.LittleEndian.PutUint32(msg[dotnetIPCHeaderSize:], dotnetPerfMapOnly)
+	if _, err = conn.Write(msg); err != nil {
+		return fmt.Errorf("failed to send command to .NET process %d: %w", pid, err)
+	}
+
+	// The error response carries the HRESULT, e.g., when the runtime is older than .NET 8.
+	resp := make([]byte, dotnetIPCHeaderSize+4)
+	n, err := io.ReadAtLeast(conn, resp, dotnetIPCHeaderSize)
+	if err != nil {
+		return fmt.Errorf("failed to read .NET process %d response: %w", pid, err)
+	}
+	if string(resp[:len(dotnetIPCMagic)]) != dotnetIPCMagic {
+		return fmt.Errorf("invalid .NET process %d response", pid)
+	}
+	if resp[i+2] == dotnetServerCommandSet && resp[i+3] == dotnetServerError {
+		if n < len(resp) {
+			return fmt.Errorf(".NET process %d failed to enable perf map", pid)
+		}
+		return fmt.Errorf(".NET process %d failed to enable perf map: HRESULT %#x", pid, binary.LittleEndian.Uint32(resp[dotnetIPCHeaderSize:]))
+	}
+	return nil
+}
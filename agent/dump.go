@@ -0,0 +1,194 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/cilium/ebpf"
+)
+
+// BufferDump is the raw contents of the buffer's maps, see Buffer.Dump.
+// The addresses and hashes are hex strings since JSON numbers can't hold 64-bit values precisely.
+type BufferDump struct {
+	Counts []CountEntry `json:"counts"`
+	// StackTraces are the stack traces by their IDs, the innermost frame goes first.
+	StackTraces map[int32][]string `json:"stack_traces"`
+	// UserStacks are the user stacks walked by the BPF program by their hashes.
+	UserStacks map[string][]string `json:"user_stacks,omitempty"`
+}
+
+// CountEntry is a raw entry of "Counts" map.
+type CountEntry struct {
+	PID           uint32 `json:"pid"`
+	UserStackID   int32  `json:"user_stack_id"`
+	KernelStackID int32  `json:"kernel_stack_id"`
+	TimeBucket    uint32 `json:"time_bucket"`
+	Event         Event  `json:"event"`
+	UserStackHash string `json:"user_stack_hash,omitempty"`
+	TraceIDHigh   string `json:"trace_id_high,omitempty"`
+	TraceIDLow    string `json:"trace_id_low,omitempty"`
+	SpanID        string `json:"span_id,omitempty"`
+	Count         uint64 `json:"count"`
+	Value         uint64 `json:"value"`
+	Cycles        uint64 `json:"cycles,omitempty"`
+	Instructions  uint64 `json:"instructions,omitempty"`
+}
+
+// Dump reads the raw contents of the buffer's maps without modifying them,
+// unlike Samples it doesn't resolve the stack IDs, so the maps can be debugged.
+func (b *Buffer) Dump() (*BufferDump, error) {
+	d := BufferDump{
+		Counts:      []CountEntry{},
+		StackTraces: make(map[int32][]string),
+		UserStacks:  make(map[string][]string),
+	}
+
+	var (
+		key   StackCountKey
+		value StackValue
+	)
+	it := b.Counts.Iterate()
+	for it.Next(&key, &value) {
+		d.Counts = append(d.Counts, CountEntry{
+			PID:           key.PID,
+			UserStackID:   key.UserStackID,
+			KernelStackID: key.KernelStackID,
+			TimeBucket:    key.TimeBucket,
+			Event:         key.Event,
+			UserStackHash: hexOrEmpty(key.UserStackHash),
+			TraceIDHigh:   hexOrEmpty(key.TraceIDHigh),
+			TraceIDLow:    hexOrEmpty(key.TraceIDLow),
+			SpanID:        hexOrEmpty(key.SpanID),
+			Count:         value.Count,
+			Value:         value.Value,
+			Cycles:        value.Cycles,
+			Instructions:  value.Instructions,
+		})
+	}
+	if err := it.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read from Counts map: %w", err)
+	}
+
+	var (
+		id    uint32
+		trace = newStackTrace(b.StackTraces)
+	)
+	it = b.StackTraces.Iterate()
+	for it.Next(&id, &trace) {
+		var addrs []string
+		for _, addr := range trace {
+			if addr == 0 {
+				break
+			}
+			addrs = append(addrs, fmt.Sprintf("%#x", addr))
+		}
+		d.StackTraces[int32(id)] = addrs
+	}
+	if err := it.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read from StackTraces map: %w", err)
+	}
+
+	if b.UserStacks == nil {
+		return &d, nil
+	}
+	var (
+		hash uint64
+		ws   WalkedStack
+	)
+	it = b.UserStacks.Iterate()
+	for it.Next(&hash, &ws) {
+		if ws.Len > MaxWalkDepth {
+			ws.Len = MaxWalkDepth
+		}
+		addrs := make([]string, ws.Len)
+		for i, addr := range ws.Addrs[:ws.Len] {
+			addrs[i] = fmt.Sprintf("%#x", addr)
+		}
+		d.UserStacks[fmt.Sprintf("%#x", hash)] = addrs
+	}
+	if err := it.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read from UserStacks map: %w", err)
+	}
+
+	return &d, nil
+}
+
+func hexOrEmpty(v uint64) string {
+	if v == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%#x", v)
+}
+
+// LoadLiveBuffers opens the buffers of a running profiler by looking up its maps by name
+// among all the BPF maps loaded into the kernel, so the maps don't have to be pinned.
+// If several profilers are running, the maps of the most recently started one are opened.
+// The caller is responsible for closing the buffers.
+func LoadLiveBuffers() ([]Buffer, error) {
+	names := []string{
+		fmt.Sprintf("%s_0", countsPinName), fmt.Sprintf("%s_0", stackTracesPinName), fmt.Sprintf("%s_0", userStacksPinName),
+		fmt.Sprintf("%s_1", countsPinName), fmt.Sprintf("%s_1", stackTracesPinName), fmt.Sprintf("%s_1", userStacksPinName),
+	}
+	maps := make(map[string]*ebpf.Map)
+	closeMaps := func() {
+		for _, m := range maps {
+			m.Close()
+		}
+	}
+
+	var id ebpf.MapID
+	for {
+		next, err := ebpf.MapGetNextID(id)
+		if errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		if err != nil {
+			closeMaps()
+			return nil, fmt.Errorf("failed to list BPF maps: %w", err)
+		}
+		id = next
+
+		// The map might be removed in the meantime.
+		m, err := ebpf.NewMapFromID(id)
+		if err != nil {
+			continue
+		}
+		info, err := m.Info()
+		if err != nil || !containsString(names, info.Name) {
+			m.Close()
+			continue
+		}
+		// The IDs grow, so the newer maps replace the older ones.
+		if old, ok := maps[info.Name]; ok {
+			old.Close()
+		}
+		maps[info.Name] = m
+	}
+
+	if len(maps) != len(names) {
+		closeMaps()
+		var missing []string
+		for _, name := range names {
+			if maps[name] == nil {
+				missing = append(missing, name)
+			}
+		}
+		return nil, fmt.Errorf("profiler maps not found: %s", strings.Join(missing, ", "))
+	}
+
+	return []Buffer{
+		{Counts: maps[names[0]], StackTraces: maps[names[1]], UserStacks: maps[names[2]]},
+		{Counts: maps[names[3]], StackTraces: maps[names[4]], UserStacks: maps[names[5]]},
+	}, nil
+}
+
+func containsString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
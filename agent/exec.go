@@ -0,0 +1,77 @@
+//go:build linux
+
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/cilium/ebpf/link"
+	"github.com/cilium/ebpf/perf"
+)
+
+// execWatcher reports the processes which called execve, see on_exec BPF program.
+type execWatcher struct {
+	link   link.Link
+	reader *perf.Reader
+	wg     sync.WaitGroup
+}
+
+// watchExecs attaches the BPF program to sched_process_exec tracepoint
+// and calls fn with the PID of every process which called execve until the watcher is closed.
+// Unlike /proc scans, the new processes are reported within milliseconds.
+func watchExecs(objs *Objects, fn func(pid uint32)) (*execWatcher, error) {
+	l, err := link.Tracepoint("sched", "sched_process_exec", objs.objs.OnExec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to attach BPF program to sched_process_exec: %w", err)
+	}
+	r, err := perf.NewReader(objs.objs.ExecEvents, os.Getpagesize())
+	if err != nil {
+		l.Close()
+		return nil, fmt.Errorf("failed to read exec events: %w", err)
+	}
+
+	w := execWatcher{
+		link:   l,
+		reader: r,
+	}
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+
+		for {
+			rec, err := r.Read()
+			if errors.Is(err, perf.ErrClosed) {
+				return
+			}
+			if err != nil {
+				log.Printf("failed to read exec event: %v", err)
+				continue
+			}
+			// The processes whose events were lost are found by the next /proc scan.
+			if rec.LostSamples > 0 {
+				log.Printf("lost %d exec events", rec.LostSamples)
+				continue
+			}
+			if len(rec.RawSample) < 4 {
+				continue
+			}
+			fn(nativeEndian.Uint32(rec.RawSample))
+		}
+	}()
+
+	return &w, nil
+}
+
+// Close detaches the BPF program and stops reading the events.
+func (w *execWatcher) Close() error {
+	err := w.link.Close()
+	if closeErr := w.reader.Close(); err == nil {
+		err = closeErr
+	}
+	w.wg.Wait()
+	return err
+}
@@ -0,0 +1,54 @@
+package agent
+
+import (
+	"errors"
+	"os"
+)
+
+// FailureReason classifies why profiling failed, so the orchestration scripts can react accordingly,
+// e.g., retry when the target process hasn't started yet, but not when the privileges are missing.
+type FailureReason string
+
+const (
+	// FailureTargetNotFound means the target process or systemd unit doesn't exist.
+	FailureTargetNotFound FailureReason = "target_not_found"
+	// FailurePermissionDenied means the profiler lacks the privileges, e.g., CAP_BPF.
+	FailurePermissionDenied FailureReason = "permission_denied"
+	// FailureKernelUnsupported means the kernel is too old or lacks the features the profiler needs.
+	FailureKernelUnsupported FailureReason = "kernel_unsupported"
+	// FailureUploadFailed means a profile or the time series couldn't be sent to the server.
+	FailureUploadFailed FailureReason = "upload_failed"
+)
+
+// Failure is an error classified by its reason, see Reason.
+type Failure struct {
+	Reason FailureReason
+	Err    error
+}
+
+func (f *Failure) Error() string {
+	return f.Err.Error()
+}
+
+func (f *Failure) Unwrap() error {
+	return f.Err
+}
+
+// failure classifies the error with the reason.
+func failure(reason FailureReason, err error) error {
+	return &Failure{Reason: reason, Err: err}
+}
+
+// Reason returns the reason of the error if it's known, see Failure.
+// The errors denied by the kernel or the file system (EPERM, EACCES) are FailurePermissionDenied
+// even if they weren't classified.
+func Reason(err error) FailureReason {
+	var f *Failure
+	switch {
+	case errors.As(err, &f):
+		return f.Reason
+	case errors.Is(err, os.ErrPermission):
+		return FailurePermissionDenied
+	}
+	return ""
+}
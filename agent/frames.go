@@ -0,0 +1,94 @@
+package agent
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"diy-parca-agent/symbol"
+)
+
+// FrameFormatter formats the stack frames of the samples for the console
+// the way perf does, i.e., as a function name plus offset rather than raw hex:
+// "[k] do_syscall_64+0x5c" in the kernel and "main.work+0x1a [app]" in user space.
+// The frames which can't be symbolized are printed as addresses, e.g., "0x7f3a5c1e2f10 [libc.so.6]".
+type FrameFormatter struct {
+	// Mappings are the memory mappings of the sampled processes by PID, see ProcessMappings.
+	Mappings map[uint32][]Mapping
+	// Symbolizer resolves user space addresses, the user frames aren't symbolized if it's nil.
+	Symbolizer *symbol.Symbolizer
+	// KernelSymbols resolve kernel addresses, the kernel frames aren't symbolized if it's nil.
+	KernelSymbols *KernelSymbols
+	// PerfMaps resolve the JIT compiled methods in anonymous mappings if set.
+	PerfMaps *PerfMaps
+}
+
+// Frames returns the frames of the sample, the innermost first:
+// the kernel frames (marked with [k]) followed by the user frames.
+func (f *FrameFormatter) Frames(s Sample) []string {
+	frames := make([]string, 0, len(s.KernelStack)+len(s.UserStack))
+	for _, addr := range s.KernelStack {
+		frames = append(frames, f.kernelFrame(addr))
+	}
+	for i, addr := range s.UserStack {
+		frames = append(frames, f.userFrame(s.PID, addr, i > 0))
+	}
+	return frames
+}
+
+func (f *FrameFormatter) kernelFrame(addr uint64) string {
+	if f.KernelSymbols != nil {
+		if start, name, ok := f.KernelSymbols.lookup(addr); ok {
+			return fmt.Sprintf("[k] %s+%#x", name, addr-start)
+		}
+	}
+	return fmt.Sprintf("[k] %#x", addr)
+}
+
+// userFrame formats the user space address of the process.
+// The return address is symbolized as the preceding instruction (the call)
+// as in userLocation, though the offset is reported for the address itself.
+func (f *FrameFormatter) userFrame(pid uint32, addr uint64, isReturn bool) string {
+	m, ok := findMapping(f.Mappings[pid], addr)
+	if !ok {
+		return fmt.Sprintf("%#x", addr)
+	}
+	binary := filepath.Base(m.Path)
+	if isAnon(m.Path) {
+		binary = "[anon]"
+	}
+
+	lookupAddr := addr
+	if isReturn {
+		lookupAddr--
+	}
+	sym, ok := f.symbolize(pid, m, lookupAddr)
+	if !ok {
+		return fmt.Sprintf("%#x [%s]", addr, binary)
+	}
+	return fmt.Sprintf("%s+%#x [%s]", sym.Func, sym.Offset+addr-lookupAddr, binary)
+}
+
+// symbolize resolves the address within the process's mapping,
+// the pseudo-paths such as [vdso] aren't symbolized.
+func (f *FrameFormatter) symbolize(pid uint32, m Mapping, addr uint64) (symbol.Symbol, bool) {
+	var (
+		sym symbol.Symbol
+		err error
+	)
+	switch {
+	case isAnon(m.Path):
+		if f.PerfMaps == nil {
+			return sym, false
+		}
+		return f.PerfMaps.Lookup(pid, addr)
+	case f.Symbolizer == nil:
+		return sym, false
+	case m.BuildID != "":
+		sym, err = f.Symbolizer.SymbolizeBuildID(m.BuildID, m.Start, m.Offset, addr)
+	case isFile(m.Path):
+		sym, err = f.Symbolizer.Symbolize(procPath(pid, m.Path), m.Start, m.Offset, addr)
+	default:
+		return sym, false
+	}
+	return sym, err == nil
+}
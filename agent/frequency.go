@@ -0,0 +1,267 @@
+//go:build linux
+
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// FrequencyOverride samples the processes of a target at their own frequency,
+// e.g., 199 Hz for the service under investigation while everything else is sampled at 19 Hz,
+// see Config.FrequencyOverrides.
+type FrequencyOverride struct {
+	// Frequency is the sampling rate of the processes (samples per second).
+	Frequency uint64
+	// PID, Exe (a glob pattern of the executable paths), SystemdUnit, and Cgroup identify the processes,
+	// exactly one of them is set.
+	PID         int
+	Exe         string
+	SystemdUnit string
+	Cgroup      string
+}
+
+// ParseFrequencyOverride parses the override of the form kind:value=Hz, where the kind is
+// pid, exe, systemd-unit, or cgroup, e.g., "exe:/opt/api/bin/*=199".
+func ParseFrequencyOverride(s string) (FrequencyOverride, error) {
+	var o FrequencyOverride
+	i := strings.LastIndex(s, "=")
+	if i < 0 {
+		return o, fmt.Errorf("invalid frequency override %q, it must be kind:value=Hz", s)
+	}
+	hz, err := strconv.ParseUint(s[i+1:], 10, 64)
+	if err != nil || hz == 0 {
+		return o, fmt.Errorf("invalid frequency %q of override %q", s[i+1:], s)
+	}
+	o.Frequency = hz
+
+	kind, value, ok := strings.Cut(s[:i], ":")
+	if !ok || value == "" {
+		return o, fmt.Errorf("invalid frequency override target %q, it must be kind:value", s[:i])
+	}
+	switch kind {
+	case "pid":
+		pid, err := strconv.Atoi(value)
+		if err != nil || pid <= 0 {
+			return o, fmt.Errorf("invalid frequency override PID %q", value)
+		}
+		o.PID = pid
+	case "exe":
+		o.Exe = value
+	case "systemd-unit":
+		o.SystemdUnit = value
+	case "cgroup":
+		o.Cgroup = value
+	default:
+		return o, fmt.Errorf("unknown frequency override kind %q", kind)
+	}
+	return o, o.validate()
+}
+
+// String formats the override as kind:value=Hz, see ParseFrequencyOverride.
+func (o FrequencyOverride) String() string {
+	var target string
+	switch {
+	case o.PID > 0:
+		target = "pid:" + strconv.Itoa(o.PID)
+	case o.Exe != "":
+		target = "exe:" + o.Exe
+	case o.SystemdUnit != "":
+		target = "systemd-unit:" + o.SystemdUnit
+	case o.Cgroup != "":
+		target = "cgroup:" + o.Cgroup
+	}
+	return fmt.Sprintf("%s=%d", target, o.Frequency)
+}
+
+func (o FrequencyOverride) validate() error {
+	if o.Frequency == 0 {
+		return fmt.Errorf("frequency override %s must have a positive frequency", o)
+	}
+	var n int
+	for _, set := range []bool{o.PID > 0, o.Exe != "", o.SystemdUnit != "", o.Cgroup != ""} {
+		if set {
+			n++
+		}
+	}
+	if n != 1 {
+		return errors.New("frequency override must have exactly one of PID, executable, systemd unit, and cgroup")
+	}
+	if o.Exe != "" {
+		if _, err := filepath.Match(o.Exe, ""); err != nil {
+			return fmt.Errorf("invalid executable pattern %q: %w", o.Exe, err)
+		}
+	}
+	return nil
+}
+
+// pids returns the processes of the override's target.
+func (o FrequencyOverride) pids() (map[uint32]bool, error) {
+	switch {
+	case o.PID > 0:
+		// The process might have exited.
+		if _, err := os.Stat(fmt.Sprintf("/proc/%d", o.PID)); err != nil {
+			return nil, nil
+		}
+		return map[uint32]bool{uint32(o.PID): true}, nil
+	case o.Exe != "":
+		return exeMatches(o.Exe)
+	case o.SystemdUnit != "":
+		return systemdUnitPIDs(o.SystemdUnit)
+	case o.Cgroup != "":
+		return cgroupPIDs(cgroupDir(o.Cgroup))
+	}
+	return nil, nil
+}
+
+// overrideTask is the perf event sampling a thread at the frequency of its process' override.
+type overrideTask struct {
+	fd        int
+	frequency uint64
+}
+
+// watchFrequencyOverrides periodically looks for the processes sampled at their own frequencies
+// until the profiler is closed, see syncFrequencyOverrides.
+func (p *Profiler) watchFrequencyOverrides() {
+	ticker := time.NewTicker(processScanInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			if err := p.syncFrequencyOverrides(); err != nil {
+				log.Print(err)
+			}
+		}
+	}
+}
+
+// syncFrequencyOverrides finds the processes of the frequency overrides,
+// so their new threads are sampled at the overridden frequencies and the exited ones are forgotten.
+func (p *Profiler) syncFrequencyOverrides() error {
+	// The processes are looked up without holding the mutex since it might take a while.
+	pids, err := p.findOverridden()
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.setOverridden(pids)
+}
+
+// findOverridden returns the frequencies of the processes matching the overrides,
+// the first matching override wins. The denied processes are never sampled, so they're skipped.
+func (p *Profiler) findOverridden() (map[uint32]uint64, error) {
+	pids := make(map[uint32]uint64)
+	for _, o := range p.overrides {
+		matches, err := o.pids()
+		if err != nil {
+			return nil, fmt.Errorf("failed to find processes of frequency override %s: %w", o, err)
+		}
+		for pid := range matches {
+			if _, ok := pids[pid]; ok {
+				continue
+			}
+			if !p.denylist.empty() && p.denylist.Denies(pid) {
+				continue
+			}
+			pids[pid] = o.Frequency
+		}
+	}
+	return pids, nil
+}
+
+// setOverridden opens the perf events of the overridden processes' threads at their frequencies,
+// closes the ones of the exited threads, and makes the per-CPU perf events skip the threads which have their own events.
+// The thread events are opened first, so the threads aren't missed in between.
+// The threads created since the last scan are still sampled by the per-CPU events, so they aren't missed either.
+// The caller must hold the mutex once the profiler is running.
+func (p *Profiler) setOverridden(pids map[uint32]uint64) error {
+	alive := make(map[uint32]bool)
+	for pid, frequency := range pids {
+		// The process might have exited.
+		tids, err := listThreads(pid)
+		if err != nil {
+			delete(pids, pid)
+			continue
+		}
+		for _, tid := range tids {
+			t, ok := p.overrideTasks[tid]
+			if ok && t.frequency == frequency {
+				alive[tid] = true
+				continue
+			}
+			// The thread ID was reused by a process of another override.
+			if ok {
+				delete(p.overrideTasks, tid)
+				if err = p.closePerfEvent(t.fd); err != nil {
+					return fmt.Errorf("thread %d: %w", tid, err)
+				}
+			}
+
+			fd, err := p.openSampleEvent(int(tid), -1, frequency, p.objs.OverrideProgram())
+			// The thread might have exited.
+			if errors.Is(err, unix.ESRCH) {
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("thread %d: %w", tid, err)
+			}
+			alive[tid] = true
+			p.overrideTasks[tid] = overrideTask{fd: fd, frequency: frequency}
+		}
+	}
+
+	for tid, t := range p.overrideTasks {
+		if alive[tid] {
+			continue
+		}
+
+		delete(p.overrideTasks, tid)
+		if err := p.closePerfEvent(t.fd); err != nil {
+			return fmt.Errorf("thread %d: %w", tid, err)
+		}
+	}
+
+	tids := make(map[uint32]bool, len(p.overrideTasks))
+	for tid := range p.overrideTasks {
+		tids[tid] = true
+	}
+	if err := p.objs.SetOverriddenThreads(tids); err != nil {
+		return err
+	}
+	p.overridden = pids
+	return nil
+}
+
+// closeOverrideTasks closes the perf events of the threads sampled at their own frequencies.
+func (p *Profiler) closeOverrideTasks() error {
+	var firstErr error
+	for tid, t := range p.overrideTasks {
+		if err := p.closePerfEvent(t.fd); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("thread %d: %w", tid, err)
+		}
+		delete(p.overrideTasks, tid)
+	}
+	return firstErr
+}
+
+// overrideEventFDs returns the perf events of the threads sampled at their own frequencies.
+func (p *Profiler) overrideEventFDs() []int {
+	fds := make([]int, 0, len(p.overrideTasks))
+	for _, t := range p.overrideTasks {
+		fds = append(fds, t.fd)
+	}
+	return fds
+}
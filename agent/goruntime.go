@@ -0,0 +1,110 @@
+//go:build linux
+
+package agent
+
+import (
+	"strings"
+
+	"github.com/google/pprof/profile"
+)
+
+// goRuntimeLabels are the values of the go_runtime label by the Go runtime functions
+// which tell what the runtime was doing on behalf of the program, see goRuntimeLabel.
+// The earlier entries take precedence, e.g., a GC worker running on the system stack is labeled gc.
+var goRuntimeLabels = []struct {
+	funcs []string
+	label string
+}{
+	// The background GC workers, the sweeper, and the scavenger run in their own goroutines.
+	{[]string{"runtime.gcBgMarkWorker", "runtime.bgsweep", "runtime.bgscavenge"}, "gc"},
+	// The goroutines which allocate too fast are made to help the GC mark.
+	{[]string{"runtime.gcAssistAlloc"}, "gc_assist"},
+	// mcall switches to the system stack to park or reschedule the goroutine.
+	{[]string{"runtime.mcall", "runtime.schedule"}, "scheduler"},
+	{[]string{"runtime.systemstack"}, "systemstack"},
+}
+
+// goSchedulingFuncs are the Go runtime functions which start the goroutines and switch the stacks.
+// Below the program's code they only tell how the goroutine got to run, see stripGoRuntime.
+var goSchedulingFuncs = map[string]bool{
+	"runtime.goexit":             true,
+	"runtime.mstart":             true,
+	"runtime.mstart0":            true,
+	"runtime.mstart1":            true,
+	"runtime.rt0_go":             true,
+	"runtime.mcall":              true,
+	"runtime.systemstack":        true,
+	"runtime.systemstack_switch": true,
+	"runtime.morestack":          true,
+}
+
+// goRuntimeLabel returns the value of the go_runtime label of the sample with the user locations (the innermost first),
+// e.g., gc for the background GC workers, so pprof -tagignore go_runtime=gc hides them.
+// It's empty unless the sample has a Go runtime function of goRuntimeLabels, e.g., it isn't symbolized.
+func goRuntimeLabel(locs []*profile.Location) string {
+	for _, l := range goRuntimeLabels {
+		for _, loc := range locs {
+			for _, line := range loc.Line {
+				if line.Function != nil && hasGoFunc(line.Function.Name, l.funcs) {
+					return l.label
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// hasGoFunc reports whether the function is one of funcs or their closures, e.g., runtime.gcBgMarkWorker.func2.
+func hasGoFunc(name string, funcs []string) bool {
+	for _, fn := range funcs {
+		if name == fn || strings.HasPrefix(name, fn+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// stripGoRuntime drops the outermost Go scheduling frames (see goSchedulingFuncs) below the program's code
+// from the user locations (the innermost first), so the Go flame graphs start at the functions
+// the goroutines were created with as they do with runtime/pprof.
+// The stacks without the program's code, e.g., the scheduler looking for work, only lose runtime.goexit
+// which runtime/pprof doesn't show either.
+func stripGoRuntime(locs []*profile.Location) []*profile.Location {
+	n := len(locs)
+	if n > 1 && onlyGoFuncs(locs[n-1], goexitFunc) {
+		n--
+	}
+
+	user := false
+	for _, loc := range locs {
+		for _, line := range loc.Line {
+			if line.Function != nil && line.Function.Name != "" && !strings.HasPrefix(line.Function.Name, "runtime.") {
+				user = true
+			}
+		}
+	}
+	if !user {
+		return locs[:n]
+	}
+
+	for n > 0 && onlyGoFuncs(locs[n-1], goSchedulingFuncs) {
+		n--
+	}
+	return locs[:n]
+}
+
+// goexitFunc is the function at the root of every goroutine stack.
+var goexitFunc = map[string]bool{"runtime.goexit": true}
+
+// onlyGoFuncs reports whether all functions of the location (including the inlined ones) are in funcs.
+func onlyGoFuncs(loc *profile.Location, funcs map[string]bool) bool {
+	if len(loc.Line) == 0 {
+		return false
+	}
+	for _, line := range loc.Line {
+		if line.Function == nil || !funcs[line.Function.Name] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,142 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// HostInfo describes the host a profile was collected on,
+// so the profiles are self-describing when they land in a shared backend.
+type HostInfo struct {
+	Hostname string
+	// CPUModel is the model name of the CPUs, e.g., Intel(R) Xeon(R) Platinum 8259CL CPU @ 2.50GHz.
+	CPUModel string
+	// CPUs is the number of online CPUs.
+	CPUs int
+	// ContainerRuntimes are the container runtimes running on the host, e.g., containerd.
+	ContainerRuntimes []string
+}
+
+// containerRuntimeSockets are the API sockets of the container runtimes by their names.
+var containerRuntimeSockets = []struct {
+	name   string
+	socket string
+}{
+	{"docker", "/run/docker.sock"},
+	{"containerd", "/run/containerd/containerd.sock"},
+	{"cri-o", "/run/crio/crio.sock"},
+	{"podman", "/run/podman/podman.sock"},
+}
+
+// ReadHostInfo returns the description of the current host.
+// The fields which can't be read are left empty.
+func ReadHostInfo() HostInfo {
+	var h HostInfo
+	h.Hostname, _ = os.Hostname()
+	h.CPUModel = cpuModel()
+	if cpus, err := onlineCPUs(); err == nil {
+		h.CPUs = len(cpus)
+	}
+	for _, rt := range containerRuntimeSockets {
+		if _, err := os.Stat(rt.socket); err == nil {
+			h.ContainerRuntimes = append(h.ContainerRuntimes, rt.name)
+		}
+	}
+	return h
+}
+
+// cpuModel returns the model name of the first CPU from /proc/cpuinfo.
+// It's empty on the architectures which don't report it, e.g., arm64.
+func cpuModel() string {
+	f, err := os.Open("/proc/cpuinfo")
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		k, v, ok := strings.Cut(sc.Text(), ":")
+		if ok && strings.TrimSpace(k) == "model name" {
+			return strings.TrimSpace(v)
+		}
+	}
+	return ""
+}
+
+const (
+	// hostCommentPrefix starts the profile comment with the hostname.
+	hostCommentPrefix = "host: "
+	// cpuCommentPrefix, runtimeCommentPrefix, and frequencyCommentPrefix start the profile comments
+	// which contain no sensitive data, so they aren't sanitized, see Sanitizer.
+	cpuCommentPrefix       = "cpu: "
+	runtimeCommentPrefix   = "container runtime: "
+	frequencyCommentPrefix = "frequency: "
+)
+
+// comments returns the host description as profile comments, e.g.,
+//
+//	host: web-1
+//	cpu: Intel(R) Xeon(R) Platinum 8259CL CPU @ 2.50GHz (8 CPUs)
+//	container runtime: containerd
+//
+// Nothing is returned for the zero HostInfo, e.g., the host of a capture recorded by an older agent is unknown.
+func (h HostInfo) comments() []string {
+	if h.Hostname == "" && h.CPUModel == "" && h.CPUs == 0 && len(h.ContainerRuntimes) == 0 {
+		return nil
+	}
+
+	var cc []string
+	if h.Hostname != "" {
+		cc = append(cc, hostCommentPrefix+h.Hostname)
+	}
+	if h.CPUModel != "" || h.CPUs > 0 {
+		model := h.CPUModel
+		if model == "" {
+			model = "unknown"
+		}
+		cc = append(cc, fmt.Sprintf("%s%s (%d CPUs)", cpuCommentPrefix, model, h.CPUs))
+	}
+	runtimes := "none"
+	if len(h.ContainerRuntimes) > 0 {
+		runtimes = strings.Join(h.ContainerRuntimes, ", ")
+	}
+	cc = append(cc, runtimeCommentPrefix+runtimes)
+	return cc
+}
+
+// maxCmdlineLen limits the length of the command lines recorded in the profile comments,
+// e.g., a JVM's classpath can take kilobytes.
+const maxCmdlineLen = 1024
+
+// ProcessCmdlines returns the command lines of the sampled processes by PID.
+// The processes which exited are skipped.
+func ProcessCmdlines(samples []Sample) map[uint32]string {
+	cmdlines := make(map[uint32]string)
+	for _, s := range samples {
+		if _, ok := cmdlines[s.PID]; ok {
+			continue
+		}
+		if cmdline, err := processCmdline(s.PID); err == nil {
+			cmdlines[s.PID] = cmdline
+		}
+	}
+	return cmdlines
+}
+
+// processCmdline returns the command line of the process with the arguments separated by spaces.
+// It's empty for the kernel threads.
+func processCmdline(pid uint32) (string, error) {
+	b, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return "", err
+	}
+	b = bytes.TrimRight(b, "\x00")
+	if len(b) > maxCmdlineLen {
+		b = b[:maxCmdlineLen]
+	}
+	return string(bytes.ReplaceAll(b, []byte{0}, []byte{' '})), nil
+}
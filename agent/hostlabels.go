@@ -0,0 +1,203 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// DefaultMetadataTimeout is how long the cloud metadata endpoints are waited for, see HostLabels.
+// They answer within milliseconds on the cloud instances, elsewhere the connections time out.
+const DefaultMetadataTimeout = time.Second
+
+// HostLabels returns the labels describing the host the profiles are collected on:
+//
+//   - hostname is the host name
+//   - node is the Kubernetes node name from NODE_NAME environment variable (set by the downward API)
+//   - cloud, instance_id, region, and zone are looked up in the metadata endpoints of AWS, GCP, and Azure
+//
+// The cloud metadata isn't looked up if metadataTimeout is zero, e.g., in the air-gapped environments.
+// The labels which can't be determined are omitted.
+func HostLabels(ctx context.Context, metadataTimeout time.Duration) Labels {
+	labels := make(Labels)
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		labels["hostname"] = hostname
+	}
+	if node := os.Getenv("NODE_NAME"); node != "" {
+		labels["node"] = node
+	}
+	if metadataTimeout <= 0 {
+		return labels
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, metadataTimeout)
+	defer cancel()
+	for name, value := range cloudLabels(ctx) {
+		labels[name] = value
+	}
+	return labels
+}
+
+// cloudMetadataProviders look up the instance metadata, they're probed concurrently.
+var cloudMetadataProviders = []struct {
+	name   string
+	lookup func(ctx context.Context, client *http.Client) (cloudInstance, error)
+}{
+	{"aws", awsInstance},
+	{"gcp", gcpInstance},
+	{"azure", azureInstance},
+}
+
+// cloudInstance describes a cloud instance.
+type cloudInstance struct {
+	id     string
+	region string
+	zone   string
+}
+
+// cloudLabels returns the labels of the cloud instance the agent runs on,
+// or nil if none of the metadata endpoints responded.
+func cloudLabels(ctx context.Context) Labels {
+	// The proxies configured for the uploads must not intercept the link-local addresses.
+	client := &http.Client{Transport: &http.Transport{}}
+	defer client.CloseIdleConnections()
+
+	type result struct {
+		cloud    string
+		instance cloudInstance
+		err      error
+	}
+	results := make(chan result, len(cloudMetadataProviders))
+	for _, p := range cloudMetadataProviders {
+		go func(name string, lookup func(context.Context, *http.Client) (cloudInstance, error)) {
+			inst, err := lookup(ctx, client)
+			results <- result{cloud: name, instance: inst, err: err}
+		}(p.name, p.lookup)
+	}
+
+	for range cloudMetadataProviders {
+		r := <-results
+		if r.err != nil || r.instance.id == "" {
+			continue
+		}
+		labels := Labels{
+			"cloud":       r.cloud,
+			"instance_id": r.instance.id,
+		}
+		if r.instance.region != "" {
+			labels["region"] = r.instance.region
+		}
+		if r.instance.zone != "" {
+			labels["zone"] = r.instance.zone
+		}
+		return labels
+	}
+	return nil
+}
+
+// awsInstance looks up the EC2 instance with IMDSv2 which requires a session token.
+func awsInstance(ctx context.Context, client *http.Client) (cloudInstance, error) {
+	const endpoint = "http://169.254.169.254/latest"
+	token, err := metadata(ctx, client, http.MethodPut, endpoint+"/api/token", http.Header{
+		"X-Aws-Ec2-Metadata-Token-Ttl-Seconds": {"60"},
+	})
+	if err != nil {
+		return cloudInstance{}, err
+	}
+	header := http.Header{"X-Aws-Ec2-Metadata-Token": {token}}
+
+	var inst cloudInstance
+	if inst.id, err = metadata(ctx, client, http.MethodGet, endpoint+"/meta-data/instance-id", header); err != nil {
+		return inst, err
+	}
+	inst.region, _ = metadata(ctx, client, http.MethodGet, endpoint+"/meta-data/placement/region", header)
+	inst.zone, _ = metadata(ctx, client, http.MethodGet, endpoint+"/meta-data/placement/availability-zone", header)
+	return inst, nil
+}
+
+// gcpInstance looks up the Compute Engine instance.
+// The zone is returned as projects/<project-number>/zones/<zone>, and the region is the zone without its suffix,
+// e.g., us-central1 of us-central1-a.
+func gcpInstance(ctx context.Context, client *http.Client) (cloudInstance, error) {
+	const endpoint = "http://metadata.google.internal/computeMetadata/v1/instance"
+	header := http.Header{"Metadata-Flavor": {"Google"}}
+
+	var (
+		inst cloudInstance
+		err  error
+	)
+	if inst.id, err = metadata(ctx, client, http.MethodGet, endpoint+"/id", header); err != nil {
+		return inst, err
+	}
+	zone, _ := metadata(ctx, client, http.MethodGet, endpoint+"/zone", header)
+	if i := strings.LastIndexByte(zone, '/'); i >= 0 {
+		zone = zone[i+1:]
+	}
+	inst.zone = zone
+	if i := strings.LastIndexByte(zone, '-'); i > 0 {
+		inst.region = zone[:i]
+	}
+	return inst, nil
+}
+
+// azureInstance looks up the Azure virtual machine.
+// The zone is a number within the region, so it's prefixed with the region, e.g., eastus-1.
+func azureInstance(ctx context.Context, client *http.Client) (cloudInstance, error) {
+	const endpoint = "http://169.254.169.254/metadata/instance/compute?api-version=2021-02-01&format=json"
+	body, err := metadata(ctx, client, http.MethodGet, endpoint, http.Header{"Metadata": {"true"}})
+	if err != nil {
+		return cloudInstance{}, err
+	}
+	var compute struct {
+		VMID     string `json:"vmId"`
+		Location string `json:"location"`
+		Zone     string `json:"zone"`
+	}
+	if err = json.Unmarshal([]byte(body), &compute); err != nil {
+		return cloudInstance{}, fmt.Errorf("failed to decode azure metadata: %w", err)
+	}
+	inst := cloudInstance{
+		id:     compute.VMID,
+		region: compute.Location,
+	}
+	if compute.Zone != "" {
+		inst.zone = compute.Location + "-" + compute.Zone
+	}
+	return inst, nil
+}
+
+// maxMetadataSize limits the size of a metadata response.
+const maxMetadataSize = 64 << 10
+
+// metadata requests the metadata endpoint and returns the trimmed response body.
+func metadata(ctx context.Context, client *http.Client, method, url string, header http.Header) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header = header
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxMetadataSize))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata endpoint %s responded with %s", url, resp.Status)
+	}
+	s := strings.TrimSpace(string(body))
+	if s == "" {
+		return "", errors.New("empty metadata response")
+	}
+	return s, nil
+}
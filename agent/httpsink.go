@@ -0,0 +1,246 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/pprof/profile"
+
+	"diy-parca-agent/model"
+)
+
+// httpSinkTimeout limits how long an upload can take.
+const httpSinkTimeout = 30 * time.Second
+
+// post sends the request body to the URL and fails unless the response status is 2xx.
+func post(ctx context.Context, client *http.Client, rawURL, contentType string, body io.Reader, header http.Header) error {
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, rawURL, body)
+	if err != nil {
+		return fmt.Errorf("failed to create upload request: %w", err)
+	}
+	for name, values := range header {
+		r.Header[name] = values
+	}
+	r.Header.Set("Content-Type", contentType)
+	resp, err := client.Do(r)
+	if err != nil {
+		return failure(FailureUploadFailed, fmt.Errorf("failed to upload profile: %w", err))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return failure(FailureUploadFailed, fmt.Errorf("upload failed with %s: %s", resp.Status, bytes.TrimSpace(msg)))
+	}
+	return nil
+}
+
+// postStream is like post, but the request body is written by the write function while it's being sent
+// (chunked transfer encoding), so the serialized profile isn't buffered in memory along with the body,
+// e.g., the large system-wide profiles of the big hosts.
+func postStream(ctx context.Context, client *http.Client, rawURL, contentType string, write func(w io.Writer) error, header http.Header) error {
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := write(pw)
+		pw.CloseWithError(err)
+		done <- err
+	}()
+
+	err := post(ctx, client, rawURL, contentType, pr, header)
+	// The writer is unblocked if the upload failed before the whole body was read.
+	pr.CloseWithError(io.ErrClosedPipe)
+	if writeErr := <-done; writeErr != nil && !errors.Is(writeErr, io.ErrClosedPipe) {
+		return fmt.Errorf("failed to encode profile: %w", writeErr)
+	}
+	return err
+}
+
+// profileName returns the name of the profile type, e.g., "cpu" for the CPU profiles
+// and "requests" for the block I/O ones.
+func profileName(p *profile.Profile) string {
+	if p.PeriodType != nil {
+		return p.PeriodType.Type
+	}
+	if len(p.SampleType) > 0 {
+		return p.SampleType[len(p.SampleType)-1].Type
+	}
+	return "unknown"
+}
+
+// ParcaSink uploads the profiles to Parca via the HTTP gateway of its profile store
+// (/profiles/writeraw), the labels become the series labels along with __name__,
+// e.g., parca_agent_cpu{service="api"}.
+type ParcaSink struct {
+	compressed
+	url    string
+	token  string
+	client *http.Client
+}
+
+// NewParcaSink returns a sink which uploads the profiles to the Parca server,
+// e.g., http://parca:7070. The bearer token is sent if it's not empty, e.g., to Polar Signals Cloud.
+func NewParcaSink(serverURL, token string) *ParcaSink {
+	return &ParcaSink{
+		url:    strings.TrimSuffix(serverURL, "/") + "/profiles/writeraw",
+		token:  token,
+		client: &http.Client{Timeout: httpSinkTimeout},
+	}
+}
+
+// Write uploads the profile as a raw (not normalized) pprof.
+// The request is streamed, so the encoded profile isn't kept in memory.
+func (s *ParcaSink) Write(ctx context.Context, p *EncodedProfile, labels Labels) error {
+	type label struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	}
+	ll := []label{{Name: "__name__", Value: "parca_agent_" + p.Type}}
+	for name, value := range labels {
+		ll = append(ll, label{Name: name, Value: value})
+	}
+	sort.Slice(ll, func(i, j int) bool { return ll[i].Name < ll[j].Name })
+	series, err := json.Marshal(ll)
+	if err != nil {
+		return err
+	}
+
+	// The request is {"normalized":false,"series":[{"labels":{"labels":[...]},"samples":[{"raw_profile":"..."}]}]},
+	// where the profile bytes are base64-encoded as the gateway expects.
+	write := func(w io.Writer) error {
+		if _, err := fmt.Fprintf(w, `{"normalized":false,"series":[{"labels":{"labels":%s},"samples":[{"raw_profile":"`, series); err != nil {
+			return err
+		}
+		enc := base64.NewEncoder(base64.StdEncoding, w)
+		if err := p.Write(enc, s.compression); err != nil {
+			return err
+		}
+		if err := enc.Close(); err != nil {
+			return err
+		}
+		_, err := io.WriteString(w, `"}]}]}`)
+		return err
+	}
+
+	header := make(http.Header)
+	if s.token != "" {
+		header.Set("Authorization", "Bearer "+s.token)
+	}
+	if err = postStream(ctx, s.client, s.url, "application/json", write, header); err != nil {
+		return fmt.Errorf("parca: %w", err)
+	}
+	return nil
+}
+
+// PyroscopeSink uploads the profiles to Pyroscope via its ingest API,
+// the labels are added to the application name, e.g., myapp.cpu{service="api"}.
+type PyroscopeSink struct {
+	compressed
+	url    string
+	app    string
+	client *http.Client
+}
+
+// NewPyroscopeSink returns a sink which uploads the profiles of the application
+// to the Pyroscope server, e.g., http://pyroscope:4040.
+func NewPyroscopeSink(serverURL, app string) *PyroscopeSink {
+	return &PyroscopeSink{
+		url:    strings.TrimSuffix(serverURL, "/") + "/ingest",
+		app:    app,
+		client: &http.Client{Timeout: httpSinkTimeout},
+	}
+}
+
+// Write uploads the profile in pprof format as a multipart form.
+// The form is streamed, so the encoded profile isn't kept in memory.
+func (s *PyroscopeSink) Write(ctx context.Context, p *EncodedProfile, labels Labels) error {
+	// The boundary is chosen upfront, since it's a part of the content type.
+	boundary := multipart.NewWriter(io.Discard).Boundary()
+	write := func(w io.Writer) error {
+		mw := multipart.NewWriter(w)
+		if err := mw.SetBoundary(boundary); err != nil {
+			return err
+		}
+		fw, err := mw.CreateFormFile("profile", "profile.pprof")
+		if err != nil {
+			return err
+		}
+		if err = p.Write(fw, s.compression); err != nil {
+			return err
+		}
+		return mw.Close()
+	}
+
+	name := s.app + "." + p.Type
+	if len(labels) > 0 {
+		name += "{" + labels.String() + "}"
+	}
+	from := p.Start
+	if p.Start.IsZero() {
+		from = time.Now().Add(-p.Duration)
+	}
+	q := url.Values{
+		"name":    {name},
+		"from":    {strconv.FormatInt(from.Unix(), 10)},
+		"until":   {strconv.FormatInt(from.Add(p.Duration).Unix(), 10)},
+		"format":  {"pprof"},
+		"spyName": {"ebpfspy"},
+	}
+	if p.Period > 0 {
+		q.Set("sampleRate", strconv.FormatInt(int64(time.Second)/p.Period, 10))
+	}
+
+	contentType := "multipart/form-data; boundary=" + boundary
+	if err := postStream(ctx, s.client, s.url+"?"+q.Encode(), contentType, write, nil); err != nil {
+		return fmt.Errorf("pyroscope: %w", err)
+	}
+	return nil
+}
+
+// OTLPSink exports the profiles to an OpenTelemetry collector via OTLP/HTTP
+// (the experimental profiles signal of opentelemetry-proto v1.3, /v1experimental/profiles).
+// The pprof is attached as the original payload, and the labels become the resource attributes.
+type OTLPSink struct {
+	compressed
+	url    string
+	client *http.Client
+}
+
+// NewOTLPSink returns a sink which exports the profiles to the collector, e.g., http://otel-collector:4318.
+func NewOTLPSink(collectorURL string) *OTLPSink {
+	return &OTLPSink{
+		url:    strings.TrimSuffix(collectorURL, "/") + "/v1experimental/profiles",
+		client: &http.Client{Timeout: httpSinkTimeout},
+	}
+}
+
+// Write exports the profile as ExportProfilesServiceRequest protobuf.
+// Unlike the other sinks, the request isn't streamed, since the protobuf messages are prefixed with their lengths.
+func (s *OTLPSink) Write(ctx context.Context, p *EncodedProfile, labels Labels) error {
+	var raw bytes.Buffer
+	if err := p.Write(&raw, s.compression); err != nil {
+		return fmt.Errorf("failed to encode profile: %w", err)
+	}
+
+	req, err := model.OTLPRequest(raw.Bytes(), p.Start, p.Duration, labels)
+	if err != nil {
+		return err
+	}
+
+	if err := post(ctx, s.client, s.url, "application/x-protobuf", bytes.NewReader(req), nil); err != nil {
+		return fmt.Errorf("otlp: %w", err)
+	}
+	return nil
+}
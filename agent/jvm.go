@@ -0,0 +1,136 @@
+//go:build linux
+
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// jvmAttachTimeout is how long to wait for the JVM to start its attach listener.
+	jvmAttachTimeout = 5 * time.Second
+	// jvmCommandTimeout is how long a diagnostic command can take, e.g., dumping the code cache.
+	jvmCommandTimeout = 30 * time.Second
+)
+
+// isJVM reports whether the process runs a HotSpot JVM, i.e., it has libjvm.so mapped.
+func isJVM(mm []Mapping) bool {
+	for _, m := range mm {
+		if filepath.Base(m.Path) == "libjvm.so" {
+			return true
+		}
+	}
+	return false
+}
+
+// jcmd runs the diagnostic command in the JVM (as jcmd does) via the HotSpot attach API
+// and returns its output, e.g., jcmd(pid, "Compiler.perfmap") makes the JVM (JDK 17+)
+// write its JIT compiled methods to /tmp/perf-<pid>.map.
+//
+// The attach listener is started on demand: the .attach_pid<pid> file is created
+// in the process's working directory and the JVM is signaled with SIGQUIT,
+// then it listens on /tmp/.java_pid<pid> socket.
+// The files are accessed via the process's mount namespace, so the containers are covered.
+// The trigger can't be created under -sandbox landlock which doesn't allow writing to the working directories.
+func jcmd(pid uint32, command string) (string, error) {
+	nspid := namespacePID(pid)
+	sock := procPath(pid, fmt.Sprintf("/tmp/.java_pid%d", nspid))
+	if _, err := os.Stat(sock); err != nil {
+		if err = startAttachListener(pid, nspid, sock); err != nil {
+			return "", err
+		}
+	}
+
+	conn, err := net.DialTimeout("unix", sock, jvmAttachTimeout)
+	if err != nil {
+		return "", fmt.Errorf("failed to attach to JVM %d: %w", pid, err)
+	}
+	defer conn.Close()
+	if err = conn.SetDeadline(time.Now().Add(jvmCommandTimeout)); err != nil {
+		return "", err
+	}
+
+	// The request is the protocol version, the command, and three arguments,
+	// each terminated with a null byte.
+	req := fmt.Sprintf("1\x00jcmd\x00%s\x00\x00\x00", command)
+	if _, err = io.WriteString(conn, req); err != nil {
+		return "", fmt.Errorf("failed to send command to JVM %d: %w", pid, err)
+	}
+
+	// The response starts with the status line, zero means success.
+	r := bufio.NewReader(conn)
+	status, err := r.ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("failed to read JVM %d response: %w", pid, err)
+	}
+	out, err := io.ReadAll(r)
+	if err != nil {
+		return "", fmt.Errorf("failed to read JVM %d response: %w", pid, err)
+	}
+	if strings.TrimSpace(status) != "0" {
+		return "", fmt.Errorf("JVM %d failed to run %s: %s", pid, command, bytes.TrimSpace(out))
+	}
+	return string(out), nil
+}
+
+// startAttachListener asks the JVM to start listening on the attach socket and waits until it does.
+// The trigger file is owned by the process's user, since the older HotSpot versions ignore it otherwise.
+func startAttachListener(pid, nspid uint32, sock string) error {
+	info, err := os.Stat(fmt.Sprintf("/proc/%d", pid))
+	if err != nil {
+		return fmt.Errorf("failed to find JVM %d owner: %w", pid, err)
+	}
+	owner, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fmt.Errorf("failed to find JVM %d owner", pid)
+	}
+
+	trigger := procPath(pid, fmt.Sprintf("/.attach_pid%d", nspid))
+	if cwd, err := os.Readlink(fmt.Sprintf("/proc/%d/cwd", pid)); err == nil {
+		trigger = procPath(pid, filepath.Join(cwd, fmt.Sprintf(".attach_pid%d", nspid)))
+	}
+	f, err := os.Create(trigger)
+	if err != nil {
+		return fmt.Errorf("failed to create JVM attach trigger: %w", err)
+	}
+	defer os.Remove(trigger)
+	err = f.Chown(int(owner.Uid), int(owner.Gid))
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("failed to chown JVM attach trigger: %w", err)
+	}
+
+	if err = unix.Kill(int(pid), unix.SIGQUIT); err != nil {
+		return fmt.Errorf("failed to signal JVM %d: %w", pid, err)
+	}
+
+	for deadline := time.Now().Add(jvmAttachTimeout); time.Now().Before(deadline); {
+		if _, err = os.Stat(sock); err == nil {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("JVM %d didn't start attach listener", pid)
+}
+
+// jvmPreservesFramePointers reports whether the JVM runs with -XX:+PreserveFramePointer.
+// Otherwise the kernel can't walk the stacks through the JIT compiled methods
+// and the Java stacks are truncated.
+func jvmPreservesFramePointers(pid uint32) (bool, error) {
+	out, err := jcmd(pid, "VM.flags")
+	if err != nil {
+		return false, err
+	}
+	return strings.Contains(out, "-XX:+PreserveFramePointer"), nil
+}
@@ -0,0 +1,170 @@
+package agent
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// kallsymsPath is a file which lists the kernel symbols.
+// Note, the addresses are zeros unless the file is read by root
+// (see kernel.kptr_restrict sysctl).
+const kallsymsPath = "/proc/kallsyms"
+
+// KernelSymbols resolves kernel addresses into function names.
+type KernelSymbols struct {
+	// addrs and names are the kernel function addresses sorted in ascending order
+	// and their corresponding names.
+	addrs []uint64
+	names []string
+}
+
+// kernelSymbol is a function symbol from /proc/kallsyms.
+type kernelSymbol struct {
+	addr uint64
+	name string
+}
+
+// LoadKernelSymbols reads the kernel function symbols from /proc/kallsyms.
+func LoadKernelSymbols() (*KernelSymbols, error) {
+	f, err := os.Open(kallsymsPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open kernel symbols: %w", err)
+	}
+	defer f.Close()
+
+	var syms []kernelSymbol
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		// A line consists of an address, symbol type, name, and an optional module name, e.g.,
+		// ffffffffc0a3a000 t nft_do_chain  [nf_tables]
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 3 {
+			continue
+		}
+		// Only the symbols from the text (code) section are kept,
+		// i.e., the types t, T, w, W (weak symbols).
+		switch fields[1] {
+		case "t", "T", "w", "W":
+		default:
+			continue
+		}
+
+		addr, err := strconv.ParseUint(fields[0], 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse kernel symbol address: %w", err)
+		}
+		if addr == 0 {
+			continue
+		}
+		syms = append(syms, kernelSymbol{addr: addr, name: fields[2]})
+	}
+	if err = sc.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read kernel symbols: %w", err)
+	}
+	if len(syms) == 0 {
+		return nil, fmt.Errorf("kernel symbol addresses are hidden, the profiler must run as root or with CAP_SYSLOG")
+	}
+
+	sort.Slice(syms, func(i, j int) bool {
+		return syms[i].addr < syms[j].addr
+	})
+	ks := KernelSymbols{
+		addrs: make([]uint64, len(syms)),
+		names: make([]string, len(syms)),
+	}
+	for i, s := range syms {
+		ks.addrs[i] = s.addr
+		ks.names[i] = s.name
+	}
+
+	return &ks, nil
+}
+
+// Lookup returns the name of the kernel function which contains the address,
+// i.e., the function with the greatest address not exceeding addr.
+func (ks *KernelSymbols) Lookup(addr uint64) (string, bool) {
+	_, name, ok := ks.lookup(addr)
+	return name, ok
+}
+
+// lookup returns the address and the name of the kernel function which contains the address.
+func (ks *KernelSymbols) lookup(addr uint64) (uint64, string, bool) {
+	i := sort.Search(len(ks.addrs), func(i int) bool {
+		return ks.addrs[i] > addr
+	})
+	if i == 0 {
+		return 0, "", false
+	}
+	return ks.addrs[i-1], ks.names[i-1], true
+}
+
+// newKernelSymbols returns the kernel symbols from the function names by address.
+func newKernelSymbols(funcs map[uint64]string) *KernelSymbols {
+	ks := KernelSymbols{
+		addrs: make([]uint64, 0, len(funcs)),
+		names: make([]string, 0, len(funcs)),
+	}
+	for addr := range funcs {
+		ks.addrs = append(ks.addrs, addr)
+	}
+	sort.Slice(ks.addrs, func(i, j int) bool {
+		return ks.addrs[i] < ks.addrs[j]
+	})
+	for _, addr := range ks.addrs {
+		ks.names = append(ks.names, funcs[addr])
+	}
+	return &ks
+}
+
+// Interrupt contexts the samples can be taken in, see irqContext.
+const (
+	irqSoft = "softirq"
+	irqHard = "hardirq"
+)
+
+// softirqFuncs and hardirqFuncs are the kernel functions (or their prefixes)
+// which process the softirqs and hardware interrupts respectively.
+var (
+	softirqFuncs = []string{"__do_softirq", "handle_softirqs"}
+	hardirqFuncs = []string{
+		// x86-64 interrupt entries.
+		"asm_common_interrupt", "common_interrupt", "asm_sysvec_", "sysvec_", "__sysvec_", "do_IRQ",
+		// arm64 interrupt entries.
+		"gic_handle_irq", "el1_interrupt", "el0_interrupt",
+		"handle_irq_event",
+	}
+)
+
+// irqContext returns the interrupt context the kernel stack was sampled in (irqSoft or irqHard),
+// or an empty string if it's a process context.
+// The innermost interrupt function decides the context,
+// e.g., the softirqs processed on the exit from a hardware interrupt are softirq context.
+// The interrupts are attributed to whatever process happened to be running.
+func (ks *KernelSymbols) irqContext(stack []uint64) string {
+	for _, addr := range stack {
+		_, name, ok := ks.lookup(addr)
+		if !ok {
+			continue
+		}
+		if hasAnyPrefix(name, softirqFuncs) {
+			return irqSoft
+		}
+		if hasAnyPrefix(name, hardirqFuncs) {
+			return irqHard
+		}
+	}
+	return ""
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,212 @@
+package agent
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// LabelProvider describes a process with labels, e.g., {"namespace": "shop", "pod": "api-7d9f"}.
+// The samples of the process are labeled with them, so the profiles carry organization-specific metadata,
+// e.g., a team or a deployment looked up by the cgroup. It returns nil if it knows nothing about the process,
+// e.g., it has already exited.
+type LabelProvider interface {
+	Labels(pid uint32) Labels
+}
+
+// LabelProviderFunc adapts a function to the LabelProvider interface.
+type LabelProviderFunc func(pid uint32) Labels
+
+// Labels calls f(pid).
+func (f LabelProviderFunc) Labels(pid uint32) Labels {
+	return f(pid)
+}
+
+// LabelProviders are the built-in label providers by name, see ParseLabelProviders.
+var LabelProviders = map[string]LabelProvider{
+	"proc":       ProcLabelProvider{},
+	"cgroup":     CgroupLabelProvider{},
+	"kubernetes": KubernetesLabelProvider{},
+}
+
+// ParseLabelProviders returns the built-in label providers by their comma-separated names,
+// e.g., "proc,kubernetes".
+func ParseLabelProviders(names string) ([]LabelProvider, error) {
+	if names == "" {
+		return nil, nil
+	}
+	var pp []LabelProvider
+	for _, name := range strings.Split(names, ",") {
+		p, ok := LabelProviders[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown label provider %q", name)
+		}
+		pp = append(pp, p)
+	}
+	return pp, nil
+}
+
+// ProcessLabels returns the labels of the processes the samples were taken from.
+// The labels of the later providers take precedence.
+// The processes without labels (e.g., the exited ones) are skipped.
+func ProcessLabels(samples []Sample, providers []LabelProvider) map[uint32]Labels {
+	if len(providers) == 0 {
+		return nil
+	}
+	labels := make(map[uint32]Labels)
+	seen := make(map[uint32]bool)
+	for _, s := range samples {
+		if seen[s.PID] {
+			continue
+		}
+		seen[s.PID] = true
+
+		var ll Labels
+		for _, p := range providers {
+			for name, value := range p.Labels(s.PID) {
+				if ll == nil {
+					ll = make(Labels)
+				}
+				ll[name] = value
+			}
+		}
+		if ll != nil {
+			labels[s.PID] = ll
+		}
+	}
+	return labels
+}
+
+// StaticLabelProvider labels every process with the same labels, e.g., {"env": "prod"},
+// so the global labels are attached to the samples too, not only to the profiles passed to the sinks.
+type StaticLabelProvider Labels
+
+// Labels returns the static labels.
+func (p StaticLabelProvider) Labels(pid uint32) Labels {
+	if len(p) == 0 {
+		return nil
+	}
+	return Labels(p)
+}
+
+// ProcLabelProvider labels the processes with their executable path and user ID,
+// e.g., {"exe": "/usr/bin/python3.11", "uid": "1000"}.
+type ProcLabelProvider struct{}
+
+// Labels returns the process metadata found in /proc.
+func (ProcLabelProvider) Labels(pid uint32) Labels {
+	labels := make(Labels)
+	if exe, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid)); err == nil {
+		labels["exe"] = strings.TrimSuffix(exe, " (deleted)")
+	}
+	if uid, err := processUID(pid); err == nil {
+		labels["uid"] = strconv.FormatUint(uint64(uid), 10)
+	}
+	if len(labels) == 0 {
+		return nil
+	}
+	return labels
+}
+
+// processUID returns the real user ID of the process.
+func processUID(pid uint32) (uint32, error) {
+	b, err := os.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return 0, err
+	}
+	// The line looks like "Uid:	1000	1000	1000	1000" (real, effective, saved, and file system UIDs).
+	for _, line := range strings.Split(string(b), "\n") {
+		if !strings.HasPrefix(line, "Uid:") {
+			continue
+		}
+		ff := strings.Fields(line)
+		if len(ff) < 2 {
+			break
+		}
+		uid, err := strconv.ParseUint(ff[1], 10, 32)
+		return uint32(uid), err
+	}
+	return 0, fmt.Errorf("uid of process %d not found", pid)
+}
+
+// CgroupLabelProvider labels the processes with their cgroup v2 path and the container ID if any,
+// e.g., {"cgroup": "/system.slice/docker-4f3a...scope", "container_id": "4f3a..."}.
+type CgroupLabelProvider struct{}
+
+// Labels returns the cgroup of the process.
+func (CgroupLabelProvider) Labels(pid uint32) Labels {
+	path, err := processCgroup(pid)
+	if err != nil || path == "" {
+		return nil
+	}
+	labels := Labels{"cgroup": path}
+	if ids := containerIDPattern.FindAllString(path, -1); len(ids) > 0 {
+		labels["container_id"] = ids[len(ids)-1]
+	}
+	return labels
+}
+
+// processCgroup returns the cgroup v2 path of the process, e.g., /system.slice/nginx.service.
+// On the hosts with cgroup v1 the path of the systemd hierarchy is returned.
+func processCgroup(pid uint32) (string, error) {
+	b, err := os.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return "", err
+	}
+	var systemd string
+	for _, line := range strings.Split(string(b), "\n") {
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		switch parts[1] {
+		case "":
+			return parts[2], nil
+		case "name=systemd":
+			systemd = parts[2]
+		}
+	}
+	return systemd, nil
+}
+
+// podUIDPattern matches the pod UID in the cgroup path of a Kubernetes container,
+// e.g., /kubepods/burstable/pod1b2c.../<container> (cgroupfs driver)
+// or /kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod1b2c..._....slice (systemd driver)
+// where the dashes of the UID are replaced with underscores.
+var podUIDPattern = regexp.MustCompile(`pod([0-9a-f]{8}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{12})`)
+
+// KubernetesLabelProvider labels the processes running in Kubernetes pods
+// with the pod's UID, name, and namespace, e.g., {"pod_uid": "1b2c...", "pod": "api-7d9f", "namespace": "shop"}.
+// The UID is found in the cgroup path, the name is the pod's host name,
+// and the namespace is read from the mounted service account (if it's mounted).
+type KubernetesLabelProvider struct{}
+
+// Labels returns the pod of the process.
+func (KubernetesLabelProvider) Labels(pid uint32) Labels {
+	path, err := processCgroup(pid)
+	if err != nil {
+		return nil
+	}
+	m := podUIDPattern.FindStringSubmatch(path)
+	if m == nil {
+		return nil
+	}
+	labels := Labels{"pod_uid": strings.ReplaceAll(m[1], "_", "-")}
+
+	if b, err := os.ReadFile(fmt.Sprintf("/proc/%d/environ", pid)); err == nil {
+		for _, env := range bytes.Split(b, []byte{0}) {
+			if bytes.HasPrefix(env, []byte("HOSTNAME=")) && len(env) > len("HOSTNAME=") {
+				labels["pod"] = string(env[len("HOSTNAME="):])
+				break
+			}
+		}
+	}
+	ns, err := os.ReadFile(procPath(pid, "/var/run/secrets/kubernetes.io/serviceaccount/namespace"))
+	if err == nil && len(bytes.TrimSpace(ns)) > 0 {
+		labels["namespace"] = string(bytes.TrimSpace(ns))
+	}
+	return labels
+}
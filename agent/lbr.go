@@ -0,0 +1,126 @@
+//go:build linux
+
+package agent
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"syscall"
+	"time"
+
+	"diy-parca-agent/symbol"
+)
+
+// executableKey identifies an executable file by its device and inode,
+// so the binaries are told apart across the mount namespaces.
+type executableKey struct {
+	dev uint64
+	ino uint64
+}
+
+// watchUnwinders periodically selects the unwinders of the sampled processes until the profiler is closed,
+// see syncUnwinders.
+func (p *Profiler) watchUnwinders() {
+	ticker := time.NewTicker(processScanInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			if err := p.syncUnwinders(); err != nil {
+				log.Print(err)
+			}
+		}
+	}
+}
+
+// syncUnwinders selects UnwinderLBR for the sampled processes whose executables omit frame pointers,
+// and resets the unwinders of the processes which have exited, see Config.LBR.
+func (p *Profiler) syncUnwinders() error {
+	// The processes are looked up without holding the mutex since it might take a while.
+	var (
+		pids map[uint32]bool
+		err  error
+	)
+	if p.targets != nil {
+		pids, err = p.targets()
+	} else {
+		var all []uint32
+		if all, err = listPIDs(); err == nil {
+			pids = make(map[uint32]bool, len(all))
+			for _, pid := range all {
+				pids[pid] = true
+			}
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to find processes to unwind with LBR: %w", err)
+	}
+
+	lbr := make(map[uint32]bool)
+	for pid := range pids {
+		if p.omitsFramePointers(pid) {
+			lbr[pid] = true
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.setUnwinders(lbr)
+}
+
+// setUnwinders writes the processes unwound with LBR to the BPF map,
+// the other processes are unwound by frame pointers.
+// The caller must hold the mutex once the profiler is running.
+func (p *Profiler) setUnwinders(lbr map[uint32]bool) error {
+	for pid := range p.lbrPIDs {
+		if lbr[pid] {
+			continue
+		}
+		if err := p.objs.SetProcessUnwinder(pid, UnwinderFramePointers); err != nil {
+			return err
+		}
+		delete(p.lbrPIDs, pid)
+	}
+	for pid := range lbr {
+		if p.lbrPIDs[pid] {
+			continue
+		}
+		if err := p.objs.SetProcessUnwinder(pid, UnwinderLBR); err != nil {
+			return err
+		}
+		p.lbrPIDs[pid] = true
+	}
+	return nil
+}
+
+// omitsFramePointers reports whether the executable of the process likely omits frame pointers.
+// The guesses are cached per executable, and the ones which can't be made are treated as having frame pointers,
+// e.g., the kernel threads have no executable.
+func (p *Profiler) omitsFramePointers(pid uint32) bool {
+	path := fmt.Sprintf("/proc/%d/exe", pid)
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false
+	}
+	k := executableKey{dev: uint64(st.Dev), ino: st.Ino}
+	if omitted, ok := p.noFramePointers[k]; ok {
+		return omitted
+	}
+
+	fp, err := symbol.DetectFramePointers(path)
+	omitted := err == nil && fp == symbol.FramePointersOmitted
+	p.noFramePointers[k] = omitted
+	if omitted {
+		exe, _ := os.Readlink(path)
+		log.Printf("%s likely omits frame pointers, its stacks are unwound with LBR", exe)
+	}
+	return omitted
+}
@@ -0,0 +1,84 @@
+package agent
+
+import (
+	"sort"
+)
+
+const (
+	// mappingKernel is where the samples taken in kernel space are attributed.
+	mappingKernel = "[kernel]"
+	// mappingAnonymous is where the samples taken in anonymous mappings are attributed, e.g., JIT code.
+	mappingAnonymous = "[anon]"
+	// mappingUnknown is where the samples are attributed when their mapping wasn't found,
+	// e.g., the process exited before its mappings were read.
+	mappingUnknown = "[unknown]"
+)
+
+// MappingShare is the number of samples taken in a mapping and its share of all the samples.
+type MappingShare struct {
+	Mapping string  `json:"mapping"`
+	Samples uint64  `json:"samples"`
+	Share   float64 `json:"share"`
+}
+
+// MappingReport aggregates the samples by the mapping their innermost frame was in,
+// e.g., the binary vs libc vs libssl vs kernel,
+// so it's clear at a glance where the time went before anyone opens a flame graph.
+type MappingReport struct {
+	samples map[string]uint64
+	total   uint64
+}
+
+// NewMappingReport returns an empty report.
+func NewMappingReport() *MappingReport {
+	return &MappingReport{
+		samples: make(map[string]uint64),
+	}
+}
+
+// Add attributes the samples from a flush to the mappings,
+// see ProcessMappings.
+func (r *MappingReport) Add(samples []Sample, mappings map[uint32][]Mapping) {
+	for _, s := range samples {
+		r.total += s.Count
+
+		// The sample was taken in kernel space if there is a kernel stack.
+		if len(s.KernelStack) > 0 {
+			r.samples[mappingKernel] += s.Count
+			continue
+		}
+		if len(s.UserStack) == 0 {
+			r.samples[mappingUnknown] += s.Count
+			continue
+		}
+
+		mp, ok := findMapping(mappings[s.PID], s.UserStack[0])
+		switch {
+		case !ok:
+			r.samples[mappingUnknown] += s.Count
+		case mp.Path == "":
+			r.samples[mappingAnonymous] += s.Count
+		default:
+			r.samples[mp.Path] += s.Count
+		}
+	}
+}
+
+// Shares returns the mappings sorted by their number of samples, the hottest first.
+func (r *MappingReport) Shares() []MappingShare {
+	shares := make([]MappingShare, 0, len(r.samples))
+	for path, n := range r.samples {
+		shares = append(shares, MappingShare{
+			Mapping: path,
+			Samples: n,
+			Share:   float64(n) / float64(r.total),
+		})
+	}
+	sort.Slice(shares, func(i, j int) bool {
+		if shares[i].Samples != shares[j].Samples {
+			return shares[i].Samples > shares[j].Samples
+		}
+		return shares[i].Mapping < shares[j].Mapping
+	})
+	return shares
+}
@@ -0,0 +1,573 @@
+// Package agent contains the building blocks of the CPU profiler based on Parca Agent:
+// the BPF program collecting stack traces and the means to read them from the BPF maps.
+package agent
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/cilium/ebpf"
+)
+
+// DefaultStackDepth is the max depth of each stack trace to track unless it's configured,
+// see ObjectsOptions.StackDepth.
+// Note, it must match MAX_STACK_DEPTH in the BPF program.
+const DefaultStackDepth = 127
+
+// MaxWalkDepth is the max depth of the user stacks walked by the BPF program itself.
+// Note, it must match MAX_WALK_DEPTH in the BPF program.
+const MaxWalkDepth = 512
+
+// File name prefixes of the pinned BPF maps, see Objects.Pin.
+const (
+	countsPinName      = "counts"
+	stackTracesPinName = "stack_traces"
+	userStacksPinName  = "user_stacks"
+)
+
+// StackCountKey represents "Counts" map key sent to user space from the BPF program running in the kernel.
+// Note, that it must match the C stack_count_key_t struct,
+// and both C and Go structs must be aligned the same way.
+type StackCountKey struct {
+	PID           uint32
+	UserStackID   int32
+	KernelStackID int32
+	// TimeBucket is the number of ObjectsOptions.TimeBucket intervals since boot
+	// when the sample was taken (zero if the samples aren't split by time).
+	TimeBucket uint32
+	// Event is the kind of the event attributed to the stacks.
+	Event Event
+	// UserBuildIDStackID identifies the user stack in "BuildIDStacks" map
+	// (negative if it wasn't stored), see ObjectsOptions.BuildIDStacks.
+	UserBuildIDStackID int32
+	// UserStackHash identifies the user stack in "UserStacks" map
+	// when it was walked by the BPF program (UserStackID is negative then).
+	UserStackHash uint64
+	// TraceIDHigh, TraceIDLow, and SpanID are the trace context of the sampled thread
+	// (zeros if unknown), see ObjectsOptions.TraceContext.
+	TraceIDHigh uint64
+	TraceIDLow  uint64
+	SpanID      uint64
+	// Overridden is 1 if the sample was taken by the perf event of a thread sampled at its process' own frequency,
+	// see Config.FrequencyOverrides.
+	Overridden uint32
+	_          uint32
+}
+
+// StackValue represents "Counts" map value: how many times the stack trace has been seen
+// and the sum of the events' values, e.g., bytes of block I/O requests.
+// The CPU samples also sum the cycles and instructions if they're counted, see ObjectsOptions.IPC.
+// Note, it must match the C stack_value_t struct.
+type StackValue struct {
+	Count        uint64
+	Value        uint64
+	Cycles       uint64
+	Instructions uint64
+}
+
+// Event is the kind of the event attributed to the stacks, see event_t in the BPF program.
+// Each profiling mode records its own events, see Mode.
+type Event uint32
+
+const (
+	// EventCPU is a CPU clock sample.
+	EventCPU Event = iota
+	// EventBlockIO is a block I/O request issued to a device, its value is the request size in bytes.
+	EventBlockIO
+	// EventTCPSend is a tcp_sendmsg call, its value is the message size in bytes.
+	EventTCPSend
+	// EventTCPRetransmit is a retransmitted TCP segment, its value is the segment size in bytes.
+	EventTCPRetransmit
+	// EventRunqueue is a period the task was runnable but not running,
+	// its value is the duration in nanoseconds.
+	EventRunqueue
+)
+
+// WalkedStack represents "UserStacks" map value which is a user stack
+// walked by the BPF program following frame pointers, see ObjectsOptions.WalkDepth.
+type WalkedStack struct {
+	Len   uint64
+	Addrs [MaxWalkDepth]uint64
+}
+
+// StackTrace represents "StackTraces" map value which is an array of memory addresses.
+// The unused trailing elements are zeros.
+// Its length must match the map's value size, see newStackTrace.
+type StackTrace []uint64
+
+// newStackTrace returns a stack trace sized to hold a value of the stack map.
+func newStackTrace(m *ebpf.Map) StackTrace {
+	return make(StackTrace, m.ValueSize()/8)
+}
+
+// Statuses of the build ID stack frames, see BuildIDStackFrame.
+const (
+	buildIDFrameEmpty = 0
+	buildIDFrameValid = 1
+	buildIDFrameIP    = 2
+)
+
+// BuildIDStackFrame is a frame of the "BuildIDStacks" map value.
+// Note, it must match the C bpf_stack_build_id struct.
+type BuildIDStackFrame struct {
+	// Status tells whether the frame is empty (0), has a build ID and file offset (1),
+	// or only has the address (2) because the build ID couldn't be read.
+	Status  int32
+	BuildID [20]byte
+	// OffsetOrIP is the file offset if the build ID is valid or the address otherwise.
+	OffsetOrIP uint64
+}
+
+// buildIDStackFrameSize is the size of BuildIDStackFrame in the map.
+const buildIDStackFrameSize = 32
+
+// BuildIDStackTrace represents "BuildIDStacks" map value, the unused trailing frames are empty.
+// Its length must match the map's value size as StackTrace's.
+type BuildIDStackTrace []BuildIDStackFrame
+
+// BuildIDFrame is a user stack frame identified by the build ID of its binary and the file offset,
+// so it can be symbolized without the process's memory mappings, e.g., after the process has exited.
+// BuildID is empty if it couldn't be read, e.g., for JIT code.
+type BuildIDFrame struct {
+	BuildID string `json:"build_id,omitempty"`
+	Offset  uint64 `json:"offset,omitempty"`
+}
+
+// Sample is a stack trace read from the BPF maps along with
+// the number of times it was seen.
+type Sample struct {
+	PID           uint32 `json:"pid"`
+	UserStackID   int32  `json:"user_stack_id"`
+	KernelStackID int32  `json:"kernel_stack_id"`
+	// UserStackHash identifies the user stack walked by the BPF program, see StackCountKey.
+	UserStackHash uint64 `json:"user_stack_hash,omitempty"`
+	// UserStack and KernelStack contain memory addresses of the stack frames.
+	// The first address is the innermost frame where the sample was taken.
+	UserStack   []uint64 `json:"user_stack"`
+	KernelStack []uint64 `json:"kernel_stack"`
+	// UserBuildIDStack is the user stack as build IDs and file offsets if they were recorded,
+	// its frames correspond to UserStack, see ObjectsOptions.BuildIDStacks.
+	UserBuildIDStack []BuildIDFrame `json:"user_build_id_stack,omitempty"`
+	Count            uint64         `json:"count"`
+	// Event is the kind of the event attributed to the stacks and Value is the sum of their values,
+	// e.g., bytes of block I/O requests (zero for CPU samples).
+	Event Event  `json:"event,omitempty"`
+	Value uint64 `json:"value,omitempty"`
+	// Cycles and Instructions are the CPU cycles and the instructions retired attributed to the CPU samples
+	// if they're counted (zeros otherwise), see Config.IPC.
+	Cycles       uint64 `json:"cycles,omitempty"`
+	Instructions uint64 `json:"instructions,omitempty"`
+	// Frequency is the sampling rate of the process if it was overridden (zero otherwise),
+	// so its CPU time is estimated by it, see Config.FrequencyOverrides.
+	Frequency uint64 `json:"frequency,omitempty"`
+	// TimeBucket is the number of time bucket intervals since boot, see StackCountKey.
+	TimeBucket uint32 `json:"time_bucket,omitempty"`
+	// Time is the start of the time bucket the sample was taken in,
+	// it's zero if the samples aren't split by time or the bucket duration is unknown.
+	Time time.Time `json:"-"`
+	// TraceIDHigh, TraceIDLow, and SpanID are the trace context of the sampled thread, see StackCountKey.
+	TraceIDHigh uint64 `json:"trace_id_high,omitempty"`
+	TraceIDLow  uint64 `json:"trace_id_low,omitempty"`
+	SpanID      uint64 `json:"span_id,omitempty"`
+	// other marks the sample which merges the rare stacks of the process, see MergeRareStacks.
+	other bool
+	// overridden marks the sample taken at the process' own frequency, see StackCountKey.
+	overridden bool
+}
+
+// TraceID returns the trace ID of the sample in W3C Trace Context format (32 hex digits),
+// or an empty string if the sample isn't associated with a trace.
+func (s *Sample) TraceID() string {
+	if s.TraceIDHigh == 0 && s.TraceIDLow == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%016x%016x", s.TraceIDHigh, s.TraceIDLow)
+}
+
+// ReadSamples reads the stack counts and resolves their stack IDs into memory addresses.
+// Negative stack IDs indicate bpf_get_stackid() errors,
+// e.g., -14 (EFAULT) is returned for a kernel stack when a process was sampled in user space.
+// Such stacks are left empty unless the user stack was walked by the BPF program,
+// then it's read from userStacks by its hash.
+func ReadSamples(counts, stackTraces, userStacks *ebpf.Map) ([]Sample, error) {
+	return readSamples(counts, stackTraces, userStacks, nil, nil)
+}
+
+// readSamples is ReadSamples which also resolves the stacks of the runqueue samples
+// from runqStackTraces and the build ID stacks from buildIDStacks (they're left empty if nil).
+func readSamples(counts, stackTraces, userStacks, runqStackTraces, buildIDStacks *ebpf.Map) ([]Sample, error) {
+	var (
+		samples []Sample
+		key     StackCountKey
+		value   StackValue
+		// stacks caches stack traces by their IDs since
+		// the same stack is usually referenced by many keys.
+		stacks     = make(map[int32][]uint64)
+		runqStacks = make(map[int32][]uint64)
+		walked     = make(map[uint64][]uint64)
+		buildIDs   = make(map[int32][]BuildIDFrame)
+	)
+	lookupStack := func(id int32, event Event) ([]uint64, error) {
+		if id < 0 {
+			return nil, nil
+		}
+		m, cache := stackTraces, stacks
+		if event == EventRunqueue {
+			if runqStackTraces == nil {
+				return nil, nil
+			}
+			m, cache = runqStackTraces, runqStacks
+		}
+		if s, ok := cache[id]; ok {
+			return s, nil
+		}
+
+		trace := newStackTrace(m)
+		if err := m.Lookup(uint32(id), trace); err != nil {
+			// The stack might have been evicted by a hash collision in the meantime.
+			if errors.Is(err, ebpf.ErrKeyNotExist) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("failed to look up stack %d: %w", id, err)
+		}
+
+		var s []uint64
+		for _, addr := range trace {
+			if addr == 0 {
+				break
+			}
+			s = append(s, addr)
+		}
+		cache[id] = s
+		return s, nil
+	}
+
+	lookupWalkedStack := func(hash uint64) ([]uint64, error) {
+		if s, ok := walked[hash]; ok {
+			return s, nil
+		}
+
+		var ws WalkedStack
+		if err := userStacks.Lookup(hash, &ws); err != nil {
+			if errors.Is(err, ebpf.ErrKeyNotExist) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("failed to look up walked stack %#x: %w", hash, err)
+		}
+		if ws.Len > MaxWalkDepth {
+			ws.Len = MaxWalkDepth
+		}
+		s := append([]uint64(nil), ws.Addrs[:ws.Len]...)
+		walked[hash] = s
+		return s, nil
+	}
+
+	lookupBuildIDStack := func(id int32) ([]BuildIDFrame, error) {
+		if id < 0 || buildIDStacks == nil {
+			return nil, nil
+		}
+		if s, ok := buildIDs[id]; ok {
+			return s, nil
+		}
+
+		trace := make(BuildIDStackTrace, buildIDStacks.ValueSize()/buildIDStackFrameSize)
+		if err := buildIDStacks.Lookup(uint32(id), trace); err != nil {
+			if errors.Is(err, ebpf.ErrKeyNotExist) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("failed to look up build ID stack %d: %w", id, err)
+		}
+
+		var s []BuildIDFrame
+		for _, f := range trace {
+			switch f.Status {
+			case buildIDFrameValid:
+				s = append(s, BuildIDFrame{BuildID: hex.EncodeToString(f.BuildID[:]), Offset: f.OffsetOrIP})
+				continue
+			case buildIDFrameIP:
+				s = append(s, BuildIDFrame{})
+				continue
+			}
+			break
+		}
+		buildIDs[id] = s
+		return s, nil
+	}
+
+	it := counts.Iterate()
+	for it.Next(&key, &value) {
+		var (
+			userStack []uint64
+			err       error
+		)
+		if key.UserStackHash != 0 && userStacks != nil {
+			userStack, err = lookupWalkedStack(key.UserStackHash)
+		} else {
+			userStack, err = lookupStack(key.UserStackID, key.Event)
+		}
+		if err != nil {
+			return nil, err
+		}
+		kernelStack, err := lookupStack(key.KernelStackID, key.Event)
+		if err != nil {
+			return nil, err
+		}
+		// The runqueue samples don't record the build ID stacks.
+		var buildIDStack []BuildIDFrame
+		if key.Event != EventRunqueue {
+			if buildIDStack, err = lookupBuildIDStack(key.UserBuildIDStackID); err != nil {
+				return nil, err
+			}
+		}
+		// The frames are matched by position, so the stacks which differ are of no use.
+		if len(buildIDStack) != len(userStack) {
+			buildIDStack = nil
+		}
+
+		samples = append(samples, Sample{
+			PID:              key.PID,
+			UserStackID:      key.UserStackID,
+			KernelStackID:    key.KernelStackID,
+			UserStackHash:    key.UserStackHash,
+			UserStack:        userStack,
+			KernelStack:      kernelStack,
+			UserBuildIDStack: buildIDStack,
+			Count:            value.Count,
+			Event:            key.Event,
+			Value:            value.Value,
+			Cycles:           value.Cycles,
+			Instructions:     value.Instructions,
+			TimeBucket:       key.TimeBucket,
+			TraceIDHigh:      key.TraceIDHigh,
+			TraceIDLow:       key.TraceIDLow,
+			SpanID:           key.SpanID,
+			overridden:       key.Overridden != 0,
+		})
+	}
+	if err := it.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read from Counts map: %w", err)
+	}
+
+	return samples, nil
+}
+
+// Buffer is a set of Counts, StackTraces, and UserStacks maps the BPF program writes samples to.
+// There are two buffers: one is written by the BPF program
+// while the other one is read by user space, see Objects.Flush.
+type Buffer struct {
+	Counts      *ebpf.Map
+	StackTraces *ebpf.Map
+	UserStacks  *ebpf.Map
+	// runqStackTraces holds the stacks of the runqueue samples.
+	// It's shared by both buffers and isn't cleared or pinned,
+	// so the runqueue stacks of the pinned buffers are left empty.
+	runqStackTraces *ebpf.Map
+	// buildIDStacks holds the user stacks as build IDs and file offsets
+	// if they're recorded (it isn't pinned), see ObjectsOptions.BuildIDStacks.
+	buildIDStacks *ebpf.Map
+}
+
+// Samples reads the samples stored in the buffer.
+func (b *Buffer) Samples() ([]Sample, error) {
+	return readSamples(b.Counts, b.StackTraces, b.UserStacks, b.runqStackTraces, b.buildIDStacks)
+}
+
+// clear deletes all the samples from the buffer, so it can be reused.
+func (b *Buffer) clear() error {
+	if err := deleteAll(b.Counts); err != nil {
+		return fmt.Errorf("failed to clear Counts map: %w", err)
+	}
+	if err := deleteAll(b.StackTraces); err != nil {
+		return fmt.Errorf("failed to clear StackTraces map: %w", err)
+	}
+	if err := deleteAll(b.UserStacks); err != nil {
+		return fmt.Errorf("failed to clear UserStacks map: %w", err)
+	}
+	if b.buildIDStacks != nil {
+		if err := deleteAll(b.buildIDStacks); err != nil {
+			return fmt.Errorf("failed to clear BuildIDStacks map: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// deleteAll deletes all the keys from the map.
+// The keys are collected before deletion because
+// deleting the current key restarts the iteration from the beginning.
+func deleteAll(m *ebpf.Map) error {
+	var (
+		keys [][]byte
+		key  interface{}
+	)
+	for {
+		next, err := m.NextKeyBytes(key)
+		if err != nil {
+			return err
+		}
+		if next == nil {
+			break
+		}
+		keys = append(keys, next)
+		key = next
+	}
+
+	for _, k := range keys {
+		if err := m.Delete(k); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close closes the buffer's maps.
+func (b *Buffer) Close() error {
+	if err := b.Counts.Close(); err != nil {
+		return err
+	}
+	if err := b.StackTraces.Close(); err != nil {
+		return err
+	}
+	return b.UserStacks.Close()
+}
+
+// pin pins the buffer's maps in dir as counts_<i>, stack_traces_<i>, and user_stacks_<i> files.
+func (b *Buffer) pin(dir string, i int) error {
+	if err := b.Counts.Pin(filepath.Join(dir, fmt.Sprintf("%s_%d", countsPinName, i))); err != nil {
+		return fmt.Errorf("failed to pin Counts map: %w", err)
+	}
+	if err := b.StackTraces.Pin(filepath.Join(dir, fmt.Sprintf("%s_%d", stackTracesPinName, i))); err != nil {
+		return fmt.Errorf("failed to pin StackTraces map: %w", err)
+	}
+	if err := b.UserStacks.Pin(filepath.Join(dir, fmt.Sprintf("%s_%d", userStacksPinName, i))); err != nil {
+		return fmt.Errorf("failed to pin UserStacks map: %w", err)
+	}
+
+	return nil
+}
+
+// unpin removes the buffer's pinned maps from the BPF file system.
+func (b *Buffer) unpin() error {
+	if err := b.Counts.Unpin(); err != nil {
+		return fmt.Errorf("failed to unpin Counts map: %w", err)
+	}
+	if err := b.StackTraces.Unpin(); err != nil {
+		return fmt.Errorf("failed to unpin StackTraces map: %w", err)
+	}
+	if err := b.UserStacks.Unpin(); err != nil {
+		return fmt.Errorf("failed to unpin UserStacks map: %w", err)
+	}
+
+	return nil
+}
+
+// LoadPinnedBuffers opens read-only buffers pinned in dir by another profiler, see Objects.Pin.
+// The caller is responsible for closing the buffers.
+func LoadPinnedBuffers(dir string) ([]Buffer, error) {
+	opts := ebpf.LoadPinOptions{ReadOnly: true}
+	var buffers []Buffer
+	for i := 0; i < 2; i++ {
+		var (
+			b   Buffer
+			err error
+		)
+		if b.Counts, err = ebpf.LoadPinnedMap(filepath.Join(dir, fmt.Sprintf("%s_%d", countsPinName, i)), &opts); err != nil {
+			closeBuffers(buffers)
+			return nil, fmt.Errorf("failed to load pinned Counts map: %w", err)
+		}
+		if b.StackTraces, err = ebpf.LoadPinnedMap(filepath.Join(dir, fmt.Sprintf("%s_%d", stackTracesPinName, i)), &opts); err != nil {
+			b.Counts.Close()
+			closeBuffers(buffers)
+			return nil, fmt.Errorf("failed to load pinned StackTraces map: %w", err)
+		}
+		if b.UserStacks, err = ebpf.LoadPinnedMap(filepath.Join(dir, fmt.Sprintf("%s_%d", userStacksPinName, i)), &opts); err != nil {
+			b.Counts.Close()
+			b.StackTraces.Close()
+			closeBuffers(buffers)
+			return nil, fmt.Errorf("failed to load pinned UserStacks map: %w", err)
+		}
+		buffers = append(buffers, b)
+	}
+
+	return buffers, nil
+}
+
+func closeBuffers(buffers []Buffer) {
+	for i := range buffers {
+		buffers[i].Close()
+	}
+}
+
+// MergeRareStacks merges the stacks seen fewer than minCount times into one "(other)" sample
+// per process and event, so the one-off stacks don't bloat the system-wide profiles.
+// The stacks are compared by their addresses, since the stack IDs are reused across flushes,
+// and the samples of the same stack from different time buckets or traces are counted together.
+// The samples are returned as is if minCount is zero.
+func MergeRareStacks(samples []Sample, minCount uint64) []Sample {
+	if minCount == 0 {
+		return samples
+	}
+
+	type stackKey struct {
+		pid   uint32
+		event Event
+		stack string
+	}
+	keyOf := func(s *Sample) stackKey {
+		b := make([]byte, 0, 8*(len(s.KernelStack)+len(s.UserStack)+1))
+		for _, addr := range s.KernelStack {
+			b = appendUint64(b, addr)
+		}
+		// The separator tells the kernel frames from the user ones.
+		b = appendUint64(b, 0)
+		for _, addr := range s.UserStack {
+			b = appendUint64(b, addr)
+		}
+		return stackKey{pid: s.PID, event: s.Event, stack: string(b)}
+	}
+
+	keys := make([]stackKey, len(samples))
+	counts := make(map[stackKey]uint64)
+	for i := range samples {
+		keys[i] = keyOf(&samples[i])
+		counts[keys[i]] += samples[i].Count
+	}
+
+	// The stacks sampled at different frequencies aren't merged, since their samples are weighted differently.
+	type otherKey struct {
+		pid       uint32
+		event     Event
+		frequency uint64
+	}
+	others := make(map[otherKey]int)
+	merged := make([]Sample, 0, len(samples))
+	for i := range samples {
+		s := &samples[i]
+		if counts[keys[i]] >= minCount {
+			merged = append(merged, *s)
+			continue
+		}
+
+		k := otherKey{pid: s.PID, event: s.Event, frequency: s.Frequency}
+		j, ok := others[k]
+		if !ok {
+			j = len(merged)
+			others[k] = j
+			merged = append(merged, Sample{PID: s.PID, Event: s.Event, Frequency: s.Frequency, other: true})
+		}
+		merged[j].Count += s.Count
+		merged[j].Value += s.Value
+		merged[j].Cycles += s.Cycles
+		merged[j].Instructions += s.Instructions
+	}
+	return merged
+}
+
+// appendUint64 appends the little-endian encoding of v to b.
+func appendUint64(b []byte, v uint64) []byte {
+	return append(b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24), byte(v>>32), byte(v>>40), byte(v>>48), byte(v>>56))
+}
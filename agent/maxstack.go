@@ -0,0 +1,74 @@
+//go:build linux
+
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// maxStackPath is the sysctl which limits the depth of the stacks collected by the kernel.
+const maxStackPath = "/proc/sys/kernel/perf_event_max_stack"
+
+// ReadMaxStack returns kernel.perf_event_max_stack sysctl (127 by default).
+// The kernel refuses to create the stack maps deeper than that,
+// and bpf_get_stackid() truncates the stacks to it if the sysctl is lowered later.
+// The perf events which collect the callchains themselves are capped by it too
+// (their sample_max_stack attribute can't exceed it).
+func ReadMaxStack() (int, error) {
+	b, err := os.ReadFile(maxStackPath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read kernel.perf_event_max_stack: %w", err)
+	}
+	limit, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse kernel.perf_event_max_stack: %w", err)
+	}
+	return limit, nil
+}
+
+// writeMaxStack sets kernel.perf_event_max_stack sysctl, it requires CAP_SYS_ADMIN.
+// The kernel refuses to change it (EBUSY) while any perf event collects the callchains,
+// e.g., perf record -g is running.
+func writeMaxStack(depth int) error {
+	if err := os.WriteFile(maxStackPath, []byte(strconv.Itoa(depth)), 0); err != nil {
+		return fmt.Errorf("failed to write kernel.perf_event_max_stack: %w", err)
+	}
+	return nil
+}
+
+// fitMaxStack returns the stack depth the stack maps can be created with,
+// and the previous value of kernel.perf_event_max_stack sysctl if it was raised (zero otherwise).
+// When the sysctl is below the depth, it's raised if asked to and the process is privileged,
+// otherwise the depth is lowered to the sysctl, so the deeper stacks are truncated.
+// The depth is kept if the sysctl can't be read.
+func fitMaxStack(depth int, raise bool) (fitted, previous int) {
+	limit, err := ReadMaxStack()
+	if err != nil || depth <= limit {
+		return depth, 0
+	}
+
+	if raise {
+		priv, err := ReadPrivileges()
+		switch {
+		case err != nil:
+		case !priv.Has(unix.CAP_SYS_ADMIN):
+			err = errors.New("CAP_SYS_ADMIN is required")
+		default:
+			err = writeMaxStack(depth)
+		}
+		if err == nil {
+			log.Printf("raised kernel.perf_event_max_stack from %d to %d", limit, depth)
+			return depth, limit
+		}
+		log.Printf("failed to raise kernel.perf_event_max_stack from %d to %d: %v", limit, depth, err)
+	}
+	log.Printf("kernel.perf_event_max_stack %d caps the stack depth %d, the deeper stacks are truncated", limit, depth)
+	return limit, 0
+}
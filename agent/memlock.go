@@ -0,0 +1,140 @@
+//go:build linux
+
+package agent
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"golang.org/x/sys/unix"
+)
+
+// memcgAccountingVersion is the kernel version since which the memory of the BPF maps and programs
+// is charged to the memory cgroup instead of RLIMIT_MEMLOCK.
+var memcgAccountingVersion = [2]int{5, 11}
+
+// mapEntryOverhead approximates the kernel's bookkeeping per map entry,
+// e.g., the hash table element header or the stack map bucket.
+const mapEntryOverhead = 64
+
+// memlock remembers RLIMIT_MEMLOCK the process started with,
+// so the limit isn't raised again every time the objects are reloaded.
+var memlock struct {
+	sync.Mutex
+	base uint64
+	set  bool
+}
+
+// raiseMemlock makes sure RLIMIT_MEMLOCK lets the BPF program and maps of the spec be loaded.
+// Nothing is changed on Linux 5.11+ which charges the BPF memory to the memory cgroup.
+// Otherwise the limit is raised by twice the memory the objects require
+// (the objects are loaded again before the old ones are closed on reload),
+// rather than to infinity which fails in the containers without CAP_SYS_RESOURCE
+// if the hard limit is lower.
+func raiseMemlock(spec *ebpf.CollectionSpec) error {
+	if major, minor, err := kernelVersion(); err == nil && !versionBefore(major, minor, memcgAccountingVersion) {
+		return nil
+	}
+
+	memlock.Lock()
+	defer memlock.Unlock()
+
+	var lim unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_MEMLOCK, &lim); err != nil {
+		return fmt.Errorf("failed to get RLIMIT_MEMLOCK: %w", err)
+	}
+	if lim.Cur == unix.RLIM_INFINITY {
+		return nil
+	}
+	if !memlock.set {
+		memlock.base = lim.Cur
+		memlock.set = true
+	}
+
+	want := memlock.base + 2*objectsMemory(spec)
+	if lim.Cur >= want {
+		return nil
+	}
+	lim.Cur = want
+	if lim.Max != unix.RLIM_INFINITY && lim.Max < want {
+		lim.Max = want
+	}
+	if err := unix.Setrlimit(unix.RLIMIT_MEMLOCK, &lim); err != nil {
+		return fmt.Errorf("failed to raise RLIMIT_MEMLOCK to %d bytes: %w", want, err)
+	}
+	return nil
+}
+
+// objectsMemory estimates the locked memory the kernel charges for the maps and programs of the spec.
+func objectsMemory(spec *ebpf.CollectionSpec) uint64 {
+	var total uint64
+	for _, ms := range spec.Maps {
+		total += mapMemory(ms)
+	}
+	for _, ps := range spec.Programs {
+		total += roundUpPage(uint64(len(ps.Instructions)) * asm.InstructionSize)
+	}
+	return total
+}
+
+// mapMemory estimates the locked memory of the map, the entries are preallocated by the kernel.
+func mapMemory(ms *ebpf.MapSpec) uint64 {
+	entries := uint64(ms.MaxEntries)
+	value := roundUp(uint64(ms.ValueSize), 8)
+	switch ms.Type {
+	case ebpf.PerCPUArray, ebpf.PerCPUHash, ebpf.LRUCPUHash:
+		value *= uint64(runtime.NumCPU())
+	case ebpf.PerfEventArray:
+		if entries == 0 {
+			entries = uint64(runtime.NumCPU())
+		}
+	}
+	return roundUpPage(entries * (roundUp(uint64(ms.KeySize), 8) + value + mapEntryOverhead))
+}
+
+// roundUp rounds n up to a multiple of the power of two m.
+func roundUp(n, m uint64) uint64 {
+	return (n + m - 1) &^ (m - 1)
+}
+
+// roundUpPage rounds n up to the memory page size.
+func roundUpPage(n uint64) uint64 {
+	return roundUp(n, uint64(os.Getpagesize()))
+}
+
+// versionBefore reports whether the kernel version major.minor is older than v.
+func versionBefore(major, minor int, v [2]int) bool {
+	return major < v[0] || major == v[0] && minor < v[1]
+}
+
+// kernelVersion returns the major and minor version of the running kernel,
+// e.g., 5 and 10 for 5.10.0-21-amd64.
+func kernelVersion() (major, minor int, err error) {
+	var u unix.Utsname
+	if err = unix.Uname(&u); err != nil {
+		return 0, 0, fmt.Errorf("failed to get kernel version: %w", err)
+	}
+	release := unix.ByteSliceToString(u.Release[:])
+	parts := strings.SplitN(release, ".", 3)
+	if len(parts) < 2 {
+		return 0, 0, fmt.Errorf("unexpected kernel release %q", release)
+	}
+	if major, err = strconv.Atoi(parts[0]); err != nil {
+		return 0, 0, fmt.Errorf("unexpected kernel release %q", release)
+	}
+	// The minor version might have a suffix, e.g., 4.19-rc1.
+	digits := parts[1]
+	if i := strings.IndexFunc(digits, func(r rune) bool { return r < '0' || r > '9' }); i >= 0 {
+		digits = digits[:i]
+	}
+	if minor, err = strconv.Atoi(digits); err != nil {
+		return 0, 0, fmt.Errorf("unexpected kernel release %q", release)
+	}
+	return major, minor, nil
+}
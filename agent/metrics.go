@@ -0,0 +1,218 @@
+package agent
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"diy-parca-agent/symbol"
+)
+
+// Metrics aggregates usage metrics from the flushed samples
+// and exposes them in Prometheus text format, so alerting can be wired to profiling data directly:
+//
+//   - parca_agent_cpu_samples_total{comm="nginx"} is the number of samples taken by process name;
+//   - parca_agent_kernel_vs_user_ratio is the ratio of the samples taken in kernel space
+//     to the samples taken in user space since the last flush;
+//   - parca_agent_top_mapping_share{mapping="/usr/lib/libc.so.6"} is the share of the user space samples
+//     taken in the hottest binary since the last flush;
+//   - parca_agent_symbol_queue_depth is the number of binaries waiting for their symbol tables to be loaded
+//     in the background;
+//   - parca_agent_unsymbolized_addresses_total is the number of addresses left unsymbolized
+//     to stay within the symbolization deadline;
+//   - parca_agent_cache_bytes{cache="symbols"} is the estimated memory used by the caches
+//     sharing the symbol memory budget (symbols, symbol_paths, processes, and perf_maps),
+//     and parca_agent_cache_budget_bytes is the budget;
+//   - parca_agent_symbol_cache_hits_total, parca_agent_symbol_cache_misses_total,
+//     and parca_agent_symbol_cache_evictions_total count the symbol table lookups and evictions.
+//
+// Metrics is safe for concurrent use and can be served as /metrics HTTP handler.
+type Metrics struct {
+	mu sync.Mutex
+	// samples is the number of samples by process name.
+	samples map[string]uint64
+	// kernelUserRatio is the kernel to user samples ratio, it's negative when unknown.
+	kernelUserRatio float64
+	// topMapping is the path of the hottest mapping and topMappingShare is its share of user samples.
+	topMapping      string
+	topMappingShare float64
+	// symbolQueueDepth is the number of queued binaries, it's negative if there is no queue.
+	symbolQueueDepth int
+	unsymbolized     uint64
+	// caches describe the caches sharing the symbol memory budget, it's nil until SetCacheStats is called.
+	caches *CacheStats
+}
+
+// CacheStats describe the caches sharing the symbol memory budget, see Symbolizer.Reserve.
+type CacheStats struct {
+	// Symbols describe the symbol tables, the process and perf map caches are reserved in their budget.
+	Symbols symbol.Stats
+	// ProcessBytes and PerfMapBytes estimate the memory used by the process metadata and the perf maps.
+	ProcessBytes int64
+	PerfMapBytes int64
+}
+
+// NewMetrics returns empty usage metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		samples:          make(map[string]uint64),
+		kernelUserRatio:  -1,
+		symbolQueueDepth: -1,
+	}
+}
+
+// Add updates the metrics with the samples from a flush.
+// The mappings and names of the processes are used to attribute the samples,
+// see ProcessMappings and ProcessNames.
+func (m *Metrics) Add(samples []Sample, mappings map[uint32][]Mapping, names map[uint32]string) {
+	var (
+		kernel, user uint64
+		byComm       = make(map[string]uint64)
+		byMapping    = make(map[string]uint64)
+	)
+	for _, s := range samples {
+		// Only the CPU samples are meaningful for the usage metrics.
+		if s.Event != EventCPU {
+			continue
+		}
+		byComm[names[s.PID]] += s.Count
+
+		// The sample was taken in kernel space if there is a kernel stack.
+		if len(s.KernelStack) > 0 {
+			kernel += s.Count
+			continue
+		}
+		if len(s.UserStack) == 0 {
+			continue
+		}
+		user += s.Count
+		if mp, ok := findMapping(mappings[s.PID], s.UserStack[0]); ok && mp.Path != "" {
+			byMapping[mp.Path] += s.Count
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for comm, n := range byComm {
+		m.samples[comm] += n
+	}
+	if len(samples) == 0 {
+		return
+	}
+
+	m.kernelUserRatio = -1
+	if user > 0 {
+		m.kernelUserRatio = float64(kernel) / float64(user)
+	}
+	m.topMapping, m.topMappingShare = "", 0
+	for path, n := range byMapping {
+		share := float64(n) / float64(user)
+		if share > m.topMappingShare || (share == m.topMappingShare && path < m.topMapping) {
+			m.topMapping, m.topMappingShare = path, share
+		}
+	}
+}
+
+// SetSymbolQueueDepth updates the number of binaries waiting for their symbol tables to be loaded.
+func (m *Metrics) SetSymbolQueueDepth(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.symbolQueueDepth = n
+}
+
+// AddUnsymbolized counts the addresses left unsymbolized to stay within the symbolization deadline.
+func (m *Metrics) AddUnsymbolized(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.unsymbolized += uint64(n)
+}
+
+// SetCacheStats updates the memory used by the caches.
+func (m *Metrics) SetCacheStats(s CacheStats) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.caches = &s
+}
+
+// WriteTo writes the metrics in Prometheus text exposition format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var b strings.Builder
+	b.WriteString("# HELP parca_agent_cpu_samples_total Number of CPU samples taken by process name.\n")
+	b.WriteString("# TYPE parca_agent_cpu_samples_total counter\n")
+	comms := make([]string, 0, len(m.samples))
+	for comm := range m.samples {
+		comms = append(comms, comm)
+	}
+	sort.Strings(comms)
+	for _, comm := range comms {
+		fmt.Fprintf(&b, "parca_agent_cpu_samples_total{comm=\"%s\"} %d\n", escapeLabelValue(comm), m.samples[comm])
+	}
+
+	if m.kernelUserRatio >= 0 {
+		b.WriteString("# HELP parca_agent_kernel_vs_user_ratio Ratio of kernel to user space CPU samples since the last flush.\n")
+		b.WriteString("# TYPE parca_agent_kernel_vs_user_ratio gauge\n")
+		fmt.Fprintf(&b, "parca_agent_kernel_vs_user_ratio %g\n", m.kernelUserRatio)
+	}
+
+	if m.topMapping != "" {
+		b.WriteString("# HELP parca_agent_top_mapping_share Share of user space CPU samples taken in the hottest binary since the last flush.\n")
+		b.WriteString("# TYPE parca_agent_top_mapping_share gauge\n")
+		fmt.Fprintf(&b, "parca_agent_top_mapping_share{mapping=\"%s\"} %g\n", escapeLabelValue(m.topMapping), m.topMappingShare)
+	}
+
+	if m.symbolQueueDepth >= 0 {
+		b.WriteString("# HELP parca_agent_symbol_queue_depth Number of binaries waiting for their symbol tables to be loaded.\n")
+		b.WriteString("# TYPE parca_agent_symbol_queue_depth gauge\n")
+		fmt.Fprintf(&b, "parca_agent_symbol_queue_depth %d\n", m.symbolQueueDepth)
+		b.WriteString("# HELP parca_agent_unsymbolized_addresses_total Number of addresses left unsymbolized to stay within the symbolization deadline.\n")
+		b.WriteString("# TYPE parca_agent_unsymbolized_addresses_total counter\n")
+		fmt.Fprintf(&b, "parca_agent_unsymbolized_addresses_total %d\n", m.unsymbolized)
+	}
+
+	if c := m.caches; c != nil {
+		b.WriteString("# HELP parca_agent_cache_bytes Estimated memory used by the caches sharing the symbol memory budget.\n")
+		b.WriteString("# TYPE parca_agent_cache_bytes gauge\n")
+		fmt.Fprintf(&b, "parca_agent_cache_bytes{cache=\"symbols\"} %d\n", c.Symbols.Bytes)
+		fmt.Fprintf(&b, "parca_agent_cache_bytes{cache=\"symbol_paths\"} %d\n", c.Symbols.PathBytes)
+		fmt.Fprintf(&b, "parca_agent_cache_bytes{cache=\"processes\"} %d\n", c.ProcessBytes)
+		fmt.Fprintf(&b, "parca_agent_cache_bytes{cache=\"perf_maps\"} %d\n", c.PerfMapBytes)
+		if c.Symbols.MaxBytes > 0 {
+			b.WriteString("# HELP parca_agent_cache_budget_bytes Memory budget of the symbol tables and the process and perf map caches.\n")
+			b.WriteString("# TYPE parca_agent_cache_budget_bytes gauge\n")
+			fmt.Fprintf(&b, "parca_agent_cache_budget_bytes %d\n", c.Symbols.MaxBytes)
+		}
+		b.WriteString("# HELP parca_agent_symbol_cache_hits_total Number of symbol table lookups served from memory.\n")
+		b.WriteString("# TYPE parca_agent_symbol_cache_hits_total counter\n")
+		fmt.Fprintf(&b, "parca_agent_symbol_cache_hits_total %d\n", c.Symbols.Hits)
+		b.WriteString("# HELP parca_agent_symbol_cache_misses_total Number of symbol table lookups not served from memory.\n")
+		b.WriteString("# TYPE parca_agent_symbol_cache_misses_total counter\n")
+		fmt.Fprintf(&b, "parca_agent_symbol_cache_misses_total %d\n", c.Symbols.Misses)
+		b.WriteString("# HELP parca_agent_symbol_cache_evictions_total Number of symbol tables evicted to stay within the memory budget.\n")
+		b.WriteString("# TYPE parca_agent_symbol_cache_evictions_total counter\n")
+		fmt.Fprintf(&b, "parca_agent_symbol_cache_evictions_total %d\n", c.Symbols.Evictions)
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// ServeHTTP serves the metrics in Prometheus text exposition format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+// escapeLabelValue escapes backslashes, double quotes, and line feeds in the label value.
+func escapeLabelValue(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
@@ -0,0 +1,139 @@
+package agent
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/pprof/profile"
+)
+
+// Mode is what the profiler attributes to the stacks.
+type Mode string
+
+const (
+	// ModeCPU samples the stacks running on the CPUs with perf CPU clock events.
+	ModeCPU Mode = "cpu"
+	// ModeBlockIO attributes the block I/O requests (count and bytes) to the stacks issuing them,
+	// showing which code paths generate disk traffic.
+	ModeBlockIO Mode = "blockio"
+	// ModeTCP attributes the bytes sent over TCP and the retransmitted segments to the stacks,
+	// revealing which code paths drive network traffic and suffer retransmits.
+	ModeTCP Mode = "tcp"
+	// ModeRunqueue attributes the time the tasks were runnable but not running (runqueue delay)
+	// to the stacks where they resumed, exposing CPU starvation.
+	ModeRunqueue Mode = "runqueue"
+)
+
+// Modes are the supported profiling modes.
+var Modes = []Mode{ModeCPU, ModeBlockIO, ModeTCP, ModeRunqueue}
+
+// ParseMode parses the profiling mode, e.g., "blockio".
+// The empty string means ModeCPU.
+func ParseMode(s string) (Mode, error) {
+	if s == "" {
+		return ModeCPU, nil
+	}
+	for _, m := range Modes {
+		if Mode(s) == m {
+			return m, nil
+		}
+	}
+	return "", fmt.Errorf("unknown profiling mode %q, expected one of %v", s, Modes)
+}
+
+// Clock is the perf event clock which drives the sampling in ModeCPU.
+type Clock string
+
+const (
+	// ClockCPU samples every CPU with PERF_COUNT_SW_CPU_CLOCK events, a high-resolution per-CPU timer,
+	// and the BPF program drops the samples of the processes which aren't targeted.
+	ClockCPU Clock = "cpu"
+	// ClockTask samples the threads of the target processes with PERF_COUNT_SW_TASK_CLOCK events
+	// which only advance while the thread runs, so the samples are attributed to the process
+	// even on a busy machine where it shares the CPUs with others.
+	// It requires the target processes, e.g., Config.PID.
+	// The threads are found by the process scans, so the new ones are sampled within processScanInterval.
+	ClockTask Clock = "task"
+	// ClockCycles samples every CPU with PERF_COUNT_HW_CPU_CYCLES hardware events,
+	// i.e., by the CPU cycles spent rather than the time, so the halted CPUs aren't sampled.
+	// The hardware events support precise sampling (PEBS on Intel, IBS on AMD), see Config.Precise.
+	// They're unavailable in most virtual machines.
+	ClockCycles Clock = "cycles"
+)
+
+// Clocks are the supported perf event clocks.
+var Clocks = []Clock{ClockCPU, ClockTask, ClockCycles}
+
+// maxPrecise is the highest precise_ip level, i.e., zero skid.
+const maxPrecise = 3
+
+// ParseClock parses the perf event clock, e.g., "task".
+// The empty string means ClockCPU.
+func ParseClock(s string) (Clock, error) {
+	if s == "" {
+		return ClockCPU, nil
+	}
+	for _, c := range Clocks {
+		if Clock(s) == c {
+			return c, nil
+		}
+	}
+	return "", fmt.Errorf("unknown clock %q, expected one of %v", s, Clocks)
+}
+
+// eventMode returns the profiling mode which records the event.
+func eventMode(e Event) Mode {
+	switch e {
+	case EventBlockIO:
+		return ModeBlockIO
+	case EventTCPSend, EventTCPRetransmit:
+		return ModeTCP
+	case EventRunqueue:
+		return ModeRunqueue
+	}
+	return ModeCPU
+}
+
+// sampleTypes returns the sample types of the profiles in the mode.
+func (m Mode) sampleTypes() []*profile.ValueType {
+	switch m {
+	case ModeBlockIO:
+		return []*profile.ValueType{
+			{Type: "requests", Unit: "count"},
+			{Type: "io", Unit: "bytes"},
+		}
+	case ModeTCP:
+		return []*profile.ValueType{
+			{Type: "sends", Unit: "count"},
+			{Type: "sent", Unit: "bytes"},
+			{Type: "retransmits", Unit: "count"},
+			{Type: "retransmitted", Unit: "bytes"},
+		}
+	case ModeRunqueue:
+		return []*profile.ValueType{
+			{Type: "delays", Unit: "count"},
+			{Type: "runqueue_latency", Unit: "nanoseconds"},
+		}
+	}
+	return []*profile.ValueType{
+		{Type: "samples", Unit: "count"},
+		{Type: "cpu", Unit: "nanoseconds"},
+	}
+}
+
+// sampleValues returns the values of the sample in the order of the mode's sample types.
+// The period is the CPU time per sample in nanoseconds unless the sample's frequency was overridden.
+func sampleValues(s Sample, period int64) []int64 {
+	switch s.Event {
+	case EventBlockIO, EventRunqueue:
+		return []int64{int64(s.Count), int64(s.Value)}
+	case EventTCPSend:
+		return []int64{int64(s.Count), int64(s.Value), 0, 0}
+	case EventTCPRetransmit:
+		return []int64{0, 0, int64(s.Count), int64(s.Value)}
+	}
+	if s.Frequency > 0 {
+		period = int64(time.Second) / int64(s.Frequency)
+	}
+	return []int64{int64(s.Count), int64(s.Count) * period}
+}
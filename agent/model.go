@@ -0,0 +1,183 @@
+package agent
+
+import (
+	"time"
+
+	"github.com/google/pprof/profile"
+
+	"diy-parca-agent/model"
+)
+
+// Model converts the samples into the profiler's own profile representation
+// which is then converted to any output format, e.g., folded stacks or speedscope.
+// The samples are symbolized and labeled the same way as by Profile.
+func Model(samples []Sample, opts ProfileOptions) *model.Profile {
+	b := newProfileBuilder(samples, opts)
+	f := newLocationFilter(opts.Focus, opts.Ignore)
+	c := modelConverter{
+		mappings:  make(map[*profile.Mapping]*model.Mapping),
+		locations: make(map[*profile.Location][]model.Frame),
+	}
+
+	var (
+		mp model.Profile
+		d  sampleData
+	)
+	for _, s := range MergeRareStacks(samples, opts.MinCount) {
+		b.fill(&d, s)
+		if !f.keep(d.locations) {
+			continue
+		}
+
+		ms := model.Sample{
+			Values:    d.values,
+			NumLabels: make(map[string]int64, len(d.numLabels)),
+		}
+		for _, l := range d.numLabels {
+			ms.NumLabels[l.key] = l.value
+			if l.unit == "" {
+				continue
+			}
+			if ms.NumUnits == nil {
+				ms.NumUnits = make(map[string]string)
+			}
+			ms.NumUnits[l.key] = l.unit
+		}
+		if len(d.labels) > 0 {
+			ms.Labels = make(map[string]string, len(d.labels))
+			for _, l := range d.labels {
+				ms.Labels[l.key] = l.value
+			}
+		}
+		for _, loc := range d.locations {
+			ms.Stack = append(ms.Stack, c.frames(loc)...)
+		}
+		mp.Samples = append(mp.Samples, ms)
+	}
+	b.finish()
+
+	for _, st := range b.p.SampleType {
+		mp.SampleTypes = append(mp.SampleTypes, model.ValueType{Type: st.Type, Unit: st.Unit})
+	}
+	if b.p.PeriodType != nil {
+		mp.PeriodType = model.ValueType{Type: b.p.PeriodType.Type, Unit: b.p.PeriodType.Unit}
+	}
+	mp.Period = b.p.Period
+	mp.Time = opts.Start
+	mp.Duration = opts.Duration
+	mp.Comments = b.p.Comments
+	return &mp
+}
+
+// ModelFromPprof converts the pprof profile into the profiler's own profile representation,
+// e.g., to write a profile read from a file as folded stacks.
+// Only the first value of the multi-value labels is kept.
+func ModelFromPprof(p *profile.Profile) *model.Profile {
+	c := modelConverter{
+		mappings:  make(map[*profile.Mapping]*model.Mapping),
+		locations: make(map[*profile.Location][]model.Frame),
+	}
+	mp := model.Profile{
+		Period:   p.Period,
+		Duration: time.Duration(p.DurationNanos),
+		Comments: p.Comments,
+	}
+	if p.TimeNanos != 0 {
+		mp.Time = time.Unix(0, p.TimeNanos)
+	}
+	for _, st := range p.SampleType {
+		mp.SampleTypes = append(mp.SampleTypes, model.ValueType{Type: st.Type, Unit: st.Unit})
+	}
+	if p.PeriodType != nil {
+		mp.PeriodType = model.ValueType{Type: p.PeriodType.Type, Unit: p.PeriodType.Unit}
+	}
+
+	for _, s := range p.Sample {
+		ms := model.Sample{Values: s.Value}
+		for k, vv := range s.Label {
+			if len(vv) == 0 {
+				continue
+			}
+			if ms.Labels == nil {
+				ms.Labels = make(map[string]string)
+			}
+			ms.Labels[k] = vv[0]
+		}
+		for k, vv := range s.NumLabel {
+			if len(vv) == 0 {
+				continue
+			}
+			if ms.NumLabels == nil {
+				ms.NumLabels = make(map[string]int64)
+			}
+			ms.NumLabels[k] = vv[0]
+			if uu := s.NumUnit[k]; len(uu) > 0 && uu[0] != "" {
+				if ms.NumUnits == nil {
+					ms.NumUnits = make(map[string]string)
+				}
+				ms.NumUnits[k] = uu[0]
+			}
+		}
+		for _, loc := range s.Location {
+			ms.Stack = append(ms.Stack, c.frames(loc)...)
+		}
+		mp.Samples = append(mp.Samples, ms)
+	}
+	return &mp
+}
+
+// modelConverter converts the pprof locations into frames, the mappings are shared by their frames.
+type modelConverter struct {
+	mappings  map[*profile.Mapping]*model.Mapping
+	locations map[*profile.Location][]model.Frame
+}
+
+func (c *modelConverter) mapping(m *profile.Mapping) *model.Mapping {
+	if m == nil {
+		return nil
+	}
+	if mm, ok := c.mappings[m]; ok {
+		return mm
+	}
+
+	mm := model.Mapping{
+		Start:      m.Start,
+		Limit:      m.Limit,
+		Offset:     m.Offset,
+		File:       m.File,
+		BuildID:    m.BuildID,
+		Symbolized: m.HasFunctions,
+		Kernel:     m.File == kernelMappingFile,
+	}
+	c.mappings[m] = &mm
+	return &mm
+}
+
+// frames returns the frames of the location, the inlined functions go first.
+// An unsymbolized location is a single frame without a function.
+func (c *modelConverter) frames(loc *profile.Location) []model.Frame {
+	if ff, ok := c.locations[loc]; ok {
+		return ff
+	}
+
+	m := c.mapping(loc.Mapping)
+	ff := make([]model.Frame, 0, len(loc.Line))
+	for i, ln := range loc.Line {
+		f := model.Frame{
+			Line:    ln.Line,
+			Address: loc.Address,
+			Mapping: m,
+			Inlined: i < len(loc.Line)-1,
+		}
+		if ln.Function != nil {
+			f.Function = ln.Function.Name
+			f.File = ln.Function.Filename
+		}
+		ff = append(ff, f)
+	}
+	if len(ff) == 0 {
+		ff = append(ff, model.Frame{Address: loc.Address, Mapping: m})
+	}
+	c.locations[loc] = ff
+	return ff
+}
@@ -0,0 +1,170 @@
+//go:build linux
+
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"diy-parca-agent/symbol"
+)
+
+// DefaultSymbolMemory is the memory budget of the symbol tables and the process and perf map caches,
+// see WithSymbolization.
+const DefaultSymbolMemory = 256 << 20
+
+// Option configures the agent started by New.
+// The options validate their arguments, so the misconfigurations fail before the BPF program is loaded.
+type Option func(c *Config) error
+
+// Targets are the processes to profile, all the processes are profiled if it's zero.
+// At most one of Self, PID, Exe, and SystemdUnit can be set,
+// and they can be combined with UIDs and Cgroups, see Config.
+type Targets struct {
+	// Self profiles the current process.
+	Self bool
+	// PID profiles the process and its descendants if Tree is set.
+	PID  int
+	Tree bool
+	// Exe profiles the processes whose executable path matches the glob pattern.
+	Exe string
+	// SystemdUnit profiles the processes of the systemd unit.
+	SystemdUnit string
+	// UIDs restrict profiling to the processes owned by the users.
+	UIDs []uint32
+	// Cgroups restrict profiling to the processes of the cgroup v2 cgroups.
+	Cgroups []string
+}
+
+// New starts profiling in the background with the given options on top of the defaults:
+// the CPU mode sampled at DefaultFrequency, a profile every DefaultInterval, all processes profiled,
+// and no symbolization. At least one sink is required. For example,
+//
+//	a, err := agent.New(
+//		agent.WithTargets(agent.Targets{Self: true}),
+//		agent.WithSink(agent.SinkFunc(func(ctx context.Context, p *agent.EncodedProfile, labels agent.Labels) error {
+//			return p.Write(w, agent.Compression{})
+//		})),
+//	)
+//	...
+//	defer a.Stop()
+//
+// See Start for the details.
+func New(opts ...Option) (*Agent, error) {
+	c := Config{
+		PID:       -1,
+		Frequency: DefaultFrequency,
+		Interval:  DefaultInterval,
+	}
+	for _, opt := range opts {
+		if err := opt(&c); err != nil {
+			return nil, err
+		}
+	}
+	if len(c.Sinks) == 0 {
+		return nil, errors.New("sink is required, see WithSink")
+	}
+
+	return Start(c)
+}
+
+// WithFrequency sets the sampling rate (samples per second).
+func WithFrequency(hz uint64) Option {
+	return func(c *Config) error {
+		if hz == 0 {
+			return errors.New("frequency must be positive")
+		}
+		c.Frequency = hz
+		return nil
+	}
+}
+
+// WithDuration sets how much time each profile covers, i.e., how often it's passed to the sink.
+func WithDuration(d time.Duration) Option {
+	return func(c *Config) error {
+		if d < time.Second {
+			return fmt.Errorf("profile duration %v is shorter than a second", d)
+		}
+		c.Interval = d
+		return nil
+	}
+}
+
+// WithTargets sets the processes to profile.
+// The conflicting targets are reported by New, e.g., both PID and Exe are set.
+func WithTargets(t Targets) Option {
+	return func(c *Config) error {
+		c.SelfPID = t.Self
+		c.PID = t.PID
+		if c.PID == 0 {
+			c.PID = -1
+		}
+		c.Tree = t.Tree
+		c.Exe = t.Exe
+		c.SystemdUnit = t.SystemdUnit
+		c.UIDs = t.UIDs
+		c.Cgroups = t.Cgroups
+		return nil
+	}
+}
+
+// WithSink adds the sinks which receive the profiles, e.g., write them to files or upload them.
+// All the sinks receive each profile, so it can be saved locally and uploaded in one run.
+func WithSink(sinks ...Sink) Option {
+	return func(c *Config) error {
+		for _, s := range sinks {
+			if s == nil {
+				return errors.New("sink must not be nil")
+			}
+		}
+		c.Sinks = append(c.Sinks, sinks...)
+		return nil
+	}
+}
+
+// WithLabels sets the labels passed to the sinks along with each profile, e.g., {"service": "api"}.
+func WithLabels(labels Labels) Option {
+	return func(c *Config) error {
+		for name := range labels {
+			if name == "" {
+				return errors.New("label name must not be empty")
+			}
+		}
+		c.Labels = labels
+		return nil
+	}
+}
+
+// WithLabelProviders adds the providers which label the samples per process,
+// e.g., the built-in KubernetesLabelProvider or a custom one which looks up the owning team.
+// The labels of the later providers take precedence.
+func WithLabelProviders(providers ...LabelProvider) Option {
+	return func(c *Config) error {
+		for _, p := range providers {
+			if p == nil {
+				return errors.New("label provider must not be nil")
+			}
+		}
+		c.LabelProviders = append(c.LabelProviders, providers...)
+		return nil
+	}
+}
+
+// WithSymbolization symbolizes the user space frames of the profiles before they're passed to the sink.
+// The symbol tables along with the process and perf map caches take up to DefaultSymbolMemory,
+// and the tables are persisted in cacheDir
+// unless it's empty, so the binaries aren't read again after a restart.
+func WithSymbolization(cacheDir string) Option {
+	return func(c *Config) error {
+		var store *symbol.Store
+		if cacheDir != "" {
+			var err error
+			if store, err = symbol.NewStore(cacheDir); err != nil {
+				return err
+			}
+		}
+		c.Symbolizer = symbol.NewSymbolizer(store, DefaultSymbolMemory)
+		return nil
+	}
+}
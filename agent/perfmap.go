@@ -0,0 +1,216 @@
+package agent
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"diy-parca-agent/symbol"
+)
+
+// PerfMaps symbolizes the code generated by JIT runtimes (Node.js with --perf-basic-prof,
+// JVM with perf-map-agent, .NET with DOTNET_PerfMapEnabled) using /tmp/perf-<pid>.map files.
+// The runtimes append a line per compiled method, e.g.,
+//
+//	7f3a5c1e2f00 1a0 LazyCompile:*fib /app/index.js:1
+//
+// where the start address and size are hex.
+// The files are watched with inotify and the appended lines are parsed as they are written,
+// so the methods compiled during the session are resolved
+// instead of showing up as addresses in anonymous mappings.
+type PerfMaps struct {
+	// inotify is read via the runtime poller, so Close unblocks the reader,
+	// and fd is its descriptor (File.Fd would switch the file into blocking mode).
+	inotify *os.File
+	fd      int
+	// jvmRefresh is how often the JVMs dump their perf maps, see PerfMapsOptions.
+	jvmRefresh time.Duration
+	dotnet     bool
+
+	mu sync.Mutex
+	// maps are the parsed perf map files by PID.
+	maps map[uint32]*perfMap
+	// files are the PIDs of the watched perf map files by the watch descriptor of their directory
+	// and the file name, e.g., perf-1234.map.
+	files map[perfMapFile]uint32
+	// jvms are the times the JVMs dumped their perf maps by PID.
+	jvms map[uint32]time.Time
+	// dotnets are the .NET processes which were asked to enable their perf maps.
+	dotnets map[uint32]bool
+	done    chan struct{}
+}
+
+// PerfMapsOptions configure the perf maps.
+type PerfMapsOptions struct {
+	// JVMRefresh is how often the JVMs (JDK 17+) are asked to dump their JIT compiled methods
+	// into the perf maps via the attach API, so Java profiling works without perf-map-agent.
+	// The JVMs running without -XX:+PreserveFramePointer are logged since their stacks are truncated.
+	// Zero disables it.
+	JVMRefresh time.Duration
+	// Dotnet enables the perf maps of the .NET (8+) processes via the diagnostics IPC
+	// unless they were started with DOTNET_PerfMapEnabled.
+	// The older runtimes need the environment variable to be set.
+	Dotnet bool
+}
+
+type perfMapFile struct {
+	wd   int32
+	name string
+}
+
+// perfMap is a perf map file parsed up to the offset.
+type perfMap struct {
+	path   string
+	offset int64
+	// funcs are sorted by address, the later entries of the same address go last.
+	funcs []symbol.Func
+}
+
+// Forget stops tracking the perf map of the process, e.g., when it exited.
+func (pm *PerfMaps) Forget(pid uint32) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	for f, p := range pm.files {
+		if p == pid {
+			delete(pm.files, f)
+		}
+	}
+	delete(pm.maps, pid)
+	delete(pm.jvms, pid)
+	delete(pm.dotnets, pid)
+}
+
+// Bytes estimates the memory used by the parsed perf maps, it's charged to the symbol memory budget,
+// see Symbolizer.Reserve.
+func (pm *PerfMaps) Bytes() int64 {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	const funcSize = 32
+	var n int64
+	for _, m := range pm.maps {
+		n += int64(len(m.path))
+		for _, fn := range m.funcs {
+			n += funcSize + int64(len(fn.Name))
+		}
+	}
+	return n
+}
+
+// Lookup returns the JIT compiled method at the address of the process.
+// The JS functions of Node.js are tagged with their tier and source location, see v8Symbol.
+func (pm *PerfMaps) Lookup(pid uint32, addr uint64) (symbol.Symbol, bool) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	m, ok := pm.maps[pid]
+	if !ok {
+		return symbol.Symbol{}, false
+	}
+	i := sort.Search(len(m.funcs), func(i int) bool {
+		return m.funcs[i].Addr > addr
+	}) - 1
+	if i < 0 || addr >= m.funcs[i].Addr+m.funcs[i].Size {
+		return symbol.Symbol{}, false
+	}
+	sym, ok := v8Symbol(m.funcs[i].Name)
+	if !ok {
+		sym = symbol.Symbol{Func: m.funcs[i].Name}
+	}
+	sym.Offset = addr - m.funcs[i].Addr
+	return sym, true
+}
+
+// update parses the complete lines written since the previous update.
+func (m *perfMap) update() error {
+	f, err := os.Open(m.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	// The file was truncated, e.g., the process exec'ed and started over.
+	if fi.Size() < m.offset {
+		m.offset = 0
+		m.funcs = nil
+	}
+	if _, err = f.Seek(m.offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	var added bool
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadString('\n')
+		// The incomplete line is parsed once the runtime finishes writing it.
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		m.offset += int64(len(line))
+
+		if fn, ok := parsePerfMapLine(line); ok {
+			m.funcs = append(m.funcs, fn)
+			added = true
+		}
+	}
+	if added {
+		sort.SliceStable(m.funcs, func(i, j int) bool {
+			return m.funcs[i].Addr < m.funcs[j].Addr
+		})
+	}
+	return nil
+}
+
+// parsePerfMapLine parses the "START SIZE name" line of a perf map file,
+// the name might contain spaces.
+func parsePerfMapLine(line string) (symbol.Func, bool) {
+	fields := strings.SplitN(strings.TrimSpace(line), " ", 3)
+	if len(fields) != 3 {
+		return symbol.Func{}, false
+	}
+	start, err := strconv.ParseUint(strings.TrimPrefix(fields[0], "0x"), 16, 64)
+	if err != nil {
+		return symbol.Func{}, false
+	}
+	size, err := strconv.ParseUint(strings.TrimPrefix(fields[1], "0x"), 16, 64)
+	if err != nil {
+		return symbol.Func{}, false
+	}
+	return symbol.Func{Addr: start, Size: size, Name: fields[2]}, true
+}
+
+// namespacePID returns the PID of the process in its PID namespace,
+// i.e., the last PID of the NSpid line of /proc/<pid>/status.
+// The host PID is returned if it can't be determined.
+func namespacePID(pid uint32) uint32 {
+	b, err := os.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return pid
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if !strings.HasPrefix(line, "NSpid:") {
+			continue
+		}
+		fields := strings.Fields(line)
+		nspid, err := strconv.ParseUint(fields[len(fields)-1], 10, 32)
+		if err != nil {
+			return pid
+		}
+		return uint32(nspid)
+	}
+	return pid
+}
@@ -0,0 +1,204 @@
+//go:build linux
+
+package agent
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// NewPerfMaps returns the perf maps which are empty until the processes are watched, see Watch.
+func NewPerfMaps(opts PerfMapsOptions) (*PerfMaps, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("failed to init inotify: %w", err)
+	}
+
+	pm := PerfMaps{
+		inotify:    os.NewFile(uintptr(fd), "inotify"),
+		fd:         fd,
+		jvmRefresh: opts.JVMRefresh,
+		dotnet:     opts.Dotnet,
+		maps:       make(map[uint32]*perfMap),
+		files:      make(map[perfMapFile]uint32),
+		jvms:       make(map[uint32]time.Time),
+		dotnets:    make(map[uint32]bool),
+		done:       make(chan struct{}),
+	}
+	go func() {
+		defer close(pm.done)
+		pm.watch()
+	}()
+
+	return &pm, nil
+}
+
+// Close stops watching the perf map files.
+func (pm *PerfMaps) Close() error {
+	err := pm.inotify.Close()
+	<-pm.done
+	return err
+}
+
+// Watch parses the process's perf map file if it exists and keeps parsing the lines appended to it.
+// Watching the same process again is a no-op.
+// The file is looked up in the process's mount namespace
+// and named after its PID in the PID namespace, so the containers are covered.
+func (pm *PerfMaps) Watch(pid uint32) error {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	if _, ok := pm.maps[pid]; ok {
+		return nil
+	}
+
+	name := fmt.Sprintf("perf-%d.map", namespacePID(pid))
+	dir := procPath(pid, "/tmp")
+	// The directory is watched since the file might not exist yet.
+	// The watch descriptor is shared by the processes of the same /tmp.
+	wd, err := unix.InotifyAddWatch(pm.fd, dir, unix.IN_CREATE|unix.IN_MODIFY)
+	if err != nil {
+		return fmt.Errorf("failed to watch %s: %w", dir, err)
+	}
+
+	m := perfMap{path: filepath.Join(dir, name)}
+	pm.maps[pid] = &m
+	pm.files[perfMapFile{wd: int32(wd), name: name}] = pid
+	if err = m.update(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// watch parses the appended lines of the perf map files on inotify events until the file is closed.
+func (pm *PerfMaps) watch() {
+	buf := make([]byte, 64<<10)
+	for {
+		n, err := pm.inotify.Read(buf)
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				log.Printf("failed to read inotify events: %v", err)
+			}
+			return
+		}
+
+		for off := 0; off+unix.SizeofInotifyEvent <= n; {
+			e := (*unix.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			nameStart := off + unix.SizeofInotifyEvent
+			off = nameStart + int(e.Len)
+			if e.Len == 0 || off > n {
+				continue
+			}
+			// The name is padded with null bytes.
+			name := string(bytes.TrimRight(buf[nameStart:off], "\x00"))
+			pm.update(perfMapFile{wd: e.Wd, name: name})
+		}
+	}
+}
+
+// update parses the lines appended to the watched perf map file.
+func (pm *PerfMaps) update(f perfMapFile) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	pid, ok := pm.files[f]
+	if !ok {
+		return
+	}
+	// The process might have exited.
+	if err := pm.maps[pid].update(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("failed to parse perf map of process %d: %v", pid, err)
+	}
+}
+
+// WatchProcesses watches the perf maps of the processes which have anonymous executable mappings
+// (where JIT runtimes place the compiled code) and forgets the processes which have exited,
+// i.e., their mappings are unknown, see ProcessMappings.
+func (pm *PerfMaps) WatchProcesses(mappings map[uint32][]Mapping) {
+	for pid, mm := range mappings {
+		if mm == nil {
+			pm.Forget(pid)
+			continue
+		}
+		for _, m := range mm {
+			if !isAnon(m.Path) {
+				continue
+			}
+			if err := pm.Watch(pid); err != nil {
+				log.Printf("JIT frames of process %d won't be symbolized: %v", pid, err)
+				break
+			}
+			if pm.jvmRefresh > 0 && isJVM(mm) {
+				pm.refreshJVM(pid)
+			}
+			if pm.dotnet && isDotnet(mm) {
+				pm.enableDotnet(pid)
+			}
+			break
+		}
+	}
+}
+
+// refreshJVM asks the JVM to dump its perf map if it hasn't done so within the refresh interval
+// and parses the map from scratch since the JVM rewrites the file.
+// The JVM's frame pointers are checked on the first dump.
+func (pm *PerfMaps) refreshJVM(pid uint32) {
+	pm.mu.Lock()
+	last, ok := pm.jvms[pid]
+	pm.mu.Unlock()
+	if ok && time.Since(last) < pm.jvmRefresh {
+		return
+	}
+
+	if !ok {
+		if fp, err := jvmPreservesFramePointers(pid); err == nil && !fp {
+			log.Printf("JVM %d runs without -XX:+PreserveFramePointer, its Java stacks are truncated", pid)
+		}
+	}
+	// The dump is retried after the interval if it failed, e.g., JDK 16 and older lack the command.
+	_, err := jcmd(pid, "Compiler.perfmap")
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	pm.jvms[pid] = time.Now()
+	if err != nil {
+		log.Printf("JIT frames of JVM %d won't be symbolized: %v", pid, err)
+		return
+	}
+	m, ok := pm.maps[pid]
+	if !ok {
+		return
+	}
+	m.offset = 0
+	m.funcs = nil
+	if err = m.update(); err != nil {
+		log.Printf("failed to parse perf map of JVM %d: %v", pid, err)
+	}
+}
+
+// enableDotnet asks the .NET process to write its perf map once,
+// unless the map is already written, i.e., the process was started with DOTNET_PerfMapEnabled.
+func (pm *PerfMaps) enableDotnet(pid uint32) {
+	pm.mu.Lock()
+	done := pm.dotnets[pid]
+	pm.dotnets[pid] = true
+	m, ok := pm.maps[pid]
+	written := ok && len(m.funcs) > 0
+	pm.mu.Unlock()
+	if done || written {
+		return
+	}
+
+	if err := dotnetEnablePerfMap(pid); err != nil {
+		log.Printf("JIT frames of .NET process %d won't be symbolized: %v", pid, err)
+	}
+}
@@ -0,0 +1,785 @@
+package agent
+
+import (
+	"debug/elf"
+	"fmt"
+	"os"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/pprof/profile"
+
+	"diy-parca-agent/symbol"
+)
+
+// kernelMappingFile is the file name of the kernel mapping as reported by perf.
+const kernelMappingFile = "[kernel.kallsyms]"
+
+// ProfileOptions control how samples are converted into a pprof profile.
+type ProfileOptions struct {
+	// Frequency is the sampling rate (samples per second) the samples were collected with.
+	// It is used to estimate CPU time, DefaultFrequency is used when it's zero.
+	Frequency uint64
+	// Mappings are the executable memory mappings of the sampled processes by PID.
+	// User space addresses are attributed to the mappings,
+	// so that pprof can symbolize them using the corresponding binaries.
+	Mappings map[uint32][]Mapping
+	// KernelSymbols resolves kernel addresses into function names if set.
+	KernelSymbols *KernelSymbols
+	// Symbolizer resolves user space addresses into function names and source lines if set.
+	// Otherwise the profile can be symbolized later by pprof.
+	Symbolizer *symbol.Symbolizer
+	// ProcessNames are the names of the sampled processes by PID, see ProcessNames.
+	// The samples are labeled with them, so a merged profile of many processes
+	// can be broken down per process.
+	ProcessNames map[uint32]string
+	// ProcessLabels are the labels of the sampled processes by PID, see ProcessLabels.
+	// The samples are labeled with them unless the label is already set, e.g., comm.
+	ProcessLabels map[uint32]Labels
+	// Labels are attached to all the samples, e.g., env=prod.
+	// The process labels of the same name take precedence, see ProcessLabels.
+	Labels Labels
+	// GuessFuncs enables the heuristic which synthesizes fn_0x<addr> functions
+	// by scanning for function prologues in the code without symbols:
+	// anonymous executable mappings (JIT) and fully stripped binaries (the latter requires Symbolizer).
+	// The samples are grouped by the guessed functions instead of one opaque frame per address.
+	GuessFuncs bool
+	// PerfMaps resolve the methods compiled by JIT runtimes in anonymous mappings if set,
+	// the guessed functions are used for the addresses not found in the perf maps.
+	PerfMaps *PerfMaps
+	// Resources are the resource snapshots of the sampled processes by PID taken at flush time,
+	// see ProcessResources. They are recorded as profile comments.
+	Resources map[uint32]Resources
+	// Cmdlines are the command lines of the sampled processes by PID, see ProcessCmdlines.
+	// They are recorded as profile comments.
+	Cmdlines map[uint32]string
+	// Host describes the host which collected the samples, it's recorded as profile comments
+	// along with the sampling frequency. The current host is described if it's nil.
+	Host *HostInfo
+	// Build describes the agent and the kernel which collected the samples,
+	// it's recorded as the first profile comment. The running agent is described if it's nil.
+	Build *BuildInfo
+	// Focus and Ignore filter the samples by their symbolized frames if set, see FilterFrames.
+	Focus  *regexp.Regexp
+	Ignore *regexp.Regexp
+	// MinCount merges the stacks seen fewer times into an "(other)" sample per process,
+	// see MergeRareStacks.
+	MinCount uint64
+	// StripGoRuntime drops the Go runtime frames which start the goroutines and switch the stacks
+	// below the program's code, e.g., runtime.goexit, so the Go flame graphs look as with runtime/pprof.
+	// The samples are labeled with the Go runtime work (go_runtime label) either way, see goRuntimeLabel.
+	StripGoRuntime bool
+	// CPUCoverage describes the CPUs which were sampled, it's recorded as a profile comment
+	// unless it's empty, see Profiler.CPUCoverage.
+	CPUCoverage CPUCoverage
+	// SymbolizeDeadline stops loading the symbol tables after the deadline if set,
+	// so a profile with many new binaries doesn't take too long to build.
+	// The addresses of the binaries whose tables aren't in memory yet are left unsymbolized
+	// (pprof can still symbolize them by build ID), and they're passed to SymbolizeDeferred,
+	// e.g., to load the tables in the background for the next profiles.
+	SymbolizeDeadline time.Time
+	SymbolizeDeferred func(pid uint32, m Mapping)
+	// SymbolizeFailed is called with every address of a binary which Symbolizer couldn't resolve if set,
+	// e.g., the binary is stripped or its symbol table isn't available, see SymbolFailures.
+	SymbolizeFailed func(pid uint32, m Mapping, err error)
+	// Start and Duration describe the profiling window if set, see profile.Profile.TimeNanos.
+	Start    time.Time
+	Duration time.Duration
+	// Sanitizer replaces the file paths, string labels, and comments with pseudonyms if set, see Sanitizer.Sanitize.
+	Sanitizer *Sanitizer
+}
+
+// Profile converts the samples into a profile in pprof format.
+// It's a CPU profile unless the samples were recorded in another mode, see Mode,
+// e.g., the block I/O samples make a profile of requests and bytes.
+func Profile(samples []Sample, opts ProfileOptions) *profile.Profile {
+	b := newProfileBuilder(samples, opts)
+	var d sampleData
+	for _, s := range MergeRareStacks(b.filterSamples(samples), opts.MinCount) {
+		b.fill(&d, s)
+		b.p.Sample = append(b.p.Sample, d.sample())
+	}
+	b.finish()
+	return b.p
+}
+
+// newProfileBuilder returns a builder of the samples' profile with everything but the samples,
+// i.e., the sample types, period, and comments.
+func newProfileBuilder(samples []Sample, opts ProfileOptions) *profileBuilder {
+	if opts.Frequency == 0 {
+		opts.Frequency = DefaultFrequency
+	}
+	period := int64(time.Second) / int64(opts.Frequency)
+	mode := ModeCPU
+	if len(samples) > 0 {
+		mode = eventMode(samples[0].Event)
+	}
+
+	b := profileBuilder{
+		opts:   opts,
+		period: period,
+		p: &profile.Profile{
+			SampleType: mode.sampleTypes(),
+		},
+		mappings:  make(map[mappingKey]*profile.Mapping),
+		functions: make(map[functionKey]*profile.Function),
+		locations: make(map[locationKey]*profile.Location),
+
+		noFramePointers: make(map[string]bool),
+		anonFuncs:       make(map[mappingKey]*symbol.Table),
+	}
+	if mode == ModeCPU {
+		b.p.PeriodType = &profile.ValueType{Type: "cpu", Unit: "nanoseconds"}
+		b.p.Period = period
+		b.counters = hasCounters(samples)
+	}
+	if b.counters {
+		b.p.SampleType = append(b.p.SampleType,
+			&profile.ValueType{Type: "cycles", Unit: "count"},
+			&profile.ValueType{Type: "instructions", Unit: "count"},
+		)
+	}
+	if !opts.Start.IsZero() {
+		b.p.TimeNanos = opts.Start.UnixNano()
+	}
+	b.p.DurationNanos = opts.Duration.Nanoseconds()
+	if opts.KernelSymbols != nil {
+		b.kernelMapping = &profile.Mapping{
+			ID:           1,
+			Start:        opts.KernelSymbols.addrs[0],
+			Limit:        ^uint64(0),
+			File:         kernelMappingFile,
+			HasFunctions: true,
+		}
+		b.p.Mapping = append(b.p.Mapping, b.kernelMapping)
+	}
+
+	build := opts.Build
+	if build == nil {
+		info := ReadBuildInfo()
+		build = &info
+	}
+	b.p.Comments = append(b.p.Comments, build.String())
+	host := opts.Host
+	if host == nil {
+		info := ReadHostInfo()
+		host = &info
+	}
+	b.p.Comments = append(b.p.Comments, host.comments()...)
+	if mode == ModeCPU {
+		b.p.Comments = append(b.p.Comments, fmt.Sprintf("%s%d Hz", frequencyCommentPrefix, opts.Frequency))
+	}
+	if c := opts.CPUCoverage.comment(); c != "" {
+		b.p.Comments = append(b.p.Comments, c)
+	}
+
+	pids := make([]uint32, 0, len(opts.Resources)+len(opts.Cmdlines))
+	for pid := range opts.Resources {
+		pids = append(pids, pid)
+	}
+	for pid := range opts.Cmdlines {
+		if _, ok := opts.Resources[pid]; !ok {
+			pids = append(pids, pid)
+		}
+	}
+	sort.Slice(pids, func(i, j int) bool { return pids[i] < pids[j] })
+	for _, pid := range pids {
+		comm := opts.ProcessNames[pid]
+		if cmdline, ok := opts.Cmdlines[pid]; ok && cmdline != "" {
+			b.p.Comments = append(b.p.Comments, fmt.Sprintf("pid %d (%s) cmdline: %s", pid, comm, cmdline))
+		}
+		if r, ok := opts.Resources[pid]; ok {
+			b.p.Comments = append(b.p.Comments, fmt.Sprintf("pid %d (%s): %s", pid, comm, r))
+		}
+	}
+	return &b
+}
+
+// sampleData are the values, labels, and locations of a sample, see profileBuilder.fill.
+// It's reused across the samples, so the labels aren't allocated as maps unless a profile.Sample is needed.
+type sampleData struct {
+	values    []int64
+	labels    []sampleLabel
+	numLabels []sampleNumLabel
+	locations []*profile.Location
+}
+
+// sampleLabel is a string label of a sample, e.g., comm.
+type sampleLabel struct {
+	key   string
+	value string
+}
+
+// sampleNumLabel is a numeric label of a sample, e.g., pid, the unit is optional.
+type sampleNumLabel struct {
+	key   string
+	value int64
+	unit  string
+}
+
+// hasLabel reports whether the sample already has the string label.
+func (d *sampleData) hasLabel(key string) bool {
+	for _, l := range d.labels {
+		if l.key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// sample returns the profile sample.
+func (d *sampleData) sample() *profile.Sample {
+	ps := profile.Sample{
+		Value:    append([]int64(nil), d.values...),
+		Location: append([]*profile.Location(nil), d.locations...),
+		NumLabel: make(map[string][]int64, len(d.numLabels)),
+	}
+	for _, l := range d.numLabels {
+		ps.NumLabel[l.key] = []int64{l.value}
+		if l.unit == "" {
+			continue
+		}
+		if ps.NumUnit == nil {
+			ps.NumUnit = make(map[string][]string)
+		}
+		ps.NumUnit[l.key] = []string{l.unit}
+	}
+	if len(d.labels) > 0 {
+		ps.Label = make(map[string][]string, len(d.labels))
+		for _, l := range d.labels {
+			ps.Label[l.key] = []string{l.value}
+		}
+	}
+	return &ps
+}
+
+// fill resets the sample data to describe the sample.
+func (b *profileBuilder) fill(d *sampleData, s Sample) {
+	d.values = sampleValues(s, b.period)
+	if b.counters {
+		d.values = append(d.values, int64(s.Cycles), int64(s.Instructions))
+	}
+	d.labels = d.labels[:0]
+	d.numLabels = append(d.numLabels[:0], sampleNumLabel{key: "pid", value: int64(s.PID)})
+	d.locations = d.locations[:0]
+
+	// The samples split by time can be sliced with pprof -tagfocus timestamp=<from>:<to>.
+	if !s.Time.IsZero() {
+		d.numLabels = append(d.numLabels, sampleNumLabel{key: "timestamp", value: s.Time.UnixNano(), unit: "nanoseconds"})
+	}
+	if comm, ok := b.opts.ProcessNames[s.PID]; ok {
+		d.labels = append(d.labels, sampleLabel{key: "comm", value: comm})
+	}
+	// The interrupt processing isn't misattributed to the interrupted process
+	// when the samples are filtered out with pprof -tagignore irq=softirq.
+	if b.opts.KernelSymbols != nil {
+		if irq := b.opts.KernelSymbols.irqContext(s.KernelStack); irq != "" {
+			d.labels = append(d.labels, sampleLabel{key: "irq", value: irq})
+		}
+	}
+	// The instructions per cycle tell the memory-bound stacks from the compute-bound ones,
+	// e.g., pprof -tagfocus 'ipc=^0\.[0-4]' focuses on the stalled ones.
+	if s.Cycles > 0 {
+		d.labels = append(d.labels, sampleLabel{key: "ipc", value: strconv.FormatFloat(float64(s.Instructions)/float64(s.Cycles), 'f', 2, 64)})
+	}
+	// The samples taken while working on a span link the profile to the distributed trace.
+	if traceID := s.TraceID(); traceID != "" {
+		d.labels = append(d.labels,
+			sampleLabel{key: "trace_id", value: traceID},
+			sampleLabel{key: "span_id", value: fmt.Sprintf("%016x", s.SpanID)},
+		)
+	}
+	for name, value := range b.opts.ProcessLabels[s.PID] {
+		if !d.hasLabel(name) {
+			d.labels = append(d.labels, sampleLabel{key: name, value: value})
+		}
+	}
+	for name, value := range b.opts.Labels {
+		if !d.hasLabel(name) {
+			d.labels = append(d.labels, sampleLabel{key: name, value: value})
+		}
+	}
+
+	if s.other {
+		d.locations = append(d.locations, b.otherLocation())
+	}
+	// The innermost frame goes first, so the kernel stack precedes the user stack.
+	for _, addr := range s.KernelStack {
+		d.locations = append(d.locations, b.kernelLocation(addr))
+	}
+	user := len(d.locations)
+	for i, addr := range s.UserStack {
+		// Except for the innermost frame, the addresses are return addresses,
+		// i.e., they point to the instruction after the call.
+		d.locations = append(d.locations, b.userLocation(s.PID, addr, i > 0))
+	}
+
+	// The GC and scheduler work of the Go programs can be told apart, e.g., pprof -tagignore go_runtime=gc.
+	if l := goRuntimeLabel(d.locations[user:]); l != "" && !d.hasLabel("go_runtime") {
+		d.labels = append(d.labels, sampleLabel{key: "go_runtime", value: l})
+	}
+	if b.opts.StripGoRuntime {
+		d.locations = d.locations[:user+len(stripGoRuntime(d.locations[user:]))]
+	}
+	if b.opts.Sanitizer != nil {
+		b.opts.Sanitizer.sanitizeLabels(d.labels)
+	}
+}
+
+// hasCounters reports whether any sample has the cycles and instructions counted, see Config.IPC.
+func hasCounters(samples []Sample) bool {
+	for i := range samples {
+		if samples[i].Cycles > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// filterSamples returns the samples whose symbolized frames pass the focus and ignore filters, see FilterFrames.
+// The samples are filtered before MergeRareStacks, so the "(other)" samples only count the stacks which passed,
+// and the ignored stacks aren't kept in the profile as a part of them.
+// The frames are matched by their own builder (see frameMatcher), so only the kept samples are filled in b.
+func (b *profileBuilder) filterSamples(samples []Sample) []Sample {
+	if b.opts.Focus == nil && b.opts.Ignore == nil {
+		return samples
+	}
+
+	m := b.frameMatcher()
+	f := newLocationFilter(b.opts.Focus, b.opts.Ignore)
+	kept := make([]Sample, 0, len(samples))
+	var d sampleData
+	for _, s := range samples {
+		m.fill(&d, s)
+		if f.keep(d.locations) {
+			kept = append(kept, s)
+		}
+	}
+	return kept
+}
+
+// frameMatcher returns a builder which symbolizes the frames of the samples to filter them,
+// so the locations, functions, and mappings of the dropped samples aren't in the profile,
+// and their addresses aren't reported as deferred or failed to symbolize.
+// It shares the functions guessed in the anonymous mappings with b, so their code is read once.
+func (b *profileBuilder) frameMatcher() *profileBuilder {
+	opts := b.opts
+	opts.SymbolizeDeferred = nil
+	opts.SymbolizeFailed = nil
+	opts.Sanitizer = nil
+	m := profileBuilder{
+		opts:            opts,
+		period:          b.period,
+		p:               &profile.Profile{},
+		kernelMapping:   b.kernelMapping,
+		mappings:        make(map[mappingKey]*profile.Mapping),
+		functions:       make(map[functionKey]*profile.Function),
+		locations:       make(map[locationKey]*profile.Location),
+		noFramePointers: make(map[string]bool),
+		anonFuncs:       b.anonFuncs,
+	}
+	if m.kernelMapping != nil {
+		m.p.Mapping = append(m.p.Mapping, m.kernelMapping)
+	}
+	return &m
+}
+
+// finish adds the comments which are only known once all the samples are converted,
+// and sanitizes the mappings, functions, and comments if needed.
+func (b *profileBuilder) finish() {
+	if b.deferred > 0 {
+		b.p.Comments = append(b.p.Comments, fmt.Sprintf("%d addresses were left unsymbolized to stay within the symbolization deadline", b.deferred))
+	}
+	if b.opts.Sanitizer != nil {
+		b.opts.Sanitizer.sanitizeProfile(b.p)
+	}
+}
+
+// FilterFrames keeps the samples which have a frame matching focus (if set)
+// and drops the ones which have a frame matching ignore (if set),
+// e.g., ignoring epoll_wait drops the idle stacks of an event loop.
+// As in pprof -focus and -ignore, the frames are matched by function name, source file, and mapping file,
+// so the profile must be symbolized first.
+func FilterFrames(p *profile.Profile, focus, ignore *regexp.Regexp) {
+	if focus == nil && ignore == nil {
+		return
+	}
+	p.FilterSamplesByName(focus, ignore, nil, nil)
+}
+
+// User space mappings are deduplicated per process (by pid and start),
+// and across processes by build ID and the file offsets they map.
+type mappingKey struct {
+	pid     uint32
+	buildID string
+	start   uint64
+	limit   uint64
+}
+
+type functionKey struct {
+	name string
+	file string
+}
+
+// User space addresses are only meaningful within a mapping,
+// hence the locations are deduplicated per mapping ID with normalized addresses
+// (or per PID if the address doesn't belong to any mapping).
+// Kernel addresses are shared by all processes, so both are zero for them.
+type locationKey struct {
+	pid       uint32
+	mappingID uint64
+	addr      uint64
+}
+
+// profileBuilder deduplicates mappings, functions, and locations of the profile.
+type profileBuilder struct {
+	opts ProfileOptions
+	// period is the sampling period in nanoseconds, see sampleValues.
+	period int64
+	// counters tells whether the samples have the cycles and instructions values, see Config.IPC.
+	counters      bool
+	p             *profile.Profile
+	kernelMapping *profile.Mapping
+	mappings      map[mappingKey]*profile.Mapping
+	functions     map[functionKey]*profile.Function
+	locations     map[locationKey]*profile.Location
+	// noFramePointers are the binaries which likely omit frame pointers.
+	// They are mentioned in the profile comments,
+	// so users understand why the stacks are truncated.
+	noFramePointers map[string]bool
+	// anonFuncs are the functions guessed in the anonymous mappings.
+	anonFuncs map[mappingKey]*symbol.Table
+	// deferred is the number of addresses left unsymbolized after the deadline, see deferSymbols.
+	deferred int
+}
+
+func (b *profileBuilder) function(name, file string) *profile.Function {
+	k := functionKey{name: name, file: file}
+	if fn, ok := b.functions[k]; ok {
+		return fn
+	}
+
+	fn := profile.Function{
+		ID:         uint64(len(b.p.Function) + 1),
+		Name:       name,
+		SystemName: name,
+		Filename:   file,
+	}
+	b.functions[k] = &fn
+	b.p.Function = append(b.p.Function, &fn)
+	return &fn
+}
+
+// mapping returns the profile mapping of the process's memory mapping.
+// The mappings of the binaries with known build IDs are normalized to file offsets,
+// i.e., their addresses are the offsets in the file regardless of where the binary was loaded.
+// Hence the processes which map the same binary share the profile mapping and its locations,
+// e.g., a shared library in system-wide mode, see normalize.
+func (b *profileBuilder) mapping(pid uint32, m Mapping) *profile.Mapping {
+	k := mappingKey{pid: pid, start: m.Start}
+	if pm, ok := b.mappings[k]; ok {
+		return pm
+	}
+
+	buildID := m.BuildID
+	var t *symbol.Table
+	if b.opts.Symbolizer != nil && (m.BuildID != "" || isFile(m.Path)) && !b.deferSymbols(pid, m) {
+		var err error
+		if m.BuildID != "" {
+			t, err = b.opts.Symbolizer.TableByBuildID(m.BuildID)
+		} else {
+			t, err = b.opts.Symbolizer.Table(procPath(pid, m.Path))
+		}
+		if err == nil {
+			buildID = t.BuildID
+		} else {
+			t = nil
+		}
+	}
+	if buildID == "" && isFile(m.Path) {
+		// The binary is identified by its build ID even if it's not symbolized.
+		buildID, _ = readBuildID(procPath(pid, m.Path))
+	}
+
+	pm := profile.Mapping{
+		Start:   m.Start,
+		Limit:   m.Limit,
+		Offset:  m.Offset,
+		File:    m.Path,
+		BuildID: buildID,
+	}
+	if buildID != "" {
+		pm.Start = m.Offset
+		pm.Limit = m.Offset + (m.Limit - m.Start)
+		sharedKey := mappingKey{
+			buildID: buildID,
+			start:   pm.Start,
+			limit:   pm.Limit,
+		}
+		if shared, ok := b.mappings[sharedKey]; ok {
+			b.mappings[k] = shared
+			return shared
+		}
+		b.mappings[sharedKey] = &pm
+	}
+	if t != nil && t.FramePointers == symbol.FramePointersOmitted && !b.noFramePointers[m.Path] {
+		b.noFramePointers[m.Path] = true
+		b.p.Comments = append(b.p.Comments, fmt.Sprintf("%s likely omits frame pointers, its stack traces may be truncated", m.Path))
+	}
+	pm.ID = uint64(len(b.p.Mapping) + 1)
+	b.mappings[k] = &pm
+	b.p.Mapping = append(b.p.Mapping, &pm)
+	return &pm
+}
+
+// normalize converts the runtime address of the process's memory mapping
+// into the address of the profile mapping, see mapping.
+func normalize(pm *profile.Mapping, m Mapping, addr uint64) uint64 {
+	if pm.BuildID == "" {
+		return addr
+	}
+	return addr - m.Start + m.Offset
+}
+
+func (b *profileBuilder) kernelLocation(addr uint64) *profile.Location {
+	k := locationKey{addr: addr}
+	if loc, ok := b.locations[k]; ok {
+		return loc
+	}
+
+	loc := b.newLocation(k)
+	if b.kernelMapping != nil {
+		loc.Mapping = b.kernelMapping
+		if name, ok := b.opts.KernelSymbols.Lookup(addr); ok {
+			loc.Line = []profile.Line{{Function: b.function(name, "")}}
+		}
+	}
+	return loc
+}
+
+// userLocation returns a location of the user space address in the process.
+// The return address is symbolized as the preceding instruction (the call)
+// to report the correct source line.
+func (b *profileBuilder) userLocation(pid uint32, addr uint64, isReturn bool) *profile.Location {
+	m, ok := findMapping(b.opts.Mappings[pid], addr)
+	if !ok {
+		k := locationKey{pid: pid, addr: addr}
+		if loc, ok := b.locations[k]; ok {
+			return loc
+		}
+		return b.newLocation(k)
+	}
+	pm := b.mapping(pid, m)
+	k := locationKey{mappingID: pm.ID, addr: normalize(pm, m, addr)}
+	if loc, ok := b.locations[k]; ok {
+		return loc
+	}
+
+	loc := b.newLocation(k)
+	loc.Mapping = pm
+
+	lookupAddr := addr
+	if isReturn {
+		lookupAddr--
+	}
+	var (
+		sym symbol.Symbol
+		err error
+	)
+	switch {
+	case isAnon(m.Path) && (b.opts.PerfMaps != nil || b.opts.GuessFuncs):
+		if sym, err = b.anonFunc(pid, m, lookupAddr); err != nil {
+			return loc
+		}
+	case b.deferSymbols(pid, m):
+		b.deferred++
+		if b.opts.SymbolizeDeferred != nil {
+			b.opts.SymbolizeDeferred(pid, m)
+		}
+		return loc
+	// The binary might be unavailable, e.g., the samples were recorded on another machine.
+	case m.BuildID != "" && b.opts.Symbolizer != nil:
+		if sym, err = b.opts.Symbolizer.SymbolizeBuildID(m.BuildID, m.Start, m.Offset, lookupAddr); err != nil {
+			b.symbolizeFailed(pid, m, err)
+			return loc
+		}
+	case isFile(m.Path) && b.opts.Symbolizer != nil:
+		path := procPath(pid, m.Path)
+		sym, err = b.opts.Symbolizer.Symbolize(path, m.Start, m.Offset, lookupAddr)
+		if err != nil && b.opts.GuessFuncs {
+			sym, err = b.opts.Symbolizer.GuessFunc(path, m.Start, m.Offset, lookupAddr)
+		}
+		if err != nil {
+			b.symbolizeFailed(pid, m, err)
+			return loc
+		}
+	default:
+		return loc
+	}
+	// The inlined functions are the location's lines, the innermost first,
+	// each one's caller is at its call site.
+	file, line := sym.File, sym.Line
+	for _, in := range sym.Inlined {
+		loc.Line = append(loc.Line, profile.Line{
+			Function: b.function(in.Func, file),
+			Line:     int64(line),
+		})
+		file, line = in.CallFile, in.CallLine
+	}
+	loc.Line = append(loc.Line, profile.Line{
+		Function: b.function(sym.Func, file),
+		Line:     int64(line),
+	})
+	loc.Mapping.HasFunctions = true
+	if len(sym.Inlined) > 0 {
+		loc.Mapping.HasInlineFrames = true
+	}
+	if sym.Line != 0 {
+		loc.Mapping.HasFilenames = true
+		loc.Mapping.HasLineNumbers = true
+	}
+
+	return loc
+}
+
+// symbolizeFailed reports the address of the mapping which couldn't be symbolized,
+// see ProfileOptions.SymbolizeFailed.
+func (b *profileBuilder) symbolizeFailed(pid uint32, m Mapping, err error) {
+	if b.opts.SymbolizeFailed != nil {
+		b.opts.SymbolizeFailed(pid, m, err)
+	}
+}
+
+// deferSymbols reports whether the addresses of the mapping are left unsymbolized,
+// because the symbolization deadline has passed and the binary's symbol table isn't in memory,
+// see ProfileOptions.SymbolizeDeadline.
+func (b *profileBuilder) deferSymbols(pid uint32, m Mapping) bool {
+	if b.opts.Symbolizer == nil || b.opts.SymbolizeDeadline.IsZero() || time.Now().Before(b.opts.SymbolizeDeadline) {
+		return false
+	}
+	if m.BuildID != "" {
+		return !b.opts.Symbolizer.CachedBuildID(m.BuildID)
+	}
+	return isFile(m.Path) && !b.opts.Symbolizer.Cached(procPath(pid, m.Path))
+}
+
+// otherFunction is the function of the samples merged by MergeRareStacks.
+const otherFunction = "(other)"
+
+// otherLocation returns the location of the samples merged by MergeRareStacks.
+// Its address is zero, so it doesn't collide with the kernel and user locations.
+func (b *profileBuilder) otherLocation() *profile.Location {
+	k := locationKey{}
+	if loc, ok := b.locations[k]; ok {
+		return loc
+	}
+
+	loc := b.newLocation(k)
+	loc.Line = []profile.Line{{Function: b.function(otherFunction, "")}}
+	return loc
+}
+
+func (b *profileBuilder) newLocation(k locationKey) *profile.Location {
+	loc := profile.Location{
+		ID:      uint64(len(b.p.Location) + 1),
+		Address: k.addr,
+	}
+	b.locations[k] = &loc
+	b.p.Location = append(b.p.Location, &loc)
+	return &loc
+}
+
+// maxAnonCodeSize limits how much code is read from an anonymous mapping
+// to guess its functions.
+const maxAnonCodeSize = 64 << 20
+
+// anonFunc returns the function at the address of the process's anonymous mapping (e.g., JIT code)
+// from the process's perf map if PerfMaps is set, otherwise the guessed one if GuessFuncs is set.
+func (b *profileBuilder) anonFunc(pid uint32, m Mapping, addr uint64) (symbol.Symbol, error) {
+	if b.opts.PerfMaps != nil {
+		if sym, ok := b.opts.PerfMaps.Lookup(pid, addr); ok {
+			return sym, nil
+		}
+	}
+	if !b.opts.GuessFuncs {
+		return symbol.Symbol{}, fmt.Errorf("no perf map entry at %#x", addr)
+	}
+	return b.guessAnonFunc(pid, m, addr)
+}
+
+// guessAnonFunc returns the function guessed at the address of the anonymous mapping.
+// The mapping's code is read from the process memory once per profile.
+func (b *profileBuilder) guessAnonFunc(pid uint32, m Mapping, addr uint64) (symbol.Symbol, error) {
+	k := mappingKey{pid: pid, start: m.Start}
+	t, ok := b.anonFuncs[k]
+	if !ok {
+		t = &symbol.Table{}
+		b.anonFuncs[k] = t
+
+		size := m.Limit - m.Start
+		if size > maxAnonCodeSize {
+			size = maxAnonCodeSize
+		}
+		code, err := readProcessMemory(pid, m.Start, size)
+		if err != nil {
+			return symbol.Symbol{}, err
+		}
+		t.Funcs = symbol.GuessFuncs(hostMachine(), code, m.Start)
+	}
+
+	sym, ok := t.Lookup(addr)
+	if !ok {
+		return sym, fmt.Errorf("no function prologue before %#x", addr)
+	}
+	return sym, nil
+}
+
+// readProcessMemory reads size bytes at the address of the process.
+func readProcessMemory(pid uint32, addr, size uint64) ([]byte, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/mem", pid))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open process memory: %w", err)
+	}
+	defer f.Close()
+
+	buf := make([]byte, size)
+	n, err := f.ReadAt(buf, int64(addr))
+	if n == 0 && err != nil {
+		return nil, fmt.Errorf("failed to read process memory: %w", err)
+	}
+	return buf[:n], nil
+}
+
+// hostMachine returns the ELF machine of the host architecture.
+func hostMachine() elf.Machine {
+	switch runtime.GOARCH {
+	case "amd64":
+		return elf.EM_X86_64
+	case "arm64":
+		return elf.EM_AARCH64
+	default:
+		return elf.EM_NONE
+	}
+}
+
+// isAnon reports whether the mapping is anonymous, e.g., JIT code.
+// The anonymous mappings named with prctl(PR_SET_VMA_ANON_NAME) look like [anon:name].
+func isAnon(path string) bool {
+	return path == "" || strings.HasPrefix(path, "[anon:")
+}
+
+// isFile reports whether the mapping path refers to a file
+// rather than a pseudo-path such as [vdso] or [heap].
+func isFile(path string) bool {
+	return strings.HasPrefix(path, "/")
+}
+
+// procPath returns the path of the process's file as seen from the host,
+// i.e., it works for processes running in containers (another mount namespace).
+func procPath(pid uint32, path string) string {
+	return fmt.Sprintf("/proc/%d/root%s", pid, path)
+}
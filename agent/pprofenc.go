@@ -0,0 +1,371 @@
+package agent
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+	"time"
+
+	"github.com/google/pprof/profile"
+)
+
+// WriteProfile writes the samples as a profile in pprof format like Profile does,
+// but the samples are encoded as they're converted instead of building the profile.Sample graph,
+// so a large system-wide profile doesn't need the maps and slices of every sample in memory.
+// Only the mappings, locations, and functions (shared by the samples) are kept until the end.
+func WriteProfile(w io.Writer, samples []Sample, opts ProfileOptions, c Compression) error {
+	return c.write(w, func(out io.Writer) error {
+		_, _, err := encodeProfile(out, samples, opts)
+		return err
+	})
+}
+
+// EncodedProfile is a profile in pprof format passed to the sinks, see EncodeProfile.
+// It's encoded once for all the sinks, and the sinks which need the profile.Profile graph decode it, see Parse.
+type EncodedProfile struct {
+	// Type is the name of the profile type, e.g., "cpu" for the CPU profiles
+	// and "requests" for the block I/O ones.
+	Type string
+	// Start and Duration describe the profiling window, Start is zero if it's unknown.
+	Start    time.Time
+	Duration time.Duration
+	// Period is the sampling period in nanoseconds of the CPU profiles, it's zero otherwise.
+	Period int64
+
+	// data is the uncompressed protobuf, and strings is the size of its string table,
+	// so the comments can be appended without decoding the profile, see Write.
+	data    []byte
+	strings int
+}
+
+// EncodeProfile encodes the samples as a profile in pprof format like WriteProfile does,
+// so the sinks receive the profile without the profile.Profile graph being built.
+func EncodeProfile(samples []Sample, opts ProfileOptions) *EncodedProfile {
+	var buf bytes.Buffer
+	// Writing to the buffer never fails.
+	b, strings, _ := encodeProfile(&buf, samples, opts)
+	p := EncodedProfile{
+		Type:     profileName(b.p),
+		Start:    opts.Start,
+		Duration: opts.Duration,
+		Period:   b.p.Period,
+		data:     buf.Bytes(),
+		strings:  strings,
+	}
+	return &p
+}
+
+// Write writes the profile compressed accordingly with the extra comments, e.g., the labels.
+func (p *EncodedProfile) Write(w io.Writer, c Compression, comments ...string) error {
+	return c.write(w, func(out io.Writer) error {
+		if _, err := out.Write(p.data); err != nil {
+			return err
+		}
+		// The repeated fields can be appended to the encoded message,
+		// so each comment is added to the string table and referenced by its index.
+		var b []byte
+		for i, comment := range comments {
+			b = appendBytesField(b, pprofProfileStringTable, []byte(comment))
+			b = appendVarintField(b, pprofProfileComment, uint64(p.strings+i))
+		}
+		_, err := out.Write(b)
+		return err
+	})
+}
+
+// Parse decodes the profile, e.g., to find its hottest functions.
+// Each call returns a new profile, so it can be modified.
+func (p *EncodedProfile) Parse() (*profile.Profile, error) {
+	return profile.ParseData(p.data)
+}
+
+// encodeProfile writes the samples as an uncompressed profile in pprof format.
+// It returns the builder of the profile without the samples and the size of the string table.
+func encodeProfile(w io.Writer, samples []Sample, opts ProfileOptions) (*profileBuilder, int, error) {
+	b := newProfileBuilder(samples, opts)
+	e := newProfileEncoder()
+	var d sampleData
+	for _, s := range MergeRareStacks(b.filterSamples(samples), opts.MinCount) {
+		b.fill(&d, s)
+		if _, err := w.Write(e.sample(&d)); err != nil {
+			return nil, 0, err
+		}
+	}
+	b.finish()
+
+	if _, err := w.Write(e.profile(b.p)); err != nil {
+		return nil, 0, err
+	}
+	return b, len(e.table), nil
+}
+
+// The field numbers of the pprof protobuf messages, see profile.proto.
+const (
+	pprofProfileSampleType    = 1
+	pprofProfileSample        = 2
+	pprofProfileMapping       = 3
+	pprofProfileLocation      = 4
+	pprofProfileFunction      = 5
+	pprofProfileStringTable   = 6
+	pprofProfileTimeNanos     = 9
+	pprofProfileDurationNanos = 10
+	pprofProfilePeriodType    = 11
+	pprofProfilePeriod        = 12
+	pprofProfileComment       = 13
+
+	pprofValueTypeType = 1
+	pprofValueTypeUnit = 2
+
+	pprofSampleLocationID = 1
+	pprofSampleValue      = 2
+	pprofSampleLabel      = 3
+
+	pprofLabelKey     = 1
+	pprofLabelStr     = 2
+	pprofLabelNum     = 3
+	pprofLabelNumUnit = 4
+
+	pprofMappingID              = 1
+	pprofMappingMemoryStart     = 2
+	pprofMappingMemoryLimit     = 3
+	pprofMappingFileOffset      = 4
+	pprofMappingFilename        = 5
+	pprofMappingBuildID         = 6
+	pprofMappingHasFunctions    = 7
+	pprofMappingHasFilenames    = 8
+	pprofMappingHasLineNumbers  = 9
+	pprofMappingHasInlineFrames = 10
+
+	pprofLocationID        = 1
+	pprofLocationMappingID = 2
+	pprofLocationAddress   = 3
+	pprofLocationLine      = 4
+	pprofLocationIsFolded  = 5
+
+	pprofLineFunctionID = 1
+	pprofLineLine       = 2
+
+	pprofFunctionID         = 1
+	pprofFunctionName       = 2
+	pprofFunctionSystemName = 3
+	pprofFunctionFilename   = 4
+	pprofFunctionStartLine  = 5
+)
+
+// profileEncoder encodes the pprof protobuf messages.
+// The strings are added to the string table as they're encoded,
+// so the table is written last along with the rest of the profile.
+type profileEncoder struct {
+	strings map[string]int64
+	table   []string
+	// buf and msg are reused to encode the samples and their nested messages.
+	buf []byte
+	msg []byte
+}
+
+func newProfileEncoder() *profileEncoder {
+	return &profileEncoder{
+		strings: map[string]int64{"": 0},
+		table:   []string{""},
+	}
+}
+
+// str returns the index of the string in the string table.
+func (e *profileEncoder) str(s string) int64 {
+	if i, ok := e.strings[s]; ok {
+		return i
+	}
+	i := int64(len(e.table))
+	e.strings[s] = i
+	e.table = append(e.table, s)
+	return i
+}
+
+// locationFilter filters the samples by the focus and ignore regexps without building the profile, see FilterFrames.
+type locationFilter struct {
+	focus  *regexp.Regexp
+	ignore *regexp.Regexp
+	// kept memoizes whether the locations are focused (true) or ignored (false),
+	// the locations matching neither aren't in the map, see profile.FilterSamplesByName.
+	kept map[uint64]bool
+}
+
+func newLocationFilter(focus, ignore *regexp.Regexp) *locationFilter {
+	return &locationFilter{
+		focus:  focus,
+		ignore: ignore,
+		kept:   make(map[uint64]bool),
+	}
+}
+
+// keep reports whether the sample with the locations passes the focus and ignore filters
+// the same way as FilterFrames does: none of its locations is ignored and at least one is focused.
+func (lf *locationFilter) keep(locations []*profile.Location) bool {
+	if lf.focus == nil && lf.ignore == nil {
+		return true
+	}
+
+	var focused bool
+	for _, loc := range locations {
+		f, ok := lf.kept[loc.ID]
+		if !ok {
+			switch {
+			case lf.ignore != nil && locationMatches(loc, lf.ignore):
+				f, ok = false, true
+			case lf.focus == nil || locationMatches(loc, lf.focus):
+				f, ok = true, true
+			}
+			if ok {
+				lf.kept[loc.ID] = f
+			}
+		}
+		if !ok {
+			continue
+		}
+		if !f {
+			return false
+		}
+		focused = true
+	}
+	return focused
+}
+
+// locationMatches reports whether any function name or file of the location, or its mapping file matches.
+func locationMatches(loc *profile.Location, re *regexp.Regexp) bool {
+	for _, ln := range loc.Line {
+		if fn := ln.Function; fn != nil && (re.MatchString(fn.Name) || re.MatchString(fn.Filename)) {
+			return true
+		}
+	}
+	return loc.Mapping != nil && re.MatchString(loc.Mapping.File)
+}
+
+// sample returns the encoded Profile.sample field.
+// The returned slice is only valid until the next call.
+func (e *profileEncoder) sample(d *sampleData) []byte {
+	b := e.msg[:0]
+	if len(d.locations) > 0 {
+		e.buf = e.buf[:0]
+		for _, loc := range d.locations {
+			e.buf = appendUvarint(e.buf, loc.ID)
+		}
+		b = appendBytesField(b, pprofSampleLocationID, e.buf)
+	}
+	e.buf = e.buf[:0]
+	for _, v := range d.values {
+		e.buf = appendUvarint(e.buf, uint64(v))
+	}
+	b = appendBytesField(b, pprofSampleValue, e.buf)
+
+	for _, l := range d.labels {
+		e.buf = appendVarintField(e.buf[:0], pprofLabelKey, uint64(e.str(l.key)))
+		e.buf = appendVarintField(e.buf, pprofLabelStr, uint64(e.str(l.value)))
+		b = appendBytesField(b, pprofSampleLabel, e.buf)
+	}
+	for _, l := range d.numLabels {
+		e.buf = appendVarintField(e.buf[:0], pprofLabelKey, uint64(e.str(l.key)))
+		e.buf = appendVarintField(e.buf, pprofLabelNum, uint64(l.value))
+		if l.unit != "" {
+			e.buf = appendVarintField(e.buf, pprofLabelNumUnit, uint64(e.str(l.unit)))
+		}
+		b = appendBytesField(b, pprofSampleLabel, e.buf)
+	}
+	e.msg = b
+
+	// The sample is wrapped into the Profile field in the buffer which isn't used anymore.
+	e.buf = appendBytesField(e.buf[:0], pprofProfileSample, b)
+	return e.buf
+}
+
+// profile returns the encoded Profile fields except for the samples, i.e.,
+// the sample types, mappings, locations, functions, and the string table.
+func (e *profileEncoder) profile(p *profile.Profile) []byte {
+	var b []byte
+	for _, st := range p.SampleType {
+		b = appendBytesField(b, pprofProfileSampleType, e.valueType(st))
+	}
+	for _, m := range p.Mapping {
+		b = appendBytesField(b, pprofProfileMapping, e.mapping(m))
+	}
+	for _, loc := range p.Location {
+		b = appendBytesField(b, pprofProfileLocation, e.location(loc))
+	}
+	for _, fn := range p.Function {
+		b = appendBytesField(b, pprofProfileFunction, e.function(fn))
+	}
+	b = appendVarintField(b, pprofProfileTimeNanos, uint64(p.TimeNanos))
+	b = appendVarintField(b, pprofProfileDurationNanos, uint64(p.DurationNanos))
+	if p.PeriodType != nil {
+		b = appendBytesField(b, pprofProfilePeriodType, e.valueType(p.PeriodType))
+	}
+	b = appendVarintField(b, pprofProfilePeriod, uint64(p.Period))
+	for _, c := range p.Comments {
+		b = appendVarintField(b, pprofProfileComment, uint64(e.str(c)))
+	}
+
+	// The table is complete once everything else is encoded.
+	for _, s := range e.table {
+		b = appendBytesField(b, pprofProfileStringTable, []byte(s))
+	}
+	return b
+}
+
+func (e *profileEncoder) valueType(vt *profile.ValueType) []byte {
+	b := appendVarintField(nil, pprofValueTypeType, uint64(e.str(vt.Type)))
+	return appendVarintField(b, pprofValueTypeUnit, uint64(e.str(vt.Unit)))
+}
+
+func (e *profileEncoder) mapping(m *profile.Mapping) []byte {
+	b := appendVarintField(nil, pprofMappingID, m.ID)
+	b = appendVarintField(b, pprofMappingMemoryStart, m.Start)
+	b = appendVarintField(b, pprofMappingMemoryLimit, m.Limit)
+	b = appendVarintField(b, pprofMappingFileOffset, m.Offset)
+	b = appendVarintField(b, pprofMappingFilename, uint64(e.str(m.File)))
+	b = appendVarintField(b, pprofMappingBuildID, uint64(e.str(m.BuildID)))
+	b = appendBoolField(b, pprofMappingHasFunctions, m.HasFunctions)
+	b = appendBoolField(b, pprofMappingHasFilenames, m.HasFilenames)
+	b = appendBoolField(b, pprofMappingHasLineNumbers, m.HasLineNumbers)
+	return appendBoolField(b, pprofMappingHasInlineFrames, m.HasInlineFrames)
+}
+
+func (e *profileEncoder) location(loc *profile.Location) []byte {
+	b := appendVarintField(nil, pprofLocationID, loc.ID)
+	if loc.Mapping != nil {
+		b = appendVarintField(b, pprofLocationMappingID, loc.Mapping.ID)
+	}
+	b = appendVarintField(b, pprofLocationAddress, loc.Address)
+	for _, ln := range loc.Line {
+		var lb []byte
+		if ln.Function != nil {
+			lb = appendVarintField(lb, pprofLineFunctionID, ln.Function.ID)
+		}
+		lb = appendVarintField(lb, pprofLineLine, uint64(ln.Line))
+		b = appendBytesField(b, pprofLocationLine, lb)
+	}
+	return appendBoolField(b, pprofLocationIsFolded, loc.IsFolded)
+}
+
+func (e *profileEncoder) function(fn *profile.Function) []byte {
+	b := appendVarintField(nil, pprofFunctionID, fn.ID)
+	b = appendVarintField(b, pprofFunctionName, uint64(e.str(fn.Name)))
+	b = appendVarintField(b, pprofFunctionSystemName, uint64(e.str(fn.SystemName)))
+	b = appendVarintField(b, pprofFunctionFilename, uint64(e.str(fn.Filename)))
+	return appendVarintField(b, pprofFunctionStartLine, uint64(fn.StartLine))
+}
+
+// appendVarintField appends the varint protobuf field unless it's zero, the default value.
+func appendVarintField(b []byte, field uint64, value uint64) []byte {
+	if value == 0 {
+		return b
+	}
+	b = appendUvarint(b, field<<3)
+	return appendUvarint(b, value)
+}
+
+// appendBoolField appends the bool protobuf field if it's true.
+func appendBoolField(b []byte, field uint64, value bool) []byte {
+	if !value {
+		return b
+	}
+	return appendVarintField(b, field, 1)
+}
@@ -0,0 +1,196 @@
+package agent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/google/pprof/profile"
+
+	"diy-parca-agent/symbol"
+)
+
+// testSamples returns the samples of two processes running the same binary
+// along with the options to symbolize them by its build ID.
+func testSamples() ([]Sample, ProfileOptions) {
+	s := symbol.NewSymbolizer(nil, 0)
+	s.Add(&symbol.Table{
+		BuildID:  "b1",
+		Segments: []symbol.Segment{{Offset: 0x1000, Vaddr: 0x1000, Filesize: 0x1000}},
+		Funcs: []symbol.Func{
+			{Addr: 0x1050, Size: 0x50, Name: "main"},
+			{Addr: 0x10b0, Size: 0x30, Name: "_start"},
+		},
+		Files: []string{"main.c", "util.h"},
+		Lines: []symbol.Line{
+			{Addr: 0x1050, File: 0, Line: 10},
+			{Addr: 0x1060, File: 1, Line: 3},
+			{Addr: 0x1070, File: 0, Line: 12},
+			{Addr: 0x10b0, File: 0, Line: 20},
+			{Addr: 0x10e0, File: 0, Line: 0},
+		},
+		Inlines: []symbol.Inline{
+			{Addr: 0x1060, Size: 0x10, Depth: 1, Name: "add", CallFile: 0, CallLine: 11},
+		},
+	})
+	mapping := Mapping{Start: 0x400000, Limit: 0x401000, Offset: 0x1000, Path: "/usr/bin/a", BuildID: "b1"}
+
+	samples := []Sample{
+		{PID: 1, UserStack: []uint64{0x400064, 0x4000b5}, Count: 3},
+		{PID: 1, UserStack: []uint64{0x400074, 0x4000b5}, Count: 2, TraceIDLow: 1, SpanID: 2},
+		{PID: 2, UserStack: []uint64{0x400054, 0x4000b5}, Count: 5},
+		{PID: 2, UserStack: []uint64{0x4000b5}, Count: 1},
+	}
+	opts := ProfileOptions{
+		Frequency:     99,
+		Mappings:      map[uint32][]Mapping{1: {mapping}, 2: {mapping}},
+		Symbolizer:    s,
+		ProcessNames:  map[uint32]string{1: "a", 2: "a"},
+		ProcessLabels: map[uint32]Labels{2: {"pod": "web-1"}},
+		Labels:        Labels{"env": "prod"},
+		Cmdlines:      map[uint32]string{1: "/usr/bin/a -v"},
+		Host:          &HostInfo{Hostname: "h1", CPUModel: "cpu", CPUs: 4},
+		Build:         &BuildInfo{Version: "v1", Kernel: "6.1.0"},
+		Start:         time.Unix(1700000000, 0),
+		Duration:      10 * time.Second,
+	}
+	return samples, opts
+}
+
+func TestEncodeProfile(t *testing.T) {
+	samples, opts := testSamples()
+	p := EncodeProfile(samples, opts)
+
+	got, err := profile.ParseData(p.data)
+	if err != nil {
+		t.Fatalf("failed to parse encoded profile: %v", err)
+	}
+	// The graph is encoded and parsed by the pprof package,
+	// so both profiles are compared in the same normalized form.
+	var buf bytes.Buffer
+	if err = Profile(samples, opts).WriteUncompressed(&buf); err != nil {
+		t.Fatalf("failed to write profile: %v", err)
+	}
+	want, err := profile.ParseData(buf.Bytes())
+	if err != nil {
+		t.Fatalf("failed to parse profile: %v", err)
+	}
+
+	if len(got.Sample) == 0 || len(got.Comments) == 0 {
+		t.Fatalf("empty profile:\n%s", got)
+	}
+	if got.String() != want.String() {
+		t.Errorf("encoded profile differs from the graph\ngot:\n%s\nwant:\n%s", got, want)
+	}
+	if gotStrs, wantStrs := stringTable(t, p.data), stringTable(t, buf.Bytes()); !equalStrings(gotStrs, wantStrs) {
+		t.Errorf("got string table %q, want %q", gotStrs, wantStrs)
+	}
+	if p.strings != len(stringTable(t, p.data)) {
+		t.Errorf("got string table size %d, want %d", p.strings, len(stringTable(t, p.data)))
+	}
+	if p.Type != "cpu" || p.Period != want.Period || !p.Start.Equal(opts.Start) || p.Duration != opts.Duration {
+		t.Errorf("unexpected profile metadata %+v", p)
+	}
+}
+
+func TestEncodedProfileWrite(t *testing.T) {
+	samples, opts := testSamples()
+	p := EncodeProfile(samples, opts)
+	want, err := p.Parse()
+	if err != nil {
+		t.Fatalf("failed to parse encoded profile: %v", err)
+	}
+	comments := []string{"labels: env=prod", want.Comments[0]}
+
+	tt := []Compression{{}, {Level: gzip.BestSpeed}, {Level: gzip.BestCompression}, {None: true}}
+	for _, c := range tt {
+		t.Run(c.String(), func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := p.Write(&buf, c, comments...); err != nil {
+				t.Fatalf("failed to write profile: %v", err)
+			}
+
+			data := buf.Bytes()
+			if !c.None {
+				zr, err := gzip.NewReader(&buf)
+				if err != nil {
+					t.Fatalf("profile isn't gzipped: %v", err)
+				}
+				if data, err = io.ReadAll(zr); err != nil {
+					t.Fatalf("failed to decompress profile: %v", err)
+				}
+			}
+			if !bytes.HasPrefix(data, p.data) {
+				t.Fatal("profile doesn't start with the encoded samples")
+			}
+
+			got, err := profile.ParseData(data)
+			if err != nil {
+				t.Fatalf("failed to parse profile: %v", err)
+			}
+			wantComments := append(append([]string{}, want.Comments...), comments...)
+			if !equalStrings(got.Comments, wantComments) {
+				t.Errorf("got comments %q, want %q", got.Comments, wantComments)
+			}
+			got.Comments = want.Comments
+			if got.String() != want.String() {
+				t.Errorf("written profile differs\ngot:\n%s\nwant:\n%s", got, want)
+			}
+		})
+	}
+}
+
+// stringTable returns the sorted string table of the uncompressed profile in pprof format.
+func stringTable(t *testing.T, data []byte) []string {
+	t.Helper()
+
+	var strs []string
+	for len(data) > 0 {
+		key, n := readVarint(data)
+		data = data[n:]
+		field, wireType := key>>3, key&7
+		switch wireType {
+		case 0:
+			_, n = readVarint(data)
+			data = data[n:]
+		case 2:
+			size, n := readVarint(data)
+			data = data[n:]
+			if field == pprofProfileStringTable {
+				strs = append(strs, string(data[:size]))
+			}
+			data = data[size:]
+		default:
+			t.Fatalf("unexpected wire type %d of field %d", wireType, field)
+		}
+	}
+	sort.Strings(strs)
+	return strs
+}
+
+// readVarint decodes the varint at the start of b and returns its value and size.
+func readVarint(b []byte) (uint64, int) {
+	var v uint64
+	for i, c := range b {
+		v |= uint64(c&0x7f) << (7 * i)
+		if c < 0x80 {
+			return v, i + 1
+		}
+	}
+	return v, len(b)
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
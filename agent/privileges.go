@@ -0,0 +1,122 @@
+//go:build linux
+
+package agent
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// perfEventParanoidPath is the sysctl which restricts the perf events of the unprivileged users.
+const perfEventParanoidPath = "/proc/sys/kernel/perf_event_paranoid"
+
+// capsVersion is the kernel version which split CAP_BPF and CAP_PERFMON off CAP_SYS_ADMIN.
+var capsVersion = [2]int{5, 8}
+
+// Privileges describe what the profiler process is allowed to do.
+// Root can do everything, while a non-root user needs CAP_BPF and CAP_PERFMON (Linux 5.8+)
+// to load the BPF program and attach it to the perf events, e.g., granted as file capabilities
+// (setcap cap_bpf,cap_perfmon+ep) or ambient capabilities (AmbientCapabilities of a systemd unit).
+type Privileges struct {
+	// Caps is the effective capability set of the process, a bit per capability, e.g., 1<<unix.CAP_BPF.
+	Caps uint64
+	// PerfEventParanoid is kernel.perf_event_paranoid sysctl, it's ignored for the processes with CAP_PERFMON.
+	// The unprivileged users can't open the CPU-wide perf events unless it's 0 or less.
+	PerfEventParanoid int
+}
+
+// ReadPrivileges returns the privileges of the current process.
+func ReadPrivileges() (Privileges, error) {
+	var p Privileges
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return p, fmt.Errorf("failed to read capabilities: %w", err)
+	}
+	defer f.Close()
+
+	// The line looks like "CapEff:	000001ffffffffff".
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := sc.Text()
+		if !strings.HasPrefix(line, "CapEff:") {
+			continue
+		}
+		if p.Caps, err = strconv.ParseUint(strings.TrimSpace(line[len("CapEff:"):]), 16, 64); err != nil {
+			return p, fmt.Errorf("failed to parse capabilities: %w", err)
+		}
+		break
+	}
+	if err = sc.Err(); err != nil {
+		return p, fmt.Errorf("failed to read capabilities: %w", err)
+	}
+
+	p.PerfEventParanoid = 2
+	if b, err := os.ReadFile(perfEventParanoidPath); err == nil {
+		if v, err := strconv.Atoi(strings.TrimSpace(string(b))); err == nil {
+			p.PerfEventParanoid = v
+		}
+	}
+	return p, nil
+}
+
+// Has reports whether the process has the capability, e.g., unix.CAP_BPF.
+func (p Privileges) Has(capability int) bool {
+	return p.Caps&(1<<uint(capability)) != 0
+}
+
+// Check explains what's missing if the BPF program can't be loaded and attached.
+func (p Privileges) Check() error {
+	if p.Has(unix.CAP_SYS_ADMIN) {
+		return nil
+	}
+
+	var missing []string
+	if !p.Has(unix.CAP_BPF) {
+		missing = append(missing, "CAP_BPF")
+	}
+	if !p.Has(unix.CAP_PERFMON) {
+		missing = append(missing, "CAP_PERFMON")
+	}
+	if len(missing) == 0 {
+		major, minor, err := kernelVersion()
+		if err == nil && versionBefore(major, minor, capsVersion) {
+			return failure(FailureKernelUnsupported, fmt.Errorf("CAP_BPF and CAP_PERFMON require Linux 5.8+, the profiler must run as root on Linux %d.%d", major, minor))
+		}
+		return nil
+	}
+
+	err := fmt.Errorf(
+		"missing %s: the profiler must run as root or with CAP_BPF and CAP_PERFMON (Linux 5.8+), e.g., sudo setcap cap_bpf,cap_perfmon+ep %s",
+		strings.Join(missing, " and "), os.Args[0],
+	)
+	if !p.Has(unix.CAP_PERFMON) && p.PerfEventParanoid > 0 {
+		err = fmt.Errorf("%w (kernel.perf_event_paranoid %d also denies the CPU-wide perf events without CAP_PERFMON)", err, p.PerfEventParanoid)
+	}
+	return failure(FailurePermissionDenied, err)
+}
+
+// Warnings describe what won't work without root, e.g., the user frames of other users' processes
+// aren't symbolized without CAP_SYS_PTRACE.
+func (p Privileges) Warnings() []string {
+	if p.Has(unix.CAP_SYS_ADMIN) {
+		return nil
+	}
+
+	var ww []string
+	if !p.Has(unix.CAP_SYS_PTRACE) {
+		ww = append(ww, "without CAP_SYS_PTRACE the memory mappings of other users' processes can't be read, their user frames won't be symbolized")
+	}
+	if !p.Has(unix.CAP_SYSLOG) {
+		ww = append(ww, "without CAP_SYSLOG the kernel symbol addresses are hidden, the kernel frames won't be symbolized")
+	}
+	major, minor, err := kernelVersion()
+	if err == nil && versionBefore(major, minor, memcgAccountingVersion) && !p.Has(unix.CAP_SYS_RESOURCE) {
+		ww = append(ww, "without CAP_SYS_RESOURCE RLIMIT_MEMLOCK can't be raised above the hard limit, the BPF maps might not fit")
+	}
+	return ww
+}
@@ -0,0 +1,171 @@
+package agent
+
+import (
+	"diy-parca-agent/symbol"
+)
+
+// ProcessCache keeps the metadata of the sampled processes fetched when they're first seen:
+// the memory mappings, names, command lines, and symbol tables of the mapped binaries.
+// The processes which exit before their profile is built (e.g., short-lived commands)
+// can't be read from /proc anymore, but their samples are still symbolized from the cache.
+type ProcessCache struct {
+	symbolizer *symbol.Symbolizer
+	// queue loads the symbol tables in the background if set, so Add doesn't wait for them.
+	queue *symbolQueue
+	procs map[uint32]*processMeta
+}
+
+// processMeta is the cached metadata of a process.
+type processMeta struct {
+	mappings []Mapping
+	name     string
+	cmdline  string
+	// sampled tells whether the process was sampled since the previous Evict.
+	sampled bool
+}
+
+// NewProcessCache returns a cache which loads the symbol tables of the processes' binaries
+// into the symbolizer as soon as they're seen. The symbolizer can be nil,
+// then only the build IDs of the binaries are cached.
+func NewProcessCache(s *symbol.Symbolizer) *ProcessCache {
+	return &ProcessCache{
+		symbolizer: s,
+		procs:      make(map[uint32]*processMeta),
+	}
+}
+
+// Add fetches the metadata of the processes sampled for the first time.
+// It must be called right after the samples are flushed, because the processes might exit soon.
+// The mappings of a known process are read again if a sampled address isn't covered by them,
+// e.g., the process has loaded a shared library.
+func (c *ProcessCache) Add(samples []Sample) {
+	for _, s := range samples {
+		pm, ok := c.procs[s.PID]
+		if !ok {
+			pm = &processMeta{}
+			if name, err := processName(s.PID); err == nil {
+				pm.name = name
+			}
+			if cmdline, err := processCmdline(s.PID); err == nil {
+				pm.cmdline = cmdline
+			}
+			c.procs[s.PID] = pm
+		}
+		pm.sampled = true
+
+		// Memory mappings are not needed when there is no user stack.
+		if len(s.UserStack) == 0 || (pm.mappings != nil && coversStack(pm.mappings, s.UserStack)) {
+			continue
+		}
+		mm, err := ReadMappings(s.PID)
+		if err != nil {
+			// The mappings read earlier are kept if the process has exited.
+			continue
+		}
+		for i := range mm {
+			c.prefetch(s.PID, &mm[i])
+		}
+		pm.mappings = mm
+	}
+}
+
+// prefetch loads the symbol table of the mapped binary into the symbolizer (or queues it),
+// so the symbolizer can resolve its path after the process exits.
+// Without the symbolizer the build ID is recorded in the mapping.
+func (c *ProcessCache) prefetch(pid uint32, m *Mapping) {
+	if !isFile(m.Path) {
+		return
+	}
+	path := procPath(pid, m.Path)
+	if c.symbolizer != nil {
+		if c.queue != nil {
+			c.queue.add(pid, *m)
+			return
+		}
+		// The errors are remembered by the symbolizer and reported when the profile is built.
+		c.symbolizer.Table(path)
+		return
+	}
+	if buildID, err := readBuildID(path); err == nil {
+		m.BuildID = buildID
+	}
+}
+
+// coversStack reports whether all the addresses of the stack belong to the mappings.
+func coversStack(mm []Mapping, stack []uint64) bool {
+	for _, addr := range stack {
+		if _, ok := findMapping(mm, addr); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Mappings returns the cached mappings of the processes the samples were taken from,
+// see ProcessMappings.
+func (c *ProcessCache) Mappings(samples []Sample) map[uint32][]Mapping {
+	mappings := make(map[uint32][]Mapping)
+	for _, s := range samples {
+		if pm, ok := c.procs[s.PID]; ok && len(s.UserStack) > 0 {
+			mappings[s.PID] = pm.mappings
+		}
+	}
+	addBuildIDMappings(mappings, samples)
+	return mappings
+}
+
+// Names returns the cached names of the processes the samples were taken from, see ProcessNames.
+func (c *ProcessCache) Names(samples []Sample) map[uint32]string {
+	names := make(map[uint32]string)
+	for _, s := range samples {
+		if pm, ok := c.procs[s.PID]; ok && pm.name != "" {
+			names[s.PID] = pm.name
+		}
+	}
+	return names
+}
+
+// Cmdlines returns the cached command lines of the processes the samples were taken from,
+// see ProcessCmdlines.
+func (c *ProcessCache) Cmdlines(samples []Sample) map[uint32]string {
+	cmdlines := make(map[uint32]string)
+	for _, s := range samples {
+		if pm, ok := c.procs[s.PID]; ok && pm.cmdline != "" {
+			cmdlines[s.PID] = pm.cmdline
+		}
+	}
+	return cmdlines
+}
+
+// Bytes estimates the memory used by the cached metadata, it's charged to the symbol memory budget,
+// see Symbolizer.Reserve.
+func (c *ProcessCache) Bytes() int64 {
+	const (
+		metaSize    = 72
+		mappingSize = 56
+	)
+	var n int64
+	for _, pm := range c.procs {
+		n += metaSize + int64(len(pm.name)+len(pm.cmdline))
+		for _, m := range pm.mappings {
+			n += mappingSize + int64(len(m.Path)+len(m.BuildID))
+		}
+	}
+	return n
+}
+
+// Evict forgets the processes which weren't sampled since the previous Evict,
+// so the cache doesn't grow with every short-lived process (and reused PIDs get fresh metadata).
+// It returns the forgotten processes, so the other caches can forget them too.
+func (c *ProcessCache) Evict() []uint32 {
+	var evicted []uint32
+	for pid, pm := range c.procs {
+		if !pm.sampled {
+			delete(c.procs, pid)
+			evicted = append(evicted, pid)
+			continue
+		}
+		pm.sampled = false
+	}
+	return evicted
+}
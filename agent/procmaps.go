@@ -0,0 +1,223 @@
+package agent
+
+import (
+	"bufio"
+	"debug/elf"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"diy-parca-agent/symbol"
+)
+
+// Mapping is an executable memory mapping of a process,
+// e.g., a binary or a shared library.
+type Mapping struct {
+	// Start and Limit are the memory addresses of the mapping [Start, Limit).
+	Start uint64
+	Limit uint64
+	// Offset is the file offset of the mapping.
+	Offset uint64
+	// Path is the file path of the mapping.
+	// It's empty for anonymous mappings, e.g., JIT code.
+	Path string
+	// BuildID identifies the mapped binary if it's known, e.g., in a capture.
+	// Then the binary is symbolized by the build ID rather than the path, see Capture.
+	BuildID string
+}
+
+// ReadMappings returns the executable memory mappings of the process
+// from /proc/<pid>/maps sorted by the start address.
+func ReadMappings(pid uint32) ([]Mapping, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/maps", pid))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open process maps: %w", err)
+	}
+	defer f.Close()
+
+	var mm []Mapping
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		m, ok, err := parseMapsLine(sc.Text())
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse process maps: %w", err)
+		}
+		if ok {
+			mm = append(mm, m)
+		}
+	}
+	if err = sc.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read process maps: %w", err)
+	}
+
+	return mm, nil
+}
+
+// parseMapsLine parses a line of /proc/<pid>/maps file, for example,
+//
+//	55d6b5a4e000-55d6b5a6c000 r-xp 00002000 fd:01 1310779  /usr/bin/top
+//
+// The fields are address range, permissions, offset, device, inode, and path.
+// It reports false if the mapping is not executable.
+func parseMapsLine(line string) (m Mapping, ok bool, err error) {
+	fields := strings.Fields(line)
+	if len(fields) < 5 {
+		return m, false, fmt.Errorf("unexpected line %q", line)
+	}
+	if !strings.Contains(fields[1], "x") {
+		return m, false, nil
+	}
+
+	start, limit, found := strings.Cut(fields[0], "-")
+	if !found {
+		return m, false, fmt.Errorf("unexpected address range %q", fields[0])
+	}
+	if m.Start, err = strconv.ParseUint(start, 16, 64); err != nil {
+		return m, false, fmt.Errorf("unexpected start address %q", start)
+	}
+	if m.Limit, err = strconv.ParseUint(limit, 16, 64); err != nil {
+		return m, false, fmt.Errorf("unexpected limit address %q", limit)
+	}
+	if m.Offset, err = strconv.ParseUint(fields[2], 16, 64); err != nil {
+		return m, false, fmt.Errorf("unexpected offset %q", fields[2])
+	}
+	// The path can contain spaces.
+	if len(fields) > 5 {
+		m.Path = strings.Join(fields[5:], " ")
+	}
+
+	return m, true, nil
+}
+
+// findMapping returns the mapping which contains the address.
+// The mappings must be sorted by the start address.
+func findMapping(mm []Mapping, addr uint64) (Mapping, bool) {
+	lo, hi := 0, len(mm)
+	for lo < hi {
+		i := (lo + hi) / 2
+		switch {
+		case addr < mm[i].Start:
+			hi = i
+		case addr >= mm[i].Limit:
+			lo = i + 1
+		default:
+			return mm[i], true
+		}
+	}
+
+	return Mapping{}, false
+}
+
+// ProcessMappings returns the executable memory mappings of the processes
+// the samples were taken from.
+// The processes which have already exited are skipped.
+func ProcessMappings(samples []Sample) map[uint32][]Mapping {
+	mappings := make(map[uint32][]Mapping)
+	for _, s := range samples {
+		if _, ok := mappings[s.PID]; ok {
+			continue
+		}
+		// Memory mappings are not needed when there is no user stack.
+		if len(s.UserStack) == 0 {
+			continue
+		}
+
+		mm, err := ReadMappings(s.PID)
+		if err != nil {
+			mm = nil
+		}
+		mappings[s.PID] = mm
+	}
+	addBuildIDMappings(mappings, samples)
+
+	return mappings
+}
+
+// BuildIDMappings derives the memory mappings of the processes from the build ID stacks of their samples,
+// see ObjectsOptions.BuildIDStacks. A frame tells the binary and the file offset of its address,
+// so the binary is assumed to be mapped at the address minus the offset
+// up to the highest sampled address. The mappings have no paths,
+// hence the binaries are symbolized by their build IDs, e.g., from the persistent symbol store.
+func BuildIDMappings(samples []Sample) map[uint32][]Mapping {
+	type binary struct {
+		pid     uint32
+		buildID string
+	}
+	seen := make(map[binary]int)
+	mappings := make(map[uint32][]Mapping)
+	for _, s := range samples {
+		for i, f := range s.UserBuildIDStack {
+			if f.BuildID == "" || i >= len(s.UserStack) || s.UserStack[i] < f.Offset {
+				continue
+			}
+			addr := s.UserStack[i]
+			k := binary{pid: s.PID, buildID: f.BuildID}
+			if j, ok := seen[k]; ok {
+				m := &mappings[s.PID][j]
+				if addr >= m.Limit {
+					m.Limit = addr + 1
+				}
+				continue
+			}
+			seen[k] = len(mappings[s.PID])
+			mappings[s.PID] = append(mappings[s.PID], Mapping{
+				Start:   addr - f.Offset,
+				Limit:   addr + 1,
+				BuildID: f.BuildID,
+			})
+		}
+	}
+
+	for _, mm := range mappings {
+		sort.Slice(mm, func(i, j int) bool { return mm[i].Start < mm[j].Start })
+	}
+	return mappings
+}
+
+// addBuildIDMappings fills in the mappings of the processes which exited before they were read
+// with the ones derived from the build ID stacks, see BuildIDMappings.
+func addBuildIDMappings(mappings map[uint32][]Mapping, samples []Sample) {
+	for pid, mm := range BuildIDMappings(samples) {
+		if len(mappings[pid]) == 0 {
+			mappings[pid] = mm
+		}
+	}
+}
+
+// ProcessNames returns the names (comm) of the processes the samples were taken from.
+// The processes which have already exited are skipped.
+func ProcessNames(samples []Sample) map[uint32]string {
+	names := make(map[uint32]string)
+	for _, s := range samples {
+		if _, ok := names[s.PID]; ok {
+			continue
+		}
+		if name, err := processName(s.PID); err == nil {
+			names[s.PID] = name
+		}
+	}
+
+	return names
+}
+
+// processName returns the name (comm) of the process.
+func processName(pid uint32) (string, error) {
+	b, err := os.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// readBuildID returns the build ID of the binary at path.
+func readBuildID(path string) (string, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	return symbol.BuildID(f)
+}
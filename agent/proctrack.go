@@ -0,0 +1,128 @@
+package agent
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// listPIDs returns the PIDs of all the processes.
+func listPIDs() ([]uint32, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list processes: %w", err)
+	}
+
+	var pids []uint32
+	for _, e := range entries {
+		if pid, err := strconv.ParseUint(e.Name(), 10, 32); err == nil {
+			pids = append(pids, uint32(pid))
+		}
+	}
+	return pids, nil
+}
+
+// listThreads returns the thread IDs of the process.
+func listThreads(pid uint32) ([]uint32, error) {
+	entries, err := os.ReadDir(fmt.Sprintf("/proc/%d/task", pid))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list threads of process %d: %w", pid, err)
+	}
+
+	var tids []uint32
+	for _, e := range entries {
+		if tid, err := strconv.ParseUint(e.Name(), 10, 32); err == nil {
+			tids = append(tids, uint32(tid))
+		}
+	}
+	return tids, nil
+}
+
+// exeMatches returns the processes whose executable path matches the glob pattern,
+// e.g., /opt/myapp/bin/*.
+func exeMatches(pattern string) (map[uint32]bool, error) {
+	all, err := listPIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	pids := make(map[uint32]bool)
+	for _, pid := range all {
+		if exeMatch(pattern, pid) {
+			pids[pid] = true
+		}
+	}
+	return pids, nil
+}
+
+// exeMatch reports whether the executable path of the process matches the glob pattern.
+func exeMatch(pattern string, pid uint32) bool {
+	// The kernel threads have no executable, and the process might have exited.
+	exe, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+	if err != nil {
+		return false
+	}
+	// The executable might have been replaced during a deployment.
+	exe = strings.TrimSuffix(exe, " (deleted)")
+	ok, _ := filepath.Match(pattern, exe)
+	return ok
+}
+
+// descendants returns the root process along with all its descendants.
+func descendants(root uint32) (map[uint32]bool, error) {
+	all, err := listPIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	children := make(map[uint32][]uint32)
+	for _, pid := range all {
+		// The process might have exited.
+		ppid, err := parentPID(pid)
+		if err != nil {
+			continue
+		}
+		children[ppid] = append(children[ppid], pid)
+	}
+
+	pids := map[uint32]bool{root: true}
+	queue := []uint32{root}
+	for len(queue) > 0 {
+		pid := queue[0]
+		queue = queue[1:]
+		for _, child := range children[pid] {
+			if !pids[child] {
+				pids[child] = true
+				queue = append(queue, child)
+			}
+		}
+	}
+	return pids, nil
+}
+
+// parentPID reads the parent PID from /proc/<pid>/stat, e.g.,
+// "1234 (postgres) S 1 ...", where the fourth field is the parent PID.
+// The command name might contain spaces and parentheses,
+// so the fields are counted from the last closing parenthesis.
+func parentPID(pid uint32) (uint32, error) {
+	b, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	i := bytes.LastIndexByte(b, ')')
+	if i < 0 {
+		return 0, fmt.Errorf("invalid stat of process %d", pid)
+	}
+	fields := bytes.Fields(b[i+1:])
+	if len(fields) < 2 {
+		return 0, fmt.Errorf("invalid stat of process %d", pid)
+	}
+	ppid, err := strconv.ParseUint(string(fields[1]), 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid parent PID of process %d: %w", pid, err)
+	}
+	return uint32(ppid), nil
+}
@@ -0,0 +1,1589 @@
+//go:build linux
+
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+	"golang.org/x/sys/unix"
+
+	"diy-parca-agent/symbol"
+)
+
+// DefaultFrequency is the default sampling rate (samples per second).
+const DefaultFrequency = 100
+
+// DefaultCPURotation is how long each CPU group is sampled by default, see Config.CPUGroups.
+const DefaultCPURotation = 10 * time.Second
+
+// cpuHotplugInterval is how often the profiler checks
+// whether CPUs went online or offline.
+const cpuHotplugInterval = 5 * time.Second
+
+// maxFlushErrors is how many flushes in a row may fail before the profiler
+// reloads the BPF objects, see Flush.
+const maxFlushErrors = 3
+
+// processScanInterval is how often the profiler looks for new target processes
+// when they are found dynamically, see Config.Tree, Config.Exe, and Config.SystemdUnit.
+const processScanInterval = time.Second
+
+// Config configures the profiler.
+type Config struct {
+	// Mode is what the profiler attributes to the stacks, ModeCPU is used when it's empty.
+	// The perf events are only opened in ModeCPU, the other modes attach to tracepoints,
+	// so Frequency, SetFrequency, and Pause don't apply to them.
+	Mode Mode
+	// PID is a process whose stack traces should be collected,
+	// -1 means all processes.
+	PID int
+	// SelfPID makes the profiler collect stack traces of the current process
+	// (all its threads). PID is ignored in this case.
+	SelfPID bool
+	// Tree makes the profiler collect stack traces of the PID's descendants too,
+	// e.g., the workers of PostgreSQL or nginx. The new children are discovered while profiling.
+	Tree bool
+	// Exe makes the profiler collect stack traces of the processes
+	// whose executable path matches the glob pattern, e.g., /opt/myapp/bin/*.
+	// The processes are rescanned while profiling. PID is ignored in this case.
+	Exe string
+	// TimeBucket splits the samples by the time they were taken into the intervals of this duration,
+	// e.g., a second, so the profiles can be sliced into sub-intervals, see Sample.Time.
+	// The samples aren't split if it's zero.
+	TimeBucket time.Duration
+	// WalkDepth makes the BPF program walk the user stacks by following frame pointers
+	// up to this depth instead of using bpf_get_stackid(), see ObjectsOptions.WalkDepth.
+	WalkDepth int
+	// BuildIDStacks makes the BPF program also record the user stacks as build IDs and file offsets,
+	// so the stacks of the processes which exit before their memory mappings are read
+	// are still symbolized, see ObjectsOptions.BuildIDStacks.
+	BuildIDStacks bool
+	// StackDepth is the max depth of the collected stacks (DefaultStackDepth if zero),
+	// e.g., 512 for the applications with deep recursion at the cost of larger maps,
+	// see ObjectsOptions.StackDepth.
+	// The depth is lowered to kernel.perf_event_max_stack sysctl if it's below, see ReadMaxStack.
+	StackDepth int
+	// RaiseMaxStack raises kernel.perf_event_max_stack sysctl to StackDepth instead of lowering the depth
+	// if the process has CAP_SYS_ADMIN. The sysctl is restored when the profiler is closed.
+	RaiseMaxStack bool
+	// UIDs restricts sampling to the processes owned by the given users,
+	// it can be combined with the other targets.
+	UIDs []uint32
+	// Cgroups restricts sampling to the processes in the given cgroup v2 cgroups and their descendants,
+	// e.g., /system.slice/docker-4f3a.scope or /sys/fs/cgroup/kubepods.slice.
+	// The cgroups are rescanned while profiling, so the new containers are sampled too.
+	// It can be combined with the other targets.
+	Cgroups []string
+	// Denylist describes the processes which are never sampled even if they're targeted,
+	// e.g., the secret managers, see Denylist.
+	Denylist Denylist
+	// TraceContext is the marker function of the form path:symbol the instrumented application
+	// calls whenever a thread starts or finishes working on a span, e.g.,
+	// /opt/myapp/bin/server:main.parcaSetTraceContext.
+	// Its arguments are the high and low halves of the trace ID and the span ID (all zeros when done),
+	// e.g., func parcaSetTraceContext(traceIDHigh, traceIDLow, spanID uint64) in Go
+	// (it must not be inlined), or a C function with the same signature.
+	// The samples are labeled with trace_id and span_id, linking CPU profiles to distributed traces.
+	TraceContext string
+	// SystemdUnit makes the profiler collect stack traces of all the processes
+	// of the systemd unit, e.g., nginx.service. PID is ignored in this case.
+	SystemdUnit string
+	// Frequency is the sampling rate (samples per second),
+	// DefaultFrequency is used when it's zero.
+	Frequency uint64
+	// Clock is the perf event clock which drives the sampling in ModeCPU,
+	// ClockCPU is used when it's empty.
+	Clock Clock
+	// Precise is the precise_ip level of the hardware events (ClockCycles):
+	// 0 allows arbitrary skid (the sampled instruction might be a few instructions after the one which overflowed
+	// the counter), 1 requests constant skid, 2 requests zero skid, and 3 requires zero skid.
+	// The levels the PMU rejects are lowered until one is accepted.
+	Precise int
+	// IPC opens an event group per CPU: the cycles event which drives the sampling (ClockCycles) leads the group,
+	// and its member counts the instructions retired. The cycles and instructions since the previous sample on the CPU
+	// are attributed to the sample, so the instructions per cycle tell the memory-bound stacks (low IPC)
+	// from the compute-bound ones, see Sample.Instructions. It requires Linux 4.15+.
+	IPC bool
+	// CPUGroups splits the online CPUs into the groups which are sampled one at a time,
+	// so the machines with hundreds of CPUs are profiled continuously with bounded overhead
+	// while all CPUs are still covered over time. CPU n belongs to group n mod CPUGroups,
+	// so each group spreads over the cores and sockets. The perf events are opened on all CPUs,
+	// but only the active group's ones are enabled. All CPUs are sampled at once when it's 0 or 1.
+	// It requires the per-CPU clocks (ClockCPU or ClockCycles).
+	CPUGroups int
+	// CPURotation is how long each CPU group is sampled before the next one,
+	// DefaultCPURotation is used when it's zero.
+	CPURotation time.Duration
+	// LBR unwinds the user stacks of the processes whose executables omit frame pointers
+	// by the call stacks which the last branch records (LBR) of Intel CPUs (Haswell+) keep.
+	// The call stacks are limited to the LBR depth (up to 32 frames on recent CPUs),
+	// the other processes are still unwound by frame pointers.
+	// It requires the hardware events (ClockCycles), Linux 5.6+, and isn't available in most VMs.
+	LBR bool
+	// FrequencyOverrides sample the processes of their targets at their own frequencies,
+	// e.g., 199 Hz for the service under investigation while everything else is sampled at Frequency.
+	// The threads of the matching processes get their own perf events at the overridden frequencies,
+	// and the per-CPU events skip those threads. The threads are found by the process scans,
+	// so the new ones are sampled by the per-CPU events at Frequency until then (within processScanInterval).
+	// The first matching override wins.
+	// It requires the per-CPU clocks (ClockCPU or ClockCycles) and can't be combined with IPC.
+	FrequencyOverrides []FrequencyOverride
+	// PinDir is a BPF file system directory to pin the maps to,
+	// so they can be inspected by another process, see Objects.Pin.
+	// The maps are not pinned when it's empty.
+	PinDir string
+
+	// Interval is how often the agent uploads a profile, see Start.
+	// DefaultInterval is used when it's zero.
+	Interval time.Duration
+	// Align makes the agent upload the profiles on the wall-clock multiples of Align instead of every Interval,
+	// e.g., at :00 of each minute with a minute, so the profiles of different hosts cover the same windows
+	// and can be joined with the metrics. The first profile covers the time from the start to the first boundary.
+	// The boundaries are counted in UTC, so a day is aligned to midnight UTC.
+	Align time.Duration
+	// Sinks receive a CPU profile every Interval, e.g., FileSink and ParcaSink
+	// save it locally and upload it in one run, see Start.
+	Sinks []Sink
+	// Labels are passed to the sinks along with each profile, e.g., {"service": "api"}.
+	Labels Labels
+	// LabelProviders label the samples of the uploaded profiles per process,
+	// e.g., KubernetesLabelProvider adds the pod and namespace, see ProfileOptions.ProcessLabels.
+	LabelProviders []LabelProvider
+	// Symbolizer resolves user space addresses of the uploaded profiles if set, see Start.
+	// Otherwise the profiles can be symbolized later by pprof.
+	// The process and perf map caches are charged to its memory budget, see Symbolizer.Reserve.
+	Symbolizer *symbol.Symbolizer
+	// SymbolizeBudget limits how long an upload may spend loading the symbol tables if set,
+	// e.g., a second, so many new binaries don't delay the next collection.
+	// The symbol tables are loaded in the background, and the addresses of the binaries
+	// which aren't loaded within the budget are left unsymbolized (pprof can symbolize them later),
+	// see ProfileOptions.SymbolizeDeadline.
+	SymbolizeBudget time.Duration
+	// GuessFuncs synthesizes functions for the code without symbols in the uploaded profiles,
+	// see ProfileOptions.GuessFuncs.
+	GuessFuncs bool
+	// PerfMaps enables symbolizing the code of JIT runtimes in the uploaded profiles
+	// using /tmp/perf-<pid>.map files, see PerfMaps.
+	PerfMaps bool
+	// JVMPerfMaps is how often the JVMs are asked to dump their perf maps if PerfMaps is set,
+	// see PerfMapsOptions.JVMRefresh.
+	JVMPerfMaps time.Duration
+	// DotnetPerfMaps enables the perf maps of the .NET processes if PerfMaps is set,
+	// see PerfMapsOptions.Dotnet.
+	DotnetPerfMaps bool
+	// Focus and Ignore filter the samples of the uploaded profiles by their symbolized frames if set,
+	// see FilterFrames.
+	Focus  *regexp.Regexp
+	Ignore *regexp.Regexp
+	// MinCount merges the stacks seen fewer times in an uploaded profile into an "(other)" sample per process,
+	// see MergeRareStacks.
+	MinCount uint64
+	// StripGoRuntime drops the Go runtime scheduling frames below the program's code in the uploaded profiles,
+	// see ProfileOptions.StripGoRuntime.
+	StripGoRuntime bool
+	// Sanitizer replaces sensitive data of the uploaded profiles with pseudonyms if set, see Start.
+	Sanitizer *Sanitizer
+	// Metrics are updated with the samples of every upload if set, see Start.
+	Metrics *Metrics
+}
+
+// Profiler samples stack traces using the BPF program attached to perf events,
+// one event per online CPU (or per target thread with ClockTask).
+type Profiler struct {
+	objs     *Objects
+	objsOpts ObjectsOptions
+	mode     Mode
+	clock    Clock
+	// precise is the precise_ip level the PMU accepted, see Config.Precise.
+	precise int
+	// counters are the instructions counters by the file descriptors of the cycles events leading their groups,
+	// see Config.IPC.
+	counters map[int]int
+	// links are the BPF programs attached in the modes other than ModeCPU.
+	links  []link.Link
+	pinDir string
+	pinned bool
+	// targets finds the processes which are sampled (all are sampled if nil), e.g., the process tree.
+	// The perf events sample all processes, and the BPF program filters them by target_pids map
+	// which is synced with the targets every processScanInterval.
+	targets func() (map[uint32]bool, error)
+	// cgroups are the target cgroups whose IDs are synced with target_cgroups map, see Config.Cgroups.
+	cgroups []string
+	// denylist are the processes which are never sampled, they're synced with denied_pids
+	// and denied_cgroups maps, see Config.Denylist.
+	denylist Denylist
+	// exe is the glob pattern of the target executables, see Config.Exe.
+	exe string
+	// execs adds the processes which exec the target executables to target_pids map
+	// without waiting for the next /proc scan.
+	execs *execWatcher
+	// traceMarker is the marker function reporting the trace context (nil if disabled),
+	// traceLink is its uprobe.
+	traceMarker *traceContextMarker
+	traceLink   link.Link
+
+	// mu guards the BPF objects, perf events and their settings
+	// since they can be changed while the profiler is running.
+	mu sync.Mutex
+	// events maps CPU numbers to the perf event file descriptors.
+	events map[int]int
+	// skipped are the online CPUs where the perf events couldn't be opened, see CPUCoverage.
+	skipped map[int]bool
+	// tasks maps the thread IDs to the perf event file descriptors with ClockTask.
+	tasks     map[uint32]int
+	frequency uint64
+	paused    bool
+	// flushErrors is the number of flushes in a row which failed.
+	flushErrors int
+	// mapStats are the peak fill of the buffers' maps, see MapStats.
+	mapStats MapStats
+	// restoreMaxStack is kernel.perf_event_max_stack sysctl to restore on close if it was raised.
+	restoreMaxStack int
+	// cpuGroups is the number of CPU groups sampled one at a time, and activeGroup is the one being sampled,
+	// see Config.CPUGroups.
+	cpuGroups   int
+	activeGroup int
+	cpuRotation time.Duration
+	// lbrPIDs are the processes whose user stacks are unwound with LBR, see Config.LBR.
+	lbrPIDs map[uint32]bool
+	// noFramePointers caches whether the executables omit frame pointers, see Config.LBR.
+	// It's used only by the unwinders watcher.
+	noFramePointers map[executableKey]bool
+	// overrides sample the processes at their own frequencies, see Config.FrequencyOverrides.
+	overrides []FrequencyOverride
+	// overridden maps the processes sampled at their own frequencies to the frequencies,
+	// and overrideTasks maps their thread IDs to the perf events.
+	overridden    map[uint32]uint64
+	overrideTasks map[uint32]overrideTask
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// maxSampleRatePath is the sysctl which limits the sampling frequency of the perf events.
+const maxSampleRatePath = "/proc/sys/kernel/perf_event_max_sample_rate"
+
+// validate checks the configuration, so the misconfigurations fail with clear errors
+// before the BPF program is loaded.
+func (c Config) validate() error {
+	var n int
+	for _, set := range []bool{c.SelfPID, c.PID > 0, c.Exe != "", c.SystemdUnit != ""} {
+		if set {
+			n++
+		}
+	}
+	if n > 1 {
+		return errors.New("only one of self, PID, executable, and systemd unit targets can be set")
+	}
+	if c.Tree && c.PID <= 0 {
+		return errors.New("process tree requires PID target")
+	}
+	if c.Interval < 0 || c.Align < 0 || c.TimeBucket < 0 || c.WalkDepth < 0 || c.StackDepth < 0 {
+		return errors.New("interval, alignment, time bucket, walk depth, and stack depth must not be negative")
+	}
+	if c.Align > 0 && c.Align < collectInterval {
+		return fmt.Errorf("alignment must be at least %s", collectInterval)
+	}
+	// The kernel would reject the perf events (the limit is lowered automatically if sampling takes too long).
+	if c.Mode != "" && c.Mode != ModeCPU {
+		return nil
+	}
+	if b, err := os.ReadFile(maxSampleRatePath); err == nil {
+		limit, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+		if err == nil && c.Frequency > limit {
+			return fmt.Errorf("frequency %d exceeds kernel.perf_event_max_sample_rate %d", c.Frequency, limit)
+		}
+	}
+	return nil
+}
+
+// NewProfiler loads the BPF program and starts sampling.
+// The caller is responsible for closing the profiler.
+func NewProfiler(c Config) (*Profiler, error) {
+	if err := c.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	// The privileges are checked upfront, since the kernel's EPERM doesn't tell what's missing.
+	if priv, err := ReadPrivileges(); err == nil {
+		if err = priv.Check(); err != nil {
+			return nil, err
+		}
+		for _, w := range priv.Warnings() {
+			log.Print(w)
+		}
+	}
+	p := Profiler{
+		objsOpts: ObjectsOptions{
+			UIDs:          c.UIDs,
+			TimeBucket:    c.TimeBucket,
+			WalkDepth:     c.WalkDepth,
+			BuildIDStacks: c.BuildIDStacks,
+			StackDepth:    c.StackDepth,
+		},
+		mode:      c.Mode,
+		pinDir:    c.PinDir,
+		cgroups:   c.Cgroups,
+		denylist:  c.Denylist,
+		events:    make(map[int]int),
+		skipped:   make(map[int]bool),
+		tasks:     make(map[uint32]int),
+		frequency: c.Frequency,
+		stop:      make(chan struct{}),
+	}
+	if p.frequency == 0 {
+		p.frequency = DefaultFrequency
+	}
+	if p.mode == "" {
+		p.mode = ModeCPU
+	}
+	if _, err := ParseMode(string(p.mode)); err != nil {
+		return nil, err
+	}
+	var err error
+	if p.clock, err = ParseClock(string(c.Clock)); err != nil {
+		return nil, err
+	}
+	// A perf event opened for a PID samples only that thread (unless inherited by new threads),
+	// and the tracepoints and kprobes fire for all processes anyway,
+	// so all processes are sampled and the BPF program drops the ones which aren't targeted.
+	// The targets can change without reattaching the perf events, e.g., when a worker is forked.
+	switch {
+	case c.SelfPID:
+		self := uint32(os.Getpid())
+		p.targets = func() (map[uint32]bool, error) { return map[uint32]bool{self: true}, nil }
+	case c.Exe != "":
+		if _, err := filepath.Match(c.Exe, ""); err != nil {
+			return nil, fmt.Errorf("invalid executable pattern %q: %w", c.Exe, err)
+		}
+		p.exe = c.Exe
+		p.targets = func() (map[uint32]bool, error) { return exeMatches(c.Exe) }
+	case c.SystemdUnit != "":
+		if _, err := systemdUnitCgroup(c.SystemdUnit); err != nil {
+			return nil, err
+		}
+		p.targets = func() (map[uint32]bool, error) { return systemdUnitPIDs(c.SystemdUnit) }
+	case c.PID > 0:
+		if _, err := parentPID(uint32(c.PID)); err != nil {
+			return nil, failure(FailureTargetNotFound, fmt.Errorf("process %d not found: %w", c.PID, err))
+		}
+		pid := uint32(c.PID)
+		p.targets = func() (map[uint32]bool, error) { return map[uint32]bool{pid: true}, nil }
+		if c.Tree {
+			p.targets = func() (map[uint32]bool, error) { return descendants(pid) }
+		}
+	}
+	p.objsOpts.FilterPIDs = p.targets != nil
+	if p.clock == ClockTask && (p.mode != ModeCPU || p.targets == nil) {
+		return nil, errors.New("task clock requires the CPU profiling mode and the target processes")
+	}
+	if c.Precise < 0 || c.Precise > maxPrecise {
+		return nil, fmt.Errorf("precise level must be between 0 and %d", maxPrecise)
+	}
+	if c.Precise > 0 && p.clock != ClockCycles {
+		return nil, errors.New("precise sampling requires the hardware events (cycles clock)")
+	}
+	p.precise = c.Precise
+	if c.IPC {
+		if p.clock != ClockCycles {
+			return nil, errors.New("IPC requires the hardware events (cycles clock)")
+		}
+		p.objsOpts.IPC = true
+		p.counters = make(map[int]int)
+	}
+	if c.CPUGroups < 0 {
+		return nil, errors.New("number of CPU groups must not be negative")
+	}
+	if c.CPUGroups > 1 {
+		if p.mode != ModeCPU || p.clock == ClockTask {
+			return nil, errors.New("CPU groups require the CPU profiling mode and the per-CPU clocks (cpu or cycles)")
+		}
+		p.cpuGroups = c.CPUGroups
+		p.cpuRotation = c.CPURotation
+		if p.cpuRotation <= 0 {
+			p.cpuRotation = DefaultCPURotation
+		}
+	}
+	if len(c.FrequencyOverrides) > 0 {
+		if p.mode != ModeCPU || p.clock == ClockTask {
+			return nil, errors.New("frequency overrides require the CPU profiling mode and the per-CPU clocks (cpu or cycles)")
+		}
+		if c.IPC {
+			return nil, errors.New("frequency overrides can't be combined with IPC")
+		}
+		for _, o := range c.FrequencyOverrides {
+			if err := o.validate(); err != nil {
+				return nil, err
+			}
+		}
+		p.overrides = c.FrequencyOverrides
+		p.overrideTasks = make(map[uint32]overrideTask)
+		p.objsOpts.FrequencyOverrides = true
+	}
+	if c.LBR {
+		if p.mode != ModeCPU || p.clock != ClockCycles {
+			return nil, errors.New("LBR requires the CPU profiling mode and the hardware events (cycles clock)")
+		}
+		p.objsOpts.LBR = true
+		p.lbrPIDs = make(map[uint32]bool)
+		p.noFramePointers = make(map[executableKey]bool)
+	}
+	if len(p.cgroups) > 0 {
+		if _, err := cgroup2Root(); err != nil {
+			return nil, fmt.Errorf("cgroups can't be targeted: %w", err)
+		}
+		p.objsOpts.FilterCgroups = true
+	}
+	p.objsOpts.DeniedComms = p.denylist.Comms
+	p.objsOpts.FilterDenied = p.denylist.scansProcesses()
+	if len(p.denylist.Cgroups) > 0 {
+		if _, err := cgroup2Root(); err != nil {
+			return nil, fmt.Errorf("cgroups can't be denied: %w", err)
+		}
+		p.objsOpts.FilterDeniedCgroups = true
+	}
+
+	if c.TraceContext != "" {
+		m, err := parseTraceContextMarker(c.TraceContext)
+		if err != nil {
+			return nil, err
+		}
+		p.traceMarker = m
+		p.objsOpts.TraceContext = true
+		p.objsOpts.TraceContextGoABI = m.goABI
+	}
+
+	// The kernel would refuse to create the stack maps deeper than the sysctl.
+	p.objsOpts.StackDepth, p.restoreMaxStack = fitMaxStack(p.StackDepth(), c.RaiseMaxStack)
+	if p.objs, err = LoadObjects(p.objsOpts); err != nil {
+		p.restoreSysctls()
+		return nil, err
+	}
+	if err = p.syncTargets(); err != nil {
+		p.Close()
+		return nil, err
+	}
+	if p.objsOpts.LBR {
+		if err = p.syncUnwinders(); err != nil {
+			p.Close()
+			return nil, err
+		}
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			p.watchUnwinders()
+		}()
+	}
+	if p.objsOpts.FrequencyOverrides {
+		if err = p.syncFrequencyOverrides(); err != nil {
+			p.Close()
+			return nil, err
+		}
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			p.watchFrequencyOverrides()
+		}()
+	}
+
+	if p.pinDir != "" {
+		if err = p.objs.Pin(p.pinDir); err != nil {
+			p.Close()
+			return nil, err
+		}
+		p.pinned = true
+	}
+
+	p.watchExecs()
+	if p.traceMarker != nil {
+		if p.traceLink, err = attachTraceContext(p.objs, p.traceMarker); err != nil {
+			p.Close()
+			return nil, err
+		}
+	}
+
+	if p.mode != ModeCPU {
+		if p.links, err = attachMode(p.objs, p.mode); err != nil {
+			p.Close()
+			return nil, err
+		}
+	} else if p.clock != ClockTask {
+		// The CPU clock and cycles events are opened per CPU, the task clock ones along with the targets.
+		cpus, err := onlineCPUs()
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		if err = p.openCPUEvents(cpus); err != nil {
+			p.Close()
+			return nil, err
+		}
+
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			p.watchCPUs()
+		}()
+		if p.cpuGroups > 1 {
+			p.wg.Add(1)
+			go func() {
+				defer p.wg.Done()
+				p.rotateCPUGroups()
+			}()
+		}
+	}
+	if p.objsOpts.FilterPIDs || p.objsOpts.FilterCgroups || p.objsOpts.FilterDenied || p.objsOpts.FilterDeniedCgroups {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			p.watchProcesses()
+		}()
+	}
+
+	return &p, nil
+}
+
+// watchExecs starts adding the processes which exec the target executables to target_pids map
+// and the denied processes to denied_pids map.
+// The processes are still found by /proc scans if the exec events are unavailable,
+// e.g., on old kernels.
+func (p *Profiler) watchExecs() {
+	if p.exe == "" && !p.objsOpts.FilterDenied {
+		return
+	}
+
+	// The watcher is closed before the objects are replaced on reload.
+	objs := p.objs
+	var err error
+	p.execs, err = watchExecs(objs, func(pid uint32) {
+		if p.objsOpts.FilterDenied && p.denylist.deniesProcess(pid) {
+			if err := objs.AddDeniedPID(pid); err != nil {
+				log.Print(err)
+			}
+			return
+		}
+		if p.exe == "" || !exeMatch(p.exe, pid) {
+			return
+		}
+		if err := objs.AddTargetPID(pid); err != nil {
+			log.Print(err)
+		}
+	})
+	if err != nil {
+		log.Printf("new processes will be found by /proc scans: %v", err)
+	}
+}
+
+// closeExecs stops watching the exec events.
+func (p *Profiler) closeExecs() error {
+	if p.execs == nil {
+		return nil
+	}
+	err := p.execs.Close()
+	p.execs = nil
+	return err
+}
+
+// closeTraceContext detaches the uprobe of the trace context marker.
+func (p *Profiler) closeTraceContext() error {
+	if p.traceLink == nil {
+		return nil
+	}
+	err := p.traceLink.Close()
+	p.traceLink = nil
+	return err
+}
+
+// openPerfEvent opens a perf event for the thread (-1 means all processes) on the given CPU (-1 means any)
+// at the profiler's frequency, see openSampleEvent.
+func (p *Profiler) openPerfEvent(tid, cpu int) (int, error) {
+	return p.openSampleEvent(tid, cpu, p.frequency, p.objs.Program())
+}
+
+// openSampleEvent opens a perf event for the thread on the CPU at the frequency, and attaches the BPF program to it.
+// The event is enabled unless the profiler is paused or the CPU isn't in the active group (see Config.CPUGroups).
+func (p *Profiler) openSampleEvent(tid, cpu int, frequency uint64, prog *ebpf.Program) (int, error) {
+	fd, err := p.perfEventOpen(tid, cpu, frequency)
+	if err != nil {
+		return -1, fmt.Errorf("failed to open the perf event: %w", err)
+	}
+
+	// Attach the BPF program to the perf event.
+	err = unix.IoctlSetInt(
+		fd,
+		unix.PERF_EVENT_IOC_SET_BPF,
+		// This BPF program file descriptor was created by a previous bpf(2) system call.
+		prog.FD(),
+	)
+	if err != nil {
+		unix.Close(fd)
+		return -1, fmt.Errorf("failed to attach BPF program to perf event: %w", err)
+	}
+	if p.objsOpts.IPC {
+		if err = p.openInstructionsCounter(fd, cpu); err != nil {
+			unix.Close(fd)
+			return -1, err
+		}
+	}
+
+	if p.paused || (cpu >= 0 && !p.sampledCPU(cpu)) {
+		return fd, nil
+	}
+	// PERF_EVENT_IOC_ENABLE enables the individual event or
+	// event group specified by the file descriptor argument.
+	if err = unix.IoctlSetInt(fd, unix.PERF_EVENT_IOC_ENABLE, 0); err != nil {
+		p.closeInstructionsCounter(fd)
+		unix.Close(fd)
+		return -1, fmt.Errorf("failed to enable the perf event: %w", err)
+	}
+
+	return fd, nil
+}
+
+// openInstructionsCounter opens the instructions counter on the CPU as a member of the group
+// led by the cycles event, and passes it to the BPF program, see Config.IPC.
+// The member is scheduled on the PMU along with the leader, so it counts only while the leader is enabled.
+func (p *Profiler) openInstructionsCounter(leader, cpu int) error {
+	attr := unix.PerfEventAttr{
+		Type:   unix.PERF_TYPE_HARDWARE,
+		Config: unix.PERF_COUNT_HW_INSTRUCTIONS,
+		Size:   uint32(unsafe.Sizeof(unix.PerfEventAttr{})),
+	}
+	fd, err := unix.PerfEventOpen(&attr, -1, cpu, leader, unix.PERF_FLAG_FD_CLOEXEC)
+	if err != nil {
+		return fmt.Errorf("failed to open the instructions counter: %w", err)
+	}
+	if err = p.objs.SetInstructionsCounter(cpu, fd); err != nil {
+		unix.Close(fd)
+		return err
+	}
+	p.counters[leader] = fd
+	return nil
+}
+
+// closeInstructionsCounter closes the instructions counter of the group led by the event if there is one.
+func (p *Profiler) closeInstructionsCounter(leader int) error {
+	fd, ok := p.counters[leader]
+	if !ok {
+		return nil
+	}
+	delete(p.counters, leader)
+	if err := unix.Close(fd); err != nil {
+		return fmt.Errorf("failed to close the instructions counter: %w", err)
+	}
+	return nil
+}
+
+// perfEventOpen opens the perf event of the profiler's clock for the thread on the CPU at the frequency,
+// see openSampleEvent.
+// The hardware events are retried with the lower precise levels if the PMU rejects the current one,
+// and the accepted level is kept for the events opened later.
+func (p *Profiler) perfEventOpen(tid, cpu int, frequency uint64) (int, error) {
+	// PERF_TYPE_SOFTWARE event type indicates that
+	// we are measuring software events provided by the kernel:
+	// PERF_COUNT_SW_CPU_CLOCK reports the CPU clock, a high-resolution per-CPU timer,
+	// PERF_COUNT_SW_TASK_CLOCK reports the clock which only advances while the thread runs.
+	// PERF_TYPE_HARDWARE event type counts the CPU cycles by the PMU.
+	typ, config := uint32(unix.PERF_TYPE_SOFTWARE), uint64(unix.PERF_COUNT_SW_CPU_CLOCK)
+	switch p.clock {
+	case ClockTask:
+		config = unix.PERF_COUNT_SW_TASK_CLOCK
+	case ClockCycles:
+		typ, config = unix.PERF_TYPE_HARDWARE, unix.PERF_COUNT_HW_CPU_CYCLES
+	}
+	attr := unix.PerfEventAttr{
+		Type: typ,
+		// Config is a Type-specific configuration, i.e., the clock.
+		Config: config,
+		// Size of attribute structure for forward/backward compatibility.
+		Size: uint32(unsafe.Sizeof(unix.PerfEventAttr{})),
+		// Sample could mean sampling period (expressed as the number of occurrences of an event)
+		// or frequency (the average rate of samples per second).
+		// See https://perf.wiki.kernel.org/index.php/Tutorial#Period_and_rate.
+		// In order to use frequency PerfBitFreq flag is set below.
+		// The kernel will adjust the sampling period to try and achieve the desired rate.
+		Sample: frequency,
+		Bits:   unix.PerfBitDisabled | unix.PerfBitFreq,
+	}
+	if p.objsOpts.LBR {
+		// The branch stack of the sample is the LBR call stack of the user space,
+		// i.e., the call instructions whose functions haven't returned yet, see Config.LBR.
+		attr.Sample_type = unix.PERF_SAMPLE_BRANCH_STACK
+		attr.Branch_sample_type = unix.PERF_SAMPLE_BRANCH_USER | unix.PERF_SAMPLE_BRANCH_CALL_STACK
+	}
+
+	for {
+		attr.Bits |= preciseBits(p.precise)
+		fd, err := unix.PerfEventOpen(
+			&attr,
+			// The CPU clock events sample all processes, see Profiler.targets.
+			tid,
+			cpu,
+			// groupFd argument allows event groups to be created.
+			// A single event on its own is created with groupFd = -1
+			// and is considered to be a group with only 1 member.
+			-1,
+			// PERF_FLAG_FD_CLOEXEC flag enables the close-on-exec flag for the created
+			// event file descriptor, so that the file descriptor is
+			// automatically closed on execve(2).
+			unix.PERF_FLAG_FD_CLOEXEC,
+		)
+		if p.precise == 0 || !(errors.Is(err, unix.EINVAL) || errors.Is(err, unix.EOPNOTSUPP)) {
+			return fd, err
+		}
+		attr.Bits &^= preciseBits(p.precise)
+		p.precise--
+		log.Printf("PMU rejected precise level %d, falling back to %d", p.precise+1, p.precise)
+	}
+}
+
+// preciseBits returns the precise_ip bits of the perf event attribute for the precise level.
+func preciseBits(level int) uint64 {
+	var bits uint64
+	if level&1 != 0 {
+		bits |= unix.PerfBitPreciseIPBit1
+	}
+	if level&2 != 0 {
+		bits |= unix.PerfBitPreciseIPBit2
+	}
+	return bits
+}
+
+// closePerfEvent disables and closes the perf event along with the members of its group.
+func (p *Profiler) closePerfEvent(fd int) error {
+	// PERF_EVENT_IOC_DISABLE disables the individual counter or
+	// event group specified by the file descriptor argument.
+	if err := unix.IoctlSetInt(fd, unix.PERF_EVENT_IOC_DISABLE, 0); err != nil {
+		p.closeInstructionsCounter(fd)
+		unix.Close(fd)
+		return fmt.Errorf("failed to disable the perf event: %w", err)
+	}
+	if err := p.closeInstructionsCounter(fd); err != nil {
+		unix.Close(fd)
+		return err
+	}
+	if err := unix.Close(fd); err != nil {
+		return fmt.Errorf("failed to close the perf event: %w", err)
+	}
+
+	return nil
+}
+
+// watchCPUs periodically checks the online CPUs until the profiler is closed.
+// The perf events are opened on the CPUs which went online
+// and closed on the ones which went offline.
+func (p *Profiler) watchCPUs() {
+	ticker := time.NewTicker(cpuHotplugInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			if err := p.syncCPUs(); err != nil {
+				log.Printf("failed to handle CPU hotplug: %v", err)
+			}
+		}
+	}
+}
+
+// watchProcesses periodically looks for the target and denied processes until the profiler is closed,
+// so the new ones are sampled (or never sampled), e.g., the forked workers.
+func (p *Profiler) watchProcesses() {
+	ticker := time.NewTicker(processScanInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			// The targets are looked up without holding the mutex since it might take a while.
+			deniedPIDs, deniedCgroups, err := p.findDenied()
+			if err != nil {
+				log.Print(err)
+				continue
+			}
+			pids, cgroups, err := p.findTargets()
+			if err != nil {
+				log.Print(err)
+				continue
+			}
+			p.mu.Lock()
+			// The denied processes are written first, so they're never sampled in between.
+			if err = p.setDenied(deniedPIDs, deniedCgroups); err == nil {
+				err = p.setTargets(pids, cgroups)
+			}
+			p.mu.Unlock()
+			if err != nil {
+				log.Print(err)
+			}
+		}
+	}
+}
+
+// syncTargets finds the target processes and cgroups and writes them to target_pids and target_cgroups maps,
+// so the BPF program samples the new processes and forgets the exited ones.
+// The denied processes and cgroups are written to denied_pids and denied_cgroups maps likewise.
+// The caller must hold the mutex once the profiler is running.
+func (p *Profiler) syncTargets() error {
+	deniedPIDs, deniedCgroups, err := p.findDenied()
+	if err != nil {
+		return err
+	}
+	if err = p.setDenied(deniedPIDs, deniedCgroups); err != nil {
+		return err
+	}
+	pids, cgroups, err := p.findTargets()
+	if err != nil {
+		return err
+	}
+	return p.setTargets(pids, cgroups)
+}
+
+// findTargets returns the target processes and cgroup IDs,
+// they are nil if the processes aren't filtered by them.
+// The denied processes are never targeted, e.g., they don't get the task clock perf events.
+func (p *Profiler) findTargets() (pids map[uint32]bool, cgroups map[uint64]bool, err error) {
+	if p.targets != nil {
+		if pids, err = p.targets(); err != nil {
+			return nil, nil, fmt.Errorf("failed to find target processes: %w", err)
+		}
+		if !p.denylist.empty() {
+			for pid := range pids {
+				if p.denylist.Denies(pid) {
+					delete(pids, pid)
+				}
+			}
+		}
+	}
+	if len(p.cgroups) > 0 {
+		if cgroups, err = cgroupIDs(p.cgroups); err != nil {
+			return nil, nil, fmt.Errorf("failed to find target cgroups: %w", err)
+		}
+	}
+	return pids, cgroups, nil
+}
+
+// setTargets writes the targets found by findTargets to the BPF maps.
+// The caller must hold the mutex once the profiler is running.
+func (p *Profiler) setTargets(pids map[uint32]bool, cgroups map[uint64]bool) error {
+	if p.clock == ClockTask {
+		if err := p.syncTasks(pids); err != nil {
+			return err
+		}
+	}
+	if p.objsOpts.FilterPIDs {
+		if err := p.objs.SetTargetPIDs(pids); err != nil {
+			return err
+		}
+	}
+	if p.objsOpts.FilterCgroups {
+		return p.objs.SetTargetCgroups(cgroups)
+	}
+	return nil
+}
+
+// findDenied returns the denied processes and cgroup IDs,
+// they are nil if the processes aren't denied by them.
+func (p *Profiler) findDenied() (pids map[uint32]bool, cgroups map[uint64]bool, err error) {
+	if p.objsOpts.FilterDenied {
+		if pids, err = p.denylist.deniedPIDs(); err != nil {
+			return nil, nil, fmt.Errorf("failed to find denied processes: %w", err)
+		}
+	}
+	if p.objsOpts.FilterDeniedCgroups {
+		if cgroups, err = cgroupIDs(p.denylist.Cgroups); err != nil {
+			return nil, nil, fmt.Errorf("failed to find denied cgroups: %w", err)
+		}
+	}
+	return pids, cgroups, nil
+}
+
+// setDenied writes the denied processes and cgroups found by findDenied to the BPF maps.
+// The caller must hold the mutex once the profiler is running.
+func (p *Profiler) setDenied(pids map[uint32]bool, cgroups map[uint64]bool) error {
+	if p.objsOpts.FilterDenied {
+		if err := p.objs.SetDeniedPIDs(pids); err != nil {
+			return err
+		}
+	}
+	if p.objsOpts.FilterDeniedCgroups {
+		return p.objs.SetDeniedCgroups(cgroups)
+	}
+	return nil
+}
+
+// syncTasks makes sure there is a task clock perf event per thread of the target processes
+// and closes the events of the threads which have exited.
+// The caller must hold the mutex once the profiler is running.
+func (p *Profiler) syncTasks(pids map[uint32]bool) error {
+	alive := make(map[uint32]bool)
+	for pid := range pids {
+		// The process might have exited.
+		tids, err := listThreads(pid)
+		if err != nil {
+			continue
+		}
+		for _, tid := range tids {
+			alive[tid] = true
+			if _, ok := p.tasks[tid]; ok {
+				continue
+			}
+
+			fd, err := p.openPerfEvent(int(tid), -1)
+			// The thread might have exited.
+			if errors.Is(err, unix.ESRCH) {
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("thread %d: %w", tid, err)
+			}
+			p.tasks[tid] = fd
+		}
+	}
+
+	for tid, fd := range p.tasks {
+		if alive[tid] {
+			continue
+		}
+
+		delete(p.tasks, tid)
+		if err := p.closePerfEvent(fd); err != nil {
+			return fmt.Errorf("thread %d: %w", tid, err)
+		}
+	}
+
+	return nil
+}
+
+// openCPUEvents opens the perf events on the CPUs.
+// The CPUs where they can't be opened, e.g., due to cgroup or CPU affinity restrictions,
+// are skipped and logged (see CPUCoverage), and the CPU hotplug watcher retries them.
+// It only fails if none of the CPUs can be sampled.
+// The caller must hold the mutex once the profiler is running.
+func (p *Profiler) openCPUEvents(cpus []int) error {
+	var lastErr error
+	for _, cpu := range cpus {
+		fd, err := p.openPerfEvent(-1, cpu)
+		if err != nil {
+			if !p.skipped[cpu] {
+				log.Printf("cpu %d skipped: %v", cpu, err)
+				p.skipped[cpu] = true
+			}
+			lastErr = err
+			continue
+		}
+		delete(p.skipped, cpu)
+		p.events[cpu] = fd
+	}
+
+	if len(p.events) == 0 && lastErr != nil {
+		return fmt.Errorf("no CPU can be sampled: %w", lastErr)
+	}
+	return nil
+}
+
+// CPUCoverage returns the online CPUs which are sampled and the ones which were skipped
+// since the perf events couldn't be opened on them.
+// The coverage is empty with the task clock since the events are opened per thread.
+func (p *Profiler) CPUCoverage() CPUCoverage {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var c CPUCoverage
+	for cpu := range p.events {
+		c.Sampled = append(c.Sampled, cpu)
+	}
+	for cpu := range p.skipped {
+		c.Skipped = append(c.Skipped, cpu)
+	}
+	sort.Ints(c.Sampled)
+	sort.Ints(c.Skipped)
+	c.Groups = p.cpuGroups
+	return c
+}
+
+// sampledCPU reports whether the CPU is in the active group, i.e., its perf event should be enabled,
+// see Config.CPUGroups.
+func (p *Profiler) sampledCPU(cpu int) bool {
+	return p.cpuGroups <= 1 || cpu%p.cpuGroups == p.activeGroup
+}
+
+// cpuGroupEvents returns the perf events of the CPUs in the group.
+func (p *Profiler) cpuGroupEvents(group int) []int {
+	var fds []int
+	for cpu, fd := range p.events {
+		if cpu%p.cpuGroups == group {
+			fds = append(fds, fd)
+		}
+	}
+	return fds
+}
+
+// rotateCPUGroups samples the next CPU group every CPURotation until the profiler is closed,
+// see Config.CPUGroups.
+func (p *Profiler) rotateCPUGroups() {
+	ticker := time.NewTicker(p.cpuRotation)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			if err := p.nextCPUGroup(); err != nil {
+				log.Printf("failed to rotate the CPU groups: %v", err)
+			}
+		}
+	}
+}
+
+// nextCPUGroup enables the perf events of the next CPU group which has any, and disables the current group's ones.
+// The next group is enabled first, so there is no gap in sampling.
+// The current group is kept if the next one can't be enabled.
+func (p *Profiler) nextCPUGroup() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	next := p.activeGroup
+	var fds []int
+	for i := 0; i < p.cpuGroups && len(fds) == 0; i++ {
+		next = (next + 1) % p.cpuGroups
+		fds = p.cpuGroupEvents(next)
+	}
+	if next == p.activeGroup {
+		return nil
+	}
+	if p.paused {
+		p.activeGroup = next
+		return nil
+	}
+
+	err := applyEvents(fds,
+		func(fd int) error { return unix.IoctlSetInt(fd, unix.PERF_EVENT_IOC_ENABLE, 0) },
+		func(fd int) error { return unix.IoctlSetInt(fd, unix.PERF_EVENT_IOC_DISABLE, 0) },
+	)
+	if err != nil {
+		return fmt.Errorf("failed to enable the perf events of CPU group %d: %w", next, err)
+	}
+	prev := p.activeGroup
+	p.activeGroup = next
+	for _, fd := range p.cpuGroupEvents(prev) {
+		if err = unix.IoctlSetInt(fd, unix.PERF_EVENT_IOC_DISABLE, 0); err != nil {
+			return fmt.Errorf("failed to disable the perf events of CPU group %d: %w", prev, err)
+		}
+	}
+	return nil
+}
+
+// syncCPUs makes sure there is a perf event per online CPU.
+func (p *Profiler) syncCPUs() error {
+	cpus, err := onlineCPUs()
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	online := make(map[int]bool, len(cpus))
+	for _, cpu := range cpus {
+		online[cpu] = true
+		if _, ok := p.events[cpu]; ok {
+			continue
+		}
+
+		fd, err := p.openPerfEvent(-1, cpu)
+		// The CPU which can't be sampled is retried quietly.
+		if err != nil {
+			if !p.skipped[cpu] {
+				log.Printf("cpu %d went online but can't be sampled: %v", cpu, err)
+				p.skipped[cpu] = true
+			}
+			continue
+		}
+		p.events[cpu] = fd
+		if p.skipped[cpu] {
+			delete(p.skipped, cpu)
+			log.Printf("cpu %d can be sampled now", cpu)
+		} else {
+			log.Printf("cpu %d went online, started sampling it", cpu)
+		}
+	}
+	for cpu := range p.skipped {
+		if !online[cpu] {
+			delete(p.skipped, cpu)
+		}
+	}
+
+	for cpu, fd := range p.events {
+		if online[cpu] {
+			continue
+		}
+
+		delete(p.events, cpu)
+		if err := p.closePerfEvent(fd); err != nil {
+			return fmt.Errorf("cpu %d: %w", cpu, err)
+		}
+		log.Printf("cpu %d went offline, stopped sampling it", cpu)
+	}
+
+	return nil
+}
+
+// CPUs returns the CPUs being sampled.
+func (p *Profiler) CPUs() []int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	cpus := make([]int, 0, len(p.events))
+	for cpu := range p.events {
+		cpus = append(cpus, cpu)
+	}
+	sort.Ints(cpus)
+	return cpus
+}
+
+// Flush returns the samples collected since the previous flush, see Objects.Flush.
+// When the BPF maps can't be read maxFlushErrors times in a row,
+// e.g., due to file descriptor exhaustion, the BPF objects are reloaded
+// instead of producing empty profiles from now on.
+// The samples which weren't flushed are lost in that case.
+func (p *Profiler) Flush() ([]Sample, error) {
+	p.mu.Lock()
+	samples, err := p.objs.Flush()
+	if err != nil {
+		p.flushErrors++
+		if p.flushErrors >= maxFlushErrors {
+			log.Printf("failed to flush samples %d times in a row, reloading BPF objects: %v", p.flushErrors, err)
+			if reloadErr := p.reload(); reloadErr != nil {
+				log.Printf("failed to reload BPF objects: %v", reloadErr)
+			} else {
+				log.Print("reloaded BPF objects, profiling resumed")
+				p.flushErrors = 0
+			}
+		}
+		p.mu.Unlock()
+		return nil, err
+	}
+	p.flushErrors = 0
+	p.mapStats.observe(samples)
+	objs := p.objs
+	// The samples taken by the perf events of the threads sampled at their own frequencies are weighted by them,
+	// the other samples of the same processes were taken by the per-CPU events before the threads were found.
+	for i := range samples {
+		if !samples[i].overridden {
+			continue
+		}
+		if hz, ok := p.overridden[samples[i].PID]; ok {
+			samples[i].Frequency = hz
+		}
+	}
+	p.mu.Unlock()
+
+	// The samples taken before the denied processes were found are dropped,
+	// e.g., a denied executable was sampled before its exec event was handled.
+	if !p.denylist.empty() {
+		denied := make(map[uint32]bool)
+		kept := samples[:0]
+		for _, s := range samples {
+			d, ok := denied[s.PID]
+			if !ok {
+				d = objs.DeniedPID(s.PID) || p.denylist.Denies(s.PID)
+				denied[s.PID] = d
+			}
+			if !d {
+				kept = append(kept, s)
+			}
+		}
+		samples = kept
+	}
+
+	if bucket := p.objsOpts.TimeBucket; bucket > 0 {
+		boot, err := bootTime()
+		if err != nil {
+			return nil, err
+		}
+		for i := range samples {
+			samples[i].Time = boot.Add(time.Duration(samples[i].TimeBucket) * bucket)
+		}
+	}
+
+	return samples, nil
+}
+
+// bootTime returns the wall clock time of the boot according to CLOCK_MONOTONIC,
+// the clock of bpf_ktime_get_ns().
+// It's computed on every call since the wall clock might be adjusted.
+func bootTime() (time.Time, error) {
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts); err != nil {
+		return time.Time{}, fmt.Errorf("failed to read monotonic clock: %w", err)
+	}
+	return time.Now().Add(-time.Duration(ts.Nano())), nil
+}
+
+// reload replaces the BPF program and maps with the freshly loaded ones
+// and attaches the new program to perf events on the online CPUs.
+// The current objects are kept if the new ones can't be loaded,
+// so the reload can be retried later.
+// The caller must hold the mutex.
+func (p *Profiler) reload() error {
+	objs, err := LoadObjects(p.objsOpts)
+	if err != nil {
+		return err
+	}
+
+	for cpu, fd := range p.events {
+		if err = p.closePerfEvent(fd); err != nil {
+			log.Printf("cpu %d: %v", cpu, err)
+		}
+		delete(p.events, cpu)
+	}
+	for tid, fd := range p.tasks {
+		if err = p.closePerfEvent(fd); err != nil {
+			log.Printf("thread %d: %v", tid, err)
+		}
+		delete(p.tasks, tid)
+	}
+	if err = p.closeOverrideTasks(); err != nil {
+		log.Print(err)
+	}
+	if err = p.closeExecs(); err != nil {
+		log.Print(err)
+	}
+	if err = p.closeTraceContext(); err != nil {
+		log.Print(err)
+	}
+	if err = closeLinks(p.links); err != nil {
+		log.Print(err)
+	}
+	p.links = nil
+	if p.pinned {
+		if err = p.objs.Unpin(); err != nil {
+			log.Print(err)
+		}
+		p.pinned = false
+	}
+	if err = p.objs.Close(); err != nil {
+		log.Print(err)
+	}
+	p.objs = objs
+	if err = p.syncTargets(); err != nil {
+		return err
+	}
+	// The new process_unwinders and overridden_tids maps are empty.
+	if p.objsOpts.LBR {
+		lbr := p.lbrPIDs
+		p.lbrPIDs = make(map[uint32]bool)
+		if err = p.setUnwinders(lbr); err != nil {
+			return err
+		}
+	}
+	if p.objsOpts.FrequencyOverrides {
+		if err = p.setOverridden(p.overridden); err != nil {
+			return err
+		}
+	}
+	p.watchExecs()
+	if p.traceMarker != nil {
+		if p.traceLink, err = attachTraceContext(p.objs, p.traceMarker); err != nil {
+			return err
+		}
+	}
+
+	if p.pinDir != "" {
+		if err = p.objs.Pin(p.pinDir); err != nil {
+			return err
+		}
+		p.pinned = true
+	}
+	if p.mode != ModeCPU {
+		p.links, err = attachMode(p.objs, p.mode)
+		return err
+	}
+	// The task clock events were opened along with the targets.
+	if p.clock == ClockTask {
+		return nil
+	}
+	// The CPUs which fail here are retried by the CPU hotplug watcher.
+	cpus, err := onlineCPUs()
+	if err != nil {
+		return err
+	}
+	return p.openCPUEvents(cpus)
+}
+
+// errNotCPUMode is returned when the perf events are controlled in the modes other than ModeCPU.
+var errNotCPUMode = errors.New("only the CPU profiling mode is sampled by perf events")
+
+// Mode returns what the profiler attributes to the stacks.
+func (p *Profiler) Mode() Mode {
+	return p.mode
+}
+
+// CPUUtilization returns the busy and idle samples of each CPU since the profiler started
+// (or since the BPF objects were reloaded).
+// It's only reported when all the processes are profiled, i.e., in ModeCPU with the CPU clock and no targets.
+func (p *Profiler) CPUUtilization() ([]CPUUtilization, error) {
+	if p.mode != ModeCPU || p.clock != ClockCPU || p.objsOpts.FilterPIDs || p.objsOpts.FilterCgroups {
+		return nil, errors.New("CPU utilization is only known when all processes are sampled")
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.objs.CPUUtilization()
+}
+
+// MapStats returns how full the maps of the buffers got between the flushes since the profiler started.
+func (p *Profiler) MapStats() MapStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ms := p.mapStats
+	b := p.objs.buffers[0]
+	ms.CountsCapacity = int(b.Counts.MaxEntries())
+	ms.StackTracesCapacity = int(b.StackTraces.MaxEntries())
+	return ms
+}
+
+// Frequency returns the current sampling rate (samples per second).
+func (p *Profiler) Frequency() uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.frequency
+}
+
+// SetFrequency changes the sampling rate (samples per second) of the running profiler,
+// e.g., it can be raised temporarily during an incident.
+// The kernel rejects frequencies above kernel.perf_event_max_sample_rate sysctl.
+func (p *Profiler) SetFrequency(frequency uint64) error {
+	if frequency == 0 {
+		return errors.New("frequency must be positive")
+	}
+	if p.mode != ModeCPU {
+		return errNotCPUMode
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// PERF_EVENT_IOC_PERIOD updates the overflow period.
+	// Since the events were opened in frequency mode,
+	// the argument is interpreted as the new sampling frequency.
+	// The previous frequency is restored on the events which were already updated
+	// in case of a failure, so all the CPUs are sampled at the same rate.
+	// The processes sampled at their own frequencies keep them, see Config.FrequencyOverrides.
+	err := applyEvents(p.eventFDs(),
+		func(fd int) error { return ioctlPerfPeriod(fd, frequency) },
+		func(fd int) error { return ioctlPerfPeriod(fd, p.frequency) },
+	)
+	if err != nil {
+		return fmt.Errorf("failed to set frequency %d: %w", frequency, err)
+	}
+	p.frequency = frequency
+
+	return nil
+}
+
+// ioctlPerfPeriod sets a new period (or frequency) of the perf event.
+// Note, the ioctl argument is a pointer to a 64-bit value.
+func ioctlPerfPeriod(fd int, period uint64) error {
+	_, _, errno := unix.Syscall(
+		unix.SYS_IOCTL,
+		uintptr(fd),
+		unix.PERF_EVENT_IOC_PERIOD,
+		uintptr(unsafe.Pointer(&period)),
+	)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// Pause stops sampling without releasing the BPF program and maps,
+// e.g., to suspend profiling during a sensitive time window.
+// The samples collected so far can still be flushed.
+func (p *Profiler) Pause() error {
+	if p.mode != ModeCPU {
+		return errNotCPUMode
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.paused {
+		return nil
+	}
+	// Only the events which were sampling are enabled again if some can't be disabled,
+	// i.e., the inactive CPU groups stay disabled, see Config.CPUGroups.
+	active := make(map[int]bool)
+	for _, fd := range p.activeEventFDs() {
+		active[fd] = true
+	}
+	// PERF_EVENT_IOC_DISABLE disables the individual counter or
+	// event group specified by the file descriptor argument.
+	err := p.forEachEvent(
+		func(fd int) error { return unix.IoctlSetInt(fd, unix.PERF_EVENT_IOC_DISABLE, 0) },
+		func(fd int) error {
+			if !active[fd] {
+				return nil
+			}
+			return unix.IoctlSetInt(fd, unix.PERF_EVENT_IOC_ENABLE, 0)
+		},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to disable the perf events: %w", err)
+	}
+	p.paused = true
+
+	return nil
+}
+
+// Resume restarts sampling paused by Pause.
+func (p *Profiler) Resume() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.paused {
+		return nil
+	}
+	err := applyEvents(p.activeEventFDs(),
+		func(fd int) error { return unix.IoctlSetInt(fd, unix.PERF_EVENT_IOC_ENABLE, 0) },
+		func(fd int) error { return unix.IoctlSetInt(fd, unix.PERF_EVENT_IOC_DISABLE, 0) },
+	)
+	if err != nil {
+		return fmt.Errorf("failed to enable the perf events: %w", err)
+	}
+	p.paused = false
+
+	return nil
+}
+
+// Paused reports whether sampling is paused.
+func (p *Profiler) Paused() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.paused
+}
+
+// forEachEvent applies fn to all the perf events (per CPU or per thread).
+// In case of a failure, undo is applied to the events which were already changed,
+// so they all stay in the same state.
+func (p *Profiler) forEachEvent(fn, undo func(fd int) error) error {
+	return applyEvents(append(p.eventFDs(), p.overrideEventFDs()...), fn, undo)
+}
+
+// activeEventFDs returns the perf events which sample unless paused:
+// the ones of the active CPU group (see Config.CPUGroups) and of the threads sampled at their own frequencies.
+func (p *Profiler) activeEventFDs() []int {
+	fds := p.eventFDs()
+	if p.cpuGroups > 1 {
+		fds = p.cpuGroupEvents(p.activeGroup)
+	}
+	return append(fds, p.overrideEventFDs()...)
+}
+
+// eventFDs returns the perf events sampling at the profiler's frequency (per CPU or per thread).
+func (p *Profiler) eventFDs() []int {
+	fds := make([]int, 0, len(p.events)+len(p.tasks))
+	for _, fd := range p.events {
+		fds = append(fds, fd)
+	}
+	for _, fd := range p.tasks {
+		fds = append(fds, fd)
+	}
+	return fds
+}
+
+// applyEvents applies fn to the perf events.
+// In case of a failure, undo is applied to the events which were already changed.
+func applyEvents(fds []int, fn, undo func(fd int) error) error {
+	var done []int
+	for _, fd := range fds {
+		if err := fn(fd); err != nil {
+			for _, prevFD := range done {
+				undo(prevFD)
+			}
+			return err
+		}
+		done = append(done, fd)
+	}
+
+	return nil
+}
+
+// Close stops sampling and releases the BPF program and maps.
+func (p *Profiler) Close() error {
+	close(p.stop)
+	p.wg.Wait()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var firstErr error
+	keepErr := func(err error) {
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	for cpu, fd := range p.events {
+		keepErr(p.closePerfEvent(fd))
+		delete(p.events, cpu)
+	}
+	for tid, fd := range p.tasks {
+		keepErr(p.closePerfEvent(fd))
+		delete(p.tasks, tid)
+	}
+	keepErr(p.closeOverrideTasks())
+	keepErr(p.closeExecs())
+	keepErr(p.closeTraceContext())
+	keepErr(closeLinks(p.links))
+	p.links = nil
+
+	if p.pinned {
+		keepErr(p.objs.Unpin())
+	}
+	keepErr(p.objs.Close())
+	p.restoreSysctls()
+
+	return firstErr
+}
+
+// StackDepth returns the max depth of the collected stacks,
+// i.e., Config.StackDepth unless it's lowered to kernel.perf_event_max_stack sysctl.
+func (p *Profiler) StackDepth() int {
+	if p.objsOpts.StackDepth == 0 {
+		return DefaultStackDepth
+	}
+	return p.objsOpts.StackDepth
+}
+
+// restoreSysctls restores the sysctls raised by the profiler, see Config.RaiseMaxStack.
+func (p *Profiler) restoreSysctls() {
+	if p.restoreMaxStack == 0 {
+		return
+	}
+	if err := writeMaxStack(p.restoreMaxStack); err != nil {
+		log.Printf("failed to restore kernel.perf_event_max_stack to %d: %v", p.restoreMaxStack, err)
+	}
+	p.restoreMaxStack = 0
+}
@@ -0,0 +1,262 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/google/pprof/profile"
+)
+
+// remoteWriteMetric is the name of the time series pushed by RemoteWriter.
+const remoteWriteMetric = "parca_agent_function_cpu_seconds"
+
+// RemoteWriter pushes the CPU time of the hottest functions of each profile
+// as time series to a Prometheus remote write endpoint, e.g.,
+// parca_agent_function_cpu_seconds{function="main.work", pid="1234", comm="app", container="..."} 2.5.
+// That gives a lightweight "continuous top" without a profiling backend.
+// It's a Sink, the labels are added to each series, e.g., env="prod".
+type RemoteWriter struct {
+	url    string
+	top    int
+	client *http.Client
+	// sampleLabels are the names of the sample labels copied to the series, see SetSampleLabels.
+	sampleLabels []string
+}
+
+// NewRemoteWriter returns a writer which pushes the top functions of each profile
+// (by flat CPU time per process) to the remote write URL,
+// e.g., http://prometheus:9090/api/v1/write.
+func NewRemoteWriter(url string, top int) *RemoteWriter {
+	return &RemoteWriter{
+		url:    url,
+		top:    top,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// SetSampleLabels makes the writer copy the sample labels with the names to the series of their processes,
+// e.g., the per-target labels of TargetLabelProvider. They take precedence over the labels passed to Write.
+func (w *RemoteWriter) SetSampleLabels(names ...string) {
+	w.sampleLabels = names
+}
+
+// functionCPU is the flat CPU time of the function in the process.
+type functionCPU struct {
+	function string
+	pid      int64
+	comm     string
+	// labels are the sample labels of the process, see RemoteWriter.SetSampleLabels.
+	labels  Labels
+	seconds float64
+}
+
+// Write converts the profile into time series and pushes them.
+// The samples are stamped with the end of the profile.
+// The profile must be symbolized, the locations without functions are ignored.
+// The profile is decoded to find the top functions.
+func (w *RemoteWriter) Write(ctx context.Context, ep *EncodedProfile, extra Labels) error {
+	ts := ep.Start.Add(ep.Duration).UnixNano() / int64(time.Millisecond)
+	if ep.Start.IsZero() {
+		ts = time.Now().UnixNano() / int64(time.Millisecond)
+	}
+	p, err := ep.Parse()
+	if err != nil {
+		return fmt.Errorf("failed to decode profile: %w", err)
+	}
+
+	var series [][]byte
+	for _, fc := range topFunctions(p, w.top, w.sampleLabels) {
+		labels := [][2]string{
+			{"__name__", remoteWriteMetric},
+			{"function", fc.function},
+			{"pid", strconv.FormatInt(fc.pid, 10)},
+		}
+		if fc.comm != "" {
+			labels = append(labels, [2]string{"comm", fc.comm})
+		}
+		if id := containerID(uint32(fc.pid)); id != "" {
+			labels = append(labels, [2]string{"container", id})
+		}
+		for name, value := range extra {
+			if _, ok := fc.labels[name]; !ok {
+				labels = append(labels, [2]string{name, value})
+			}
+		}
+		for name, value := range fc.labels {
+			labels = append(labels, [2]string{name, value})
+		}
+		series = append(series, encodeTimeSeries(labels, fc.seconds, ts))
+	}
+	if len(series) == 0 {
+		return nil
+	}
+
+	var req []byte
+	for _, s := range series {
+		// WriteRequest.timeseries = 1.
+		req = appendBytesField(req, 1, s)
+	}
+	body := snappyEncode(req)
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create remote write request: %w", err)
+	}
+	r.Header.Set("Content-Encoding", "snappy")
+	r.Header.Set("Content-Type", "application/x-protobuf")
+	r.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	resp, err := w.client.Do(r)
+	if err != nil {
+		return failure(FailureUploadFailed, fmt.Errorf("failed to push time series: %w", err))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return failure(FailureUploadFailed, fmt.Errorf("remote write failed with %s: %s", resp.Status, bytes.TrimSpace(msg)))
+	}
+	return nil
+}
+
+// topFunctions returns the functions with the most flat CPU time per process, the hottest first.
+// The CPU time is taken from the cpu/nanoseconds sample value.
+// The sample labels with the given names are kept along with the functions.
+func topFunctions(p *profile.Profile, top int, labelNames []string) []functionCPU {
+	valueIdx := -1
+	for i, st := range p.SampleType {
+		if st.Type == "cpu" && st.Unit == "nanoseconds" {
+			valueIdx = i
+		}
+	}
+	if valueIdx < 0 {
+		return nil
+	}
+
+	type funcKey struct {
+		function string
+		pid      int64
+	}
+	byFunc := make(map[funcKey]*functionCPU)
+	for _, s := range p.Sample {
+		if len(s.Location) == 0 || len(s.Location[0].Line) == 0 {
+			continue
+		}
+		// The inlined functions go first, so the first line is the innermost function.
+		fn := s.Location[0].Line[0].Function
+		if fn == nil {
+			continue
+		}
+		var pid int64
+		if v := s.NumLabel["pid"]; len(v) > 0 {
+			pid = v[0]
+		}
+		k := funcKey{function: fn.Name, pid: pid}
+		fc, ok := byFunc[k]
+		if !ok {
+			fc = &functionCPU{function: fn.Name, pid: pid}
+			if v := s.Label["comm"]; len(v) > 0 {
+				fc.comm = v[0]
+			}
+			for _, name := range labelNames {
+				if v := s.Label[name]; len(v) > 0 {
+					if fc.labels == nil {
+						fc.labels = make(Labels)
+					}
+					fc.labels[name] = v[0]
+				}
+			}
+			byFunc[k] = fc
+		}
+		fc.seconds += float64(s.Value[valueIdx]) / float64(time.Second)
+	}
+
+	funcs := make([]functionCPU, 0, len(byFunc))
+	for _, fc := range byFunc {
+		funcs = append(funcs, *fc)
+	}
+	sort.Slice(funcs, func(i, j int) bool {
+		return funcs[i].seconds > funcs[j].seconds
+	})
+	if top > 0 && len(funcs) > top {
+		funcs = funcs[:top]
+	}
+	return funcs
+}
+
+// encodeTimeSeries encodes prometheus.TimeSeries protobuf message with a single sample.
+// The labels must be sorted by name, so __name__ goes first.
+func encodeTimeSeries(labels [][2]string, value float64, timestampMs int64) []byte {
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i][0] < labels[j][0]
+	})
+
+	var b []byte
+	for _, l := range labels {
+		// Label.name = 1, Label.value = 2.
+		var lb []byte
+		lb = appendBytesField(lb, 1, []byte(l[0]))
+		lb = appendBytesField(lb, 2, []byte(l[1]))
+		// TimeSeries.labels = 1.
+		b = appendBytesField(b, 1, lb)
+	}
+
+	// Sample.value = 1 (double), Sample.timestamp = 2 (int64).
+	sb := appendUvarint(nil, 1<<3|1)
+	var v [8]byte
+	binary.LittleEndian.PutUint64(v[:], math.Float64bits(value))
+	sb = append(sb, v[:]...)
+	sb = appendUvarint(sb, 2<<3|0)
+	sb = appendUvarint(sb, uint64(timestampMs))
+	// TimeSeries.samples = 2.
+	return appendBytesField(b, 2, sb)
+}
+
+// appendBytesField appends the length-delimited protobuf field.
+func appendBytesField(b []byte, field uint64, value []byte) []byte {
+	b = appendUvarint(b, field<<3|2)
+	b = appendUvarint(b, uint64(len(value)))
+	return append(b, value...)
+}
+
+// appendUvarint appends the varint-encoded x.
+func appendUvarint(b []byte, x uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], x)
+	return append(b, buf[:n]...)
+}
+
+// snappyEncode encodes the data in snappy block format which remote write requires.
+// The data is stored as literals without compression,
+// since the requests are small and it's not worth a dependency.
+func snappyEncode(data []byte) []byte {
+	b := appendUvarint(nil, uint64(len(data)))
+	for len(data) > 0 {
+		chunk := data
+		if len(chunk) > math.MaxUint16 {
+			chunk = chunk[:math.MaxUint16]
+		}
+		data = data[len(chunk):]
+
+		// A literal of 61+ bytes is tagged 60<<2 (1-byte length) or 61<<2 (2-byte length),
+		// followed by the length minus one.
+		n := len(chunk) - 1
+		switch {
+		case n < 60:
+			b = append(b, byte(n)<<2)
+		case n < 1<<8:
+			b = append(b, 60<<2, byte(n))
+		default:
+			b = append(b, 61<<2, byte(n), byte(n>>8))
+		}
+		b = append(b, chunk...)
+	}
+	return b
+}
@@ -0,0 +1,154 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clockTicks is the number of clock ticks per second (USER_HZ) the CPU times in /proc are measured in.
+// It's 100 on all the mainstream architectures.
+const clockTicks = 100
+
+// Resources is a snapshot of the resource usage and limits of a process taken at flush time.
+// It gives analysts the context alongside the stacks, e.g., whether the process was throttled.
+// The limits are read from the process's cgroup v2, they're zeros if unlimited or unknown.
+type Resources struct {
+	// RSS is the resident set size in bytes.
+	RSS uint64
+	// CPUTime is the user and system CPU time the process has consumed since it started.
+	CPUTime time.Duration
+	// Threads is the number of threads of the process.
+	Threads int
+	// CPULimit is the number of CPUs the cgroup may use (cpu.max).
+	CPULimit float64
+	// MemoryLimit is the memory limit of the cgroup in bytes (memory.max).
+	MemoryLimit uint64
+	// ThrottledPeriods is the number of periods the cgroup was throttled,
+	// and ThrottledTime is the total time it was throttled for (cpu.stat).
+	ThrottledPeriods uint64
+	ThrottledTime    time.Duration
+}
+
+// String formats the resources as a profile comment.
+func (r Resources) String() string {
+	s := fmt.Sprintf("rss=%dMiB cpu_time=%s threads=%d", r.RSS>>20, r.CPUTime, r.Threads)
+	if r.CPULimit > 0 {
+		s += fmt.Sprintf(" cpu_limit=%g", r.CPULimit)
+	}
+	if r.MemoryLimit > 0 {
+		s += fmt.Sprintf(" memory_limit=%dMiB", r.MemoryLimit>>20)
+	}
+	if r.ThrottledPeriods > 0 {
+		s += fmt.Sprintf(" throttled=%d periods (%s)", r.ThrottledPeriods, r.ThrottledTime)
+	}
+	return s
+}
+
+// ProcessResources returns the resources of the processes the samples were taken from.
+// The processes which have already exited are skipped.
+func ProcessResources(samples []Sample) map[uint32]Resources {
+	resources := make(map[uint32]Resources)
+	for _, s := range samples {
+		if _, ok := resources[s.PID]; ok {
+			continue
+		}
+		if r, err := readResources(s.PID); err == nil {
+			resources[s.PID] = r
+		}
+	}
+
+	return resources
+}
+
+// readResources reads the resource usage of the process from /proc/<pid>/stat and statm,
+// and the limits of its cgroup.
+func readResources(pid uint32) (Resources, error) {
+	var r Resources
+
+	b, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return r, err
+	}
+	// The process name might contain spaces and parentheses,
+	// so the fields are counted from the last parenthesis, starting with the state (3rd field).
+	i := strings.LastIndexByte(string(b), ')')
+	if i < 0 {
+		return r, fmt.Errorf("invalid /proc/%d/stat", pid)
+	}
+	fields := strings.Fields(string(b[i+1:]))
+	if len(fields) < 18 {
+		return r, fmt.Errorf("invalid /proc/%d/stat", pid)
+	}
+	// utime and stime are the 14th and 15th fields, num_threads is the 20th.
+	utime, _ := strconv.ParseUint(fields[11], 10, 64)
+	stime, _ := strconv.ParseUint(fields[12], 10, 64)
+	r.CPUTime = time.Duration(utime+stime) * time.Second / clockTicks
+	r.Threads, _ = strconv.Atoi(fields[17])
+
+	// The second field of statm is the resident set size in pages.
+	if b, err = os.ReadFile(fmt.Sprintf("/proc/%d/statm", pid)); err == nil {
+		if fields = strings.Fields(string(b)); len(fields) > 1 {
+			pages, _ := strconv.ParseUint(fields[1], 10, 64)
+			r.RSS = pages * uint64(os.Getpagesize())
+		}
+	}
+
+	if dir := processCgroupDir(pid); dir != "" {
+		readCgroupLimits(dir, &r)
+	}
+
+	return r, nil
+}
+
+// processCgroupDir returns the cgroup v2 directory of the process,
+// or an empty string if it's unknown, e.g., on the hosts with cgroup v1.
+func processCgroupDir(pid uint32) string {
+	b, err := os.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return ""
+	}
+	// The unified hierarchy is listed as 0::/path.
+	for _, line := range strings.Split(string(b), "\n") {
+		if path := strings.TrimPrefix(line, "0::"); path != line {
+			return filepath.Join(cgroupRoot, path)
+		}
+	}
+	return ""
+}
+
+// readCgroupLimits reads the CPU and memory limits of the cgroup v2 and its CPU throttling stats.
+func readCgroupLimits(dir string, r *Resources) {
+	// cpu.max contains the quota and period in microseconds, e.g., "200000 100000" (2 CPUs)
+	// or "max 100000" if unlimited.
+	if b, err := os.ReadFile(filepath.Join(dir, "cpu.max")); err == nil {
+		if fields := strings.Fields(string(b)); len(fields) == 2 {
+			quota, qErr := strconv.ParseFloat(fields[0], 64)
+			period, pErr := strconv.ParseFloat(fields[1], 64)
+			if qErr == nil && pErr == nil && period > 0 {
+				r.CPULimit = quota / period
+			}
+		}
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, "memory.max")); err == nil {
+		r.MemoryLimit, _ = strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, "cpu.stat")); err == nil {
+		for _, line := range strings.Split(string(b), "\n") {
+			k, v, ok := strings.Cut(line, " ")
+			if !ok {
+				continue
+			}
+			n, _ := strconv.ParseUint(v, 10, 64)
+			switch k {
+			case "nr_throttled":
+				r.ThrottledPeriods = n
+			case "throttled_usec":
+				r.ThrottledTime = time.Duration(n) * time.Microsecond
+			}
+		}
+	}
+}
@@ -0,0 +1,178 @@
+//go:build linux
+
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// SandboxReadPaths are the paths the profiler reads after it has started:
+// the process metadata, the binaries to symbolize, and the files needed to upload the profiles.
+// The paths which don't exist on the host are skipped.
+var SandboxReadPaths = []string{
+	"/proc",
+	"/sys",
+	"/usr",
+	"/lib",
+	"/lib64",
+	"/bin",
+	"/sbin",
+	"/opt",
+	"/etc/hosts",
+	"/etc/resolv.conf",
+	"/etc/nsswitch.conf",
+	"/etc/ssl",
+	"/etc/pki",
+}
+
+// SandboxOptions configure the sandbox, see Sandbox.
+type SandboxOptions struct {
+	// Landlock restricts the file system access to the read and write paths (Linux 5.13+).
+	// It's skipped with a warning if the kernel doesn't support it.
+	Landlock bool
+	// ReadPaths are readable with Landlock in addition to SandboxReadPaths,
+	// e.g., /home if the profiled binaries reside there.
+	ReadPaths []string
+	// WritePaths are readable and writable with Landlock, e.g., the symbol cache and output directories.
+	// The directories are writable recursively, and a file path makes only that file writable.
+	WritePaths []string
+}
+
+// Sandbox restricts what the profiler can do once it has started, so a compromised profiler
+// can't do arbitrary damage despite its privileges. The seccomp filter denies the system calls
+// the profiler never needs (exec, ptrace, mounting, loading kernel modules, rebooting, etc.),
+// and optionally Landlock restricts the file system access to the given paths.
+// The restrictions apply to all threads and can't be lifted, e.g., the processes can't be targeted
+// by systemd unit anymore (it runs systemctl).
+func Sandbox(opts SandboxOptions) error {
+	// The privileges can't be gained by executing setuid binaries after that,
+	// which is required to install the filters without CAP_SYS_ADMIN.
+	if _, _, errno := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, unix.PR_SET_NO_NEW_PRIVS, 1, 0); errno != 0 {
+		if errno != syscall.ENOTSUP {
+			return fmt.Errorf("failed to set no_new_privs: %w", errno)
+		}
+		// The threads created by cgo can't be signaled, then seccomp sets it on all threads below.
+		if opts.Landlock {
+			return errors.New("landlock requires the profiler built without cgo (CGO_ENABLED=0) to restrict all threads")
+		}
+	}
+
+	if opts.Landlock {
+		if err := landlock(append(append([]string(nil), SandboxReadPaths...), opts.ReadPaths...), opts.WritePaths); err != nil {
+			return err
+		}
+	}
+	return seccomp()
+}
+
+// Landlock constants, see include/uapi/linux/landlock.h.
+const (
+	landlockCreateRulesetVersion = 1 << 0
+	landlockRulePathBeneath      = 1
+
+	landlockAccessFSExecute    = 1 << 0
+	landlockAccessFSWriteFile  = 1 << 1
+	landlockAccessFSReadFile   = 1 << 2
+	landlockAccessFSReadDir    = 1 << 3
+	landlockAccessFSRemoveDir  = 1 << 4
+	landlockAccessFSRemoveFile = 1 << 5
+	landlockAccessFSMakeChar   = 1 << 6
+	landlockAccessFSMakeDir    = 1 << 7
+	landlockAccessFSMakeReg    = 1 << 8
+	landlockAccessFSMakeSock   = 1 << 9
+	landlockAccessFSMakeFifo   = 1 << 10
+	landlockAccessFSMakeBlock  = 1 << 11
+	landlockAccessFSMakeSym    = 1 << 12
+
+	// landlockAccessFS are the accesses of the first Landlock ABI which are denied unless a rule allows them.
+	landlockAccessFS = 1<<13 - 1
+	// landlockAccessFile are the accesses which apply to the files (not only directories).
+	landlockAccessFile = landlockAccessFSExecute | landlockAccessFSWriteFile | landlockAccessFSReadFile
+
+	landlockAccessRead  = landlockAccessFSReadFile | landlockAccessFSReadDir
+	landlockAccessWrite = landlockAccessRead | landlockAccessFSWriteFile | landlockAccessFSRemoveDir |
+		landlockAccessFSRemoveFile | landlockAccessFSMakeDir | landlockAccessFSMakeReg | landlockAccessFSMakeSock
+)
+
+// landlockRulesetAttr is struct landlock_ruleset_attr.
+type landlockRulesetAttr struct {
+	handledAccessFS uint64
+}
+
+// landlockPathBeneathAttr is the packed struct landlock_path_beneath_attr,
+// the kernel reads only its first 12 bytes.
+type landlockPathBeneathAttr struct {
+	allowedAccess uint64
+	parentFD      int32
+}
+
+// landlock restricts the file system access of all threads to the read and write paths.
+// It's skipped with a warning if the kernel doesn't support Landlock.
+func landlock(readPaths, writePaths []string) error {
+	abi, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, 0, 0, landlockCreateRulesetVersion)
+	if errno != 0 || abi < 1 {
+		log.Printf("landlock isn't supported by the kernel, the file system access isn't restricted: %v", errno)
+		return nil
+	}
+
+	attr := landlockRulesetAttr{handledAccessFS: landlockAccessFS}
+	fd, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return fmt.Errorf("failed to create landlock ruleset: %w", errno)
+	}
+	defer unix.Close(int(fd))
+
+	for _, r := range []struct {
+		paths  []string
+		access uint64
+	}{
+		{readPaths, landlockAccessRead},
+		{writePaths, landlockAccessWrite},
+	} {
+		for _, path := range r.paths {
+			if err := landlockAllow(int(fd), path, r.access); err != nil {
+				return err
+			}
+		}
+	}
+
+	if _, _, errno = syscall.AllThreadsSyscall(unix.SYS_LANDLOCK_RESTRICT_SELF, fd, 0, 0); errno != 0 {
+		return fmt.Errorf("failed to enforce landlock ruleset: %w", errno)
+	}
+	return nil
+}
+
+// landlockAllow adds the rule which allows the access beneath the path to the ruleset.
+// The paths which don't exist are skipped.
+func landlockAllow(ruleset int, path string, access uint64) error {
+	fd, err := unix.Open(path, unix.O_PATH|unix.O_CLOEXEC, 0)
+	if errors.Is(err, unix.ENOENT) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open %s for landlock rule: %w", path, err)
+	}
+	defer unix.Close(fd)
+
+	var st unix.Stat_t
+	if err = unix.Fstat(fd, &st); err != nil {
+		return fmt.Errorf("failed to stat %s for landlock rule: %w", path, err)
+	}
+	// The directory accesses can't be granted on a file.
+	if st.Mode&unix.S_IFMT != unix.S_IFDIR {
+		access &= landlockAccessFile
+	}
+
+	attr := landlockPathBeneathAttr{allowedAccess: access, parentFD: int32(fd)}
+	_, _, errno := unix.Syscall6(unix.SYS_LANDLOCK_ADD_RULE, uintptr(ruleset), landlockRulePathBeneath, uintptr(unsafe.Pointer(&attr)), 0, 0, 0)
+	if errno != 0 {
+		return fmt.Errorf("failed to add landlock rule for %s: %w", path, errno)
+	}
+	return nil
+}
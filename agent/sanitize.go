@@ -0,0 +1,160 @@
+package agent
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/google/pprof/profile"
+)
+
+// Sanitizer replaces potentially sensitive data in profiles with pseudonyms,
+// so the profiles can be shared, e.g., attached to a bug report.
+// File paths (they often contain user names) are replaced with a hash of their directory
+// keeping the file name, e.g., /home/alice/app/server becomes 1f2e3d4c5b6a7988/server.
+// String labels and comments (host names, command lines) are hashed as a whole.
+//
+// The hashes are keyed with a random secret, so they can't be reversed by hashing known paths.
+// The owner can de-anonymize the profiles using the mapping of pseudonyms, see WriteMapping.
+type Sanitizer struct {
+	key []byte
+
+	mu sync.Mutex
+	// originals are the sanitized strings by their pseudonyms.
+	originals map[string]string
+}
+
+// NewSanitizer returns a sanitizer with a random secret key.
+func NewSanitizer() (*Sanitizer, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate sanitizer key: %w", err)
+	}
+
+	s := Sanitizer{
+		key:       key,
+		originals: make(map[string]string),
+	}
+	return &s, nil
+}
+
+// Sanitize replaces file paths, string labels, and comments of the profile with pseudonyms.
+// Function names are kept since they are needed to make sense of the profile.
+func (s *Sanitizer) Sanitize(p *profile.Profile) {
+	s.mu.Lock()
+	for _, sample := range p.Sample {
+		for key, values := range sample.Label {
+			for i := range values {
+				values[i] = s.hash(values[i])
+			}
+			sample.Label[key] = values
+		}
+	}
+	s.mu.Unlock()
+
+	s.sanitizeProfile(p)
+}
+
+// sanitizeLabels replaces the values of the string labels of a sample with pseudonyms
+// as the sample is converted, see ProfileOptions.Sanitizer.
+func (s *Sanitizer) sanitizeLabels(labels []sampleLabel) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range labels {
+		labels[i].value = s.hash(labels[i].value)
+	}
+}
+
+// sanitizeProfile replaces the file paths and comments of the profile with pseudonyms,
+// the samples are left as is.
+func (s *Sanitizer) sanitizeProfile(p *profile.Profile) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The comments might mention the paths, e.g., the binaries without frame pointers,
+	// so the paths are replaced in the comments as well.
+	paths := make(map[string]string)
+	for _, m := range p.Mapping {
+		if isFile(m.File) {
+			pseudonym := s.path(m.File)
+			paths[m.File] = pseudonym
+			m.File = pseudonym
+		}
+	}
+	for _, fn := range p.Function {
+		if fn.Filename != "" {
+			fn.Filename = s.path(fn.Filename)
+		}
+	}
+	originals := make([]string, 0, len(paths))
+	for orig := range paths {
+		originals = append(originals, orig)
+	}
+	// The longer paths are replaced first in case a path is a prefix of another one.
+	sort.Slice(originals, func(i, j int) bool {
+		return len(originals[i]) > len(originals[j])
+	})
+	for i, c := range p.Comments {
+		if isPublicComment(c) {
+			continue
+		}
+		for _, orig := range originals {
+			c = strings.ReplaceAll(c, orig, paths[orig])
+		}
+		if c == p.Comments[i] {
+			c = s.hash(c)
+		}
+		p.Comments[i] = c
+	}
+}
+
+// path returns a pseudonym of the file path which keeps the file name.
+func (s *Sanitizer) path(p string) string {
+	dir, file := path.Split(p)
+	if dir == "" {
+		return file
+	}
+
+	pseudonym := s.hash(dir) + "/" + file
+	s.originals[pseudonym] = p
+	return pseudonym
+}
+
+// hash returns a pseudonym of the string.
+func (s *Sanitizer) hash(v string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(v))
+	pseudonym := hex.EncodeToString(mac.Sum(nil)[:8])
+	s.originals[pseudonym] = v
+	return pseudonym
+}
+
+// WriteMapping writes the pseudonyms and the original strings they replaced as a JSON object.
+func (s *Sanitizer) WriteMapping(w io.Writer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(s.originals)
+}
+
+// isPublicComment tells whether the profile comment contains no sensitive data,
+// e.g., the build info or the CPU model, so it's kept as is.
+func isPublicComment(c string) bool {
+	for _, prefix := range []string{buildInfoPrefix, cpuCommentPrefix, runtimeCommentPrefix, frequencyCommentPrefix, coverageCommentPrefix} {
+		if strings.HasPrefix(c, prefix) {
+			return true
+		}
+	}
+	return false
+}
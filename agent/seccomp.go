@@ -0,0 +1,103 @@
+//go:build linux && (amd64 || arm64)
+
+package agent
+
+import (
+	"fmt"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Seccomp constants, see include/uapi/linux/seccomp.h and include/uapi/linux/audit.h.
+const (
+	seccompSetModeFilter   = 1
+	seccompFilterFlagTSync = 1 << 0
+	seccompRetAllow        = 0x7fff0000
+	seccompRetErrno        = 0x00050000
+
+	auditArchX86_64  = 0xc000003e
+	auditArchAArch64 = 0xc00000b7
+
+	// x32SyscallBit marks the system calls of x32 ABI on x86_64 which have their own numbers.
+	x32SyscallBit = 0x40000000
+)
+
+// seccompDenied are the system calls the profiler never makes once it has started.
+// They fail with EPERM.
+var seccompDenied = []uintptr{
+	unix.SYS_EXECVE,
+	unix.SYS_EXECVEAT,
+	unix.SYS_PTRACE,
+	unix.SYS_PROCESS_VM_WRITEV,
+	unix.SYS_MOUNT,
+	unix.SYS_UMOUNT2,
+	unix.SYS_PIVOT_ROOT,
+	unix.SYS_CHROOT,
+	unix.SYS_FSOPEN,
+	unix.SYS_FSCONFIG,
+	unix.SYS_FSMOUNT,
+	unix.SYS_MOVE_MOUNT,
+	unix.SYS_OPEN_TREE,
+	unix.SYS_SETNS,
+	unix.SYS_UNSHARE,
+	unix.SYS_KEXEC_LOAD,
+	unix.SYS_KEXEC_FILE_LOAD,
+	unix.SYS_INIT_MODULE,
+	unix.SYS_FINIT_MODULE,
+	unix.SYS_DELETE_MODULE,
+	unix.SYS_REBOOT,
+	unix.SYS_SWAPON,
+	unix.SYS_SWAPOFF,
+	unix.SYS_ACCT,
+	unix.SYS_SETTIMEOFDAY,
+	unix.SYS_CLOCK_SETTIME,
+	unix.SYS_SETHOSTNAME,
+	unix.SYS_SETDOMAINNAME,
+	unix.SYS_OPEN_BY_HANDLE_AT,
+	unix.SYS_USERFAULTFD,
+	unix.SYS_PERSONALITY,
+	unix.SYS_ADD_KEY,
+	unix.SYS_REQUEST_KEY,
+	unix.SYS_KEYCTL,
+}
+
+// seccomp installs the filter which denies seccompDenied system calls on all threads.
+func seccomp() error {
+	arch := uint32(auditArchX86_64)
+	if runtime.GOARCH == "arm64" {
+		arch = auditArchAArch64
+	}
+
+	deny := unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: seccompRetErrno | uint32(unix.EPERM)}
+	// The offsets of nr and arch fields of struct seccomp_data.
+	filter := []unix.SockFilter{
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: 4},
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: arch, Jt: 1},
+		deny,
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: 0},
+		{Code: unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K, K: x32SyscallBit},
+	}
+	for _, nr := range seccompDenied {
+		filter = append(filter, unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: uint32(nr)})
+	}
+	filter = append(filter, unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: seccompRetAllow}, deny)
+	// The matching system calls jump to the last instruction.
+	for i := 4; i < len(filter)-2; i++ {
+		filter[i].Jt = uint8(len(filter) - 1 - (i + 1))
+	}
+
+	prog := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	// The calling thread must have no_new_privs set, so it's not switched in between.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("failed to set no_new_privs: %w", err)
+	}
+	_, _, errno := unix.Syscall(unix.SYS_SECCOMP, seccompSetModeFilter, seccompFilterFlagTSync, uintptr(unsafe.Pointer(&prog)))
+	if errno != 0 {
+		return fmt.Errorf("failed to install seccomp filter: %w", errno)
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build linux && !amd64 && !arm64
+
+package agent
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// seccomp isn't implemented on the architectures other than amd64 and arm64.
+func seccomp() error {
+	return fmt.Errorf("seccomp filter isn't supported on %s", runtime.GOARCH)
+}
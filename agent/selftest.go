@@ -0,0 +1,209 @@
+//go:build linux
+
+package agent
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// SelfTestCheck is the outcome of a self-test check, see SelfTest.
+type SelfTestCheck struct {
+	Name string `json:"name"`
+	// Required tells whether the profiler can't work without it,
+	// the other checks are the optional features.
+	Required bool `json:"required"`
+	OK       bool `json:"ok"`
+	// Detail describes the outcome, e.g., the number of samples or why the check failed.
+	Detail string `json:"detail,omitempty"`
+	// Err is why the check failed.
+	Err error `json:"-"`
+}
+
+// selfTestDuration is how long the current process burns the CPU to be sampled, see SelfTest.
+const selfTestDuration = time.Second
+
+// SelfTest validates that the profiler works on the host before it's deployed:
+// it loads the BPF program, samples the current process to verify the samples arrive,
+// and probes the optional features which depend on the kernel version and configuration,
+// e.g., the BPF stack walking or the hardware events which aren't available in most VMs.
+func SelfTest() []SelfTestCheck {
+	checks := []SelfTestCheck{
+		selfTestKernel(),
+		runCheck("privileges", true, func() (string, error) {
+			priv, err := ReadPrivileges()
+			if err != nil {
+				return "", err
+			}
+			return "", priv.Check()
+		}),
+		runCheck("BPF program", true, func() (string, error) {
+			return "", loadObjects(ObjectsOptions{})
+		}),
+		runCheck("CPU sampling", true, selfTestSampling),
+
+		runCheck("kernel symbols", false, func() (string, error) {
+			_, err := LoadKernelSymbols()
+			return "", err
+		}),
+		runCheck("cgroup v2 targets and denylist (-cgroup, -deny cgroup:)", false, func() (string, error) {
+			root, err := cgroup2Root()
+			if err != nil {
+				return "", err
+			}
+			return root, loadObjects(ObjectsOptions{FilterCgroups: true, FilterDeniedCgroups: true})
+		}),
+		runCheck("stacks as deep as the default (kernel.perf_event_max_stack)", false, func() (string, error) {
+			limit, err := ReadMaxStack()
+			if err != nil {
+				return "", err
+			}
+			if limit < DefaultStackDepth {
+				return "", fmt.Errorf("%d is below %d, the stacks are truncated unless -raise-max-stack is set", limit, DefaultStackDepth)
+			}
+			return strconv.Itoa(limit), nil
+		}),
+		runCheck("BPF stack walking (-walk-depth)", false, func() (string, error) {
+			return "", loadObjects(ObjectsOptions{WalkDepth: MaxWalkDepth})
+		}),
+		runCheck("build ID stacks (-build-id-stacks)", false, func() (string, error) {
+			return "", loadObjects(ObjectsOptions{BuildIDStacks: true})
+		}),
+	}
+	for _, c := range Clocks {
+		if c == ClockCPU {
+			continue
+		}
+		c := c
+		checks = append(checks, runCheck(fmt.Sprintf("%s clock (-clock %s)", c, c), false, func() (string, error) {
+			return "", openProfiler(Config{SelfPID: true, Clock: c})
+		}))
+	}
+	checks = append(checks, runCheck("instructions per cycle (-ipc)", false, func() (string, error) {
+		return "", openProfiler(Config{SelfPID: true, Clock: ClockCycles, IPC: true})
+	}))
+	checks = append(checks, runCheck("LBR call stacks (-lbr)", false, func() (string, error) {
+		return "", openProfiler(Config{SelfPID: true, Clock: ClockCycles, LBR: true})
+	}))
+	for _, m := range Modes {
+		if m == ModeCPU {
+			continue
+		}
+		m := m
+		checks = append(checks, runCheck(fmt.Sprintf("%s mode (-mode %s)", m, m), false, func() (string, error) {
+			return "", openProfiler(Config{SelfPID: true, Mode: m})
+		}))
+	}
+	return append(checks,
+		runCheck("landlock sandbox (-sandbox landlock)", false, func() (string, error) {
+			abi, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, 0, 0, landlockCreateRulesetVersion)
+			if errno != 0 {
+				return "", errno
+			}
+			return fmt.Sprintf("ABI %d", abi), nil
+		}),
+		runCheck("BPF memory accounted to cgroup (no RLIMIT_MEMLOCK)", false, func() (string, error) {
+			major, minor, err := kernelVersion()
+			if err != nil {
+				return "", err
+			}
+			if versionBefore(major, minor, memcgAccountingVersion) {
+				return "", fmt.Errorf("requires Linux %d.%d+, RLIMIT_MEMLOCK is raised instead", memcgAccountingVersion[0], memcgAccountingVersion[1])
+			}
+			return "", nil
+		}),
+	)
+}
+
+// runCheck runs the check function which returns the details of the outcome.
+func runCheck(name string, required bool, fn func() (string, error)) SelfTestCheck {
+	detail, err := fn()
+	c := SelfTestCheck{
+		Name:     name,
+		Required: required,
+		OK:       err == nil,
+		Detail:   detail,
+		Err:      err,
+	}
+	if err != nil {
+		c.Detail = err.Error()
+	}
+	return c
+}
+
+// selfTestKernel reports the kernel release and checks it's new enough to load the BPF program.
+func selfTestKernel() SelfTestCheck {
+	return runCheck("kernel", true, func() (string, error) {
+		release := "Linux " + ReadBuildInfo().Kernel
+		major, minor, err := kernelVersion()
+		if err != nil {
+			return "", err
+		}
+		if versionBefore(major, minor, [2]int{4, 9}) {
+			return "", failure(FailureKernelUnsupported, fmt.Errorf("%s is older than Linux 4.9", release))
+		}
+		return release, nil
+	})
+}
+
+// selfTestSampling samples the current process while it burns the CPU
+// and checks that the samples with the user stacks arrive.
+func selfTestSampling() (string, error) {
+	p, err := NewProfiler(Config{SelfPID: true})
+	if err != nil {
+		return "", err
+	}
+	defer p.Close()
+
+	var sum [sha256.Size]byte
+	for deadline := time.Now().Add(selfTestDuration); time.Now().Before(deadline); {
+		sum = sha256.Sum256(sum[:])
+	}
+	samples, err := p.Flush()
+	if err != nil {
+		return "", err
+	}
+
+	self := uint32(os.Getpid())
+	var count, withStacks uint64
+	for _, s := range samples {
+		if s.PID != self {
+			continue
+		}
+		count += s.Count
+		if len(s.UserStack) > 0 {
+			withStacks += s.Count
+		}
+	}
+	switch {
+	case count == 0:
+		return "", errors.New("no samples arrived")
+	case withStacks == 0:
+		return "", fmt.Errorf("%d samples arrived without user stacks", count)
+	}
+	return fmt.Sprintf("%d samples in %s, %d with user stacks", count, selfTestDuration, withStacks), nil
+}
+
+// loadObjects loads the BPF program with the options and unloads it.
+func loadObjects(opts ObjectsOptions) error {
+	o, err := LoadObjects(opts)
+	if err != nil {
+		return err
+	}
+	return o.Close()
+}
+
+// openProfiler starts the profiler with the config and closes it.
+func openProfiler(c Config) error {
+	p, err := NewProfiler(c)
+	if err != nil {
+		return err
+	}
+	return p.Close()
+}
@@ -0,0 +1,174 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/pprof/profile"
+)
+
+// Labels describe the profiled service, e.g., {"service": "api", "env": "prod"}.
+// The sinks attach them to the profiles the way their backend expects, see Config.Labels.
+type Labels map[string]string
+
+// String returns the labels sorted by name, e.g., "env=prod,service=api".
+func (l Labels) String() string {
+	names := make([]string, 0, len(l))
+	for name := range l {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + "=" + l[name]
+	}
+	return strings.Join(pairs, ",")
+}
+
+// Sink receives the profiles produced by the agent, e.g., saves them locally or uploads them.
+// The profile is encoded once and shared by all the sinks, see EncodedProfile.
+type Sink interface {
+	Write(ctx context.Context, p *EncodedProfile, labels Labels) error
+}
+
+// SinkFunc adapts a function to the Sink interface.
+type SinkFunc func(ctx context.Context, p *EncodedProfile, labels Labels) error
+
+// Write calls f(ctx, p, labels).
+func (f SinkFunc) Write(ctx context.Context, p *EncodedProfile, labels Labels) error {
+	return f(ctx, p, labels)
+}
+
+// MultiSink writes the profiles to all its sinks in order,
+// e.g., a profile can be saved locally and uploaded in one run.
+// A failing sink doesn't prevent the others from receiving the profile.
+type MultiSink []Sink
+
+// Write writes the profile to all the sinks and reports the ones which failed.
+func (m MultiSink) Write(ctx context.Context, p *EncodedProfile, labels Labels) error {
+	var (
+		errs []string
+		// reason classifies the error by the first failed sink's reason, e.g., FailureUploadFailed.
+		reason FailureReason
+	)
+	for _, s := range m {
+		if err := s.Write(ctx, p, labels); err != nil {
+			errs = append(errs, err.Error())
+			if reason == "" {
+				reason = Reason(err)
+			}
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	err := fmt.Errorf("%d of %d sinks failed: %s", len(errs), len(m), strings.Join(errs, "; "))
+	if reason != "" {
+		return failure(reason, err)
+	}
+	return err
+}
+
+// labelCommentPrefix starts the profile comment with the labels, see labelComments.
+const labelCommentPrefix = "labels: "
+
+// labelComments returns the labels recorded as a comment, e.g., "labels: env=prod,service=api",
+// for the sinks which have nowhere else to put them. There is no comment if there are no labels.
+func labelComments(labels Labels) []string {
+	if len(labels) == 0 {
+		return nil
+	}
+	return []string{labelCommentPrefix + labels.String()}
+}
+
+// withLabelComment returns a copy of the profile with the labels recorded as a comment, see labelComments.
+// The profile itself is returned if there are no labels.
+func withLabelComment(p *profile.Profile, labels Labels) *profile.Profile {
+	if len(labels) == 0 {
+		return p
+	}
+	p = p.Copy()
+	p.Comments = append(p.Comments, labelComments(labels)...)
+	return p
+}
+
+// FileSink writes each profile to a pprof file in the directory
+// named after the profile type and its start time, e.g., cpu-20240102T150405Z.pb.gz
+// (the profiles are gzipped unless the compression is changed, see Compression.Ext).
+// The labels are recorded as a profile comment.
+type FileSink struct {
+	compressed
+	dir string
+}
+
+// NewFileSink returns a sink which writes the profiles to the directory, it's created if needed.
+func NewFileSink(dir string) (*FileSink, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create profile directory: %w", err)
+	}
+	return &FileSink{dir: dir}, nil
+}
+
+// Write writes the profile to a new file.
+func (s *FileSink) Write(ctx context.Context, p *EncodedProfile, labels Labels) error {
+	t := p.Start.UTC()
+	if p.Start.IsZero() {
+		t = time.Now().UTC()
+	}
+	name := p.Type + "-" + t.Format("20060102T150405Z") + s.compression.Ext()
+	return writeProfileFile(filepath.Join(s.dir, name), func(w io.Writer) error {
+		return p.Write(w, s.compression, labelComments(labels)...)
+	})
+}
+
+// StdoutSink prints a summary of each profile and its hottest functions,
+// e.g., to watch the agent locally.
+type StdoutSink struct {
+	w   io.Writer
+	top int
+}
+
+// NewStdoutSink returns a sink which prints the top functions of each profile to stdout.
+func NewStdoutSink(top int) *StdoutSink {
+	return &StdoutSink{w: os.Stdout, top: top}
+}
+
+// Write prints the profile's time, duration, labels, and the top functions by self samples.
+// The profile is decoded to find the top functions.
+func (s *StdoutSink) Write(ctx context.Context, ep *EncodedProfile, labels Labels) error {
+	p, err := ep.Parse()
+	if err != nil {
+		return fmt.Errorf("failed to decode profile: %w", err)
+	}
+	var samples int64
+	for _, ps := range p.Sample {
+		if len(ps.Value) > 0 {
+			samples += ps.Value[0]
+		}
+	}
+	header := fmt.Sprintf("%s %v: %d samples", time.Unix(0, p.TimeNanos).Format(time.RFC3339), time.Duration(p.DurationNanos), samples)
+	if len(labels) > 0 {
+		header += " {" + labels.String() + "}"
+	}
+	if _, err := fmt.Fprintln(s.w, header); err != nil {
+		return err
+	}
+
+	for _, f := range TopFunctions(p, s.top) {
+		space := "[u]"
+		if f.Kernel {
+			space = "[k]"
+		}
+		if _, err := fmt.Fprintf(s.w, "  %6.2f%% %6.2f%%  %s %s\n", f.SelfShare*100, f.TotalShare*100, space, f.Function); err != nil {
+			return err
+		}
+	}
+	return nil
+}
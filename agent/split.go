@@ -0,0 +1,176 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/pprof/profile"
+)
+
+// DefaultPerPIDTemplate names the per-process profiles by default, see PerPIDPath.
+const DefaultPerPIDTemplate = "{type}-{comm}-{pid}-{time}.pb.gz"
+
+// ProcessProfile is the part of a merged profile sampled from one process, see SplitByPID.
+type ProcessProfile struct {
+	PID     uint32
+	Comm    string
+	Profile *profile.Profile
+}
+
+// SplitByPID splits the profile into one profile per process (by the pid sample label) sorted by PID,
+// since some tools can't filter a merged profile by label.
+// The comments describing the other processes are dropped, and the samples without pid are skipped.
+func SplitByPID(p *profile.Profile) []ProcessProfile {
+	samples := make(map[uint32][]*profile.Sample)
+	comms := make(map[uint32]string)
+	for _, s := range p.Sample {
+		pids := s.NumLabel["pid"]
+		if len(pids) == 0 {
+			continue
+		}
+		pid := uint32(pids[0])
+		samples[pid] = append(samples[pid], s)
+		if comm := s.Label["comm"]; len(comm) > 0 {
+			comms[pid] = comm[0]
+		}
+	}
+
+	pids := make([]uint32, 0, len(samples))
+	for pid := range samples {
+		pids = append(pids, pid)
+	}
+	sort.Slice(pids, func(i, j int) bool { return pids[i] < pids[j] })
+
+	pp := make([]ProcessProfile, len(pids))
+	for i, pid := range pids {
+		// The samples are shared with the merged profile until it's compacted.
+		sp := profile.Profile{
+			SampleType:        p.SampleType,
+			DefaultSampleType: p.DefaultSampleType,
+			Sample:            samples[pid],
+			Mapping:           p.Mapping,
+			Location:          p.Location,
+			Function:          p.Function,
+			Comments:          processComments(p.Comments, pid),
+			DropFrames:        p.DropFrames,
+			KeepFrames:        p.KeepFrames,
+			TimeNanos:         p.TimeNanos,
+			DurationNanos:     p.DurationNanos,
+			PeriodType:        p.PeriodType,
+			Period:            p.Period,
+		}
+		pp[i] = ProcessProfile{
+			PID:     pid,
+			Comm:    comms[pid],
+			Profile: sp.Compact(),
+		}
+	}
+	return pp
+}
+
+// processComments returns the comments which don't describe another process,
+// e.g., "pid 1234 (nginx): ..." is kept only in the profile of PID 1234.
+func processComments(comments []string, pid uint32) []string {
+	own := fmt.Sprintf("pid %d ", pid)
+	var cc []string
+	for _, c := range comments {
+		if strings.HasPrefix(c, "pid ") && !strings.HasPrefix(c, own) {
+			continue
+		}
+		cc = append(cc, c)
+	}
+	return cc
+}
+
+// PerPIDPath fills in the template of a per-process profile file name, e.g., "{comm}-{pid}.pb.gz".
+// The placeholders are {pid}, {comm} (the process name with path separators replaced),
+// {type} (the profile type, e.g., cpu), and {time} (the profile's start time, e.g., 20240102T150405Z).
+func PerPIDPath(template string, p *profile.Profile, pid uint32, comm string) string {
+	t := time.Unix(0, p.TimeNanos).UTC()
+	if p.TimeNanos == 0 {
+		t = time.Now().UTC()
+	}
+	if comm == "" {
+		comm = "unknown"
+	}
+	r := strings.NewReplacer(
+		"{pid}", strconv.FormatUint(uint64(pid), 10),
+		"{comm}", strings.NewReplacer("/", "_", string(filepath.Separator), "_").Replace(comm),
+		"{type}", profileName(p),
+		"{time}", t.Format("20060102T150405Z"),
+	)
+	return r.Replace(template)
+}
+
+// PerPIDFileSink writes one gzipped pprof file per sampled process to the directory
+// named after the template, see PerPIDPath. It can be combined with FileSink
+// to keep the merged profile too.
+type PerPIDFileSink struct {
+	compressed
+	dir      string
+	template string
+}
+
+// NewPerPIDFileSink returns a sink which writes the per-process profiles to the directory,
+// it's created if needed. DefaultPerPIDTemplate is used if the template is empty.
+func NewPerPIDFileSink(dir, template string) (*PerPIDFileSink, error) {
+	if template == "" {
+		template = DefaultPerPIDTemplate
+	}
+	if !strings.Contains(template, "{pid}") {
+		return nil, fmt.Errorf("per-process file name template %q must contain {pid}", template)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create profile directory: %w", err)
+	}
+	return &PerPIDFileSink{dir: dir, template: template}, nil
+}
+
+// Write splits the profile by process and writes each part to its own file.
+// The labels are recorded as a profile comment.
+// The profile is decoded to be split.
+func (s *PerPIDFileSink) Write(ctx context.Context, ep *EncodedProfile, labels Labels) error {
+	p, err := ep.Parse()
+	if err != nil {
+		return fmt.Errorf("failed to decode profile: %w", err)
+	}
+	for _, pp := range SplitByPID(p) {
+		path := filepath.Join(s.dir, PerPIDPath(s.template, pp.Profile, pp.PID, pp.Comm))
+		pp := withLabelComment(pp.Profile, labels)
+		err = writeProfileFile(path, func(w io.Writer) error {
+			return s.compression.WriteProfile(w, pp)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeProfileFile writes the profile to a temporary file in the same directory
+// and renames it into place once it's written, so the readers never see partial profiles.
+func writeProfileFile(path string, write func(w io.Writer) error) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("failed to create profile directory: %w", err)
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return fmt.Errorf("failed to create profile file: %w", err)
+	}
+	defer os.Remove(f.Name())
+	if err = write(f); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write profile: %w", err)
+	}
+	if err = f.Close(); err != nil {
+		return fmt.Errorf("failed to write profile: %w", err)
+	}
+	return os.Rename(f.Name(), path)
+}
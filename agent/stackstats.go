@@ -0,0 +1,196 @@
+package agent
+
+import (
+	"hash/fnv"
+	"math/bits"
+)
+
+// errnoEFAULT is returned by bpf_get_stackid() as -EFAULT when there is no stack to collect,
+// e.g., for a kernel stack when a process was sampled in user space,
+// or for a user stack of a kernel thread.
+const errnoEFAULT = 14
+
+// StackStats tells where the samples were taken (kernel, user space, or both)
+// and how many stacks failed to resolve,
+// so it's clear whether a profile is dominated by syscalls or missing unwind data.
+// The samples are weighted by their counts.
+type StackStats struct {
+	Samples uint64
+	// Kernel and User are the samples which only had kernel or user frames,
+	// Both are the samples which had both, e.g., a syscall.
+	Kernel uint64
+	User   uint64
+	Both   uint64
+	// Empty are the samples without any frames.
+	Empty uint64
+	// KernelFailed and UserFailed are the samples whose kernel or user stack failed to resolve,
+	// e.g., the stack ID collided in the stack_traces map or the stack was evicted before it was read.
+	KernelFailed uint64
+	UserFailed   uint64
+
+	// KernelDepths and UserDepths are the distributions of the stack depths, see DepthHistogram.
+	KernelDepths DepthHistogram
+	UserDepths   DepthHistogram
+	// MaxKernelDepth and MaxUserDepth are the depth limits of the stacks (DefaultStackDepth if zero),
+	// e.g., Config.StackDepth or Config.WalkDepth.
+	// KernelTruncated and UserTruncated are the samples whose stacks reached the limits,
+	// so they were likely truncated.
+	MaxKernelDepth  int
+	MaxUserDepth    int
+	KernelTruncated uint64
+	UserTruncated   uint64
+
+	// stacks are the hashes of the unique stacks (both kernel and user frames) seen so far.
+	stacks map[uint64]struct{}
+}
+
+// Add adds the samples to the stats.
+func (st *StackStats) Add(samples []Sample) {
+	if st.stacks == nil {
+		st.stacks = make(map[uint64]struct{})
+	}
+	maxKernel, maxUser := st.MaxKernelDepth, st.MaxUserDepth
+	if maxKernel == 0 {
+		maxKernel = DefaultStackDepth
+	}
+	if maxUser == 0 {
+		maxUser = DefaultStackDepth
+	}
+
+	for _, s := range samples {
+		st.Samples += s.Count
+		st.stacks[stackHash(s)] = struct{}{}
+		st.KernelDepths.add(len(s.KernelStack), s.Count)
+		st.UserDepths.add(len(s.UserStack), s.Count)
+		if len(s.KernelStack) >= maxKernel {
+			st.KernelTruncated += s.Count
+		}
+		if len(s.UserStack) >= maxUser {
+			st.UserTruncated += s.Count
+		}
+
+		switch k, u := len(s.KernelStack) > 0, len(s.UserStack) > 0; {
+		case k && u:
+			st.Both += s.Count
+		case k:
+			st.Kernel += s.Count
+		case u:
+			st.User += s.Count
+		default:
+			st.Empty += s.Count
+		}
+
+		if len(s.KernelStack) == 0 && s.KernelStackID != -errnoEFAULT {
+			st.KernelFailed += s.Count
+		}
+		if len(s.UserStack) == 0 && s.UserStackID != -errnoEFAULT {
+			st.UserFailed += s.Count
+		}
+	}
+}
+
+// UniqueStacks returns the number of distinct stacks seen so far,
+// a kernel stack with different user stacks counts as different stacks.
+func (st *StackStats) UniqueStacks() int {
+	return len(st.stacks)
+}
+
+// stackHash hashes the addresses of the sample's stacks.
+func stackHash(s Sample) uint64 {
+	h := fnv.New64a()
+	var b []byte
+	for _, addr := range s.KernelStack {
+		b = appendUint64(b, addr)
+	}
+	// The separator tells apart the kernel and user frames.
+	b = appendUint64(b, 0)
+	for _, addr := range s.UserStack {
+		b = appendUint64(b, addr)
+	}
+	h.Write(b)
+	return h.Sum64()
+}
+
+// depthBuckets is the number of DepthHistogram buckets, the last one has the depths of 256 and more.
+const depthBuckets = 9
+
+// DepthHistogram is the number of samples by their stack depth in the power of two buckets:
+// 1, 2-3, 4-7, ..., 128-255, and 256+. The empty stacks aren't counted.
+type DepthHistogram [depthBuckets]uint64
+
+// DepthBucket is the number of samples whose stack depth is within [Min, Max],
+// Max is zero for the last unbounded bucket.
+type DepthBucket struct {
+	Min     int    `json:"min"`
+	Max     int    `json:"max,omitempty"`
+	Samples uint64 `json:"samples"`
+}
+
+// add counts the samples of the stack depth.
+func (h *DepthHistogram) add(depth int, count uint64) {
+	if depth == 0 {
+		return
+	}
+	i := bits.Len(uint(depth)) - 1
+	if i >= depthBuckets {
+		i = depthBuckets - 1
+	}
+	h[i] += count
+}
+
+// Buckets returns the non-empty buckets from the shallowest to the deepest stacks.
+func (h *DepthHistogram) Buckets() []DepthBucket {
+	var bb []DepthBucket
+	for i, n := range h {
+		if n == 0 {
+			continue
+		}
+		b := DepthBucket{Min: 1 << i, Samples: n}
+		if i < depthBuckets-1 {
+			b.Max = 1<<(i+1) - 1
+		}
+		bb = append(bb, b)
+	}
+	return bb
+}
+
+// MapStats tell how full the maps of the buffers got between the flushes.
+// A full Counts map drops the samples, and a full StackTraces map fails to store the stacks
+// (see StackStats.KernelFailed and UserFailed), then the flush interval should be shorter.
+type MapStats struct {
+	// Counts and StackTraces are the peak numbers of the entries seen in a flushed buffer.
+	Counts      int `json:"counts"`
+	StackTraces int `json:"stack_traces"`
+	// CountsCapacity and StackTracesCapacity are the max entries of the maps.
+	CountsCapacity      int `json:"counts_capacity"`
+	StackTracesCapacity int `json:"stack_traces_capacity"`
+}
+
+// observe updates the peaks with the samples read from a buffer.
+// The stacks stored in the StackTraces map are told by their IDs,
+// the user stacks walked by the BPF program are stored in the UserStacks map instead.
+func (ms *MapStats) observe(samples []Sample) {
+	ids := make(map[int32]struct{})
+	for _, s := range samples {
+		if s.KernelStackID >= 0 {
+			ids[s.KernelStackID] = struct{}{}
+		}
+		if s.UserStackHash == 0 && s.UserStackID >= 0 {
+			ids[s.UserStackID] = struct{}{}
+		}
+	}
+	if len(samples) > ms.Counts {
+		ms.Counts = len(samples)
+	}
+	if len(ids) > ms.StackTraces {
+		ms.StackTraces = len(ids)
+	}
+}
+
+// Share returns the share of n in all the samples.
+func (st *StackStats) Share(n uint64) float64 {
+	if st.Samples == 0 {
+		return 0
+	}
+	return float64(n) / float64(st.Samples)
+}
@@ -0,0 +1,73 @@
+package agent
+
+import (
+	"sort"
+)
+
+// UnresolvedMapping is a binary whose addresses couldn't be symbolized.
+type UnresolvedMapping struct {
+	Path    string `json:"path"`
+	BuildID string `json:"build_id,omitempty"`
+	// Addresses is the number of the distinct addresses which weren't symbolized.
+	Addresses int `json:"addresses"`
+	// Error is the first symbolization error, e.g., the binary has no symbols.
+	Error string `json:"error"`
+}
+
+// SymbolFailures collects the binaries whose addresses couldn't be symbolized,
+// so a missing or stripped symbol table is reported instead of silently producing hex addresses,
+// e.g., a CI pipeline can check that the binaries ship with their symbols.
+// Its Add method is meant to be ProfileOptions.SymbolizeFailed.
+type SymbolFailures struct {
+	mappings map[unresolvedKey]*UnresolvedMapping
+}
+
+// unresolvedKey identifies a binary by its path and build ID,
+// so the same binary mapped by many processes is reported once.
+type unresolvedKey struct {
+	path    string
+	buildID string
+}
+
+// NewSymbolFailures returns an empty collection of the symbolization failures.
+func NewSymbolFailures() *SymbolFailures {
+	return &SymbolFailures{
+		mappings: make(map[unresolvedKey]*UnresolvedMapping),
+	}
+}
+
+// Add records the address of the process's mapping which couldn't be symbolized.
+func (f *SymbolFailures) Add(pid uint32, m Mapping, err error) {
+	k := unresolvedKey{path: m.Path, buildID: m.BuildID}
+	um, ok := f.mappings[k]
+	if !ok {
+		um = &UnresolvedMapping{
+			Path:    m.Path,
+			BuildID: m.BuildID,
+			Error:   err.Error(),
+		}
+		f.mappings[k] = um
+	}
+	um.Addresses++
+}
+
+// Len returns the number of the binaries which failed to symbolize.
+func (f *SymbolFailures) Len() int {
+	return len(f.mappings)
+}
+
+// Mappings returns the binaries which failed to symbolize sorted by the number of their addresses,
+// the most unresolved first.
+func (f *SymbolFailures) Mappings() []UnresolvedMapping {
+	mm := make([]UnresolvedMapping, 0, len(f.mappings))
+	for _, um := range f.mappings {
+		mm = append(mm, *um)
+	}
+	sort.Slice(mm, func(i, j int) bool {
+		if mm[i].Addresses != mm[j].Addresses {
+			return mm[i].Addresses > mm[j].Addresses
+		}
+		return mm[i].Path < mm[j].Path
+	})
+	return mm
+}
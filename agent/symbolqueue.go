@@ -0,0 +1,124 @@
+package agent
+
+import (
+	"sync"
+
+	"diy-parca-agent/symbol"
+)
+
+// maxSymbolQueue is the max number of binaries waiting for their symbol tables to be loaded.
+// The binaries which don't fit are queued again when their addresses are symbolized next time.
+const maxSymbolQueue = 1024
+
+// symbolQueue loads the symbol tables of the sampled binaries in the background,
+// so neither collecting the samples nor building a profile waits for the large binaries to be read.
+// The addresses of the binaries still in the queue when a profile is built are left unsymbolized,
+// see ProfileOptions.SymbolizeDeadline.
+type symbolQueue struct {
+	symbolizer *symbol.Symbolizer
+	metrics    *Metrics
+	items      chan symbolQueueItem
+
+	// mu guards queued, the items in the channel or being loaded.
+	mu     sync.Mutex
+	queued map[symbolQueueItem]bool
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// symbolQueueItem identifies a binary by its path as seen from the host or by its build ID,
+// see Symbolizer.Table and Symbolizer.TableByBuildID.
+type symbolQueueItem struct {
+	path    string
+	buildID string
+}
+
+// newSymbolQueue starts loading the queued symbol tables into the symbolizer until the queue is closed.
+// The queue depth is reported to the metrics if they're set.
+func newSymbolQueue(s *symbol.Symbolizer, m *Metrics) *symbolQueue {
+	q := symbolQueue{
+		symbolizer: s,
+		metrics:    m,
+		items:      make(chan symbolQueueItem, maxSymbolQueue),
+		queued:     make(map[symbolQueueItem]bool),
+		stop:       make(chan struct{}),
+	}
+	q.report()
+	q.wg.Add(1)
+	go func() {
+		defer q.wg.Done()
+		q.run()
+	}()
+	return &q
+}
+
+// add queues the binary of the process's mapping unless its symbol table is already in memory.
+// It never blocks: the binary is skipped if the queue is full.
+func (q *symbolQueue) add(pid uint32, m Mapping) {
+	var it symbolQueueItem
+	switch {
+	case m.BuildID != "":
+		if q.symbolizer.CachedBuildID(m.BuildID) {
+			return
+		}
+		it.buildID = m.BuildID
+	case isFile(m.Path):
+		it.path = procPath(pid, m.Path)
+		if q.symbolizer.Cached(it.path) {
+			return
+		}
+	default:
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.queued[it] {
+		return
+	}
+	select {
+	case q.items <- it:
+		q.queued[it] = true
+		q.report()
+	default:
+	}
+}
+
+// run loads the symbol tables of the queued binaries.
+// The errors are remembered by the symbolizer and reported when the profile is built.
+func (q *symbolQueue) run() {
+	for {
+		select {
+		case <-q.stop:
+			return
+		case it := <-q.items:
+			if it.buildID != "" {
+				q.symbolizer.TableByBuildID(it.buildID)
+			} else {
+				q.symbolizer.Table(it.path)
+			}
+
+			q.mu.Lock()
+			delete(q.queued, it)
+			q.report()
+			q.mu.Unlock()
+		}
+	}
+}
+
+// report updates the queue depth metric.
+// The caller must hold the mutex.
+func (q *symbolQueue) report() {
+	if q.metrics != nil {
+		q.metrics.SetSymbolQueueDepth(len(q.queued))
+	}
+}
+
+// Close stops loading the symbol tables once the current one is loaded,
+// the binaries left in the queue are dropped.
+func (q *symbolQueue) Close() {
+	close(q.stop)
+	q.wg.Wait()
+}
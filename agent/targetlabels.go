@@ -0,0 +1,76 @@
+//go:build linux
+
+package agent
+
+import (
+	"fmt"
+	"strings"
+)
+
+// TargetLabels labels the processes matched by the rules, e.g., team=payments for the processes of /opt/payments/bin/*.
+// The rules are the same as the ones of Denylist: comm, exe, cgroup, and label.
+type TargetLabels struct {
+	Match  Denylist
+	Labels Labels
+}
+
+// ParseTargetLabels parses the rules and the labels separated by a space,
+// e.g., "exe:/opt/payments/bin/* team=payments,tier=backend", see ParseDenylist.
+func ParseTargetLabels(s string) (TargetLabels, error) {
+	var t TargetLabels
+	rules, labels, ok := strings.Cut(strings.TrimSpace(s), " ")
+	if !ok {
+		return t, fmt.Errorf("invalid target labels %q, they must be <rules> <name>=<value>,...", s)
+	}
+
+	var err error
+	if t.Match, err = ParseDenylist(rules); err != nil {
+		return t, err
+	}
+	t.Labels = make(Labels)
+	for _, pair := range strings.Split(strings.TrimSpace(labels), ",") {
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok || name == "" {
+			return t, fmt.Errorf("invalid label %q, expected name=value", pair)
+		}
+		t.Labels[name] = value
+	}
+	return t, nil
+}
+
+// TargetLabelProvider labels the processes matched by any of the target rules,
+// the labels of the later rules take precedence.
+// It's meant to go last among the label providers, so its labels override the global and the discovered ones.
+type TargetLabelProvider []TargetLabels
+
+// Labels returns the labels of the rules which match the process.
+func (p TargetLabelProvider) Labels(pid uint32) Labels {
+	var labels Labels
+	for _, t := range p {
+		if !t.Match.Denies(pid) {
+			continue
+		}
+		if labels == nil {
+			labels = make(Labels)
+		}
+		for name, value := range t.Labels {
+			labels[name] = value
+		}
+	}
+	return labels
+}
+
+// Names returns the names of all the labels the rules can attach, e.g., to copy them to the remote write series.
+func (p TargetLabelProvider) Names() []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, t := range p {
+		for name := range t.Labels {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
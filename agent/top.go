@@ -0,0 +1,160 @@
+package agent
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"sort"
+
+	"github.com/google/pprof/profile"
+)
+
+// FunctionShare is the share of samples of a function:
+// Self is where the function was the innermost frame, Total is where it was anywhere on the stack.
+type FunctionShare struct {
+	Function string
+	// Kernel tells whether the function is in the kernel.
+	Kernel     bool
+	Self       int64
+	Total      int64
+	SelfShare  float64
+	TotalShare float64
+}
+
+// TopFunctions returns the n functions with the most self samples in the profile, the hottest first
+// (all functions if n is zero).
+// The samples are counted by the first sample value, e.g., samples/count in the CPU profiles.
+// The addresses which weren't symbolized are reported as functions of their own.
+func TopFunctions(p *profile.Profile, n int) []FunctionShare {
+	var all int64
+	byFunc := make(map[string]*FunctionShare)
+	share := func(name string, kernel bool) *FunctionShare {
+		fs, ok := byFunc[name]
+		if !ok {
+			fs = &FunctionShare{Function: name, Kernel: kernel}
+			byFunc[name] = fs
+		}
+		return fs
+	}
+
+	for _, s := range p.Sample {
+		if len(s.Value) == 0 || len(s.Location) == 0 {
+			continue
+		}
+		v := s.Value[0]
+		all += v
+
+		// A recursive function is counted once per sample in its total.
+		seen := make(map[string]bool)
+		for i, loc := range s.Location {
+			kernel := loc.Mapping != nil && loc.Mapping.File == kernelMappingFile
+			names := locationFunctions(loc)
+			for j, name := range names {
+				fs := share(name, kernel)
+				// The inlined functions go first, so the first line of the first location is the innermost function.
+				if i == 0 && j == 0 {
+					fs.Self += v
+				}
+				if !seen[name] {
+					seen[name] = true
+					fs.Total += v
+				}
+			}
+		}
+	}
+
+	funcs := make([]FunctionShare, 0, len(byFunc))
+	for _, fs := range byFunc {
+		if all > 0 {
+			fs.SelfShare = float64(fs.Self) / float64(all)
+			fs.TotalShare = float64(fs.Total) / float64(all)
+		}
+		funcs = append(funcs, *fs)
+	}
+	sort.Slice(funcs, func(i, j int) bool {
+		if funcs[i].Self != funcs[j].Self {
+			return funcs[i].Self > funcs[j].Self
+		}
+		if funcs[i].Total != funcs[j].Total {
+			return funcs[i].Total > funcs[j].Total
+		}
+		return funcs[i].Function < funcs[j].Function
+	})
+	if n > 0 && len(funcs) > n {
+		funcs = funcs[:n]
+	}
+	return funcs
+}
+
+// locationFunctions returns the function names of the location, the inlined ones first,
+// or its address along with the binary if it wasn't symbolized, e.g., "0x1a2b [app]".
+func locationFunctions(loc *profile.Location) []string {
+	var names []string
+	for _, line := range loc.Line {
+		if line.Function != nil {
+			names = append(names, line.Function.Name)
+		}
+	}
+	if len(names) > 0 {
+		return names
+	}
+	if loc.Mapping != nil && loc.Mapping.File != "" {
+		return []string{fmt.Sprintf("%#x [%s]", loc.Address, filepath.Base(loc.Mapping.File))}
+	}
+	return []string{fmt.Sprintf("%#x", loc.Address)}
+}
+
+// FunctionChange is how the self share of a function changed between two profiles,
+// e.g., from 12% of CPU time in the base profile to 30% in the new one.
+type FunctionChange struct {
+	Function string
+	// Kernel tells whether the function is in the kernel.
+	Kernel    bool
+	BaseShare float64
+	NewShare  float64
+}
+
+// Delta returns the change of the function's share, it's negative if the function got cooler.
+func (c FunctionChange) Delta() float64 {
+	return c.NewShare - c.BaseShare
+}
+
+// CompareFunctions returns the n functions whose self share changed most between the profiles
+// (all functions if n is zero), either way, the largest change first.
+// The shares are compared rather than the samples, so the profiles of different durations are comparable.
+// The functions missing in a profile have zero share there.
+func CompareFunctions(base, p *profile.Profile, n int) []FunctionChange {
+	byFunc := make(map[string]*FunctionChange)
+	change := func(fs FunctionShare) *FunctionChange {
+		c, ok := byFunc[fs.Function]
+		if !ok {
+			c = &FunctionChange{Function: fs.Function, Kernel: fs.Kernel}
+			byFunc[fs.Function] = c
+		}
+		return c
+	}
+	for _, fs := range TopFunctions(base, 0) {
+		change(fs).BaseShare = fs.SelfShare
+	}
+	for _, fs := range TopFunctions(p, 0) {
+		change(fs).NewShare = fs.SelfShare
+	}
+
+	changes := make([]FunctionChange, 0, len(byFunc))
+	for _, c := range byFunc {
+		if c.Delta() != 0 {
+			changes = append(changes, *c)
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		di, dj := math.Abs(changes[i].Delta()), math.Abs(changes[j].Delta())
+		if di != dj {
+			return di > dj
+		}
+		return changes[i].Function < changes[j].Function
+	})
+	if n > 0 && len(changes) > n {
+		changes = changes[:n]
+	}
+	return changes
+}
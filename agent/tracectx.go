@@ -0,0 +1,58 @@
+//go:build linux
+
+package agent
+
+import (
+	"debug/elf"
+	"fmt"
+	"strings"
+
+	"github.com/cilium/ebpf/link"
+)
+
+// traceContextMarker is the marker function reporting the trace context, see Config.TraceContext.
+type traceContextMarker struct {
+	// path is the binary or shared library which defines the function.
+	path   string
+	symbol string
+	// goABI is set when the function is written in Go.
+	goABI bool
+}
+
+// parseTraceContextMarker parses the marker function of the form path:symbol,
+// e.g., /opt/myapp/bin/server:main.parcaSetTraceContext.
+func parseTraceContextMarker(s string) (*traceContextMarker, error) {
+	i := strings.LastIndex(s, ":")
+	if i <= 0 || i == len(s)-1 {
+		return nil, fmt.Errorf("trace context marker %q must be of the form path:symbol", s)
+	}
+	m := traceContextMarker{
+		path:   s[:i],
+		symbol: s[i+1:],
+	}
+
+	f, err := elf.Open(m.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open trace context marker binary: %w", err)
+	}
+	defer f.Close()
+	// Go binaries have the function table in .gopclntab section,
+	// and Go 1.17+ passes the arguments in registers on x86-64 (regabi).
+	m.goABI = f.Section(".gopclntab") != nil
+
+	return &m, nil
+}
+
+// attachTraceContext attaches on_trace_context BPF program as a uprobe to the marker function,
+// so the BPF program knows the trace context of every thread of the processes running the binary.
+func attachTraceContext(objs *Objects, m *traceContextMarker) (link.Link, error) {
+	ex, err := link.OpenExecutable(m.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open trace context marker binary: %w", err)
+	}
+	l, err := ex.Uprobe(m.symbol, objs.objs.OnTraceContext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to attach uprobe to trace context marker %s: %w", m.symbol, err)
+	}
+	return l, nil
+}
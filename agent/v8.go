@@ -0,0 +1,94 @@
+package agent
+
+import (
+	"strconv"
+	"strings"
+
+	"diy-parca-agent/symbol"
+)
+
+// v8Tags are the tags V8 (Node.js) prefixes the JS functions with in the perf maps,
+// the older versions describe how the code was compiled, the newer ones just say JS.
+var v8Tags = []string{"JS:", "LazyCompile:", "Function:", "Script:", "Eval:", "InterpretedFunction:"}
+
+// v8Tiers are the execution tiers by the marker V8 puts before the function name.
+// The interpreted functions have their own frames (copies of the interpreter trampoline)
+// only if Node.js runs with --interpreted-frames-native-stack,
+// otherwise they're all attributed to the interpreter builtins.
+var v8Tiers = map[byte]string{
+	'~': "interpreted", // Ignition
+	'^': "baseline",    // Sparkplug
+	'+': "jit",         // Maglev
+	'*': "jit",         // TurboFan
+}
+
+// v8Symbol parses the perf map entry of a JS function written by Node.js with --perf-basic-prof,
+// e.g., "JS:*fib /app/index.js:12:5" or "LazyCompile:~main /app/index.js:1".
+// The function name is tagged with its tier, e.g., "fib [jit]" and "main [interpreted]",
+// so the interpreted and JIT compiled frames of the same function are told apart in the profile.
+// The source file and line are parsed too.
+// The entries of the builtins, stubs, and other runtimes aren't parsed.
+func v8Symbol(name string) (symbol.Symbol, bool) {
+	var (
+		tag  string
+		rest string
+	)
+	for _, t := range v8Tags {
+		if strings.HasPrefix(name, t) {
+			tag, rest = t, name[len(t):]
+			break
+		}
+	}
+	if tag == "" {
+		return symbol.Symbol{}, false
+	}
+
+	var tier string
+	if tag == "InterpretedFunction:" {
+		tier = v8Tiers['~']
+	}
+	if len(rest) > 0 {
+		if t, ok := v8Tiers[rest[0]]; ok {
+			tier = t
+			rest = rest[1:]
+		}
+	}
+
+	var sym symbol.Symbol
+	fn := rest
+	if i := strings.IndexByte(rest, ' '); i >= 0 {
+		fn = rest[:i]
+		sym.File, sym.Line = v8Location(rest[i+1:])
+	}
+	if fn == "" {
+		fn = "(anonymous)"
+	}
+	sym.Func = fn
+	if tier != "" {
+		sym.Func += " [" + tier + "]"
+	}
+	return sym, true
+}
+
+// v8Location parses the source location of a JS function, e.g., "/app/index.js:12:5"
+// where the column is omitted by the older V8 versions.
+func v8Location(loc string) (string, int) {
+	var nums []int
+	for len(nums) < 2 {
+		i := strings.LastIndexByte(loc, ':')
+		if i < 0 {
+			break
+		}
+		n, err := strconv.Atoi(loc[i+1:])
+		if err != nil {
+			break
+		}
+		nums = append(nums, n)
+		loc = loc[:i]
+	}
+	if len(nums) == 0 {
+		return loc, 0
+	}
+	// The line precedes the column.
+	return loc, nums[len(nums)-1]
+}
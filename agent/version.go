@@ -0,0 +1,66 @@
+package agent
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"runtime/debug"
+	"strings"
+)
+
+// Version is the version of the agent.
+// It's set at build time, e.g., go build -ldflags "-X diy-parca-agent/agent.Version=v1.2.3".
+var Version = "dev"
+
+// buildInfoPrefix starts the profile comments describing the build,
+// they aren't sanitized since they contain no sensitive data, see Sanitizer.
+const buildInfoPrefix = "parca-agent "
+
+// BuildInfo describes the code and the kernel which produced a profile,
+// so the profiles can be traced back to them.
+type BuildInfo struct {
+	// Version is the agent version, see Version.
+	Version string
+	// Commit is the git commit the agent was built from (empty if unknown).
+	Commit string
+	// BPFObjectHash is the SHA-256 prefix of the embedded BPF object.
+	BPFObjectHash string
+	// Kernel is the release of the kernel the profile was collected on, e.g., 5.15.0-76-generic.
+	Kernel string
+}
+
+// ReadBuildInfo returns the build info of the running agent.
+func ReadBuildInfo() BuildInfo {
+	b := BuildInfo{Version: Version}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			if s.Key == "vcs.revision" {
+				b.Commit = s.Value
+			}
+		}
+	}
+	sum := sha256.Sum256(_ParcaAgentBytes)
+	b.BPFObjectHash = hex.EncodeToString(sum[:6])
+	if release, err := os.ReadFile("/proc/sys/kernel/osrelease"); err == nil {
+		b.Kernel = strings.TrimSpace(string(release))
+	}
+	return b
+}
+
+// String formats the build info, e.g.,
+// parca-agent v1.2.3 (commit 3f1c2a9, bpf 9ae16a3b2f90) on Linux 5.15.0-76-generic.
+func (b BuildInfo) String() string {
+	commit := b.Commit
+	if len(commit) > 12 {
+		commit = commit[:12]
+	}
+	if commit == "" {
+		commit = "unknown"
+	}
+	s := fmt.Sprintf("%s%s (commit %s, bpf %s)", buildInfoPrefix, b.Version, commit, b.BPFObjectHash)
+	if b.Kernel != "" {
+		s += " on Linux " + b.Kernel
+	}
+	return s
+}
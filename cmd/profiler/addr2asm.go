@@ -0,0 +1,233 @@
+//go:build linux
+
+package main
+
+import (
+	"debug/elf"
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/google/pprof/profile"
+	"golang.org/x/arch/arm64/arm64asm"
+	"golang.org/x/arch/x86/x86asm"
+
+	"diy-parca-agent/symbol"
+)
+
+// maxAsmFuncSize limits the disassembly of huge functions
+// and the ones without size, e.g., hand-written assembly.
+const maxAsmFuncSize = 4096
+
+// addr2asm disassembles the hottest functions of the profile
+// and annotates their instructions with the number of samples, similar to perf annotate.
+// The functions are found in the binaries referenced by the profile's mappings.
+func addr2asm(args []string) error {
+	fs := flag.NewFlagSet("addr2asm", flag.ExitOnError)
+	top := fs.Int("top", 5, "number of the hottest functions to print")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: profiler addr2asm [flags] cpu.pprof")
+	}
+
+	p, err := readProfile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	funcs := hotInstructions(p, symbol.NewSymbolizer(nil, 0))
+	if len(funcs) > *top {
+		funcs = funcs[:*top]
+	}
+	for _, fn := range funcs {
+		if err = printAnnotatedAsm(fn); err != nil {
+			fmt.Printf("ROUTINE ======================== %s in %s\n%v\n\n", fn.fn.Name, fn.path, err)
+		}
+	}
+	return nil
+}
+
+// asmFunc is a function with the samples attributed to its instructions.
+type asmFunc struct {
+	// path is the binary which contains the function.
+	path  string
+	table *symbol.Table
+	fn    symbol.Func
+	// flat and cum are the total sample counts of the function.
+	flat, cum int64
+	// insts are the flat and cumulative sample counts by instruction's virtual address.
+	// The cumulative samples of the callers are attributed to the call instruction.
+	insts map[uint64]*lineCount
+}
+
+// hotInstructions attributes the samples to the instructions
+// and returns the functions sorted by flat samples (the hottest first).
+func hotInstructions(p *profile.Profile, s *symbol.Symbolizer) []*asmFunc {
+	type funcKey struct {
+		path string
+		addr uint64
+	}
+	funcs := make(map[funcKey]*asmFunc)
+
+	for _, sample := range p.Sample {
+		if len(sample.Value) == 0 {
+			continue
+		}
+		count := sample.Value[0]
+		seen := make(map[funcKey]bool)
+		for i, loc := range sample.Location {
+			m := loc.Mapping
+			if m == nil || !strings.HasPrefix(m.File, "/") {
+				continue
+			}
+			t, err := s.Table(m.File)
+			if err != nil {
+				continue
+			}
+			addr := loc.Address
+			// The return address points to the instruction after the call.
+			if i > 0 {
+				addr--
+			}
+			vaddr, ok := t.Addr(addr - m.Start + m.Offset)
+			if !ok {
+				continue
+			}
+			fn, ok := t.Func(vaddr)
+			if !ok {
+				continue
+			}
+
+			k := funcKey{path: m.File, addr: fn.Addr}
+			af, ok := funcs[k]
+			if !ok {
+				af = &asmFunc{
+					path:  m.File,
+					table: t,
+					fn:    fn,
+					insts: make(map[uint64]*lineCount),
+				}
+				funcs[k] = af
+			}
+			ic, ok := af.insts[vaddr]
+			if !ok {
+				ic = &lineCount{}
+				af.insts[vaddr] = ic
+			}
+
+			if i == 0 {
+				af.flat += count
+				ic.flat += count
+			}
+			ic.cum += count
+			// A recursive function is counted once per sample.
+			if !seen[k] {
+				seen[k] = true
+				af.cum += count
+			}
+		}
+	}
+
+	sorted := make([]*asmFunc, 0, len(funcs))
+	for _, af := range funcs {
+		sorted = append(sorted, af)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].flat != sorted[j].flat {
+			return sorted[i].flat > sorted[j].flat
+		}
+		return sorted[i].cum > sorted[j].cum
+	})
+	return sorted
+}
+
+// printAnnotatedAsm disassembles the function and prints its instructions with the samples.
+func printAnnotatedAsm(af *asmFunc) error {
+	f, err := elf.Open(af.path)
+	if err != nil {
+		return fmt.Errorf("failed to open ELF: %w", err)
+	}
+	defer f.Close()
+
+	code, err := readFuncCode(f, af.fn)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("ROUTINE ======================== %s in %s\n", af.fn.Name, af.path)
+	fmt.Printf("%10d %10d (flat, cum) samples\n", af.flat, af.cum)
+
+	// The call targets are printed as function names.
+	// The symbols without size are ignored since they are usually labels
+	// which would match the data addresses, e.g., runtime.etext.
+	symname := func(addr uint64) (string, uint64) {
+		fn, ok := af.table.Func(addr)
+		if !ok || fn.Size == 0 {
+			return "", 0
+		}
+		return fn.Name, fn.Addr
+	}
+	for pc := af.fn.Addr; len(code) > 0; {
+		text, size := disassemble(f.Machine, code, pc, symname)
+		if ic, ok := af.insts[pc]; ok {
+			fmt.Printf("%10d %10d %#x: %s\n", ic.flat, ic.cum, pc, text)
+		} else {
+			fmt.Printf("%10s %10s %#x: %s\n", ".", ".", pc, text)
+		}
+		code = code[size:]
+		pc += uint64(size)
+	}
+	fmt.Println()
+
+	return nil
+}
+
+// readFuncCode reads the machine code of the function from the binary.
+func readFuncCode(f *elf.File, fn symbol.Func) ([]byte, error) {
+	size := fn.Size
+	if size == 0 || size > maxAsmFuncSize {
+		size = maxAsmFuncSize
+	}
+	for _, s := range f.Sections {
+		if s.Flags&elf.SHF_EXECINSTR == 0 || fn.Addr < s.Addr || fn.Addr >= s.Addr+s.Size {
+			continue
+		}
+		if end := s.Addr + s.Size; fn.Addr+size > end {
+			size = end - fn.Addr
+		}
+		code := make([]byte, size)
+		if _, err := s.ReadAt(code, int64(fn.Addr-s.Addr)); err != nil {
+			return nil, fmt.Errorf("failed to read code of %s: %w", fn.Name, err)
+		}
+		return code, nil
+	}
+
+	return nil, fmt.Errorf("code of %s not found", fn.Name)
+}
+
+// disassemble decodes the first instruction of the code at pc
+// and returns its text along with its size in bytes.
+// The undecodable bytes are skipped one (x86) or four (arm64) at a time.
+func disassemble(machine elf.Machine, code []byte, pc uint64, symname x86asm.SymLookup) (string, int) {
+	switch machine {
+	case elf.EM_X86_64:
+		inst, err := x86asm.Decode(code, 64)
+		if err != nil {
+			return fmt.Sprintf("?? %#02x", code[0]), 1
+		}
+		return x86asm.GNUSyntax(inst, pc, symname), inst.Len
+	case elf.EM_AARCH64:
+		if len(code) < 4 {
+			return "??", len(code)
+		}
+		inst, err := arm64asm.Decode(code)
+		if err != nil {
+			return "??", 4
+		}
+		return arm64asm.GNUSyntax(inst), 4
+	default:
+		return fmt.Sprintf("unsupported architecture %s", machine), len(code)
+	}
+}
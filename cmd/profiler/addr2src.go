@@ -0,0 +1,255 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/google/pprof/profile"
+
+	"diy-parca-agent/symbol"
+)
+
+// addr2src prints the source code of the hottest functions of the profile
+// annotated with the number of samples per line, similar to pprof -list.
+// The locations which pprof didn't symbolize are resolved using the binaries
+// referenced by the profile's mappings.
+func addr2src(args []string) error {
+	fs := flag.NewFlagSet("addr2src", flag.ExitOnError)
+	top := fs.Int("top", 5, "number of the hottest functions to print")
+	srcDirs := fs.String("src", "", "comma-separated directories to look up the source files in, e.g., $HOME/go/src")
+	context := fs.Int("context", 2, "number of source lines to print around the annotated lines")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: profiler addr2src [flags] cpu.pprof")
+	}
+
+	p, err := readProfile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	var dirs []string
+	if *srcDirs != "" {
+		dirs = strings.Split(*srcDirs, ",")
+	}
+
+	funcs := hotSourceLines(p, symbol.NewSymbolizer(nil, 0))
+	if len(funcs) > *top {
+		funcs = funcs[:*top]
+	}
+	for _, fn := range funcs {
+		printAnnotatedSource(fn, dirs, *context)
+	}
+	return nil
+}
+
+// sourceFunc is a function with the samples attributed to its source lines.
+type sourceFunc struct {
+	name string
+	file string
+	// flat and cum are the total sample counts of the function.
+	flat, cum int64
+	// lines are the flat and cumulative sample counts by line number.
+	lines map[int]*lineCount
+}
+
+type lineCount struct {
+	flat, cum int64
+}
+
+// hotSourceLines attributes the samples to the source lines
+// and returns the functions sorted by flat samples (the hottest first).
+// Flat samples were taken in the function itself,
+// while cumulative ones also include the functions it called.
+func hotSourceLines(p *profile.Profile, s *symbol.Symbolizer) []*sourceFunc {
+	byName := make(map[string]*sourceFunc)
+	for _, sample := range p.Sample {
+		if len(sample.Value) == 0 {
+			continue
+		}
+		count := sample.Value[0]
+		// A recursive function is counted once per sample in the cumulative counts.
+		seen := make(map[string]bool)
+		for i, loc := range sample.Location {
+			// The inlined functions go first, so only the first symbol of the leaf location is flat.
+			for j, sym := range locationSymbols(loc, i > 0, s) {
+				if sym.File == "" || sym.Line == 0 {
+					continue
+				}
+				fn, ok := byName[sym.Func]
+				if !ok {
+					fn = &sourceFunc{
+						name:  sym.Func,
+						file:  sym.File,
+						lines: make(map[int]*lineCount),
+					}
+					byName[sym.Func] = fn
+				}
+				lc, ok := fn.lines[sym.Line]
+				if !ok {
+					lc = &lineCount{}
+					fn.lines[sym.Line] = lc
+				}
+
+				if i == 0 && j == 0 {
+					fn.flat += count
+					lc.flat += count
+				}
+				lineKey := fmt.Sprintf("%s:%d", sym.Func, sym.Line)
+				if !seen[lineKey] {
+					seen[lineKey] = true
+					lc.cum += count
+				}
+				if !seen[sym.Func] {
+					seen[sym.Func] = true
+					fn.cum += count
+				}
+			}
+		}
+	}
+
+	funcs := make([]*sourceFunc, 0, len(byName))
+	for _, fn := range byName {
+		funcs = append(funcs, fn)
+	}
+	sort.Slice(funcs, func(i, j int) bool {
+		if funcs[i].flat != funcs[j].flat {
+			return funcs[i].flat > funcs[j].flat
+		}
+		return funcs[i].cum > funcs[j].cum
+	})
+	return funcs
+}
+
+// locationSymbols returns the symbols of the location.
+// The profile's line information is used if present,
+// otherwise the address is symbolized using the mapping's binary.
+// The return addresses are symbolized as the preceding call instruction.
+func locationSymbols(loc *profile.Location, isReturn bool, s *symbol.Symbolizer) []symbol.Symbol {
+	var syms []symbol.Symbol
+	for _, ln := range loc.Line {
+		if ln.Function == nil {
+			continue
+		}
+		syms = append(syms, symbol.Symbol{
+			Func: ln.Function.Name,
+			File: ln.Function.Filename,
+			Line: int(ln.Line),
+		})
+	}
+	if len(syms) > 0 {
+		return syms
+	}
+
+	m := loc.Mapping
+	if m == nil || !strings.HasPrefix(m.File, "/") {
+		return nil
+	}
+	addr := loc.Address
+	if isReturn {
+		addr--
+	}
+	sym, err := s.Symbolize(m.File, m.Start, m.Offset, addr)
+	if err != nil {
+		return nil
+	}
+	// Each inlined function's caller is at its call site, see symbol.Symbol.Inlined.
+	for _, in := range sym.Inlined {
+		syms = append(syms, symbol.Symbol{Func: in.Func, File: sym.File, Line: sym.Line})
+		sym.File, sym.Line = in.CallFile, in.CallLine
+	}
+	return append(syms, sym)
+}
+
+// printAnnotatedSource prints the function's source lines with the samples,
+// along with the context lines around them.
+func printAnnotatedSource(fn *sourceFunc, dirs []string, context int) {
+	fmt.Printf("ROUTINE ======================== %s in %s\n", fn.name, fn.file)
+	fmt.Printf("%10d %10d (flat, cum) samples\n", fn.flat, fn.cum)
+
+	lineNums := make([]int, 0, len(fn.lines))
+	for n := range fn.lines {
+		lineNums = append(lineNums, n)
+	}
+	sort.Ints(lineNums)
+
+	src, err := readSourceLines(fn.file, dirs)
+	if err != nil {
+		// The counts are still useful without the source code.
+		for _, n := range lineNums {
+			lc := fn.lines[n]
+			fmt.Printf("%10d %10d %5d: <source unavailable>\n", lc.flat, lc.cum, n)
+		}
+		fmt.Println()
+		return
+	}
+
+	// printed is the last printed line number, so overlapping contexts aren't repeated.
+	printed := 0
+	for _, n := range lineNums {
+		from := n - context
+		if from <= printed {
+			from = printed + 1
+		} else if printed > 0 && from > printed+1 {
+			fmt.Println("         .          .     ...")
+		}
+		to := n + context
+		if to > len(src) {
+			to = len(src)
+		}
+		for i := from; i <= to; i++ {
+			if i < 1 {
+				continue
+			}
+			if lc, ok := fn.lines[i]; ok {
+				fmt.Printf("%10d %10d %5d: %s\n", lc.flat, lc.cum, i, src[i-1])
+			} else {
+				fmt.Printf("%10s %10s %5d: %s\n", ".", ".", i, src[i-1])
+			}
+			printed = i
+		}
+	}
+	fmt.Println()
+}
+
+// readSourceLines reads the source file looking it up in dirs.
+// The file might have been compiled on another machine,
+// so its path is trimmed from the left until it's found in one of the dirs,
+// e.g., /build/app/cmd/main.go is looked up as cmd/main.go and main.go too.
+func readSourceLines(file string, dirs []string) ([]string, error) {
+	candidates := []string{file}
+	parts := strings.Split(strings.TrimPrefix(filepath.ToSlash(file), "/"), "/")
+	for _, dir := range dirs {
+		for i := range parts {
+			candidates = append(candidates, filepath.Join(dir, filepath.Join(parts[i:]...)))
+		}
+	}
+
+	for _, path := range candidates {
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		var lines []string
+		sc := bufio.NewScanner(f)
+		sc.Buffer(nil, 1<<20)
+		for sc.Scan() {
+			lines = append(lines, sc.Text())
+		}
+		err = sc.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		return lines, nil
+	}
+
+	return nil, fmt.Errorf("source file %s not found", file)
+}
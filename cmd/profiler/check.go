@@ -0,0 +1,155 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/google/pprof/profile"
+)
+
+// check validates the pprof profiles and prints their statistics.
+// Servers tend to reject subtly malformed profiles with cryptic errors,
+// so the problems are reported in terms of the profile's IDs.
+func check(args []string) error {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return errors.New("at least one pprof file is required")
+	}
+
+	var invalid bool
+	for _, path := range fs.Args() {
+		p, err := readProfile(path)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("%s:\n", path)
+		printProfileStats(p)
+		problems, warnings := checkProfile(p)
+		for _, msg := range problems {
+			fmt.Printf("  problem: %s\n", msg)
+		}
+		for _, msg := range warnings {
+			fmt.Printf("  warning: %s\n", msg)
+		}
+		if len(problems) > 0 {
+			invalid = true
+		}
+	}
+
+	if invalid {
+		return errors.New("invalid profile")
+	}
+	return nil
+}
+
+func readProfile(path string) (*profile.Profile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open profile: %w", err)
+	}
+	defer f.Close()
+
+	// Parse fails on dangling references, e.g., a sample referring to a missing location.
+	p, err := profile.Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return p, nil
+}
+
+func printProfileStats(p *profile.Profile) {
+	totals := make([]int64, len(p.SampleType))
+	for _, s := range p.Sample {
+		for i, v := range s.Value {
+			if i < len(totals) {
+				totals[i] += v
+			}
+		}
+	}
+	var unsymbolized int
+	for _, loc := range p.Location {
+		if len(loc.Line) == 0 {
+			unsymbolized++
+		}
+	}
+
+	fmt.Printf("  samples: %d\n", len(p.Sample))
+	for i, st := range p.SampleType {
+		fmt.Printf("  total %s/%s: %d\n", st.Type, st.Unit, totals[i])
+	}
+	fmt.Printf("  locations: %d (%d unsymbolized)\n", len(p.Location), unsymbolized)
+	fmt.Printf("  mappings: %d\n", len(p.Mapping))
+	fmt.Printf("  functions: %d\n", len(p.Function))
+}
+
+// checkProfile returns the problems found in the profile:
+// duplicate or zero IDs, addresses outside of their mappings,
+// and samples without values or locations.
+// Unreferenced mappings and functions are only warnings,
+// e.g., Go runtime/pprof always includes [vdso] mapping.
+func checkProfile(p *profile.Profile) (problems, warnings []string) {
+	report := func(format string, a ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, a...))
+	}
+	warn := func(format string, a ...interface{}) {
+		warnings = append(warnings, fmt.Sprintf(format, a...))
+	}
+
+	if err := p.CheckValid(); err != nil {
+		report("%v", err)
+	}
+
+	usedMappings := make(map[uint64]bool)
+	usedFunctions := make(map[uint64]bool)
+	for _, loc := range p.Location {
+		if m := loc.Mapping; m != nil {
+			usedMappings[m.ID] = true
+			// The kernel mapping has no limit, see agent.Profile.
+			if loc.Address < m.Start || (loc.Address >= m.Limit && m.Limit != ^uint64(0)) {
+				report("location %d address %#x is outside of mapping %d [%#x, %#x)", loc.ID, loc.Address, m.ID, m.Start, m.Limit)
+			}
+		}
+		for _, ln := range loc.Line {
+			if ln.Function != nil {
+				usedFunctions[ln.Function.ID] = true
+			}
+		}
+	}
+	for _, m := range p.Mapping {
+		if m.Start >= m.Limit {
+			report("mapping %d has empty range [%#x, %#x)", m.ID, m.Start, m.Limit)
+		}
+		if !usedMappings[m.ID] {
+			warn("mapping %d (%s) isn't referenced by any location", m.ID, m.File)
+		}
+	}
+	for _, fn := range p.Function {
+		if !usedFunctions[fn.ID] {
+			warn("function %d (%s) isn't referenced by any location", fn.ID, fn.Name)
+		}
+	}
+
+	for i, s := range p.Sample {
+		if len(s.Location) == 0 {
+			report("sample %d has no locations", i)
+		}
+		zero := true
+		for _, v := range s.Value {
+			if v != 0 {
+				zero = false
+				break
+			}
+		}
+		if zero {
+			report("sample %d has zero values", i)
+		}
+	}
+
+	return problems, warnings
+}
@@ -0,0 +1,122 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/google/pprof/profile"
+
+	"diy-parca-agent/agent"
+	"diy-parca-agent/symbol"
+)
+
+// compare prints the functions whose CPU share changed most between two profiles,
+// answering what just regressed right from the command line.
+// The profiles are either read from the pprof files, e.g., the ones stored by "serve",
+// or collected live as two consecutive windows.
+func compare(args []string) error {
+	fs := flag.NewFlagSet("compare", flag.ExitOnError)
+	window := fs.Duration("window", 0, "collect two consecutive windows of this duration and compare them instead of reading the profiles, e.g., 30s")
+	pid := fs.Int("pid", -1, "PID whose stack traces should be collected with -window (default is all processes)")
+	exe := fs.String("exe", "", "glob pattern of the executables whose processes' stack traces should be collected with -window, e.g., '/opt/myapp/bin/*'")
+	frequency := fs.Uint64("frequency", agent.DefaultFrequency, "sampling frequency (samples per second) with -window")
+	top := fs.Int("top", 20, "number of the functions to print, 0 prints all the changed functions")
+	fs.Parse(args)
+
+	var base, p *profile.Profile
+	switch {
+	case *window > 0 && fs.NArg() == 0:
+		var err error
+		if base, p, err = collectWindows(agent.Config{PID: *pid, Exe: *exe, Frequency: *frequency}, *window); err != nil {
+			return err
+		}
+	case *window == 0 && fs.NArg() == 2:
+		var err error
+		if base, err = readProfile(fs.Arg(0)); err != nil {
+			return err
+		}
+		if p, err = readProfile(fs.Arg(1)); err != nil {
+			return err
+		}
+	default:
+		return errors.New("usage: profiler compare [flags] base.pprof new.pprof, or profiler compare -window 30s [flags]")
+	}
+
+	printChanges(agent.CompareFunctions(base, p, *top))
+	return nil
+}
+
+// collectWindows profiles the targets for two consecutive windows and returns their profiles.
+// It's interrupted by INT/TERM signal.
+func collectWindows(c agent.Config, window time.Duration) (base, p *profile.Profile, err error) {
+	profiler, err := agent.NewProfiler(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer profiler.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	s := symbol.NewSymbolizer(nil, 256<<20)
+	var captures [2]*agent.Capture
+	for i, name := range []string{"base", "new"} {
+		fmt.Fprintf(os.Stderr, "Collecting the %s window for %s...\n", name, window)
+		captures[i] = agent.NewCapture(c.Frequency)
+		if err = collectWindow(ctx, profiler, captures[i], window); err != nil {
+			return nil, nil, err
+		}
+	}
+	return captures[0].Profile(s), captures[1].Profile(s), nil
+}
+
+// collectWindow flushes the samples into the capture every second until the window ends
+// or the context is cancelled.
+func collectWindow(ctx context.Context, profiler *agent.Profiler, c *agent.Capture, window time.Duration) error {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	end := time.Now().Add(window)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		samples, err := profiler.Flush()
+		if err != nil {
+			return fmt.Errorf("failed to flush samples: %w", err)
+		}
+		c.Add(samples)
+		if !time.Now().Before(end) {
+			return nil
+		}
+	}
+}
+
+// printChanges prints the self share of the functions in both profiles and its change,
+// the kernel functions are marked with [k].
+func printChanges(changes []agent.FunctionChange) {
+	if len(changes) == 0 {
+		fmt.Println("No function changed its share.")
+		return
+	}
+
+	fmt.Printf("Top %d changed functions:\n", len(changes))
+	fmt.Printf("  %7s %7s %8s      %s\n", "base", "new", "delta", "function")
+	for _, c := range changes {
+		space := "[u]"
+		if c.Kernel {
+			space = "[k]"
+		}
+		fmt.Printf("  %6.2f%% %6.2f%% %+7.2f%%  %s %s\n", c.BaseShare*100, c.NewShare*100, c.Delta()*100, space, c.Function)
+	}
+}
@@ -0,0 +1,160 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"diy-parca-agent/agent"
+)
+
+// controlServer listens on a Unix socket for commands which change the running profiler:
+//
+//	frequency        prints the sampling frequency
+//	frequency <hz>   changes the sampling frequency, e.g., raises it during an incident
+//	pause            stops sampling, e.g., during a sensitive time window
+//	resume           restarts the paused sampling
+//	status           prints whether sampling is "running" or "paused"
+//
+// Each command is a line of text, and the server replies with a line
+// which is either "ok", the requested value, or "error: <reason>".
+type controlServer struct {
+	ln       net.Listener
+	profiler *agent.Profiler
+}
+
+// listenControl starts serving the control commands on the Unix socket path.
+func listenControl(path string, p *agent.Profiler) (*controlServer, error) {
+	// The socket file might be left behind by a profiler which was killed.
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to remove stale control socket: %w", err)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on control socket: %w", err)
+	}
+	// Only the owner (root) can control the profiler.
+	if err = os.Chmod(path, 0600); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("failed to restrict control socket permissions: %w", err)
+	}
+
+	s := controlServer{
+		ln:       ln,
+		profiler: p,
+	}
+	go s.serve()
+	return &s, nil
+}
+
+func (s *controlServer) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("failed to accept control connection: %v", err)
+			}
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *controlServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	sc := bufio.NewScanner(conn)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		if _, err := fmt.Fprintln(conn, s.exec(line)); err != nil {
+			return
+		}
+	}
+}
+
+// exec executes the command and returns a reply.
+func (s *controlServer) exec(line string) string {
+	args := strings.Fields(line)
+	switch cmd := args[0]; {
+	case cmd == "frequency" && len(args) == 1:
+		return strconv.FormatUint(s.profiler.Frequency(), 10)
+	case cmd == "frequency" && len(args) == 2:
+		hz, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			return "error: invalid frequency"
+		}
+		if err = s.profiler.SetFrequency(hz); err != nil {
+			return "error: " + err.Error()
+		}
+		log.Printf("sampling frequency changed to %d", hz)
+		return "ok"
+	case cmd == "pause" && len(args) == 1:
+		if err := s.profiler.Pause(); err != nil {
+			return "error: " + err.Error()
+		}
+		log.Print("sampling paused")
+		return "ok"
+	case cmd == "resume" && len(args) == 1:
+		if err := s.profiler.Resume(); err != nil {
+			return "error: " + err.Error()
+		}
+		log.Print("sampling resumed")
+		return "ok"
+	case cmd == "status" && len(args) == 1:
+		if s.profiler.Paused() {
+			return "paused"
+		}
+		return "running"
+	default:
+		return fmt.Sprintf("error: unknown command %q", line)
+	}
+}
+
+// Close stops accepting the commands and removes the socket file.
+func (s *controlServer) Close() error {
+	return s.ln.Close()
+}
+
+// ctl sends a command to the running profiler via its control socket
+// and prints the reply, e.g., "profiler ctl frequency 999".
+func ctl(args []string) error {
+	fs := flag.NewFlagSet("ctl", flag.ExitOnError)
+	path := fs.String("control", "/run/parca-agent.sock", "control socket of the running profiler")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return fmt.Errorf("command is required, e.g., frequency 999")
+	}
+
+	conn, err := net.Dial("unix", *path)
+	if err != nil {
+		return fmt.Errorf("failed to connect to control socket: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err = fmt.Fprintln(conn, strings.Join(fs.Args(), " ")); err != nil {
+		return fmt.Errorf("failed to send command: %w", err)
+	}
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to read reply: %w", err)
+	}
+	reply = strings.TrimSpace(reply)
+	fmt.Println(reply)
+
+	if strings.HasPrefix(reply, "error:") {
+		return errors.New("command failed")
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/pprof/profile"
+
+	"diy-parca-agent/agent"
+	"diy-parca-agent/model"
+)
+
+// convert converts a profile file between pprof, folded stacks, and speedscope JSON,
+// e.g., to render the archived pprof profiles with flame graph tools.
+// The folded stacks and speedscope files lack the addresses and mappings,
+// so the pprof profiles converted from them only have the function names.
+func convert(args []string) error {
+	fs := flag.NewFlagSet("convert", flag.ExitOnError)
+	from := fs.String("from", "auto", "input format: pprof, folded, speedscope, or auto to detect it by the file extension and contents")
+	to := fs.String("to", "folded", "output format: pprof, folded, or speedscope")
+	output := fs.String("o", "-", "file to write the converted profile to, - is stdout")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: profiler convert [flags] cpu.pprof")
+	}
+	if *to != "pprof" && !isModelFormat(*to) {
+		return fmt.Errorf("unknown output format %q", *to)
+	}
+
+	path := fs.Arg(0)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read profile: %w", err)
+	}
+	format := *from
+	if format == "auto" {
+		format = detectFormat(path, data)
+	}
+	p, err := readModel(data, format)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "-" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return fmt.Errorf("failed to create output file: %w", err)
+		}
+		defer f.Close()
+		w = f
+	}
+	if *to == "pprof" {
+		if err = p.Pprof().Write(w); err != nil {
+			return fmt.Errorf("failed to write pprof: %w", err)
+		}
+		return nil
+	}
+	return writeModel(w, p, *to, filepath.Base(path))
+}
+
+// detectFormat guesses the profile format by the file extension, or by the contents if the extension is unknown:
+// speedscope is JSON, pprof is gzipped or parses as protobuf, and the rest is taken for folded stacks.
+func detectFormat(path string, data []byte) string {
+	switch {
+	case strings.HasSuffix(path, ".json"):
+		return "speedscope"
+	case strings.HasSuffix(path, ".folded"), strings.HasSuffix(path, ".collapsed"), strings.HasSuffix(path, ".txt"):
+		return "folded"
+	case strings.HasSuffix(path, ".pprof"), strings.HasSuffix(path, ".pb.gz"), strings.HasSuffix(path, ".pb"):
+		return "pprof"
+	}
+
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) > 0 && trimmed[0] == '{' {
+		return "speedscope"
+	}
+	if bytes.HasPrefix(data, []byte{0x1f, 0x8b}) {
+		return "pprof"
+	}
+	if _, err := profile.ParseData(data); err == nil {
+		return "pprof"
+	}
+	return "folded"
+}
+
+// readModel reads the profile of the format into the profile model.
+func readModel(data []byte, format string) (*model.Profile, error) {
+	switch format {
+	case "pprof":
+		p, err := profile.ParseData(data)
+		if err != nil {
+			return nil, err
+		}
+		return agent.ModelFromPprof(p), nil
+	case "folded":
+		return model.ReadFolded(bytes.NewReader(data))
+	case "speedscope":
+		return model.ReadSpeedscope(bytes.NewReader(data))
+	default:
+		return nil, fmt.Errorf("unknown input format %q", format)
+	}
+}
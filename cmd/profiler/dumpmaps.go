@@ -0,0 +1,51 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"diy-parca-agent/agent"
+)
+
+// dumpMaps prints the raw contents of the Counts, StackTraces, and UserStacks maps
+// of both buffers as JSON: the key fields, counts, and raw addresses.
+// Unlike inspect, the stack IDs aren't resolved, so the maps can be debugged and scripted, e.g., with jq.
+func dumpMaps(args []string) error {
+	fs := flag.NewFlagSet("dump-maps", flag.ExitOnError)
+	pinDir := fs.String("pin", "/sys/fs/bpf/parca-agent", "BPF file system directory where the profiler pinned its maps")
+	live := fs.Bool("live", false, "find the maps of a running profiler among the loaded BPF maps instead of the pinned ones")
+	fs.Parse(args)
+
+	var (
+		buffers []agent.Buffer
+		err     error
+	)
+	if *live {
+		buffers, err = agent.LoadLiveBuffers()
+	} else {
+		buffers, err = agent.LoadPinnedBuffers(*pinDir)
+	}
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for i := range buffers {
+			buffers[i].Close()
+		}
+	}()
+
+	dumps := make([]*agent.BufferDump, len(buffers))
+	for i := range buffers {
+		if dumps[i], err = buffers[i].Dump(); err != nil {
+			return fmt.Errorf("buffer %d: %w", i, err)
+		}
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(map[string]interface{}{"buffers": dumps})
+}
@@ -0,0 +1,36 @@
+//go:build linux
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// envPrefix is the prefix of the environment variables which configure the profiler.
+const envPrefix = "PARCA_AGENT_"
+
+// envName returns the environment variable name of the flag,
+// e.g., PARCA_AGENT_SYMBOL_CACHE for -symbol-cache.
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// setFlagsFromEnv sets the flags from the PARCA_AGENT_* environment variables,
+// so the profiler can be configured in a container image without a wrapper script.
+// It must be called before parsing the command line, so the flags take precedence.
+func setFlagsFromEnv(fs *flag.FlagSet) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok || err != nil {
+			return
+		}
+		if setErr := f.Value.Set(value); setErr != nil {
+			err = fmt.Errorf("invalid value %q for %s: %w", value, envName(f.Name), setErr)
+		}
+	})
+	return err
+}
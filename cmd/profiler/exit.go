@@ -0,0 +1,61 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+
+	"diy-parca-agent/agent"
+)
+
+// The exit codes of the profiler, so the orchestration scripts can tell the failures apart,
+// e.g., retry when the target hasn't started yet. The invalid flags exit with code 2 (see flag.ExitOnError).
+const (
+	exitOK                = 0
+	exitFailure           = 1
+	exitTargetNotFound    = 3
+	exitPermissionDenied  = 4
+	exitKernelUnsupported = 5
+	exitUploadFailed      = 6
+)
+
+// exitCodes are the exit codes by the failure reasons, the unknown reasons exit with exitFailure.
+var exitCodes = map[agent.FailureReason]int{
+	agent.FailureTargetNotFound:    exitTargetNotFound,
+	agent.FailurePermissionDenied:  exitPermissionDenied,
+	agent.FailureKernelUnsupported: exitKernelUnsupported,
+	agent.FailureUploadFailed:      exitUploadFailed,
+}
+
+// exitStatus is the final line printed to stderr, e.g.,
+//
+//	{"status":"error","exit_code":4,"reason":"permission_denied","error":"missing CAP_BPF: ..."}
+type exitStatus struct {
+	Status   string              `json:"status"`
+	ExitCode int                 `json:"exit_code"`
+	Reason   agent.FailureReason `json:"reason,omitempty"`
+	Error    string              `json:"error,omitempty"`
+}
+
+// exit logs the error of the command and prints the exit status as JSON to stderr.
+// It returns the exit code of the error, see exitCodes.
+func exit(err error) int {
+	st := exitStatus{
+		Status:   "ok",
+		ExitCode: exitOK,
+	}
+	if err != nil {
+		log.Print(err)
+		st.Status = "error"
+		st.ExitCode = exitFailure
+		st.Reason = agent.Reason(err)
+		st.Error = err.Error()
+		if code, ok := exitCodes[st.Reason]; ok {
+			st.ExitCode = code
+		}
+	}
+	json.NewEncoder(os.Stderr).Encode(st)
+	return st.ExitCode
+}
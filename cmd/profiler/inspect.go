@@ -0,0 +1,267 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+
+	"github.com/google/pprof/profile"
+
+	"diy-parca-agent/agent"
+	"diy-parca-agent/model"
+	"diy-parca-agent/symbol"
+)
+
+// inspect attaches to the maps pinned by another profiler instance
+// and dumps their contents as JSON or pprof.
+// The maps are opened read-only, so the running profiler is not affected.
+func inspect(args []string) error {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	pinDir := fs.String("pin", "/sys/fs/bpf/parca-agent", "BPF file system directory where the profiler pinned its maps")
+	format := fs.String("format", "json", "output format: json, pprof, folded, or speedscope")
+	output := fs.String("o", "-", "file to write the output to, - is stdout, the merged pprof isn't written if it's empty")
+	perPID := fs.String("per-pid", "", perPIDUsage+" (pprof format only)")
+	frequency := fs.Uint64("frequency", agent.DefaultFrequency, "sampling frequency of the profiler, it is used to estimate CPU time in pprof")
+	symbolize := fs.Bool("symbolize", true, "symbolize user space addresses in pprof")
+	symbolCache := fs.String("symbol-cache", "", "directory to persist the extracted symbol tables, e.g., /var/cache/parca-agent/symbols")
+	symbolMemory := fs.Int64("symbol-memory", 256<<20, "memory budget in bytes for the symbol tables, 0 means no limit")
+	guessFuncs := fs.Bool("guess-funcs", false, "group the addresses without symbols (JIT code, fully stripped binaries) into functions found by scanning for prologues")
+	sanitize := fs.String("sanitize", "", "replace file paths and labels in pprof with pseudonyms and write their mapping to the file, e.g., pseudonyms.json")
+	focus := fs.String("focus", "", focusUsage)
+	ignore := fs.String("ignore", "", ignoreUsage)
+	minCount := fs.Uint64("min-count", 0, minCountUsage)
+	stripGoRuntime := fs.Bool("strip-go-runtime", false, stripGoRuntimeUsage)
+	labels := addLabelFlag(fs)
+	fs.Parse(args)
+
+	if *format != "json" && *format != "pprof" && !isModelFormat(*format) {
+		return fmt.Errorf("unknown output format %q", *format)
+	}
+	if *perPID != "" && *format != "pprof" {
+		return errors.New("-per-pid requires pprof format")
+	}
+	if *sanitize != "" && *format != "pprof" {
+		return errors.New("-sanitize requires pprof format")
+	}
+	focusRe, ignoreRe, err := compileFrameFilters(*focus, *ignore)
+	if err != nil {
+		return err
+	}
+
+	buffers, err := agent.LoadPinnedBuffers(*pinDir)
+	if err != nil {
+		return err
+	}
+	// Both buffers are read since the profiler might not have flushed the inactive one yet.
+	var samples []agent.Sample
+	for i := range buffers {
+		defer buffers[i].Close()
+
+		s, err := buffers[i].Samples()
+		if err != nil {
+			return err
+		}
+		samples = append(samples, s...)
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "-" && *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return fmt.Errorf("failed to create output file: %w", err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if *format != "json" {
+		opts := agent.ProfileOptions{
+			Frequency:      *frequency,
+			Mappings:       agent.ProcessMappings(samples),
+			ProcessNames:   agent.ProcessNames(samples),
+			Resources:      agent.ProcessResources(samples),
+			Cmdlines:       agent.ProcessCmdlines(samples),
+			GuessFuncs:     *guessFuncs,
+			Focus:          focusRe,
+			Ignore:         ignoreRe,
+			MinCount:       *minCount,
+			StripGoRuntime: *stripGoRuntime,
+			Labels:         agent.Labels(*labels),
+		}
+		// Kernel frames are left unsymbolized if the kernel symbols are unavailable.
+		if opts.KernelSymbols, err = agent.LoadKernelSymbols(); err != nil {
+			log.Printf("kernel frames won't be symbolized: %v", err)
+		}
+		if *symbolize {
+			if opts.Symbolizer, err = newSymbolizer(*symbolCache, *symbolMemory); err != nil {
+				return err
+			}
+		}
+		if isModelFormat(*format) {
+			if *output == "" {
+				return nil
+			}
+			return writeModel(w, agent.Model(samples, opts), *format, *pinDir)
+		}
+		// The profile is encoded as the samples are converted unless it has to be post-processed.
+		if *sanitize == "" && *perPID == "" {
+			if *output == "" {
+				return nil
+			}
+			if err = agent.WriteProfile(w, samples, opts, agent.Compression{}); err != nil {
+				return fmt.Errorf("failed to write pprof: %w", err)
+			}
+			return nil
+		}
+		p := agent.Profile(samples, opts)
+		if *sanitize != "" {
+			if err = sanitizeProfile(p, *sanitize); err != nil {
+				return err
+			}
+		}
+		if *perPID != "" {
+			if err = writePerPID(p, *perPID); err != nil {
+				return err
+			}
+		}
+		if *output == "" {
+			return nil
+		}
+		if err = p.Write(w); err != nil {
+			return fmt.Errorf("failed to write pprof: %w", err)
+		}
+		return nil
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err = enc.Encode(samples); err != nil {
+		return fmt.Errorf("failed to write json: %w", err)
+	}
+	return nil
+}
+
+// isModelFormat reports whether the output format is written from the profile model, see writeModel.
+func isModelFormat(format string) bool {
+	return format == "folded" || format == "speedscope"
+}
+
+// writeModel writes the profile in the format: folded stacks or speedscope JSON.
+// The name describes the profile in speedscope, e.g., the file it was converted from.
+func writeModel(w io.Writer, p *model.Profile, format, name string) error {
+	var err error
+	switch format {
+	case "folded":
+		err = p.WriteFolded(w)
+	case "speedscope":
+		err = p.WriteSpeedscope(w, name)
+	default:
+		return fmt.Errorf("unknown output format %q", format)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", format, err)
+	}
+	return nil
+}
+
+// newSymbolizer returns a symbolizer which persists the symbol tables in cacheDir
+// and keeps up to maxBytes of them in memory.
+// The tables are only kept in memory if cacheDir is empty.
+func newSymbolizer(cacheDir string, maxBytes int64) (*symbol.Symbolizer, error) {
+	if cacheDir == "" {
+		return symbol.NewSymbolizer(nil, maxBytes), nil
+	}
+
+	store, err := symbol.NewStore(cacheDir)
+	if err != nil {
+		return nil, err
+	}
+	return symbol.NewSymbolizer(store, maxBytes), nil
+}
+
+const (
+	perPIDUsage = "also write one pprof per process named after the template, e.g., profiles/{comm}-{pid}.pb.gz, with {pid}, {comm}, {type}, and {time} placeholders"
+	focusUsage  = "keep only the samples which have a frame (function, source file, or binary) matching the regexp, e.g., 'nginx|ngx_'"
+	ignoreUsage = "drop the samples which have a frame (function, source file, or binary) matching the regexp, e.g., 'epoll_wait'"
+	// minCountUsage describes -min-count flag, see agent.MergeRareStacks.
+	minCountUsage = "merge the stacks seen fewer than N times into an \"(other)\" sample per process, 0 keeps all stacks"
+	// stripGoRuntimeUsage describes -strip-go-runtime flag, see agent.ProfileOptions.StripGoRuntime.
+	stripGoRuntimeUsage = "drop the Go runtime frames which start the goroutines and switch the stacks (runtime.goexit, runtime.mcall, runtime.systemstack) below the program's code, so the Go flame graphs look as with runtime/pprof"
+	// clockUsage describes -clock flag, see agent.Clock.
+	clockUsage = "perf event clock of the cpu mode: cpu samples every CPU, task samples only the threads of the target processes (-pid, -exe, -systemd-unit) while they run, cycles samples every CPU by the CPU cycles (hardware events)"
+	// preciseUsage describes -precise flag, see agent.Config.Precise.
+	preciseUsage = "precise_ip level of the hardware events (-clock cycles) from 0 (arbitrary skid) to 3 (zero skid) using PEBS/IBS, lowered until the PMU accepts it"
+	// frequencyOverrideUsage describes -frequency-override flag, see agent.Config.FrequencyOverrides.
+	frequencyOverrideUsage = "sample the processes of a target at their own frequency (repeatable), e.g., 'exe:/opt/api/bin/*=199', the kinds are pid, exe, systemd-unit, and cgroup, the first matching override wins"
+	// cpuGroupsUsage describes -cpu-groups flag, see agent.Config.CPUGroups.
+	cpuGroupsUsage = "split the online CPUs into N groups (CPU n is in group n mod N) and sample one group at a time, rotating every -cpu-rotation, to bound the overhead on the huge machines; 0 samples all CPUs at once"
+	// cpuRotationUsage describes -cpu-rotation flag, see agent.Config.CPURotation.
+	cpuRotationUsage = "how long each CPU group is sampled before the next one (-cpu-groups)"
+	// lbrUsage describes -lbr flag, see agent.Config.LBR.
+	lbrUsage = "unwind the user stacks of the processes whose executables omit frame pointers by the last branch records (Intel CPUs, -clock cycles), the call stacks are limited to the LBR depth (up to 32 frames)"
+	// ipcUsage describes -ipc flag, see agent.Config.IPC.
+	ipcUsage = "count the instructions along with the cycles (-clock cycles) in an event group per CPU, so the profile has cycles and instructions values and the samples are labeled with their instructions per cycle (ipc) to tell the memory-bound stacks from the compute-bound ones"
+	// sandboxUsage describes -sandbox flag, see agent.Sandbox.
+	sandboxUsage = "restrict the profiler once it has started: seccomp denies exec, ptrace, mounts, and module loading, landlock also limits the file system access to /proc, /sys, the system binaries, -sandbox-read, and the output paths (Linux 5.13+)"
+	// sandboxReadUsage describes -sandbox-read flag, see agent.SandboxOptions.
+	sandboxReadUsage = "comma-separated paths the profiler can read with -sandbox landlock in addition to the defaults, e.g., /home,/srv where the profiled binaries reside"
+	// denyUsage describes -deny flag, see agent.ParseDenylist.
+	denyUsage = "comma-separated rules of the processes which are never sampled even if targeted: comm:<name>, exe:<glob>, cgroup:<path>, or label:<name>=<value>, e.g., comm:vault,exe:/usr/bin/ssh-agent"
+	// stackDepthUsage describes -stack-depth flag, see agent.Config.StackDepth.
+	stackDepthUsage = "max depth of the collected stacks, it's lowered to kernel.perf_event_max_stack sysctl unless -raise-max-stack is set (default 127)"
+	// raiseMaxStackUsage describes -raise-max-stack flag, see agent.Config.RaiseMaxStack.
+	raiseMaxStackUsage = "raise kernel.perf_event_max_stack sysctl to -stack-depth if it's lower (requires CAP_SYS_ADMIN), it's restored on exit"
+	// buildIDStacksUsage describes -build-id-stacks flag, see agent.Config.BuildIDStacks.
+	buildIDStacksUsage = "also record user stacks as build IDs and file offsets to symbolize the processes which exit before their mappings are read (Linux 4.17+)"
+	// perfMapUsage describes -perf-map flag, see agent.PerfMaps.
+	perfMapUsage = "symbolize the code of JIT runtimes (Node.js, JVM, .NET) using /tmp/perf-<pid>.map files watched during the run"
+	// jvmPerfMapUsage describes -jvm-perf-map flag, see agent.PerfMapsOptions.
+	jvmPerfMapUsage = "how often to ask the JVMs (JDK 17+) to dump their perf maps via the attach API, 0 disables it (implies -perf-map if set)"
+	// strictSymbolsUsage describes -strict-symbols flag, see agent.SymbolFailures.
+	strictSymbolsUsage = "fail with a report of the binaries whose addresses couldn't be symbolized (the profile is still written), e.g., to check in CI that the binaries ship with their symbols, by default they're left as addresses"
+	// dotnetPerfMapUsage describes -dotnet-perf-map flag, see agent.PerfMapsOptions.
+	dotnetPerfMapUsage = "enable the perf maps of the .NET (8+) processes via the diagnostics IPC (implies -perf-map)"
+)
+
+// compileFrameFilters compiles -focus and -ignore regexps, see agent.FilterFrames.
+// The regexp is nil when the flag is empty.
+func compileFrameFilters(focus, ignore string) (focusRe, ignoreRe *regexp.Regexp, err error) {
+	if focus != "" {
+		if focusRe, err = regexp.Compile(focus); err != nil {
+			return nil, nil, fmt.Errorf("invalid focus regexp: %w", err)
+		}
+	}
+	if ignore != "" {
+		if ignoreRe, err = regexp.Compile(ignore); err != nil {
+			return nil, nil, fmt.Errorf("invalid ignore regexp: %w", err)
+		}
+	}
+	return focusRe, ignoreRe, nil
+}
+
+// sanitizeProfile replaces sensitive data of the profile with pseudonyms
+// and writes the mapping of pseudonyms to the file, so the owner can de-anonymize the profile.
+func sanitizeProfile(p *profile.Profile, mappingPath string) error {
+	s, err := agent.NewSanitizer()
+	if err != nil {
+		return err
+	}
+	s.Sanitize(p)
+
+	f, err := os.OpenFile(mappingPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create pseudonyms file: %w", err)
+	}
+	if err = s.WriteMapping(f); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write pseudonyms: %w", err)
+	}
+	return f.Close()
+}
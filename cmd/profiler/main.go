@@ -2,123 +2,391 @@
 
 /*
 Program profiler is a CPU profiler based on Parca Agent.
-It takes PID as an input and samples the process 100 times per second.
+It takes PID as an input and samples the process 100 times per second by default.
+On exit it prints the top functions by self samples (see -top flag),
+the raw stack IDs of every flush along with their frames
+(e.g., "[k] do_syscall_64+0x5c" and "main.work+0x1a [app]") are printed with -raw flag.
+The sampling frequency can be changed at runtime via the control socket (see -control flag):
+
+	profiler ctl -control /run/parca-agent.sock frequency 999
+
+The "inspect" command dumps the maps pinned by a running profiler (see -pin flag)
+as JSON or pprof:
+
+	profiler inspect -pin /sys/fs/bpf/parca-agent -format pprof -o cpu.pprof
+
+The "dump-maps" command prints the raw contents of the pinned (or live) maps as JSON
+for debugging and scripting:
+
+	profiler dump-maps -live | jq '.buffers[].counts[] | select(.pid == 1234)'
+
+The "symbols extract" command prepares the symbols of binaries built in CI,
+so they can be shipped stripped:
+
+	profiler symbols extract -format parca -o debuginfo ./bin/server
+
+The "check" command validates pprof profiles and prints their statistics:
+
+	profiler check cpu.pprof
+
+The "addr2src" command prints the source of the hottest functions annotated with samples per line:
+
+	profiler addr2src -top 3 -src $HOME/src cpu.pprof
+
+The "addr2asm" command disassembles the hottest functions and annotates their instructions with samples:
+
+	profiler addr2asm -top 3 cpu.pprof
+
+The "compare" command prints the functions whose CPU share changed most between two profiles,
+or between two consecutive windows collected live:
+
+	profiler compare before.pb.gz after.pb.gz
+	profiler compare -window 30s -pid 1234
+
+The "selftest" command validates the host before deployment: it loads the BPF program,
+verifies that the samples of the current process arrive, and reports which optional kernel features are available:
+
+	sudo profiler selftest
+
+The raw samples can be recorded along with the memory mappings and symbols (see -record flag),
+and converted to pprof later on another machine with the "replay" command:
+
+	profiler -record raw.capture
+	profiler replay -o cpu.pprof raw.capture
+
+The pprof profile of all the samples can be written on exit (see -profile flag),
+e.g., to stdout and piped to pprof:
+
+	profiler -pid 1234 -profile - | go tool pprof -http=: -
+
+The CPU time of the hottest functions can be pushed to Prometheus via remote write
+as parca_agent_function_cpu_seconds time series, giving a lightweight "continuous top":
+
+	profiler -remote-write http://localhost:9090/api/v1/write -remote-write-top 20
+
+The usage metrics derived from the samples, e.g., parca_agent_cpu_samples_total{comm="nginx"},
+can be scraped by Prometheus from /metrics endpoint:
+
+	profiler -metrics :9100
+
+The "serve" command runs the profiler as a long-running daemon which combines
+service discovery, continuous profiling, symbolization, local storage of the profiles,
+the HTTP endpoints (/metrics, /profiles), and remote write:
+
+	profiler serve -exe '/opt/myapp/bin/*' -storage /var/lib/parca-agent/profiles -listen :7071
+
+The exit code tells the failures apart, e.g., 3 if the target isn't found and 4 if the privileges are missing,
+and the exit status is printed to stderr as the final JSON line.
+
+The flags can also be set with PARCA_AGENT_* environment variables,
+e.g., PARCA_AGENT_FREQUENCY=99 for -frequency, which is handy in containers.
+The command line flags take precedence.
 */
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
-	"runtime"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
-	"unsafe"
 
-	"golang.org/x/sys/unix"
+	"diy-parca-agent/agent"
+	"diy-parca-agent/symbol"
 )
 
-//go:generate go run github.com/cilium/ebpf/cmd/bpf2go -cflags $BPF_CFLAGS -cc clang-13 ParcaAgent ./bpf/parca-agent.bpf.c -- -I../../headers
-
 func main() {
-	// By default an exit code is set to indicate a failure since
-	// there are more failure scenarios to begin with.
-	exitCode := 1
-	defer func() { os.Exit(exitCode) }()
+	var (
+		cmd  func([]string) error
+		args = os.Args[1:]
+	)
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "inspect":
+			cmd = inspect
+		case "ctl":
+			cmd = ctl
+		case "symbols":
+			cmd = symbols
+		case "check":
+			cmd = check
+		case "addr2src":
+			cmd = addr2src
+		case "addr2asm":
+			cmd = addr2asm
+		case "replay":
+			cmd = replay
+		case "convert":
+			cmd = convert
+		case "compare":
+			cmd = compare
+		case "serve":
+			cmd = serve
+		case "dump-maps":
+			cmd = dumpMaps
+		case "selftest":
+			cmd = selftest
+		}
+		if cmd != nil {
+			args = os.Args[2:]
+		}
+	}
+	if cmd == nil {
+		cmd = record
+	}
+	os.Exit(exit(cmd(args)))
+}
 
+// record samples the target processes until it receives INT/TERM signal,
+// then it prints the summary and writes the profile and the capture if requested.
+// It's the default command.
+func record(args []string) (runErr error) {
 	pid := flag.Int("pid", -1, "PID whose stack traces should be collected (default is all processes)")
-	flag.Parse()
-
-	// Increase the resource limit of the current process to provide sufficient space
-	// for locking memory for the BPF maps.
-	err := unix.Setrlimit(
-		unix.RLIMIT_MEMLOCK,
-		&unix.Rlimit{
-			Cur: unix.RLIM_INFINITY,
-			Max: unix.RLIM_INFINITY,
-		},
-	)
+	tree := flag.Bool("tree", false, "collect stack traces of the PID's descendants too, including the ones forked while profiling")
+	exe := flag.String("exe", "", "glob pattern of the executables whose processes' stack traces should be collected, e.g., '/opt/myapp/bin/*' (PID is ignored)")
+	timeBucket := flag.Duration("time-bucket", 0, "split the samples by the time they were taken into intervals of this duration, e.g., 1s, so profiles can be sliced with pprof -tagfocus timestamp")
+	stackDepth := flag.Int("stack-depth", 0, stackDepthUsage)
+	raiseMaxStack := flag.Bool("raise-max-stack", false, raiseMaxStackUsage)
+	sandboxMode := flag.String("sandbox", "", sandboxUsage)
+	sandboxRead := flag.String("sandbox-read", "", sandboxReadUsage)
+	buildIDStacks := flag.Bool("build-id-stacks", false, buildIDStacksUsage)
+	walkDepth := flag.Int("walk-depth", 0, fmt.Sprintf("walk user stacks by frame pointers in the BPF program up to this depth (at most %d) instead of bpf_get_stackid()", agent.MaxWalkDepth))
+	var uids uidList
+	flag.Var(&uids, "uid", "comma-separated users (names or IDs) whose processes' stack traces should be collected, it can be combined with -pid or -systemd-unit")
+	cgroups := flag.String("cgroup", "", "comma-separated cgroup v2 paths whose processes' stack traces should be collected including the descendant cgroups, e.g., /system.slice/docker-4f3a.scope, it can be combined with the other targets")
+	deny := flag.String("deny", "", denyUsage)
+	unit := flag.String("systemd-unit", "", "systemd unit whose processes' stack traces should be collected, e.g., nginx.service (PID is ignored)")
+	traceContext := flag.String("trace-context", "", "marker function (path:symbol) the instrumented application calls with the current trace and span IDs, e.g., /opt/myapp/bin/server:main.parcaSetTraceContext, so the samples are labeled with trace_id and span_id")
+	mode := flag.String("mode", string(agent.ModeCPU), fmt.Sprintf("profiling mode, one of %v: cpu samples the stacks on CPUs, blockio attributes block I/O requests and bytes to the stacks issuing them, tcp attributes TCP bytes sent and retransmits to the stacks, runqueue attributes the time tasks waited for a CPU to the stacks", agent.Modes))
+	frequency := flag.Uint64("frequency", agent.DefaultFrequency, "sampling frequency (samples per second)")
+	clock := flag.String("clock", string(agent.ClockCPU), clockUsage)
+	precise := flag.Int("precise", 0, preciseUsage)
+	ipc := flag.Bool("ipc", false, ipcUsage)
+	lbr := flag.Bool("lbr", false, lbrUsage)
+	var frequencyOverrides frequencyOverrideList
+	flag.Var(&frequencyOverrides, "frequency-override", frequencyOverrideUsage)
+	cpuGroups := flag.Int("cpu-groups", 0, cpuGroupsUsage)
+	cpuRotation := flag.Duration("cpu-rotation", agent.DefaultCPURotation, cpuRotationUsage)
+	pinDir := flag.String("pin", "", "BPF file system directory to pin the maps to, e.g., /sys/fs/bpf/parca-agent, so they can be inspected with \"profiler inspect\"")
+	controlPath := flag.String("control", "", "Unix socket to accept control commands on, e.g., /run/parca-agent.sock, see \"profiler ctl\"")
+	remoteWrite := flag.String("remote-write", "", "Prometheus remote write URL to push the CPU time of the hottest functions to, e.g., http://localhost:9090/api/v1/write")
+	remoteWriteTop := flag.Int("remote-write-top", 20, "number of the hottest functions to push per interval, see -remote-write")
+	remoteWriteInterval := flag.Duration("remote-write-interval", 10*time.Second, "how often to push the hottest functions, see -remote-write")
+	metricsAddr := flag.String("metrics", "", "address to serve usage metrics derived from the samples on /metrics, e.g., :9100")
+	profilePath := flag.String("profile", "", "file to write the gzipped pprof profile of all the samples to on exit, - is stdout (the other console output is suppressed), e.g., -profile - | go tool pprof -http=: -")
+	strictSymbols := flag.Bool("strict-symbols", false, strictSymbolsUsage+", see -profile")
+	recordPath := flag.String("record", "", "file to record the raw samples to along with the mappings and symbols needed to symbolize them, see \"profiler replay\"")
+	labels := addLabelFlag(flag.CommandLine)
+	top := flag.Int("top", 20, "print the top N functions by self samples with their self and total percentages on exit, 0 disables it")
+	focus := flag.String("focus", "", focusUsage+", see -profile and -top")
+	ignore := flag.String("ignore", "", ignoreUsage+", see -profile and -top")
+	minCount := flag.Uint64("min-count", 0, minCountUsage+", see -profile")
+	stripGoRuntime := flag.Bool("strip-go-runtime", false, stripGoRuntimeUsage+", see -profile")
+	raw := flag.Bool("raw", false, "print the stack IDs, counts, and frames of every flush")
+	perfMap := flag.Bool("perf-map", false, perfMapUsage)
+	jvmPerfMap := flag.Duration("jvm-perf-map", 0, jvmPerfMapUsage)
+	dotnetPerfMap := flag.Bool("dotnet-perf-map", false, dotnetPerfMapUsage)
+	quiet := flag.Bool("quiet", false, "don't print the progress lines and the stacks of every flush (-raw)")
+	output := flag.String("output", "text", "format of the summary printed on exit: text or json (the sample counts, top functions, dropped stacks, CPU utilization, and mappings), json implies -quiet")
+	mappingReport := flag.String("mapping-report", "text", "print the share of samples per mapping (binary, libc, kernel) on exit: text, json, or none")
+	version := flag.Bool("version", false, "print the agent version, git commit, BPF object hash, and kernel version, and exit")
+	if err := setFlagsFromEnv(flag.CommandLine); err != nil {
+		return err
+	}
+	flag.CommandLine.Parse(args)
+
+	if *version {
+		fmt.Println(agent.ReadBuildInfo())
+		return nil
+	}
+
+	profilingMode, err := agent.ParseMode(*mode)
 	if err != nil {
-		log.Printf("failed to set temporary RLIMIT_MEMLOCK: %v", err)
-		return
+		return err
+	}
+	focusRe, ignoreRe, err := compileFrameFilters(*focus, *ignore)
+	if err != nil {
+		return err
+	}
+	if *mappingReport != "text" && *mappingReport != "json" && *mappingReport != "none" {
+		return fmt.Errorf("unknown mapping report format %q", *mappingReport)
+	}
+	if *output != "text" && *output != "json" {
+		return fmt.Errorf("unknown output format %q", *output)
+	}
+	if *sandboxMode != "" && *unit != "" {
+		return errors.New("-sandbox can't be combined with -systemd-unit which runs systemctl")
+	}
+	denylist, err := agent.ParseDenylist(*deny)
+	if err != nil {
+		return err
+	}
+	// The JSON summary must be the only thing printed to stdout.
+	if *output == "json" {
+		*quiet = true
+	}
+	if *quiet {
+		*raw = false
+	}
+	// The console output is suppressed, so the profile can be piped, e.g., to go tool pprof.
+	// The logs still go to stderr.
+	stdout := os.Stdout
+	if *profilePath == "-" {
+		if os.Stdout, err = os.OpenFile(os.DevNull, os.O_WRONLY, 0); err != nil {
+			return err
+		}
 	}
 
-	objs := ParcaAgentObjects{}
-	if err := LoadParcaAgentObjects(&objs, nil); err != nil {
-		log.Printf("failed to load BPF program and maps: %v", err)
-		return
+	profiler, err := agent.NewProfiler(agent.Config{
+		Mode:               profilingMode,
+		PID:                *pid,
+		Tree:               *tree,
+		Exe:                *exe,
+		SystemdUnit:        *unit,
+		UIDs:               uids,
+		Cgroups:            splitList(*cgroups),
+		Denylist:           denylist,
+		TimeBucket:         *timeBucket,
+		WalkDepth:          *walkDepth,
+		BuildIDStacks:      *buildIDStacks,
+		StackDepth:         *stackDepth,
+		RaiseMaxStack:      *raiseMaxStack,
+		TraceContext:       *traceContext,
+		Frequency:          *frequency,
+		Clock:              agent.Clock(*clock),
+		Precise:            *precise,
+		IPC:                *ipc,
+		LBR:                *lbr,
+		FrequencyOverrides: frequencyOverrides,
+		CPUGroups:          *cpuGroups,
+		CPURotation:        *cpuRotation,
+		PinDir:             *pinDir,
+	})
+	if err != nil {
+		return err
 	}
-	defer objs.Close()
-
-	for cpu := 0; cpu < runtime.NumCPU(); cpu++ {
-		fd, err := unix.PerfEventOpen(
-			&unix.PerfEventAttr{
-				// PERF_TYPE_SOFTWARE event type indicates that
-				// we are measuring software events provided by the kernel.
-				Type: unix.PERF_TYPE_SOFTWARE,
-				// Config is a Type-specific configuration.
-				// PERF_COUNT_SW_CPU_CLOCK reports the CPU clock, a high-resolution per-CPU timer.
-				Config: unix.PERF_COUNT_SW_CPU_CLOCK,
-				// Size of attribute structure for forward/backward compatibility.
-				Size: uint32(unsafe.Sizeof(unix.PerfEventAttr{})),
-				// Sample could mean sampling period (expressed as the number of occurrences of an event)
-				// or frequency (the average rate of samples per second).
-				// See https://perf.wiki.kernel.org/index.php/Tutorial#Period_and_rate.
-				// In order to use frequency PerfBitFreq flag is set below.
-				// The kernel will adjust the sampling period to try and achieve the desired rate.
-				Sample: 100,
-				Bits:   unix.PerfBitDisabled | unix.PerfBitFreq,
-			},
-			*pid,
-			cpu,
-			// groupFd argument allows event groups to be created.
-			// A single event on its own is created with groupFd = -1
-			// and is considered to be a group with only 1 member.
-			-1,
-			// PERF_FLAG_FD_CLOEXEC flag enables the close-on-exec flag for the created
-			// event file descriptor, so that the file descriptor is
-			// automatically closed on execve(2).
-			unix.PERF_FLAG_FD_CLOEXEC,
-		)
+	defer func() {
+		if err = profiler.Close(); err != nil {
+			log.Print(err)
+		}
+	}()
+
+	if *controlPath != "" {
+		ctrl, err := listenControl(*controlPath, profiler)
 		if err != nil {
-			log.Printf("failed to open the perf event: %v", err)
-			return
+			return err
 		}
-		defer func(fd int) {
-			if err = unix.Close(fd); err != nil {
-				log.Printf("failed to close the perf event: %v", err)
+		defer ctrl.Close()
+	}
+
+	// The capture keeps the mappings and symbols of the processes which exit before the profile is written.
+	var capture *agent.Capture
+	if *recordPath != "" || *profilePath != "" {
+		capture = agent.NewCapture(*frequency)
+		capture.Labels = agent.Labels(*labels)
+	}
+	if *recordPath != "" {
+		defer func() {
+			if err = writeCapture(*recordPath, capture); err != nil {
+				log.Print(err)
 			}
-		}(fd)
-
-		// Attach the BPF program to the perf event.
-		err = unix.IoctlSetInt(
-			fd,
-			unix.PERF_EVENT_IOC_SET_BPF,
-			// This BPF program file descriptor was created by a previous bpf(2) system call.
-			objs.ParcaAgentPrograms.DoSample.FD(),
-		)
-		if err != nil {
-			log.Printf("failed to attach BPF program to perf event: %v", err)
-			return
+		}()
+	}
+	if *profilePath != "" {
+		defer func() {
+			err := writeProfile(*profilePath, stdout, capture, *strictSymbols, focusRe, ignoreRe, *minCount, *stripGoRuntime)
+			switch {
+			case err == nil:
+			case runErr == nil:
+				runErr = err
+			default:
+				log.Print(err)
+			}
+		}()
+	}
+
+	var exporter *topExporter
+	if *remoteWrite != "" {
+		exporter = newTopExporter(*remoteWrite, *remoteWriteTop, *remoteWriteInterval, *frequency, agent.Labels(*labels))
+		// The pushes go on after a failure, but the command fails with the last one.
+		defer func() {
+			if runErr == nil && exporter.err != nil {
+				runErr = exporter.err
+			}
+		}()
+	}
+
+	var metrics *agent.Metrics
+	if *metricsAddr != "" {
+		metrics = agent.NewMetrics()
+		if err = serveMetrics(*metricsAddr, metrics); err != nil {
+			return err
 		}
+	}
 
-		// PERF_EVENT_IOC_ENABLE enables the individual event or
-		// event group specified by the file descriptor argument.
-		err = unix.IoctlSetInt(fd, unix.PERF_EVENT_IOC_ENABLE, 0)
+	var report *agent.MappingReport
+	if *mappingReport != "none" {
+		report = agent.NewMappingReport()
+	}
+	stackStats := agent.StackStats{
+		MaxKernelDepth: profiler.StackDepth(),
+		MaxUserDepth:   profiler.StackDepth(),
+	}
+	if *walkDepth > 0 {
+		stackStats.MaxUserDepth = *walkDepth
+	}
+	var perfMaps *agent.PerfMaps
+	if *perfMap || *jvmPerfMap > 0 || *dotnetPerfMap {
+		perfMaps, err = agent.NewPerfMaps(agent.PerfMapsOptions{
+			JVMRefresh: *jvmPerfMap,
+			Dotnet:     *dotnetPerfMap,
+		})
 		if err != nil {
-			log.Fatalf("failed to enable the perf event: %v", err)
-			return
+			return err
 		}
-		// PERF_EVENT_IOC_DISABLE disables the individual counter or
-		// event group specified by the file descriptor argument.
-		defer func(fd int) {
-			err = unix.IoctlSetInt(fd, unix.PERF_EVENT_IOC_DISABLE, 0)
-			if err != nil {
-				log.Printf("failed to disable the perf event: %v", err)
-			}
-		}(fd)
+		defer perfMaps.Close()
+	}
+	var topFuncs *topCollector
+	if *top > 0 {
+		topFuncs = newTopCollector(*frequency, focusRe, ignoreRe, perfMaps)
+	}
+	var frames *agent.FrameFormatter
+	if *raw {
+		frames = &agent.FrameFormatter{
+			Symbolizer: symbol.NewSymbolizer(nil, 256<<20),
+			PerfMaps:   perfMaps,
+		}
+		// Kernel frames are printed as addresses if the kernel symbols are unavailable.
+		if frames.KernelSymbols, err = agent.LoadKernelSymbols(); err != nil {
+			log.Printf("kernel frames won't be symbolized: %v", err)
+		}
+	}
+
+	var writeDirs []string
+	if *pinDir != "" {
+		writeDirs = append(writeDirs, *pinDir)
+	}
+	if *controlPath != "" {
+		writeDirs = append(writeDirs, filepath.Dir(*controlPath))
+	}
+	readPaths := splitList(*sandboxRead)
+	// The perf maps are found in /tmp of the processes.
+	if perfMaps != nil {
+		readPaths = append(readPaths, "/tmp")
+	}
+	if err = sandbox(*sandboxMode, readPaths, writeDirs, []string{*recordPath, *profilePath}); err != nil {
+		return err
 	}
 
 	sig := make(chan os.Signal, 1)
@@ -126,36 +394,290 @@ func main() {
 	ticker := time.NewTicker(time.Second)
 	defer ticker.Stop()
 
-	fmt.Println("Waiting for stack traces...")
+	if !*quiet {
+		fmt.Println("Waiting for stack traces...")
+	}
 Loop:
 	for {
 		select {
 		case <-sig:
 			break Loop
 		case <-ticker.C:
-			var (
-				key   stackCountKey
-				value uint64
-			)
-			it := objs.ParcaAgentMaps.Counts.Iterate()
-			for it.Next(&key, &value) {
-				fmt.Printf("%+v seen %d times\n", key, value)
+			samples, err := profiler.Flush()
+			if err != nil {
+				log.Printf("failed to flush samples: %v", err)
+				continue
+			}
+			stackStats.Add(samples)
+			if capture != nil {
+				capture.Add(samples)
+			}
+			if exporter != nil {
+				exporter.add(samples)
+			}
+			if metrics != nil || report != nil || topFuncs != nil || frames != nil || perfMaps != nil {
+				// The mappings are read while the processes are still running.
+				mappings := agent.ProcessMappings(samples)
+				if metrics != nil {
+					metrics.Add(samples, mappings, agent.ProcessNames(samples))
+				}
+				// The perf maps are parsed before the frames are printed.
+				if perfMaps != nil {
+					perfMaps.WatchProcesses(mappings)
+				}
+				if report != nil {
+					report.Add(samples, mappings)
+				}
+				if topFuncs != nil {
+					topFuncs.add(samples)
+				}
+				if frames != nil {
+					frames.Mappings = mappings
+				}
 			}
-			if err = it.Err(); err != nil {
-				log.Printf("failed to read from Counts map: %v", err)
+			if !*raw {
+				continue
+			}
+			for _, s := range samples {
+				if s.UserStackHash != 0 {
+					fmt.Printf("{PID:%d UserStackHash:%#x KernelStackID:%d} seen %d times\n", s.PID, s.UserStackHash, s.KernelStackID, s.Count)
+				} else {
+					fmt.Printf("{PID:%d UserStackID:%d KernelStackID:%d} seen %d times\n", s.PID, s.UserStackID, s.KernelStackID, s.Count)
+				}
+				for _, f := range frames.Frames(s) {
+					fmt.Printf("    %s\n", f)
+				}
 			}
 		}
 	}
 
+	if *output == "json" {
+		var funcs []agent.FunctionShare
+		if topFuncs != nil {
+			funcs = topFuncs.functions(*top)
+		}
+		cpus, _ := profiler.CPUUtilization()
+		var mappings []agent.MappingShare
+		if report != nil {
+			mappings = report.Shares()
+		}
+		if err = printRunSummary(newRunSummary(&stackStats, profiler.MapStats(), funcs, cpus, mappings)); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	if topFuncs != nil {
+		topFuncs.print(*top)
+	}
+
+	printStackStats(&stackStats, profiler.MapStats())
+
+	// The utilization gives context to the stacks, e.g., whether the CPUs were saturated.
+	if cpus, err := profiler.CPUUtilization(); err == nil {
+		printCPUUtilization(cpus)
+	}
+
+	if report != nil {
+		if err = printMappingReport(report.Shares(), *mappingReport); err != nil {
+			return err
+		}
+	}
+
 	// The program terminates successfully if it received INT/TERM signal.
-	exitCode = 0
+	return nil
+}
+
+// serveMetrics serves the usage metrics on /metrics in the background.
+func serveMetrics(addr string, m *agent.Metrics) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for metrics: %w", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	go func() {
+		if err := http.Serve(ln, mux); err != nil {
+			log.Printf("metrics server stopped: %v", err)
+		}
+	}()
+	return nil
+}
+
+// printCPUUtilization prints the busy vs idle share of each CPU over the profiling window.
+func printCPUUtilization(cpus []agent.CPUUtilization) {
+	fmt.Println("CPU utilization:")
+	for _, u := range cpus {
+		busy := u.BusyShare() * 100
+		fmt.Printf("  cpu %d: busy %.1f%% idle %.1f%%\n", u.CPU, busy, 100-busy)
+	}
+}
+
+// printStackStats prints the share of samples with kernel and user frames,
+// the share of stacks which failed to resolve or were likely truncated, the stack depths, and the map usage.
+func printStackStats(st *agent.StackStats, ms agent.MapStats) {
+	if st.Samples == 0 {
+		return
+	}
+	fmt.Printf("Stacks of %d samples (%d unique):\n", st.Samples, st.UniqueStacks())
+	fmt.Printf("  kernel only %.1f%%, user only %.1f%%, both %.1f%%, none %.1f%%\n",
+		st.Share(st.Kernel)*100, st.Share(st.User)*100, st.Share(st.Both)*100, st.Share(st.Empty)*100)
+	fmt.Printf("  failed to resolve: kernel %.1f%%, user %.1f%%\n",
+		st.Share(st.KernelFailed)*100, st.Share(st.UserFailed)*100)
+	fmt.Printf("  reached max depth (likely truncated): kernel %.1f%%, user %.1f%%\n",
+		st.Share(st.KernelTruncated)*100, st.Share(st.UserTruncated)*100)
+	printDepthHistogram("kernel", st, st.KernelDepths.Buckets())
+	printDepthHistogram("user", st, st.UserDepths.Buckets())
+	fmt.Printf("  peak map usage: counts %d/%d, stack traces %d/%d\n",
+		ms.Counts, ms.CountsCapacity, ms.StackTraces, ms.StackTracesCapacity)
+}
+
+// printDepthHistogram prints the share of samples by the stack depth, e.g., "4-7 12.5%".
+func printDepthHistogram(name string, st *agent.StackStats, buckets []agent.DepthBucket) {
+	if len(buckets) == 0 {
+		return
+	}
+	fmt.Printf("  %s stack depths:", name)
+	for _, b := range buckets {
+		switch {
+		case b.Max == 0:
+			fmt.Printf(" %d+", b.Min)
+		case b.Min == b.Max:
+			fmt.Printf(" %d", b.Min)
+		default:
+			fmt.Printf(" %d-%d", b.Min, b.Max)
+		}
+		fmt.Printf(" %.1f%%", st.Share(b.Samples)*100)
+	}
+	fmt.Println()
+}
+
+// printMappingReport prints the share of samples per mapping in text or json format.
+func printMappingReport(shares []agent.MappingShare, format string) error {
+	if format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(shares); err != nil {
+			return fmt.Errorf("failed to write mapping report: %w", err)
+		}
+		return nil
+	}
+
+	if len(shares) == 0 {
+		return nil
+	}
+	fmt.Println("Samples per mapping:")
+	for _, s := range shares {
+		fmt.Printf("  %5.1f%% %8d  %s\n", s.Share*100, s.Samples, s.Mapping)
+	}
+	return nil
 }
 
-// stackCountKey represents "Counts" map key sent to user space from the BPF program running in the kernel.
-// Note, that it must match the C stack_count_key_t struct,
-// and both C and Go structs must be aligned the same way.
-type stackCountKey struct {
-	PID           uint32
-	UserStackID   int32
-	KernelStackID int32
+// writeProfile writes the pprof profile of the captured samples to the file or stdout if the path is "-".
+// The samples are filtered by their symbolized frames if focus or ignore is set, see agent.FilterFrames,
+// and then the stacks seen fewer than minCount times are merged, see agent.MergeRareStacks.
+// The Go scheduling frames below the program's code are dropped with stripGoRuntime, see agent.ProfileOptions.
+// With strictSymbols it fails after writing the profile if any binary couldn't be symbolized, see checkSymbols.
+func writeProfile(path string, stdout *os.File, c *agent.Capture, strictSymbols bool, focus, ignore *regexp.Regexp, minCount uint64, stripGoRuntime bool) error {
+	opts := c.ProfileOptions(symbol.NewSymbolizer(nil, 256<<20))
+	opts.Focus = focus
+	opts.Ignore = ignore
+	opts.MinCount = minCount
+	opts.StripGoRuntime = stripGoRuntime
+	var failures *agent.SymbolFailures
+	if strictSymbols {
+		failures = agent.NewSymbolFailures()
+		opts.SymbolizeFailed = failures.Add
+	}
+	if path == "-" {
+		if err := agent.WriteProfile(stdout, c.Samples, opts, agent.Compression{}); err != nil {
+			return fmt.Errorf("failed to write pprof: %w", err)
+		}
+		return checkSymbols(failures)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create profile file: %w", err)
+	}
+	if err = agent.WriteProfile(f, c.Samples, opts, agent.Compression{}); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write pprof: %w", err)
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return checkSymbols(failures)
+}
+
+func writeCapture(path string, c *agent.Capture) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create capture file: %w", err)
+	}
+	if err = c.Write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// splitList splits the comma-separated flag value, e.g., -cgroup /a,/b.
+func splitList(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
+// uidList is a flag of comma-separated user names or IDs, e.g., -uid www-data,1000.
+type uidList []uint32
+
+func (l *uidList) String() string {
+	ids := make([]string, len(*l))
+	for i, uid := range *l {
+		ids[i] = strconv.FormatUint(uint64(uid), 10)
+	}
+	return strings.Join(ids, ",")
+}
+
+func (l *uidList) Set(value string) error {
+	*l = nil
+	for _, name := range strings.Split(value, ",") {
+		if uid, err := strconv.ParseUint(name, 10, 32); err == nil {
+			*l = append(*l, uint32(uid))
+			continue
+		}
+
+		u, err := user.Lookup(name)
+		if err != nil {
+			return err
+		}
+		uid, err := strconv.ParseUint(u.Uid, 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid UID %q of user %s", u.Uid, name)
+		}
+		*l = append(*l, uint32(uid))
+	}
+	return nil
+}
+
+// frequencyOverrideList collects the repeatable -frequency-override flags, see agent.ParseFrequencyOverride.
+type frequencyOverrideList []agent.FrequencyOverride
+
+func (l *frequencyOverrideList) String() string {
+	overrides := make([]string, len(*l))
+	for i, o := range *l {
+		overrides[i] = o.String()
+	}
+	return strings.Join(overrides, ",")
+}
+
+func (l *frequencyOverrideList) Set(value string) error {
+	o, err := agent.ParseFrequencyOverride(value)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, o)
+	return nil
 }
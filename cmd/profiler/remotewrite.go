@@ -0,0 +1,92 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"diy-parca-agent/agent"
+	"diy-parca-agent/symbol"
+)
+
+// topExporter accumulates the flushed samples and pushes the hottest functions
+// to Prometheus remote write endpoint every interval, see -remote-write flag.
+type topExporter struct {
+	writer     *agent.RemoteWriter
+	interval   time.Duration
+	frequency  uint64
+	kernel     *agent.KernelSymbols
+	symbolizer *symbol.Symbolizer
+	// labels are attached to the pushed series, see -label flag.
+	labels agent.Labels
+
+	start    time.Time
+	samples  []agent.Sample
+	mappings map[uint32][]agent.Mapping
+	names    map[uint32]string
+	// err is the last failed push, the command fails with it, see agent.FailureUploadFailed.
+	err error
+}
+
+func newTopExporter(url string, top int, interval time.Duration, frequency uint64, labels agent.Labels) *topExporter {
+	e := topExporter{
+		writer:     agent.NewRemoteWriter(url, top),
+		interval:   interval,
+		frequency:  frequency,
+		symbolizer: symbol.NewSymbolizer(nil, 256<<20),
+		labels:     labels,
+		start:      time.Now(),
+		mappings:   make(map[uint32][]agent.Mapping),
+		names:      make(map[uint32]string),
+	}
+	// Kernel frames are left unsymbolized if the kernel symbols are unavailable.
+	var err error
+	if e.kernel, err = agent.LoadKernelSymbols(); err != nil {
+		log.Printf("kernel frames won't be symbolized: %v", err)
+	}
+	return &e
+}
+
+// add adds the samples and pushes the time series once the interval has passed.
+// The mappings and names of the processes are read right away
+// because the processes might exit before the push.
+func (e *topExporter) add(samples []agent.Sample) {
+	e.samples = append(e.samples, samples...)
+	for pid, mm := range agent.ProcessMappings(samples) {
+		if _, ok := e.mappings[pid]; !ok {
+			e.mappings[pid] = mm
+		}
+	}
+	for pid, name := range agent.ProcessNames(samples) {
+		e.names[pid] = name
+	}
+
+	now := time.Now()
+	if now.Sub(e.start) < e.interval {
+		return
+	}
+
+	p := agent.EncodeProfile(e.samples, agent.ProfileOptions{
+		Frequency:     e.frequency,
+		Mappings:      e.mappings,
+		ProcessNames:  e.names,
+		KernelSymbols: e.kernel,
+		Symbolizer:    e.symbolizer,
+		Start:         e.start,
+		Duration:      now.Sub(e.start),
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), e.interval)
+	defer cancel()
+	if err := e.writer.Write(ctx, p, e.labels); err != nil {
+		log.Print(err)
+		e.err = err
+	}
+
+	e.start = now
+	e.samples = nil
+	e.mappings = make(map[uint32][]agent.Mapping)
+	e.names = make(map[uint32]string)
+}
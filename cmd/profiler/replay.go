@@ -0,0 +1,171 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/pprof/profile"
+
+	"diy-parca-agent/agent"
+)
+
+// replay converts the raw capture recorded with -record flag into a pprof profile.
+// The capture is self-contained, so it can be replayed on another machine
+// after the sampled processes have exited.
+func replay(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	output := fs.String("o", "-", "file to write the profile to, - is stdout, the merged profile isn't written if it's empty")
+	format := fs.String("format", "pprof", "output format: pprof, folded, or speedscope")
+	perPID := fs.String("per-pid", "", perPIDUsage)
+	symbolCache := fs.String("symbol-cache", "", "directory with the symbol tables extracted earlier, they are used when the capture lacks a table")
+	sanitize := fs.String("sanitize", "", "replace file paths and labels in pprof with pseudonyms and write their mapping to the file, e.g., pseudonyms.json")
+	focus := fs.String("focus", "", focusUsage)
+	ignore := fs.String("ignore", "", ignoreUsage)
+	minCount := fs.Uint64("min-count", 0, minCountUsage)
+	stripGoRuntime := fs.Bool("strip-go-runtime", false, stripGoRuntimeUsage)
+	strictSymbols := fs.Bool("strict-symbols", false, strictSymbolsUsage)
+	labels := addLabelFlag(fs)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: profiler replay [flags] raw.capture")
+	}
+	if *format != "pprof" && !isModelFormat(*format) {
+		return fmt.Errorf("unknown output format %q", *format)
+	}
+	if (*perPID != "" || *sanitize != "") && *format != "pprof" {
+		return errors.New("-per-pid and -sanitize require pprof format")
+	}
+	focusRe, ignoreRe, err := compileFrameFilters(*focus, *ignore)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("failed to open capture: %w", err)
+	}
+	defer f.Close()
+	c, err := agent.ReadCapture(f)
+	if err != nil {
+		return err
+	}
+
+	// The captured tables must stay in memory, so there is no memory budget.
+	s, err := newSymbolizer(*symbolCache, 0)
+	if err != nil {
+		return err
+	}
+	opts := c.ProfileOptions(s)
+	opts.MinCount = *minCount
+	opts.StripGoRuntime = *stripGoRuntime
+	opts.Focus = focusRe
+	opts.Ignore = ignoreRe
+	// The labels override the recorded ones of the same name.
+	if len(*labels) > 0 {
+		opts.Labels = make(agent.Labels, len(c.Labels)+len(*labels))
+		for name, value := range c.Labels {
+			opts.Labels[name] = value
+		}
+		for name, value := range *labels {
+			opts.Labels[name] = value
+		}
+	}
+	var failures *agent.SymbolFailures
+	if *strictSymbols {
+		failures = agent.NewSymbolFailures()
+		opts.SymbolizeFailed = failures.Add
+	}
+
+	var p *profile.Profile
+	// The profile is encoded as the samples are converted unless it has to be post-processed.
+	if *sanitize != "" || *perPID != "" {
+		p = agent.Profile(c.Samples, opts)
+	}
+	if *sanitize != "" {
+		if err = sanitizeProfile(p, *sanitize); err != nil {
+			return err
+		}
+	}
+	if *perPID != "" {
+		if err = writePerPID(p, *perPID); err != nil {
+			return err
+		}
+	}
+	if *output == "" {
+		return checkSymbols(failures)
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "-" {
+		out, err := os.Create(*output)
+		if err != nil {
+			return fmt.Errorf("failed to create output file: %w", err)
+		}
+		defer out.Close()
+		w = out
+	}
+	if isModelFormat(*format) {
+		if err = writeModel(w, agent.Model(c.Samples, opts), *format, filepath.Base(fs.Arg(0))); err != nil {
+			return err
+		}
+		return checkSymbols(failures)
+	}
+	if p != nil {
+		err = p.Write(w)
+	} else {
+		err = agent.WriteProfile(w, c.Samples, opts, agent.Compression{})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write pprof: %w", err)
+	}
+	return checkSymbols(failures)
+}
+
+// checkSymbols prints the binaries which failed to symbolize to stderr
+// and returns an error if there are any, see -strict-symbols.
+func checkSymbols(failures *agent.SymbolFailures) error {
+	if failures == nil || failures.Len() == 0 {
+		return nil
+	}
+	fmt.Fprintln(os.Stderr, "Unresolved mappings:")
+	for _, m := range failures.Mappings() {
+		name := m.Path
+		if m.BuildID != "" {
+			name += " (build ID " + m.BuildID + ")"
+		}
+		fmt.Fprintf(os.Stderr, "  %s: %d addresses: %s\n", name, m.Addresses, m.Error)
+	}
+	return fmt.Errorf("%d binaries failed to symbolize", failures.Len())
+}
+
+// writePerPID writes one pprof file per process of the profile named after the template, see agent.PerPIDPath.
+func writePerPID(p *profile.Profile, template string) error {
+	if !strings.Contains(template, "{pid}") {
+		return fmt.Errorf("per-process file name template %q must contain {pid}", template)
+	}
+	for _, pp := range agent.SplitByPID(p) {
+		path := agent.PerPIDPath(template, pp.Profile, pp.PID, pp.Comm)
+		if dir := filepath.Dir(path); dir != "." {
+			if err := os.MkdirAll(dir, 0o755); err != nil {
+				return fmt.Errorf("failed to create output directory: %w", err)
+			}
+		}
+		f, err := os.Create(path)
+		if err != nil {
+			return fmt.Errorf("failed to create output file: %w", err)
+		}
+		err = pp.Profile.Write(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("failed to write pprof: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"diy-parca-agent/agent"
+)
+
+// sandbox applies -sandbox mode once the profiler has started, see agent.Sandbox:
+// seccomp denies the dangerous system calls, and landlock also restricts the file system access
+// to the default and the given paths (e.g., -sandbox-read) plus the writable directories and files.
+// The files are written to their directories, so the directories are made writable instead.
+func sandbox(mode string, readPaths, writeDirs, writeFiles []string) error {
+	var opts agent.SandboxOptions
+	switch mode {
+	case "":
+		return nil
+	case "seccomp":
+	case "landlock":
+		opts.Landlock = true
+	default:
+		return fmt.Errorf("unknown sandbox mode %q", mode)
+	}
+
+	opts.ReadPaths = readPaths
+	for _, dir := range writeDirs {
+		if dir != "" {
+			opts.WritePaths = append(opts.WritePaths, dir)
+		}
+	}
+	for _, path := range writeFiles {
+		if path != "" && path != "-" {
+			opts.WritePaths = append(opts.WritePaths, filepath.Dir(path))
+		}
+	}
+	return agent.Sandbox(opts)
+}
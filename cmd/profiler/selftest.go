@@ -0,0 +1,83 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"diy-parca-agent/agent"
+)
+
+// selftest validates that the profiler works on the host before it's deployed:
+// the BPF program loads, the samples of the current process arrive,
+// and which optional features the kernel supports.
+// It fails if any required check fails, so it can gate a rollout.
+func selftest(args []string) error {
+	fs := flag.NewFlagSet("selftest", flag.ExitOnError)
+	output := fs.String("output", "text", "format of the report: text or json")
+	fs.Parse(args)
+
+	if *output != "text" && *output != "json" {
+		return fmt.Errorf("unknown output format %q", *output)
+	}
+
+	checks := agent.SelfTest()
+	var failed *agent.SelfTestCheck
+	for i := range checks {
+		if !checks[i].OK && checks[i].Required {
+			failed = &checks[i]
+			break
+		}
+	}
+
+	if *output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err := enc.Encode(struct {
+			OK     bool                  `json:"ok"`
+			Checks []agent.SelfTestCheck `json:"checks"`
+		}{failed == nil, checks})
+		if err != nil {
+			return fmt.Errorf("failed to write report: %w", err)
+		}
+	} else {
+		printSelfTest(checks)
+	}
+
+	if failed != nil {
+		return fmt.Errorf("self-test failed: %s: %w", failed.Name, failed.Err)
+	}
+	return nil
+}
+
+// printSelfTest prints a line per check: its status, name, and details.
+// The optional features which aren't available are reported as "no" instead of "FAIL".
+func printSelfTest(checks []agent.SelfTestCheck) {
+	fmt.Println("Required:")
+	for _, c := range checks {
+		if c.Required {
+			printSelfTestCheck(c, "FAIL")
+		}
+	}
+	fmt.Println("Optional features:")
+	for _, c := range checks {
+		if !c.Required {
+			printSelfTestCheck(c, "no")
+		}
+	}
+}
+
+func printSelfTestCheck(c agent.SelfTestCheck, failed string) {
+	status := "ok"
+	if !c.OK {
+		status = failed
+	}
+	if c.Detail == "" {
+		fmt.Printf("  %-4s  %s\n", status, c.Name)
+		return
+	}
+	fmt.Printf("  %-4s  %s: %s\n", status, c.Name, c.Detail)
+}
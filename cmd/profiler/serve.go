@@ -0,0 +1,502 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"diy-parca-agent/agent"
+)
+
+// serve runs the profiler as a long-running daemon:
+// it continuously profiles the discovered targets, symbolizes the profiles,
+// keeps them in local storage, serves them along with the usage metrics over HTTP,
+// and passes them to the configured sinks, e.g., uploads them to Parca
+// and pushes the hottest functions via Prometheus remote write.
+// It's the production counterpart to the one-shot record flow.
+func serve(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	listen := fs.String("listen", ":7071", "address to serve /metrics, /profiles, and /profiles/latest on")
+	storageDir := fs.String("storage", "", "directory to keep the profiles in, e.g., /var/lib/parca-agent/profiles (they're only kept in memory if empty)")
+	retention := fs.Duration("retention", 24*time.Hour, "how long to keep the profiles in -storage")
+	interval := fs.Duration("interval", agent.DefaultInterval, "how often to produce a profile")
+	align := fs.Duration("align", 0, "produce the profiles on the wall-clock multiples of the duration instead of every -interval, e.g., 1m produces them at :00 of each minute, so they're comparable across hosts")
+	symbolCache := fs.String("symbol-cache", "", "directory to persist the extracted symbol tables, e.g., /var/cache/parca-agent/symbols")
+	symbolMemory := fs.Int64("symbol-memory", 256<<20, "memory budget in bytes for the symbol tables and the process and perf map caches, 0 means no limit")
+	symbolizeBudget := fs.Duration("symbolize-budget", time.Second, "how long a profile may spend loading symbol tables, the binaries which don't fit are loaded in the background and their addresses are left unsymbolized meanwhile, 0 means no limit")
+	remoteWrite := fs.String("remote-write", "", "Prometheus remote write URL to push the CPU time of the hottest functions to, e.g., http://localhost:9090/api/v1/write")
+	remoteWriteTop := fs.Int("remote-write-top", 20, "number of the hottest functions to push per profile, see -remote-write")
+	outputDir := fs.String("output-dir", "", "directory to write each profile to as a gzipped pprof file, e.g., /var/lib/parca-agent/out")
+	outputPerPID := fs.String("output-per-pid", "", "also write one pprof per process to -output-dir named after the template, e.g., "+agent.DefaultPerPIDTemplate+", with {pid}, {comm}, {type}, and {time} placeholders")
+	compression := fs.String("compression", "gzip", "compression of the stored, written, and uploaded profiles: gzip, gzip:<level> from 1 (fastest) to 9 (smallest), or none to save CPU at high flush rates")
+	outputMerged := fs.Bool("output-merged", true, "write the merged profile of all processes to -output-dir, see -output-per-pid")
+	parcaURL := fs.String("parca", "", "Parca server URL to upload the profiles to, e.g., http://localhost:7070")
+	parcaToken := fs.String("parca-token", "", "bearer token to authenticate the uploads to -parca")
+	pyroscopeURL := fs.String("pyroscope", "", "Pyroscope server URL to upload the profiles to, e.g., http://localhost:4040")
+	pyroscopeApp := fs.String("pyroscope-app", "parca-agent", "application name of the profiles uploaded to -pyroscope")
+	otlpURL := fs.String("otlp", "", "OTLP/HTTP collector URL to export the profiles to, e.g., http://localhost:4318")
+	stdout := fs.Int("stdout", 0, "print the given number of the hottest functions of each profile to stdout")
+	labels := addLabelFlag(fs)
+	var targetLabels targetLabelList
+	fs.Var(&targetLabels, "target-label", "labels of the samples of the processes matched by the rules which override the other labels (repeatable), e.g., 'exe:/opt/payments/bin/* team=payments', the rules are the same as of -deny")
+	hostLabels := fs.Bool("host-labels", true, "attach the host labels to the profiles and their samples: hostname, node (from NODE_NAME), and cloud, instance_id, region, and zone (from the cloud metadata endpoints, see -cloud-metadata), the -label flags take precedence")
+	cloudMetadata := fs.Bool("cloud-metadata", true, "look up the AWS, GCP, and Azure metadata endpoints for -host-labels, disable it in the air-gapped environments")
+	labelProviders := fs.String("label-providers", "", "comma-separated providers which label the samples per process: proc (exe, uid), cgroup (cgroup, container_id), kubernetes (pod_uid, pod, namespace)")
+	var triggerTargets triggerTargetList
+	fs.Var(&triggerTargets, "trigger-target", "named target which is profiled intensively when an alert fires (repeatable), e.g., api=exe:/opt/api/bin/*, the kinds are pid, exe, systemd-unit, and cgroup, see /trigger endpoint")
+	triggerWindow := fs.Duration("trigger-window", 30*time.Second, "how long to profile a -trigger-target when an alert fires")
+	triggerFrequency := fs.Uint64("trigger-frequency", 999, "sampling frequency (samples per second) of the -trigger-target windows")
+	triggerToken := fs.String("trigger-token", "", "bearer token required by /trigger endpoint")
+	controlPath := fs.String("control", "", "Unix socket to accept control commands on, e.g., /run/parca-agent.sock, see \"profiler ctl\"")
+	pid := fs.Int("pid", -1, "PID whose stack traces should be collected (default is all processes)")
+	tree := fs.Bool("tree", false, "collect stack traces of the PID's descendants too")
+	exe := fs.String("exe", "", "glob pattern of the executables whose processes' stack traces should be collected, e.g., '/opt/myapp/bin/*'")
+	unit := fs.String("systemd-unit", "", "systemd unit whose processes' stack traces should be collected, e.g., nginx.service")
+	var uids uidList
+	fs.Var(&uids, "uid", "comma-separated users (names or IDs) whose processes' stack traces should be collected")
+	cgroups := fs.String("cgroup", "", "comma-separated cgroup v2 paths whose processes' stack traces should be collected, e.g., /system.slice/docker-4f3a.scope")
+	deny := fs.String("deny", "", denyUsage)
+	mode := fs.String("mode", string(agent.ModeCPU), fmt.Sprintf("profiling mode, one of %v", agent.Modes))
+	frequency := fs.Uint64("frequency", agent.DefaultFrequency, "sampling frequency (samples per second)")
+	clock := fs.String("clock", string(agent.ClockCPU), clockUsage)
+	precise := fs.Int("precise", 0, preciseUsage)
+	ipc := fs.Bool("ipc", false, ipcUsage)
+	lbr := fs.Bool("lbr", false, lbrUsage)
+	var frequencyOverrides frequencyOverrideList
+	fs.Var(&frequencyOverrides, "frequency-override", frequencyOverrideUsage)
+	cpuGroups := fs.Int("cpu-groups", 0, cpuGroupsUsage)
+	cpuRotation := fs.Duration("cpu-rotation", agent.DefaultCPURotation, cpuRotationUsage)
+	stackDepth := fs.Int("stack-depth", 0, stackDepthUsage)
+	raiseMaxStack := fs.Bool("raise-max-stack", false, raiseMaxStackUsage)
+	sandboxMode := fs.String("sandbox", "", sandboxUsage)
+	sandboxRead := fs.String("sandbox-read", "", sandboxReadUsage)
+	buildIDStacks := fs.Bool("build-id-stacks", false, buildIDStacksUsage)
+	focus := fs.String("focus", "", focusUsage)
+	ignore := fs.String("ignore", "", ignoreUsage)
+	minCount := fs.Uint64("min-count", 0, minCountUsage)
+	stripGoRuntime := fs.Bool("strip-go-runtime", false, stripGoRuntimeUsage)
+	perfMap := fs.Bool("perf-map", false, perfMapUsage)
+	jvmPerfMap := fs.Duration("jvm-perf-map", 0, jvmPerfMapUsage)
+	dotnetPerfMap := fs.Bool("dotnet-perf-map", false, dotnetPerfMapUsage)
+	if err := setFlagsFromEnv(fs); err != nil {
+		return err
+	}
+	fs.Parse(args)
+
+	profilingMode, err := agent.ParseMode(*mode)
+	if err != nil {
+		return err
+	}
+	focusRe, ignoreRe, err := compileFrameFilters(*focus, *ignore)
+	if err != nil {
+		return err
+	}
+	if *sandboxMode != "" && *unit != "" {
+		return errors.New("-sandbox can't be combined with -systemd-unit which runs systemctl")
+	}
+	for name, c := range triggerTargets {
+		if *sandboxMode != "" && c.SystemdUnit != "" {
+			return fmt.Errorf("-sandbox can't be combined with -trigger-target %s which runs systemctl", name)
+		}
+	}
+	denylist, err := agent.ParseDenylist(*deny)
+	if err != nil {
+		return err
+	}
+	symbolizer, err := newSymbolizer(*symbolCache, *symbolMemory)
+	if err != nil {
+		return err
+	}
+	profileCompression, err := agent.ParseCompression(*compression)
+	if err != nil {
+		return err
+	}
+	store, err := newProfileStore(*storageDir, *retention, profileCompression)
+	if err != nil {
+		return err
+	}
+	profileLabels := agent.Labels(*labels)
+	if *hostLabels {
+		var timeout time.Duration
+		if *cloudMetadata {
+			timeout = agent.DefaultMetadataTimeout
+		}
+		// The explicit labels override the detected ones.
+		hl := agent.HostLabels(context.Background(), timeout)
+		for name, value := range profileLabels {
+			hl[name] = value
+		}
+		profileLabels = hl
+		log.Printf("host labels: %v", hl)
+	}
+	providers, err := agent.ParseLabelProviders(*labelProviders)
+	if err != nil {
+		return err
+	}
+	// The global labels go first and the per-target ones last, so the latter take precedence.
+	if len(profileLabels) > 0 {
+		providers = append([]agent.LabelProvider{agent.StaticLabelProvider(profileLabels)}, providers...)
+	}
+	if len(targetLabels) > 0 {
+		providers = append(providers, agent.TargetLabelProvider(targetLabels))
+	}
+	// The profiles are always stored, and the other sinks are optional.
+	sinks := []agent.Sink{agent.SinkFunc(func(ctx context.Context, p *agent.EncodedProfile, labels agent.Labels) error {
+		return store.add(p)
+	})}
+	if *outputDir != "" && *outputMerged {
+		s, err := agent.NewFileSink(*outputDir)
+		if err != nil {
+			return err
+		}
+		s.SetCompression(profileCompression)
+		sinks = append(sinks, s)
+	}
+	if *outputDir != "" && *outputPerPID != "" {
+		s, err := agent.NewPerPIDFileSink(*outputDir, *outputPerPID)
+		if err != nil {
+			return err
+		}
+		s.SetCompression(profileCompression)
+		sinks = append(sinks, s)
+	}
+	if *parcaURL != "" {
+		s := agent.NewParcaSink(*parcaURL, *parcaToken)
+		s.SetCompression(profileCompression)
+		sinks = append(sinks, s)
+	}
+	if *pyroscopeURL != "" {
+		s := agent.NewPyroscopeSink(*pyroscopeURL, *pyroscopeApp)
+		s.SetCompression(profileCompression)
+		sinks = append(sinks, s)
+	}
+	if *otlpURL != "" {
+		s := agent.NewOTLPSink(*otlpURL)
+		s.SetCompression(profileCompression)
+		sinks = append(sinks, s)
+	}
+	if *stdout > 0 {
+		sinks = append(sinks, agent.NewStdoutSink(*stdout))
+	}
+	if *remoteWrite != "" {
+		w := agent.NewRemoteWriter(*remoteWrite, *remoteWriteTop)
+		w.SetSampleLabels(agent.TargetLabelProvider(targetLabels).Names()...)
+		sinks = append(sinks, w)
+	}
+	metrics := agent.NewMetrics()
+
+	ln, err := net.Listen("tcp", *listen)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	mux.Handle("/profiles", store)
+	mux.Handle("/profiles/", store)
+	if len(triggerTargets) > 0 {
+		trigger := newTriggerHandler(triggerTargets, *triggerWindow, *triggerFrequency, *triggerToken)
+		trigger.denylist = denylist
+		trigger.symbolizer = symbolizer
+		trigger.sink = agent.MultiSink(sinks)
+		trigger.labels = profileLabels
+		defer trigger.Close()
+		mux.Handle("/trigger", trigger)
+	}
+	srv := http.Server{Handler: mux}
+	go func() {
+		if err := srv.Serve(ln); err != http.ErrServerClosed {
+			log.Printf("HTTP server stopped: %v", err)
+		}
+	}()
+	defer srv.Close()
+
+	a, err := agent.Start(agent.Config{
+		Mode:               profilingMode,
+		PID:                *pid,
+		Tree:               *tree,
+		Exe:                *exe,
+		SystemdUnit:        *unit,
+		UIDs:               uids,
+		Cgroups:            splitList(*cgroups),
+		Denylist:           denylist,
+		Frequency:          *frequency,
+		Clock:              agent.Clock(*clock),
+		Precise:            *precise,
+		IPC:                *ipc,
+		LBR:                *lbr,
+		FrequencyOverrides: frequencyOverrides,
+		CPUGroups:          *cpuGroups,
+		CPURotation:        *cpuRotation,
+		BuildIDStacks:      *buildIDStacks,
+		StackDepth:         *stackDepth,
+		RaiseMaxStack:      *raiseMaxStack,
+		Interval:           *interval,
+		Align:              *align,
+		Symbolizer:         symbolizer,
+		SymbolizeBudget:    *symbolizeBudget,
+		PerfMaps:           *perfMap || *jvmPerfMap > 0 || *dotnetPerfMap,
+		JVMPerfMaps:        *jvmPerfMap,
+		DotnetPerfMaps:     *dotnetPerfMap,
+		Focus:              focusRe,
+		Ignore:             ignoreRe,
+		MinCount:           *minCount,
+		StripGoRuntime:     *stripGoRuntime,
+		Metrics:            metrics,
+		Sinks:              sinks,
+		Labels:             profileLabels,
+		LabelProviders:     providers,
+	})
+	if err != nil {
+		return err
+	}
+
+	if *controlPath != "" {
+		ctrl, err := listenControl(*controlPath, a.Profiler())
+		if err != nil {
+			a.Stop()
+			return err
+		}
+		defer ctrl.Close()
+	}
+
+	writeDirs := []string{*storageDir, *outputDir, *symbolCache}
+	if *controlPath != "" {
+		writeDirs = append(writeDirs, filepath.Dir(*controlPath))
+	}
+	readPaths := splitList(*sandboxRead)
+	// The perf maps are found in /tmp of the processes.
+	if *perfMap || *jvmPerfMap > 0 || *dotnetPerfMap {
+		readPaths = append(readPaths, "/tmp")
+	}
+	if err = sandbox(*sandboxMode, readPaths, writeDirs, nil); err != nil {
+		a.Stop()
+		return err
+	}
+
+	log.Printf("serving on %s", ln.Addr())
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	<-sig
+
+	// The samples collected since the last profile are stored on exit.
+	return a.Stop()
+}
+
+// parseLabels parses the comma-separated labels, e.g., "env=prod,service=api".
+func parseLabels(s string) (agent.Labels, error) {
+	if s == "" {
+		return nil, nil
+	}
+	labels := make(agent.Labels)
+	for _, pair := range splitList(s) {
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid label %q, expected name=value", pair)
+		}
+		labels[name] = value
+	}
+	return labels, nil
+}
+
+// labelList collects the repeatable -label flags, each is name=value or comma-separated pairs.
+type labelList agent.Labels
+
+// labelUsage describes -label flag, see addLabelFlag.
+const labelUsage = "label to attach to the profiles and their samples (repeatable), e.g., -label env=prod -label team=payments or -label env=prod,team=payments"
+
+// addLabelFlag registers the repeatable -label flag on the commands which emit profiles.
+func addLabelFlag(fs *flag.FlagSet) *labelList {
+	var l labelList
+	fs.Var(&l, "label", labelUsage)
+	return &l
+}
+
+func (l *labelList) String() string {
+	pairs := make([]string, 0, len(*l))
+	for name, value := range *l {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (l *labelList) Set(value string) error {
+	labels, err := parseLabels(value)
+	if err != nil {
+		return err
+	}
+	if *l == nil {
+		*l = make(labelList)
+	}
+	for name, v := range labels {
+		(*l)[name] = v
+	}
+	return nil
+}
+
+// targetLabelList collects the repeatable -target-label flags, see agent.ParseTargetLabels.
+type targetLabelList []agent.TargetLabels
+
+func (l *targetLabelList) String() string {
+	if len(*l) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d rules", len(*l))
+}
+
+func (l *targetLabelList) Set(value string) error {
+	t, err := agent.ParseTargetLabels(value)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, t)
+	return nil
+}
+
+// profileStore keeps the recent profiles in a directory (or only the latest one in memory)
+// and serves them over HTTP:
+// /profiles lists the stored profiles as JSON, /profiles/latest and /profiles/<name> download them.
+type profileStore struct {
+	dir         string
+	retention   time.Duration
+	compression agent.Compression
+
+	mu     sync.Mutex
+	latest []byte
+}
+
+// storedProfile describes a profile in the store.
+type storedProfile struct {
+	Name string    `json:"name"`
+	Time time.Time `json:"time"`
+	Size int64     `json:"size"`
+}
+
+func newProfileStore(dir string, retention time.Duration, compression agent.Compression) (*profileStore, error) {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, fmt.Errorf("failed to create storage directory: %w", err)
+		}
+	}
+	return &profileStore{dir: dir, retention: retention, compression: compression}, nil
+}
+
+// add stores the profile and removes the ones older than the retention period.
+func (s *profileStore) add(p *agent.EncodedProfile) error {
+	var b bytes.Buffer
+	if err := p.Write(&b, s.compression); err != nil {
+		return fmt.Errorf("failed to encode profile: %w", err)
+	}
+
+	s.mu.Lock()
+	s.latest = b.Bytes()
+	s.mu.Unlock()
+
+	if s.dir == "" {
+		return nil
+	}
+	name := "profile-" + p.Start.UTC().Format("20060102T150405Z") + s.compression.Ext()
+	if err := os.WriteFile(filepath.Join(s.dir, name), b.Bytes(), 0600); err != nil {
+		return fmt.Errorf("failed to store profile: %w", err)
+	}
+	return s.prune()
+}
+
+// prune removes the profiles older than the retention period.
+func (s *profileStore) prune() error {
+	profiles, err := s.list()
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-s.retention)
+	for _, p := range profiles {
+		if p.Time.Before(cutoff) {
+			if err = os.Remove(filepath.Join(s.dir, p.Name)); err != nil {
+				return fmt.Errorf("failed to remove expired profile: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// list returns the stored profiles, the newest first.
+func (s *profileStore) list() ([]storedProfile, error) {
+	if s.dir == "" {
+		return nil, nil
+	}
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list profiles: %w", err)
+	}
+
+	var profiles []storedProfile
+	for _, e := range entries {
+		if !isProfileFile(e.Name()) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		profiles = append(profiles, storedProfile{Name: e.Name(), Time: info.ModTime(), Size: info.Size()})
+	}
+	sort.Slice(profiles, func(i, j int) bool {
+		return profiles[i].Time.After(profiles[j].Time)
+	})
+	return profiles, nil
+}
+
+func (s *profileStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/profiles")
+	name = strings.TrimPrefix(name, "/")
+	switch name {
+	case "":
+		profiles, err := s.list()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(profiles)
+	case "latest":
+		s.mu.Lock()
+		latest := s.latest
+		s.mu.Unlock()
+		if latest == nil {
+			http.Error(w, "no profile yet", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(latest)
+	default:
+		// The names are flat, so the files outside of the directory can't be served.
+		if s.dir == "" || name != filepath.Base(name) || !isProfileFile(name) {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeFile(w, r, filepath.Join(s.dir, name))
+	}
+}
+
+// isProfileFile reports whether the file in the store is a profile, i.e., it's named *.pb.gz
+// or *.pb if the profiles aren't compressed.
+func isProfileFile(name string) bool {
+	return strings.HasSuffix(name, ".pb.gz") || strings.HasSuffix(name, ".pb")
+}
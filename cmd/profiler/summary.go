@@ -0,0 +1,98 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"diy-parca-agent/agent"
+)
+
+// runSummary is printed on exit with -output json, so the wrappers can parse the results
+// instead of scraping the console output.
+type runSummary struct {
+	Samples uint64 `json:"samples"`
+	// Stacks are the samples by where they were taken, see agent.StackStats.
+	Stacks struct {
+		KernelOnly uint64 `json:"kernel_only"`
+		UserOnly   uint64 `json:"user_only"`
+		Both       uint64 `json:"both"`
+		None       uint64 `json:"none"`
+	} `json:"stacks"`
+	// DroppedStacks are the samples whose stacks failed to resolve.
+	DroppedStacks struct {
+		Kernel uint64 `json:"kernel"`
+		User   uint64 `json:"user"`
+	} `json:"dropped_stacks"`
+	// TruncatedStacks are the samples whose stacks reached the max depth.
+	TruncatedStacks struct {
+		Kernel uint64 `json:"kernel"`
+		User   uint64 `json:"user"`
+	} `json:"truncated_stacks"`
+	// StackDepths are the samples by their stack depth, see agent.DepthHistogram.
+	StackDepths struct {
+		Kernel []agent.DepthBucket `json:"kernel"`
+		User   []agent.DepthBucket `json:"user"`
+	} `json:"stack_depths"`
+	UniqueStacks int                  `json:"unique_stacks"`
+	Maps         agent.MapStats       `json:"maps"`
+	TopFunctions []summaryFunction    `json:"top_functions"`
+	CPUs         []summaryCPU         `json:"cpus,omitempty"`
+	Mappings     []agent.MappingShare `json:"mappings,omitempty"`
+}
+
+// summaryFunction is one of the hottest functions, see agent.FunctionShare.
+type summaryFunction struct {
+	Function   string  `json:"function"`
+	Kernel     bool    `json:"kernel"`
+	Self       int64   `json:"self"`
+	Total      int64   `json:"total"`
+	SelfShare  float64 `json:"self_share"`
+	TotalShare float64 `json:"total_share"`
+}
+
+// summaryCPU is the utilization of a CPU over the profiling window, see agent.CPUUtilization.
+type summaryCPU struct {
+	CPU       int     `json:"cpu"`
+	BusyShare float64 `json:"busy_share"`
+}
+
+// newRunSummary summarizes the run, the top functions, CPUs, and mappings are optional.
+func newRunSummary(st *agent.StackStats, ms agent.MapStats, funcs []agent.FunctionShare, cpus []agent.CPUUtilization, mappings []agent.MappingShare) runSummary {
+	s := runSummary{
+		Samples:      st.Samples,
+		UniqueStacks: st.UniqueStacks(),
+		Maps:         ms,
+		TopFunctions: make([]summaryFunction, len(funcs)),
+		Mappings:     mappings,
+	}
+	s.Stacks.KernelOnly = st.Kernel
+	s.Stacks.UserOnly = st.User
+	s.Stacks.Both = st.Both
+	s.Stacks.None = st.Empty
+	s.DroppedStacks.Kernel = st.KernelFailed
+	s.DroppedStacks.User = st.UserFailed
+	s.TruncatedStacks.Kernel = st.KernelTruncated
+	s.TruncatedStacks.User = st.UserTruncated
+	s.StackDepths.Kernel = st.KernelDepths.Buckets()
+	s.StackDepths.User = st.UserDepths.Buckets()
+	for i, f := range funcs {
+		s.TopFunctions[i] = summaryFunction(f)
+	}
+	for _, u := range cpus {
+		s.CPUs = append(s.CPUs, summaryCPU{CPU: u.CPU, BusyShare: u.BusyShare()})
+	}
+	return s
+}
+
+// printRunSummary prints the summary as JSON to stdout.
+func printRunSummary(s runSummary) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(s); err != nil {
+		return fmt.Errorf("failed to write summary: %w", err)
+	}
+	return nil
+}
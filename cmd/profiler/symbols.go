@@ -0,0 +1,127 @@
+//go:build linux
+
+package main
+
+import (
+	"debug/elf"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"diy-parca-agent/symbol"
+)
+
+// symbols dispatches the symbol management commands.
+// Currently there is only "extract".
+func symbols(args []string) error {
+	if len(args) == 0 || args[0] != "extract" {
+		return errors.New("usage: profiler symbols extract [flags] <binary>...")
+	}
+	return extractSymbols(args[1:])
+}
+
+// extractSymbols prepares the symbols of the binaries ahead of deployment,
+// e.g., for binaries built in CI which are stripped before shipping.
+// There are two artifact formats:
+//
+//   - table is the symbol table used by the profiler itself (see -symbol-cache flag of inspect).
+//     The output directory can be copied to the hosts as a symbol cache.
+//   - parca is the debuginfo layout of Parca's object storage bucket, i.e., <build-id>/debuginfo.
+//     The directory can be synced to the bucket Parca reads debuginfo from.
+//
+// The build ID of each extracted binary is printed along with its path.
+func extractSymbols(args []string) error {
+	fs := flag.NewFlagSet("symbols extract", flag.ExitOnError)
+	format := fs.String("format", "table", "artifact format: table or parca")
+	output := fs.String("o", "symbols", "directory to write the artifacts to")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return errors.New("at least one binary is required")
+	}
+
+	var extract func(path string) (string, error)
+	switch *format {
+	case "table":
+		store, err := symbol.NewStore(*output)
+		if err != nil {
+			return err
+		}
+		extract = func(path string) (string, error) {
+			t, err := symbol.Extract(path)
+			if err != nil {
+				return "", err
+			}
+			if err = store.Save(t); err != nil {
+				return "", err
+			}
+			return t.BuildID, nil
+		}
+	case "parca":
+		extract = func(path string) (string, error) {
+			return writeDebuginfo(path, *output)
+		}
+	default:
+		return fmt.Errorf("unknown artifact format %q", *format)
+	}
+
+	for _, path := range fs.Args() {
+		buildID, err := extract(path)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		fmt.Println(buildID, path)
+	}
+	return nil
+}
+
+// writeDebuginfo copies the binary to <dir>/<build-id>/debuginfo.
+// The binary must have a build ID and symbols,
+// otherwise Parca can't match it with the profiles or symbolize them.
+func writeDebuginfo(path, dir string) (string, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open ELF: %w", err)
+	}
+	buildID, err := symbol.BuildID(f)
+	hasSymbols := f.Section(".symtab") != nil || f.Section(".gnu_debugdata") != nil || symbol.HasDebugInfo(f)
+	f.Close()
+	switch {
+	case err != nil:
+		return "", err
+	case buildID == "":
+		return "", errors.New("binary has no build ID")
+	case !hasSymbols:
+		return "", errors.New("binary is stripped, extract symbols before stripping it")
+	}
+
+	dst := filepath.Join(dir, buildID, "debuginfo")
+	if err = os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return "", fmt.Errorf("failed to create debuginfo directory: %w", err)
+	}
+	if err = copyFile(path, dst); err != nil {
+		return "", fmt.Errorf("failed to copy debuginfo: %w", err)
+	}
+
+	return buildID, nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
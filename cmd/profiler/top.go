@@ -0,0 +1,88 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+
+	"diy-parca-agent/agent"
+	"diy-parca-agent/symbol"
+)
+
+// topCollector accumulates the flushed samples to print the hottest functions
+// at the end of a run, see -top flag.
+type topCollector struct {
+	frequency uint64
+	// focus and ignore filter the samples by their symbolized frames, see agent.FilterFrames.
+	focus   *regexp.Regexp
+	ignore  *regexp.Regexp
+	samples []agent.Sample
+	// procs cache the mappings of the sampled processes and the symbols of their binaries,
+	// so the processes which exit before the end of the run are symbolized too.
+	procs      *agent.ProcessCache
+	symbolizer *symbol.Symbolizer
+	// perfMaps resolve the JIT frames if set, see -perf-map flag.
+	perfMaps *agent.PerfMaps
+}
+
+func newTopCollector(frequency uint64, focus, ignore *regexp.Regexp, perfMaps *agent.PerfMaps) *topCollector {
+	s := symbol.NewSymbolizer(nil, 256<<20)
+	return &topCollector{
+		frequency:  frequency,
+		focus:      focus,
+		ignore:     ignore,
+		perfMaps:   perfMaps,
+		procs:      agent.NewProcessCache(s),
+		symbolizer: s,
+	}
+}
+
+// add adds the samples and caches the metadata of their processes,
+// it must be called right after the flush.
+func (c *topCollector) add(samples []agent.Sample) {
+	c.samples = append(c.samples, samples...)
+	c.procs.Add(samples)
+}
+
+// functions symbolizes the samples and returns the top n functions by self samples.
+func (c *topCollector) functions(n int) []agent.FunctionShare {
+	if len(c.samples) == 0 {
+		return nil
+	}
+
+	opts := agent.ProfileOptions{
+		Frequency:  c.frequency,
+		Mappings:   c.procs.Mappings(c.samples),
+		Symbolizer: c.symbolizer,
+		Focus:      c.focus,
+		Ignore:     c.ignore,
+		PerfMaps:   c.perfMaps,
+	}
+	// Kernel frames are left unsymbolized if the kernel symbols are unavailable.
+	var err error
+	if opts.KernelSymbols, err = agent.LoadKernelSymbols(); err != nil {
+		log.Printf("kernel frames won't be symbolized: %v", err)
+	}
+	return agent.TopFunctions(agent.Profile(c.samples, opts), n)
+}
+
+// print prints the top n functions by self samples along with their self and total percentages,
+// the kernel functions are marked with [k].
+func (c *topCollector) print(n int) {
+	funcs := c.functions(n)
+	if len(funcs) == 0 {
+		return
+	}
+
+	fmt.Printf("Top %d functions:\n", len(funcs))
+	fmt.Printf("  %7s %7s      %s\n", "self", "total", "function")
+	for _, f := range funcs {
+		space := "[u]"
+		if f.Kernel {
+			space = "[k]"
+		}
+		fmt.Printf("  %6.2f%% %6.2f%%  %s %s\n", f.SelfShare*100, f.TotalShare*100, space, f.Function)
+	}
+}
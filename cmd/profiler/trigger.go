@@ -0,0 +1,224 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"diy-parca-agent/agent"
+	"diy-parca-agent/symbol"
+)
+
+// triggerTargetList collects the repeatable -trigger-target flags of the form name=kind:value,
+// where the kind is pid, exe, systemd-unit, or cgroup, e.g., api=exe:/opt/api/bin/*.
+type triggerTargetList map[string]agent.Config
+
+func (l *triggerTargetList) String() string {
+	names := make([]string, 0, len(*l))
+	for name := range *l {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+func (l *triggerTargetList) Set(value string) error {
+	name, rule, ok := strings.Cut(value, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("invalid trigger target %q, it must be name=kind:value", value)
+	}
+	kind, v, ok := strings.Cut(rule, ":")
+	if !ok || v == "" {
+		return fmt.Errorf("invalid trigger target rule %q, it must be kind:value", rule)
+	}
+	var c agent.Config
+	switch kind {
+	case "pid":
+		pid, err := strconv.Atoi(v)
+		if err != nil || pid <= 0 {
+			return fmt.Errorf("invalid trigger target PID %q", v)
+		}
+		c.PID = pid
+	case "exe":
+		c.Exe = v
+	case "systemd-unit":
+		c.SystemdUnit = v
+	case "cgroup":
+		c.Cgroups = []string{v}
+	default:
+		return fmt.Errorf("unknown trigger target kind %q", kind)
+	}
+	if *l == nil {
+		*l = make(triggerTargetList)
+	}
+	(*l)[name] = c
+	return nil
+}
+
+// triggerHandler starts an intensive profiling window of a named target when an alert fires,
+// and passes the resulting profile to the sinks labeled with the alert and target names.
+// It accepts the Alertmanager webhooks (the target is the alert's "target" label)
+// and the plain requests, e.g., POST /trigger?target=api&alert=HighLatency.
+// A target is profiled by one window at a time, the triggers which arrive meanwhile are ignored.
+type triggerHandler struct {
+	targets    triggerTargetList
+	window     time.Duration
+	frequency  uint64
+	token      string
+	denylist   agent.Denylist
+	symbolizer *symbol.Symbolizer
+	sink       agent.Sink
+	labels     agent.Labels
+
+	// ctx cancels the windows in progress when the handler is closed.
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// mu guards running, the targets being profiled.
+	mu      sync.Mutex
+	running map[string]bool
+}
+
+func newTriggerHandler(targets triggerTargetList, window time.Duration, frequency uint64, token string) *triggerHandler {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &triggerHandler{
+		targets:   targets,
+		window:    window,
+		frequency: frequency,
+		token:     token,
+		ctx:       ctx,
+		cancel:    cancel,
+		running:   make(map[string]bool),
+	}
+}
+
+// alertmanagerWebhook is the part of the Alertmanager webhook payload the handler needs.
+type alertmanagerWebhook struct {
+	Alerts []struct {
+		Status string            `json:"status"`
+		Labels map[string]string `json:"labels"`
+	} `json:"alerts"`
+}
+
+// triggerResponse lists the targets whose profiling windows were started.
+type triggerResponse struct {
+	Started []string `json:"started"`
+}
+
+func (h *triggerHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+h.token)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	resp := triggerResponse{Started: []string{}}
+	if target := r.URL.Query().Get("target"); target != "" {
+		if _, ok := h.targets[target]; !ok {
+			http.Error(w, fmt.Sprintf("unknown target %q", target), http.StatusNotFound)
+			return
+		}
+		alert := r.URL.Query().Get("alert")
+		if alert == "" {
+			alert = "manual"
+		}
+		if !h.start(target, alert) {
+			http.Error(w, fmt.Sprintf("target %q is already being profiled", target), http.StatusConflict)
+			return
+		}
+		resp.Started = append(resp.Started, target)
+	} else {
+		var hook alertmanagerWebhook
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&hook); err != nil {
+			http.Error(w, fmt.Sprintf("invalid webhook: %v", err), http.StatusBadRequest)
+			return
+		}
+		for _, a := range hook.Alerts {
+			target := a.Labels["target"]
+			if a.Status != "firing" || target == "" {
+				continue
+			}
+			if _, ok := h.targets[target]; !ok {
+				log.Printf("alert %s fired for unknown target %q", a.Labels["alertname"], target)
+				continue
+			}
+			if h.start(target, a.Labels["alertname"]) {
+				resp.Started = append(resp.Started, target)
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// start profiles the target in the background unless it's already being profiled.
+func (h *triggerHandler) start(target, alert string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.running[target] {
+		return false
+	}
+	h.running[target] = true
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		if err := h.profile(target, alert); err != nil {
+			log.Printf("failed to profile target %s for alert %s: %v", target, alert, err)
+		}
+
+		h.mu.Lock()
+		delete(h.running, target)
+		h.mu.Unlock()
+	}()
+	return true
+}
+
+// profile collects a window of the target's samples with the high frequency,
+// and writes the profile to the sinks labeled with the alert and target names.
+func (h *triggerHandler) profile(target, alert string) error {
+	c := h.targets[target]
+	c.Frequency = h.frequency
+	c.Denylist = h.denylist
+	profiler, err := agent.NewProfiler(c)
+	if err != nil {
+		return err
+	}
+	defer profiler.Close()
+
+	log.Printf("profiling target %s for %s at %d Hz triggered by alert %s", target, h.window, h.frequency, alert)
+	capture := agent.NewCapture(h.frequency)
+	if err = collectWindow(h.ctx, profiler, capture, h.window); err != nil {
+		return err
+	}
+
+	labels := make(agent.Labels)
+	for name, value := range h.labels {
+		labels[name] = value
+	}
+	labels["alert"] = alert
+	labels["target"] = target
+	return h.sink.Write(h.ctx, agent.EncodeProfile(capture.Samples, capture.ProfileOptions(h.symbolizer)), labels)
+}
+
+// Close cancels the profiling windows in progress and waits for them to stop.
+func (h *triggerHandler) Close() {
+	h.cancel()
+	h.wg.Wait()
+}
@@ -2,6 +2,11 @@ module diy-parca-agent
 
 go 1.18
 
-require github.com/cilium/ebpf v0.8.1
+require (
+	github.com/cilium/ebpf v0.8.1
+	github.com/google/pprof v0.0.0-20210407192527-94a9f03dee38
+	github.com/ulikunitz/xz v0.5.12
+	golang.org/x/arch v0.3.0
+)
 
-require golang.org/x/sys v0.0.0-20210906170528-6f6e22806c34 // indirect
+require golang.org/x/sys v0.0.0-20210906170528-6f6e22806c34
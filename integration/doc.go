@@ -0,0 +1,7 @@
+// Package integration runs the end-to-end tests of the profiler against a controllable workload,
+// the CPU burner in testdata/burner whose hot functions are known upfront.
+// The tests load the BPF program, so they require root and are excluded from the regular runs
+// by the integration build tag:
+//
+//	sudo go test -tags integration ./integration
+package integration
@@ -0,0 +1,133 @@
+//go:build integration && linux
+
+package integration
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/pprof/profile"
+
+	"diy-parca-agent/agent"
+)
+
+// profileDuration is how long the burner is profiled, long enough for a few hundred samples at 100 Hz.
+const profileDuration = 5 * time.Second
+
+// TestProfile profiles the burner and checks its hot functions in the profile written on exit.
+func TestProfile(t *testing.T) {
+	dir, profiler, burner := setup(t)
+	path := filepath.Join(dir, "cpu.pb.gz")
+	runProfiler(t, profiler, "-pid", burner, "-profile", path, "-quiet", "-top", "0", "-mapping-report", "none")
+
+	checkHotFunctions(t, readProfile(t, path))
+}
+
+// TestRecordReplay records the burner's samples and checks its hot functions in the replayed profile,
+// i.e., the capture carries everything needed to symbolize them.
+func TestRecordReplay(t *testing.T) {
+	dir, profiler, burner := setup(t)
+	capture := filepath.Join(dir, "raw.capture")
+	runProfiler(t, profiler, "-pid", burner, "-record", capture, "-quiet", "-top", "0", "-mapping-report", "none")
+
+	path := filepath.Join(dir, "cpu.pprof")
+	if out, err := exec.Command(profiler, "replay", "-strict-symbols", "-o", path, capture).CombinedOutput(); err != nil {
+		t.Fatalf("replay failed: %v\n%s", err, out)
+	}
+	checkHotFunctions(t, readProfile(t, path))
+}
+
+// setup builds the profiler and the burner, and starts the burner which is killed when the test ends.
+// It returns the temporary directory, the profiler's path, and the burner's PID.
+func setup(t *testing.T) (dir, profiler, pid string) {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("the profiler must run as root to load the BPF program")
+	}
+
+	dir = t.TempDir()
+	profiler = filepath.Join(dir, "profiler")
+	burner := filepath.Join(dir, "burner")
+	build(t, profiler, "../cmd/profiler")
+	build(t, burner, "./testdata/burner")
+
+	cmd := exec.Command(burner, "-duration", (3 * profileDuration).String())
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("failed to start burner: %v", err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	return dir, profiler, strconv.Itoa(cmd.Process.Pid)
+}
+
+// build builds the package into the binary at path.
+func build(t *testing.T, path, pkg string) {
+	t.Helper()
+	if out, err := exec.Command("go", "build", "-o", path, pkg).CombinedOutput(); err != nil {
+		t.Fatalf("failed to build %s: %v\n%s", pkg, err, out)
+	}
+}
+
+// runProfiler runs the profiler with the arguments for profileDuration,
+// then it stops the profiler with INT signal and expects it to exit successfully.
+func runProfiler(t *testing.T, profiler string, args ...string) {
+	t.Helper()
+	cmd := exec.Command(profiler, args...)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("failed to start profiler: %v", err)
+	}
+	time.Sleep(profileDuration)
+	if err := cmd.Process.Signal(syscall.SIGINT); err != nil {
+		t.Fatalf("failed to stop profiler: %v", err)
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("profiler failed: %v", err)
+	}
+}
+
+func readProfile(t *testing.T, path string) *profile.Profile {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	p, err := profile.Parse(f)
+	if err != nil {
+		t.Fatalf("failed to parse %s: %v", path, err)
+	}
+	return p
+}
+
+// checkHotFunctions expects the burner's functions in the profile: burnHot is on the stack
+// about three times as often as burnCold, the self time is in the hashing they both call.
+func checkHotFunctions(t *testing.T, p *profile.Profile) {
+	t.Helper()
+	if len(p.Sample) == 0 {
+		t.Fatal("profile has no samples")
+	}
+
+	shares := make(map[string]float64)
+	for _, f := range agent.TopFunctions(p, 0) {
+		shares[f.Function] = f.TotalShare
+	}
+	hot, cold := shares["main.burnHot"], shares["main.burnCold"]
+	if hot == 0 || cold == 0 {
+		t.Fatalf("burner's functions are missing: main.burnHot %.2f, main.burnCold %.2f", hot, cold)
+	}
+	// The ratio is 3 in theory, it's checked loosely, since the sampling is statistical.
+	if ratio := hot / cold; ratio < 2 || ratio > 4.5 {
+		t.Errorf("main.burnHot/main.burnCold = %.2f, want about 3", ratio)
+	}
+	if share := shares["main.main"]; share < 0.9 {
+		t.Errorf("main.main total share = %.2f, want almost all the samples", share)
+	}
+}
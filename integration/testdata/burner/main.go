@@ -0,0 +1,43 @@
+// Program burner is the workload of the integration tests.
+// It spins on the CPU until it's killed, spending about three quarters of the time in burnHot
+// and a quarter in burnCold, so the tests can assert the functions and their ratio in the profiles.
+package main
+
+import (
+	"crypto/sha256"
+	"flag"
+	"time"
+)
+
+func main() {
+	duration := flag.Duration("duration", time.Minute, "how long to burn the CPU before exiting")
+	flag.Parse()
+
+	deadline := time.Now().Add(*duration)
+	var sum [sha256.Size]byte
+	for time.Now().Before(deadline) {
+		for i := 0; i < 3; i++ {
+			sum = burnHot(sum)
+		}
+		sum = burnCold(sum)
+	}
+}
+
+// burnHot and burnCold hash the data the same number of times,
+// and they're never inlined, so they show up in the stacks as themselves.
+//
+//go:noinline
+func burnHot(sum [sha256.Size]byte) [sha256.Size]byte {
+	for i := 0; i < 1000; i++ {
+		sum = sha256.Sum256(sum[:])
+	}
+	return sum
+}
+
+//go:noinline
+func burnCold(sum [sha256.Size]byte) [sha256.Size]byte {
+	for i := 0; i < 1000; i++ {
+		sum = sha256.Sum256(sum[:])
+	}
+	return sum
+}
@@ -0,0 +1,115 @@
+package model
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// kernelSuffix marks the kernel functions in the folded stacks.
+const kernelSuffix = "_[k]"
+
+// WriteFolded writes the profile as folded stacks, one line per stack with its total,
+// e.g., "nginx;main;ngx_process_events;epoll_wait 12",
+// which flamegraph.pl and most flame graph tools read.
+// The frames go from the outermost to the innermost, and the stack is prefixed with the process name (comm label)
+// if it's known. The kernel functions have the _[k] suffix.
+// The stacks are summed up by the first value of the samples, e.g., samples/count in a CPU profile,
+// and written sorted.
+func (p *Profile) WriteFolded(w io.Writer) error {
+	totals := make(map[string]int64)
+	var frames []string
+	for _, s := range p.Samples {
+		if len(s.Values) == 0 {
+			continue
+		}
+
+		frames = frames[:0]
+		if comm := s.Labels["comm"]; comm != "" {
+			frames = append(frames, foldedName(comm))
+		}
+		for i := len(s.Stack) - 1; i >= 0; i-- {
+			f := s.Stack[i]
+			name := foldedName(f.Name())
+			if f.Mapping != nil && f.Mapping.Kernel {
+				name += kernelSuffix
+			}
+			frames = append(frames, name)
+		}
+		if len(frames) == 0 {
+			continue
+		}
+		totals[strings.Join(frames, ";")] += s.Values[0]
+	}
+
+	stacks := make([]string, 0, len(totals))
+	for stack := range totals {
+		stacks = append(stacks, stack)
+	}
+	sort.Strings(stacks)
+
+	bw := bufio.NewWriter(w)
+	for _, stack := range stacks {
+		fmt.Fprintf(bw, "%s %d\n", stack, totals[stack])
+	}
+	return bw.Flush()
+}
+
+// ReadFolded reads the folded stacks written by WriteFolded or by stackcollapse scripts,
+// e.g., "nginx;main;ngx_process_events;epoll_wait 12", into a profile with samples/count values.
+// The frames carry only the function names, and the kernel functions (_[k] suffix) are attributed to the kernel mapping.
+// The process name which prefixes the stacks can't be told apart from the functions,
+// so it becomes the outermost frame.
+func ReadFolded(r io.Reader) (*Profile, error) {
+	p := Profile{
+		SampleTypes: []ValueType{{Type: "samples", Unit: "count"}},
+	}
+	kernel := Mapping{File: "[kernel.kallsyms]", Symbolized: true, Kernel: true}
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<20)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		if i < 0 {
+			return nil, fmt.Errorf("line %d: missing stack count", n)
+		}
+		count, err := strconv.ParseInt(line[i+1:], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid stack count: %w", n, err)
+		}
+
+		names := strings.Split(line[:i], ";")
+		s := Sample{
+			Stack:  make(Stack, 0, len(names)),
+			Values: []int64{count},
+		}
+		// The folded stacks go from the outermost to the innermost frame.
+		for j := len(names) - 1; j >= 0; j-- {
+			f := Frame{Function: names[j]}
+			if strings.HasSuffix(f.Function, kernelSuffix) {
+				f.Function = strings.TrimSuffix(f.Function, kernelSuffix)
+				f.Mapping = &kernel
+			}
+			s.Stack = append(s.Stack, f)
+		}
+		p.Samples = append(p.Samples, s)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read folded stacks: %w", err)
+	}
+	return &p, nil
+}
+
+// foldedReplacer replaces the characters which separate the frames and lines in the folded format.
+var foldedReplacer = strings.NewReplacer(";", ":", "\n", " ")
+
+func foldedName(name string) string {
+	return foldedReplacer.Replace(name)
+}
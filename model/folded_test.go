@@ -0,0 +1,88 @@
+package model
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFoldedRoundTrip(t *testing.T) {
+	kernel := &Mapping{File: "[kernel.kallsyms]", Symbolized: true, Kernel: true}
+	p := Profile{
+		SampleTypes: []ValueType{{Type: "samples", Unit: "count"}, {Type: "cpu", Unit: "nanoseconds"}},
+		Samples: []Sample{
+			{
+				Stack:  Stack{{Function: "epoll_wait", Mapping: kernel}, {Function: "ngx_process_events"}, {Function: "main"}},
+				Values: []int64{12, 120},
+				Labels: map[string]string{"comm": "nginx"},
+			},
+			{
+				Stack:  Stack{{Function: "ngx_process_events"}, {Function: "main"}},
+				Values: []int64{0, 10},
+				Labels: map[string]string{"comm": "nginx"},
+			},
+			// The stacks are summed up by the first value.
+			{
+				Stack:  Stack{{Function: "a;b"}, {Function: "main"}},
+				Values: []int64{2, 20},
+			},
+			{
+				Stack:  Stack{{Function: "a;b"}, {Function: "main"}},
+				Values: []int64{3, 30},
+			},
+		},
+	}
+	const want = "main;a:b 5\n" +
+		"nginx;main;ngx_process_events 0\n" +
+		"nginx;main;ngx_process_events;epoll_wait_[k] 12\n"
+
+	var buf bytes.Buffer
+	if err := p.WriteFolded(&buf); err != nil {
+		t.Fatalf("failed to write folded stacks: %v", err)
+	}
+	if got := buf.String(); got != want {
+		t.Fatalf("got folded stacks\n%s\nwant\n%s", got, want)
+	}
+
+	got, err := ReadFolded(&buf)
+	if err != nil {
+		t.Fatalf("failed to read folded stacks: %v", err)
+	}
+	wantProfile := &Profile{
+		SampleTypes: []ValueType{{Type: "samples", Unit: "count"}},
+		Samples: []Sample{
+			{Stack: Stack{{Function: "a:b"}, {Function: "main"}}, Values: []int64{5}},
+			{Stack: Stack{{Function: "ngx_process_events"}, {Function: "main"}, {Function: "nginx"}}, Values: []int64{0}},
+			{
+				Stack:  Stack{{Function: "epoll_wait", Mapping: kernel}, {Function: "ngx_process_events"}, {Function: "main"}, {Function: "nginx"}},
+				Values: []int64{12},
+			},
+		},
+	}
+	if !reflect.DeepEqual(got, wantProfile) {
+		t.Errorf("got %+v, want %+v", got, wantProfile)
+	}
+
+	buf.Reset()
+	if err = got.WriteFolded(&buf); err != nil {
+		t.Fatalf("failed to write folded stacks: %v", err)
+	}
+	if got := buf.String(); got != want {
+		t.Errorf("got folded stacks after reading\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestReadFolded(t *testing.T) {
+	tt := map[string]string{
+		"missing count": "main;work\n",
+		"invalid count": "main;work x\n",
+	}
+	for name, in := range tt {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ReadFolded(strings.NewReader(in)); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+// Package model is the profiler's own representation of the symbolized samples.
+// The samples are resolved into stacks of frames once, see agent.Model,
+// and then converted to the output formats: pprof, folded stacks, speedscope, and OTLP.
+package model
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
+// Profile is the samples collected during a profiling window.
+type Profile struct {
+	// SampleTypes describe the values of each sample, e.g., samples/count and cpu/nanoseconds.
+	SampleTypes []ValueType
+	// PeriodType and Period describe the sampling period, e.g., cpu/nanoseconds 10101010.
+	PeriodType ValueType
+	Period     int64
+	// Time and Duration describe the profiling window if they're known.
+	Time     time.Time
+	Duration time.Duration
+	// Comments are free-form notes, e.g., the profiler's version.
+	Comments []string
+	Samples  []Sample
+}
+
+// ValueType is the kind and unit of a value, e.g., cpu/nanoseconds.
+type ValueType struct {
+	Type string
+	Unit string
+}
+
+// Sample is the values attributed to a stack, e.g., the number of times it was sampled.
+type Sample struct {
+	Stack  Stack
+	Values []int64
+	// Labels are the string labels, e.g., comm=nginx.
+	Labels map[string]string
+	// NumLabels are the numeric labels, e.g., pid=1234, NumUnits have the units of some of them.
+	NumLabels map[string]int64
+	NumUnits  map[string]string
+}
+
+// Stack is the frames of a stack trace, the innermost frame goes first.
+type Stack []Frame
+
+// Frame is a function on the stack.
+// The inlined functions have their own frames which share the address of the function they're inlined into.
+type Frame struct {
+	// Function is the function name, it's empty if the address wasn't symbolized.
+	Function string
+	File     string
+	Line     int64
+	// Address is the instruction address, the frames merged by the profiler have none.
+	Address uint64
+	// Mapping is the binary the address belongs to, it's nil if it's unknown.
+	Mapping *Mapping
+	// Inlined tells whether the function was inlined into the function of the next frame.
+	Inlined bool
+}
+
+// Name returns the function name or the address along with the binary name if it wasn't symbolized,
+// e.g., 0x4a1f2c [nginx].
+func (f Frame) Name() string {
+	if f.Function != "" {
+		return f.Function
+	}
+	if f.Mapping != nil && f.Mapping.File != "" {
+		return fmt.Sprintf("%#x [%s]", f.Address, filepath.Base(f.Mapping.File))
+	}
+	return fmt.Sprintf("%#x", f.Address)
+}
+
+// Mapping is a memory mapping of a binary, it's shared by the frames of the binary.
+type Mapping struct {
+	// Start and Limit are the memory addresses of the mapping [Start, Limit),
+	// Offset is the file offset of the mapping.
+	Start  uint64
+	Limit  uint64
+	Offset uint64
+	File   string
+	// BuildID identifies the binary if it's known.
+	BuildID string
+	// Symbolized tells whether the addresses of the binary were symbolized.
+	Symbolized bool
+	// Kernel tells whether it's the kernel.
+	Kernel bool
+}
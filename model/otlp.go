@@ -0,0 +1,86 @@
+package model
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"sort"
+	"time"
+)
+
+// OTLP converts the profile into ExportProfilesServiceRequest protobuf of OTLP
+// (the experimental profiles signal of opentelemetry-proto v1.3).
+// The gzipped pprof is attached as the original payload, and the attributes describe the resource,
+// e.g., service.name=nginx.
+func (p *Profile) OTLP(attrs map[string]string) ([]byte, error) {
+	var raw bytes.Buffer
+	if err := p.Pprof().Write(&raw); err != nil {
+		return nil, err
+	}
+	return OTLPRequest(raw.Bytes(), p.Time, p.Duration, attrs)
+}
+
+// OTLPRequest returns ExportProfilesServiceRequest protobuf which carries the encoded pprof as the original payload.
+// The profiling window ends now if its start is unknown.
+func OTLPRequest(pprof []byte, start time.Time, duration time.Duration, attrs map[string]string) ([]byte, error) {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	if start.IsZero() {
+		start = time.Now().Add(-duration)
+	}
+
+	// ProfileContainer: profile_id = 1, start_time_unix_nano = 2 and end_time_unix_nano = 3 (fixed64),
+	// original_payload_format = 6, original_payload = 7.
+	var container []byte
+	container = appendBytesField(container, 1, id[:])
+	container = appendFixed64Field(container, 2, uint64(start.UnixNano()))
+	container = appendFixed64Field(container, 3, uint64(start.Add(duration).UnixNano()))
+	container = appendBytesField(container, 6, []byte("pprof"))
+	container = appendBytesField(container, 7, pprof)
+	// ScopeProfiles.profiles = 2.
+	scope := appendBytesField(nil, 2, container)
+
+	// Resource.attributes = 1 of KeyValue (key = 1, value = 2 of AnyValue with string_value = 1).
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var resource []byte
+	for _, name := range names {
+		var kv []byte
+		kv = appendBytesField(kv, 1, []byte(name))
+		kv = appendBytesField(kv, 2, appendBytesField(nil, 1, []byte(attrs[name])))
+		resource = appendBytesField(resource, 1, kv)
+	}
+
+	// ResourceProfiles: resource = 1, scope_profiles = 2.
+	rp := appendBytesField(nil, 1, resource)
+	rp = appendBytesField(rp, 2, scope)
+	// ExportProfilesServiceRequest.resource_profiles = 1.
+	return appendBytesField(nil, 1, rp), nil
+}
+
+// appendBytesField appends the length-delimited protobuf field.
+func appendBytesField(b []byte, field uint64, value []byte) []byte {
+	b = appendUvarint(b, field<<3|2)
+	b = appendUvarint(b, uint64(len(value)))
+	return append(b, value...)
+}
+
+// appendFixed64Field appends the fixed64 protobuf field.
+func appendFixed64Field(b []byte, field uint64, value uint64) []byte {
+	b = appendUvarint(b, field<<3|1)
+	var v [8]byte
+	binary.LittleEndian.PutUint64(v[:], value)
+	return append(b, v[:]...)
+}
+
+// appendUvarint appends the varint-encoded x.
+func appendUvarint(b []byte, x uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], x)
+	return append(b, buf[:n]...)
+}
@@ -0,0 +1,152 @@
+package model
+
+import (
+	"github.com/google/pprof/profile"
+)
+
+// Pprof converts the profile into pprof format.
+// The mappings, functions, and locations are deduplicated across the samples.
+func (p *Profile) Pprof() *profile.Profile {
+	c := pprofConverter{
+		p: &profile.Profile{
+			Period:   p.Period,
+			Comments: p.Comments,
+		},
+		mappings:  make(map[*Mapping]*profile.Mapping),
+		functions: make(map[pprofFunctionKey]*profile.Function),
+		locations: make(map[pprofLocationKey]*profile.Location),
+	}
+	for _, st := range p.SampleTypes {
+		c.p.SampleType = append(c.p.SampleType, &profile.ValueType{Type: st.Type, Unit: st.Unit})
+	}
+	if p.PeriodType != (ValueType{}) {
+		c.p.PeriodType = &profile.ValueType{Type: p.PeriodType.Type, Unit: p.PeriodType.Unit}
+	}
+	if !p.Time.IsZero() {
+		c.p.TimeNanos = p.Time.UnixNano()
+	}
+	c.p.DurationNanos = p.Duration.Nanoseconds()
+
+	for _, s := range p.Samples {
+		ps := profile.Sample{
+			Value: append([]int64(nil), s.Values...),
+		}
+		if len(s.Labels) > 0 {
+			ps.Label = make(map[string][]string, len(s.Labels))
+			for k, v := range s.Labels {
+				ps.Label[k] = []string{v}
+			}
+		}
+		if len(s.NumLabels) > 0 {
+			ps.NumLabel = make(map[string][]int64, len(s.NumLabels))
+			for k, v := range s.NumLabels {
+				ps.NumLabel[k] = []int64{v}
+			}
+		}
+		if len(s.NumUnits) > 0 {
+			ps.NumUnit = make(map[string][]string, len(s.NumUnits))
+			for k, v := range s.NumUnits {
+				ps.NumUnit[k] = []string{v}
+			}
+		}
+
+		// The inlined frames and the frame they're inlined into make a single location.
+		stack := s.Stack
+		for len(stack) > 0 {
+			n := 1
+			for n < len(stack) && stack[n-1].Inlined {
+				n++
+			}
+			ps.Location = append(ps.Location, c.location(stack[:n]))
+			stack = stack[n:]
+		}
+		c.p.Sample = append(c.p.Sample, &ps)
+	}
+	return c.p
+}
+
+type pprofFunctionKey struct {
+	name string
+	file string
+}
+
+// The locations are deduplicated by the address within a mapping,
+// the function and line tell apart the frames without an address, e.g., the merged rare stacks
+// or the frames read from the folded stacks.
+type pprofLocationKey struct {
+	mapping  *Mapping
+	addr     uint64
+	function string
+	line     int64
+}
+
+// pprofConverter deduplicates the mappings, functions, and locations of the pprof profile.
+type pprofConverter struct {
+	p         *profile.Profile
+	mappings  map[*Mapping]*profile.Mapping
+	functions map[pprofFunctionKey]*profile.Function
+	locations map[pprofLocationKey]*profile.Location
+}
+
+func (c *pprofConverter) mapping(m *Mapping) *profile.Mapping {
+	if m == nil {
+		return nil
+	}
+	if pm, ok := c.mappings[m]; ok {
+		return pm
+	}
+
+	pm := profile.Mapping{
+		ID:           uint64(len(c.p.Mapping) + 1),
+		Start:        m.Start,
+		Limit:        m.Limit,
+		Offset:       m.Offset,
+		File:         m.File,
+		BuildID:      m.BuildID,
+		HasFunctions: m.Symbolized,
+	}
+	c.mappings[m] = &pm
+	c.p.Mapping = append(c.p.Mapping, &pm)
+	return &pm
+}
+
+func (c *pprofConverter) function(name, file string) *profile.Function {
+	k := pprofFunctionKey{name: name, file: file}
+	if fn, ok := c.functions[k]; ok {
+		return fn
+	}
+
+	fn := profile.Function{
+		ID:         uint64(len(c.p.Function) + 1),
+		Name:       name,
+		SystemName: name,
+		Filename:   file,
+	}
+	c.functions[k] = &fn
+	c.p.Function = append(c.p.Function, &fn)
+	return &fn
+}
+
+// location returns the location of the frames, the innermost inlined frame goes first.
+func (c *pprofConverter) location(frames []Frame) *profile.Location {
+	last := frames[len(frames)-1]
+	k := pprofLocationKey{mapping: last.Mapping, addr: last.Address, function: frames[0].Function, line: frames[0].Line}
+	if loc, ok := c.locations[k]; ok {
+		return loc
+	}
+
+	loc := profile.Location{
+		ID:      uint64(len(c.p.Location) + 1),
+		Mapping: c.mapping(last.Mapping),
+		Address: last.Address,
+	}
+	for _, f := range frames {
+		if f.Function == "" {
+			continue
+		}
+		loc.Line = append(loc.Line, profile.Line{Function: c.function(f.Function, f.File), Line: f.Line})
+	}
+	c.locations[k] = &loc
+	c.p.Location = append(c.p.Location, &loc)
+	return &loc
+}
@@ -0,0 +1,199 @@
+package model
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// speedscopeSchema is the file format the speedscope.app reads.
+const speedscopeSchema = "https://www.speedscope.app/file-format-schema.json"
+
+type speedscopeFile struct {
+	Schema   string              `json:"$schema"`
+	Shared   speedscopeShared    `json:"shared"`
+	Profiles []speedscopeProfile `json:"profiles"`
+	Name     string              `json:"name,omitempty"`
+	Exporter string              `json:"exporter"`
+}
+
+type speedscopeShared struct {
+	Frames []speedscopeFrame `json:"frames"`
+}
+
+type speedscopeFrame struct {
+	Name string `json:"name"`
+	File string `json:"file,omitempty"`
+	Line int64  `json:"line,omitempty"`
+}
+
+type speedscopeProfile struct {
+	Type       string  `json:"type"`
+	Name       string  `json:"name"`
+	Unit       string  `json:"unit"`
+	StartValue int64   `json:"startValue"`
+	EndValue   int64   `json:"endValue"`
+	Samples    [][]int `json:"samples"`
+	Weights    []int64 `json:"weights"`
+}
+
+// WriteSpeedscope writes the profile in the speedscope JSON format, see https://www.speedscope.app.
+// Each sample type becomes a sampled profile of its own, e.g., samples/count and cpu/nanoseconds,
+// so they can be switched in the viewer. The samples are weighted by their values,
+// and the zero weights are kept, so the profiles have the same stacks and ReadSpeedscope merges them back.
+func (p *Profile) WriteSpeedscope(w io.Writer, name string) error {
+	f := speedscopeFile{
+		Schema:   speedscopeSchema,
+		Name:     name,
+		Exporter: "diy-parca-agent",
+		Shared:   speedscopeShared{Frames: []speedscopeFrame{}},
+		Profiles: []speedscopeProfile{},
+	}
+
+	type frameKey struct {
+		name string
+		file string
+		line int64
+	}
+	frames := make(map[frameKey]int)
+	stacks := make([][]int, len(p.Samples))
+	for i, s := range p.Samples {
+		// The speedscope stacks go from the outermost to the innermost frame.
+		stack := make([]int, 0, len(s.Stack))
+		for j := len(s.Stack) - 1; j >= 0; j-- {
+			fr := s.Stack[j]
+			k := frameKey{name: fr.Name(), file: fr.File, line: fr.Line}
+			idx, ok := frames[k]
+			if !ok {
+				idx = len(f.Shared.Frames)
+				frames[k] = idx
+				f.Shared.Frames = append(f.Shared.Frames, speedscopeFrame{Name: k.name, File: k.file, Line: k.line})
+			}
+			stack = append(stack, idx)
+		}
+		stacks[i] = stack
+	}
+
+	for i, st := range p.SampleTypes {
+		sp := speedscopeProfile{
+			Type:    "sampled",
+			Name:    st.Type + "/" + st.Unit,
+			Unit:    speedscopeUnit(st.Unit),
+			Samples: make([][]int, 0, len(p.Samples)),
+			Weights: make([]int64, 0, len(p.Samples)),
+		}
+		for j, s := range p.Samples {
+			var v int64
+			if i < len(s.Values) {
+				v = s.Values[i]
+			}
+			sp.Samples = append(sp.Samples, stacks[j])
+			sp.Weights = append(sp.Weights, v)
+			sp.EndValue += v
+		}
+		f.Profiles = append(f.Profiles, sp)
+	}
+
+	return json.NewEncoder(w).Encode(f)
+}
+
+// ReadSpeedscope reads the sampled profiles of the speedscope JSON file into a profile,
+// each of them becomes a sample type, e.g., the ones written by WriteSpeedscope.
+// The profiles which have the same stacks (as written by WriteSpeedscope) are merged into multi-value samples.
+// The evented profiles are skipped, since their stacks have no sample counts.
+func ReadSpeedscope(r io.Reader) (*Profile, error) {
+	var f speedscopeFile
+	if err := json.NewDecoder(r).Decode(&f); err != nil {
+		return nil, fmt.Errorf("failed to decode speedscope file: %w", err)
+	}
+
+	var sampled []speedscopeProfile
+	for _, sp := range f.Profiles {
+		if sp.Type == "sampled" {
+			sampled = append(sampled, sp)
+		}
+	}
+	if len(sampled) == 0 {
+		return nil, errors.New("speedscope file has no sampled profiles")
+	}
+
+	frames := make([]Frame, len(f.Shared.Frames))
+	for i, fr := range f.Shared.Frames {
+		frames[i] = Frame{Function: fr.Name, File: fr.File, Line: fr.Line}
+	}
+	stack := func(ss []int) (Stack, error) {
+		// The speedscope stacks go from the outermost to the innermost frame.
+		st := make(Stack, 0, len(ss))
+		for i := len(ss) - 1; i >= 0; i-- {
+			if ss[i] < 0 || ss[i] >= len(frames) {
+				return nil, fmt.Errorf("speedscope sample refers to missing frame %d", ss[i])
+			}
+			st = append(st, frames[ss[i]])
+		}
+		return st, nil
+	}
+
+	var p Profile
+	merged := sameSpeedscopeStacks(sampled)
+	for i, sp := range sampled {
+		vt := ValueType{Type: sp.Name, Unit: sp.Unit}
+		if t, u, ok := strings.Cut(sp.Name, "/"); ok {
+			vt = ValueType{Type: t, Unit: u}
+		}
+		if vt.Unit == "none" {
+			vt.Unit = "count"
+		}
+		p.SampleTypes = append(p.SampleTypes, vt)
+		if len(sp.Weights) != len(sp.Samples) {
+			return nil, fmt.Errorf("speedscope profile %q has %d samples and %d weights", sp.Name, len(sp.Samples), len(sp.Weights))
+		}
+
+		for j, ss := range sp.Samples {
+			if merged && i > 0 {
+				p.Samples[j].Values[i] = sp.Weights[j]
+				continue
+			}
+			st, err := stack(ss)
+			if err != nil {
+				return nil, err
+			}
+			s := Sample{Stack: st, Values: make([]int64, len(sampled))}
+			s.Values[i] = sp.Weights[j]
+			p.Samples = append(p.Samples, s)
+		}
+	}
+	return &p, nil
+}
+
+// sameSpeedscopeStacks reports whether the profiles have the same stacks in the same order.
+func sameSpeedscopeStacks(profiles []speedscopeProfile) bool {
+	for _, sp := range profiles[1:] {
+		if len(sp.Samples) != len(profiles[0].Samples) {
+			return false
+		}
+		for j, ss := range sp.Samples {
+			want := profiles[0].Samples[j]
+			if len(ss) != len(want) {
+				return false
+			}
+			for k := range ss {
+				if ss[k] != want[k] {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+// speedscopeUnit returns the speedscope unit of the pprof unit, it's "none" for counts.
+func speedscopeUnit(unit string) string {
+	switch unit {
+	case "nanoseconds", "microseconds", "milliseconds", "seconds", "bytes":
+		return unit
+	default:
+		return "none"
+	}
+}
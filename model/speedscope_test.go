@@ -0,0 +1,61 @@
+package model
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestSpeedscopeRoundTrip(t *testing.T) {
+	main := Frame{Function: "main", File: "main.go", Line: 10}
+	work := Frame{Function: "work", File: "work.go", Line: 20}
+	idle := Frame{Function: "idle", File: "work.go", Line: 30}
+
+	tt := map[string]*Profile{
+		"single value": {
+			SampleTypes: []ValueType{{Type: "samples", Unit: "count"}},
+			Samples: []Sample{
+				{Stack: Stack{work, main}, Values: []int64{3}},
+				{Stack: Stack{main}, Values: []int64{1}},
+			},
+		},
+		"multi value": {
+			SampleTypes: []ValueType{{Type: "samples", Unit: "count"}, {Type: "cpu", Unit: "nanoseconds"}},
+			Samples: []Sample{
+				{Stack: Stack{work, main}, Values: []int64{3, 30}},
+				{Stack: Stack{idle, main}, Values: []int64{2, 0}},
+				{Stack: Stack{main}, Values: []int64{0, 10}},
+			},
+		},
+	}
+	for name, want := range tt {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := want.WriteSpeedscope(&buf, name); err != nil {
+				t.Fatalf("failed to write speedscope: %v", err)
+			}
+			got, err := ReadSpeedscope(&buf)
+			if err != nil {
+				t.Fatalf("failed to read speedscope: %v", err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestReadSpeedscope(t *testing.T) {
+	tt := map[string]string{
+		"no sampled profiles": `{"shared":{"frames":[]},"profiles":[{"type":"evented","name":"a","unit":"none"}]}`,
+		"missing frame":       `{"shared":{"frames":[]},"profiles":[{"type":"sampled","name":"a","unit":"none","samples":[[0]],"weights":[1]}]}`,
+		"missing weights":     `{"shared":{"frames":[{"name":"main"}]},"profiles":[{"type":"sampled","name":"a","unit":"none","samples":[[0]],"weights":[]}]}`,
+	}
+	for name, in := range tt {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ReadSpeedscope(bytes.NewBufferString(in)); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
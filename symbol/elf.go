@@ -0,0 +1,326 @@
+package symbol
+
+import (
+	"bytes"
+	"debug/dwarf"
+	"debug/elf"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+
+	"github.com/ulikunitz/xz"
+)
+
+// BuildID returns the GNU build ID of the ELF binary (from .note.gnu.build-id section),
+// or Go build ID if the former is absent.
+// Both are hex-encoded the same way Parca does,
+// so the IDs can be used as file names and match the debuginfo uploaded to Parca.
+// An empty string is returned if the binary has neither.
+func BuildID(f *elf.File) (string, error) {
+	if s := f.Section(".note.gnu.build-id"); s != nil {
+		desc, err := readNote(s, f.ByteOrder, "GNU\x00", 3) // NT_GNU_BUILD_ID
+		if err != nil {
+			return "", fmt.Errorf("failed to read GNU build ID: %w", err)
+		}
+		if desc != nil {
+			return hex.EncodeToString(desc), nil
+		}
+	}
+	if s := f.Section(".note.go.buildid"); s != nil {
+		desc, err := readNote(s, f.ByteOrder, "Go\x00\x00", 4) // ELF_NOTE_GOBUILDID_TAG
+		if err != nil {
+			return "", fmt.Errorf("failed to read Go build ID: %w", err)
+		}
+		if desc != nil {
+			return hex.EncodeToString(desc), nil
+		}
+	}
+
+	return "", nil
+}
+
+// readNote returns the descriptor of the first note in the section
+// with the given name and type, or nil if there is none.
+// A note consists of name size, descriptor size, type,
+// followed by the name and the descriptor, each padded to 4 bytes.
+func readNote(s *elf.Section, order binary.ByteOrder, name string, typ uint32) ([]byte, error) {
+	data, err := s.Data()
+	if err != nil {
+		return nil, err
+	}
+
+	align := func(n uint32) uint32 { return (n + 3) &^ 3 }
+
+	for len(data) >= 12 {
+		nameSize := order.Uint32(data[0:4])
+		descSize := order.Uint32(data[4:8])
+		noteType := order.Uint32(data[8:12])
+		data = data[12:]
+		if uint32(len(data)) < align(nameSize)+descSize {
+			return nil, errors.New("note is truncated")
+		}
+
+		noteName := data[:nameSize]
+		data = data[align(nameSize):]
+		desc := data[:descSize]
+		if uint32(len(data)) > align(descSize) {
+			data = data[align(descSize):]
+		} else {
+			data = nil
+		}
+
+		if noteType == typ && string(noteName) == name {
+			return desc, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// Extract reads the symbol table of the ELF binary at path:
+// function symbols from .symtab and .dynsym sections,
+// and the line table from DWARF if the binary has debug info.
+func Extract(path string) (*Table, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open ELF: %w", err)
+	}
+	defer f.Close()
+
+	return extract(path, f)
+}
+
+func extract(path string, f *elf.File) (*Table, error) {
+	var (
+		t   Table
+		err error
+	)
+	if t.BuildID, err = BuildID(f); err != nil {
+		return nil, err
+	}
+
+	for _, p := range f.Progs {
+		if p.Type == elf.PT_LOAD && p.Flags&elf.PF_X != 0 {
+			t.Segments = append(t.Segments, Segment{
+				Offset:   p.Off,
+				Vaddr:    p.Vaddr,
+				Filesize: p.Filesz,
+			})
+		}
+	}
+
+	if t.Funcs, err = readFuncs(f); err != nil {
+		return nil, err
+	}
+	t.FramePointers = detectFramePointers(f, t.Funcs)
+
+	if !HasDebugInfo(f) {
+		// The binary was stripped of the debug info, function names are still available.
+		return &t, nil
+	}
+	// The compressed sections (SHF_COMPRESSED and legacy .zdebug_*) are decompressed by debug/elf.
+	// The line table is skipped if they can't be read, e.g., zstd compression requires Go 1.21+.
+	d, err := f.DWARF()
+	if err != nil {
+		log.Printf("%s: source lines won't be symbolized: failed to read DWARF: %v", path, err)
+		return &t, nil
+	}
+	if t.Files, t.Lines, err = readLines(d); err != nil {
+		return nil, fmt.Errorf("failed to read DWARF line table: %w", err)
+	}
+	files, inlines, err := readInlines(d, newSplitDWARF(path, f), t.Files)
+	if err != nil {
+		log.Printf("%s: inlined functions won't be symbolized: %v", path, err)
+		return &t, nil
+	}
+	t.Files, t.Inlines = files, inlines
+
+	return &t, nil
+}
+
+// HasDebugInfo reports whether the binary has DWARF debug info,
+// including the compressed one: either SHF_COMPRESSED .debug_info section
+// or legacy .zdebug_info section produced by gcc -gz=zlib-gnu.
+func HasDebugInfo(f *elf.File) bool {
+	return f.Section(".debug_info") != nil || f.Section(".zdebug_info") != nil
+}
+
+// readFuncs returns the function symbols sorted by address.
+// When several symbols have the same address, the global one is preferred.
+func readFuncs(f *elf.File) ([]Func, error) {
+	var syms []elf.Symbol
+	s, err := f.Symbols()
+	if err != nil && !errors.Is(err, elf.ErrNoSymbols) {
+		return nil, fmt.Errorf("failed to read symbols: %w", err)
+	}
+	syms = append(syms, s...)
+	s, err = f.DynamicSymbols()
+	if err != nil && !errors.Is(err, elf.ErrNoSymbols) {
+		return nil, fmt.Errorf("failed to read dynamic symbols: %w", err)
+	}
+	syms = append(syms, s...)
+	s, err = miniDebugInfoSymbols(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read MiniDebugInfo symbols: %w", err)
+	}
+	syms = append(syms, s...)
+
+	funcs := make([]Func, 0, len(syms))
+	global := make([]bool, 0, len(syms))
+	for _, s := range syms {
+		if elf.ST_TYPE(s.Info) != elf.STT_FUNC || s.Value == 0 || s.Section == elf.SHN_UNDEF {
+			continue
+		}
+		funcs = append(funcs, Func{
+			Addr: s.Value,
+			Size: s.Size,
+			Name: s.Name,
+		})
+		global = append(global, elf.ST_BIND(s.Info) == elf.STB_GLOBAL)
+	}
+	plt, err := pltFuncs(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read PLT: %w", err)
+	}
+	for _, fn := range plt {
+		funcs = append(funcs, fn)
+		global = append(global, false)
+	}
+
+	idx := make([]int, len(funcs))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(i, j int) bool {
+		a, b := idx[i], idx[j]
+		if funcs[a].Addr != funcs[b].Addr {
+			return funcs[a].Addr < funcs[b].Addr
+		}
+		return global[a] && !global[b]
+	})
+
+	sorted := make([]Func, 0, len(funcs))
+	for _, i := range idx {
+		if n := len(sorted); n > 0 && sorted[n-1].Addr == funcs[i].Addr {
+			continue
+		}
+		sorted = append(sorted, funcs[i])
+	}
+
+	return sorted, nil
+}
+
+// miniDebugInfoSymbols returns the symbols from MiniDebugInfo if the binary has it.
+// Fedora and RHEL strip the binaries but keep the symbols of the local functions
+// (the ones missing in .dynsym) in .gnu_debugdata section
+// which is an xz-compressed ELF file with .symtab section.
+func miniDebugInfoSymbols(f *elf.File) ([]elf.Symbol, error) {
+	s := f.Section(".gnu_debugdata")
+	if s == nil {
+		return nil, nil
+	}
+
+	zr, err := xz.NewReader(s.Open())
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, err
+	}
+	mini, err := elf.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer mini.Close()
+
+	syms, err := mini.Symbols()
+	if err != nil && !errors.Is(err, elf.ErrNoSymbols) {
+		return nil, err
+	}
+	return syms, nil
+}
+
+// readLines returns the source files and the line table sorted by address.
+// Binaries built with -gsplit-dwarf (debug fission) have skeleton units
+// which point to .dwo/.dwp files with the rest of the debug info (see readInlines).
+// The line tables stay in the binary though, so the skeleton units are read the same way.
+func readLines(d *dwarf.Data) ([]string, []Line, error) {
+	var (
+		files     []string
+		fileIndex = make(map[string]uint32)
+		lines     []Line
+		le        dwarf.LineEntry
+	)
+	r := d.Reader()
+	for {
+		e, err := r.Next()
+		if err != nil {
+			return nil, nil, err
+		}
+		if e == nil {
+			break
+		}
+		if e.Tag != dwarf.TagCompileUnit && e.Tag != dwarf.TagSkeletonUnit {
+			r.SkipChildren()
+			continue
+		}
+
+		lr, err := d.LineReader(e)
+		if err != nil {
+			return nil, nil, err
+		}
+		r.SkipChildren()
+		if lr == nil {
+			continue
+		}
+
+		for {
+			if err = lr.Next(&le); err != nil {
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				return nil, nil, err
+			}
+			if le.EndSequence {
+				lines = append(lines, Line{Addr: le.Address})
+				continue
+			}
+
+			var name string
+			if le.File != nil {
+				name = le.File.Name
+			}
+			i, ok := fileIndex[name]
+			if !ok {
+				i = uint32(len(files))
+				fileIndex[name] = i
+				files = append(files, name)
+			}
+			// Consecutive rows often describe the same line.
+			if n := len(lines); n > 0 && lines[n-1].File == i && lines[n-1].Line == uint32(le.Line) {
+				continue
+			}
+			lines = append(lines, Line{
+				Addr: le.Address,
+				File: i,
+				Line: uint32(le.Line),
+			})
+		}
+	}
+
+	// A sequence might start at the address where another one ends,
+	// so the end of sequence marker goes first.
+	sort.SliceStable(lines, func(i, j int) bool {
+		if lines[i].Addr != lines[j].Addr {
+			return lines[i].Addr < lines[j].Addr
+		}
+		return lines[i].Line == 0 && lines[j].Line != 0
+	})
+
+	return files, lines, nil
+}
@@ -0,0 +1,139 @@
+package symbol
+
+import (
+	"bytes"
+	"debug/elf"
+	"fmt"
+)
+
+// FramePointers tells whether the binary's functions maintain frame pointers.
+// The kernel walks user stacks by following the frame pointers,
+// so the stacks passing through the functions which omit them are truncated.
+type FramePointers uint8
+
+const (
+	// FramePointersUnknown means the usage couldn't be determined,
+	// e.g., the binary has no symbols or the architecture isn't supported.
+	FramePointersUnknown FramePointers = iota
+	// FramePointersPresent means most of the functions set up a frame pointer.
+	FramePointersPresent
+	// FramePointersOmitted means most of the functions were compiled without frame pointers,
+	// e.g., with gcc -O2 which implies -fomit-frame-pointer.
+	FramePointersOmitted
+)
+
+func (fp FramePointers) String() string {
+	switch fp {
+	case FramePointersPresent:
+		return "present"
+	case FramePointersOmitted:
+		return "omitted"
+	default:
+		return "unknown"
+	}
+}
+
+const (
+	// minFramePointerFuncs is the minimum number of functions to inspect
+	// to make a guess about the frame pointers.
+	minFramePointerFuncs = 10
+	// prologueSize is the number of bytes at the function start
+	// where the frame pointer setup is looked for.
+	prologueSize = 32
+)
+
+var (
+	// x86-64 endbr64 instruction which precedes the prologue when CET is enabled.
+	amd64Endbr64 = []byte{0xf3, 0x0f, 0x1e, 0xfa}
+	// x86-64 frame pointer setup is push %rbp followed by mov %rsp,%rbp.
+	// The compiler might schedule other instructions in between.
+	amd64PushRBP   = []byte{0x55}
+	amd64MovRSPRBP = []byte{0x48, 0x89, 0xe5}
+	// arm64 frame pointer setup: mov x29, sp.
+	arm64Prologue = []byte{0xfd, 0x03, 0x00, 0x91}
+)
+
+// DetectFramePointers guesses whether the binary at path maintains frame pointers
+// without extracting its whole symbol table, e.g., to choose how to unwind its stacks.
+func DetectFramePointers(path string) (FramePointers, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return FramePointersUnknown, fmt.Errorf("failed to open ELF: %w", err)
+	}
+	defer f.Close()
+
+	funcs, err := readFuncs(f)
+	if err != nil {
+		return FramePointersUnknown, err
+	}
+	return detectFramePointers(f, funcs), nil
+}
+
+// detectFramePointers guesses whether the binary maintains frame pointers
+// by looking for the frame pointer setup in the functions' prologues.
+// Go binaries always have frame pointers on amd64 and arm64,
+// though their prologues start with a stack bound check.
+func detectFramePointers(f *elf.File, funcs []Func) FramePointers {
+	if f.Machine != elf.EM_X86_64 && f.Machine != elf.EM_AARCH64 {
+		return FramePointersUnknown
+	}
+	if f.Section(".gopclntab") != nil || f.Section(".note.go.buildid") != nil {
+		return FramePointersPresent
+	}
+
+	var (
+		total, withFP int
+		prologue      = make([]byte, prologueSize)
+	)
+	for _, fn := range funcs {
+		// Tiny functions are usually leaves which don't need a frame.
+		if fn.Size < prologueSize {
+			continue
+		}
+		s := textSection(f, fn.Addr)
+		if s == nil {
+			continue
+		}
+		if _, err := s.ReadAt(prologue, int64(fn.Addr-s.Addr)); err != nil {
+			continue
+		}
+
+		total++
+		switch f.Machine {
+		case elf.EM_X86_64:
+			code := bytes.TrimPrefix(prologue, amd64Endbr64)
+			if bytes.HasPrefix(code, amd64PushRBP) && bytes.Contains(code, amd64MovRSPRBP) {
+				withFP++
+			}
+		case elf.EM_AARCH64:
+			// The frame record is stored by stp x29, x30 first,
+			// so the frame pointer is set by one of the following instructions.
+			for i := 4; i+4 <= len(prologue); i += 4 {
+				if bytes.Equal(prologue[i:i+4], arm64Prologue) {
+					withFP++
+					break
+				}
+			}
+		}
+	}
+
+	switch {
+	case total < minFramePointerFuncs:
+		return FramePointersUnknown
+	case withFP*2 >= total:
+		return FramePointersPresent
+	default:
+		return FramePointersOmitted
+	}
+}
+
+// textSection returns the executable section which contains the address.
+func textSection(f *elf.File, addr uint64) *elf.Section {
+	for _, s := range f.Sections {
+		if s.Type == elf.SHT_PROGBITS && s.Flags&elf.SHF_EXECINSTR != 0 &&
+			addr >= s.Addr && addr < s.Addr+s.Size {
+			return s
+		}
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package symbol
+
+import (
+	"bytes"
+	"debug/elf"
+	"fmt"
+)
+
+// amd64FuncAlign is the function alignment used by gcc and clang on x86-64 by default.
+// The prologues are only looked for at the aligned addresses to avoid matching
+// the prologue bytes in the middle of instructions.
+const amd64FuncAlign = 16
+
+var (
+	// arm64 paciasp instruction which precedes the prologue when pointer authentication is enabled.
+	arm64Paciasp = []byte{0x3f, 0x23, 0x03, 0xd5}
+)
+
+// GuessFuncs synthesizes functions named fn_0x<addr> for the machine code without symbols,
+// e.g., fully stripped binaries or JIT code, so the samples are grouped by function
+// rather than reported as one frame per address.
+// The functions start at the frame pointer setup instructions (x86-64 and arm64),
+// or at endbr64 instruction which marks the indirect branch targets on x86-64.
+// Each function ends where the next one starts.
+// The code is located at addr.
+func GuessFuncs(machine elf.Machine, code []byte, addr uint64) []Func {
+	var starts []uint64
+	switch machine {
+	case elf.EM_X86_64:
+		for i := 0; i < len(code); i += amd64FuncAlign {
+			c := code[i:]
+			if len(c) > prologueSize {
+				c = c[:prologueSize]
+			}
+			// The compiler might schedule other instructions between push and mov.
+			if bytes.HasPrefix(c, amd64Endbr64) ||
+				(bytes.HasPrefix(c, amd64PushRBP) && bytes.Contains(c, amd64MovRSPRBP)) {
+				starts = append(starts, addr+uint64(i))
+			}
+		}
+	case elf.EM_AARCH64:
+		for i := 0; i+8 <= len(code); i += 4 {
+			c := code[i:]
+			if bytes.HasPrefix(c, arm64Paciasp) {
+				starts = append(starts, addr+uint64(i))
+				// The prologue follows, it shouldn't start another function.
+				i += 4
+				continue
+			}
+			if isArm64FrameRecordStore(c) {
+				starts = append(starts, addr+uint64(i))
+			}
+		}
+	default:
+		return nil
+	}
+
+	funcs := make([]Func, len(starts))
+	end := addr + uint64(len(code))
+	for i, start := range starts {
+		next := end
+		if i+1 < len(starts) {
+			next = starts[i+1]
+		}
+		funcs[i] = Func{
+			Addr: start,
+			Size: next - start,
+			Name: fmt.Sprintf("fn_%#x", start),
+		}
+	}
+	return funcs
+}
+
+// isArm64FrameRecordStore reports whether the instruction is
+// stp x29, x30, [sp, #-N]! which stores the frame record in the prologue.
+func isArm64FrameRecordStore(code []byte) bool {
+	inst := uint32(code[0]) | uint32(code[1])<<8 | uint32(code[2])<<16 | uint32(code[3])<<24
+	return inst&0xffc07fff == 0xa9807bfd
+}
+
+// guessTable returns a table with the functions guessed in the executable segments of the binary.
+func guessTable(path string) (*Table, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open ELF: %w", err)
+	}
+	defer f.Close()
+
+	var t Table
+	for _, p := range f.Progs {
+		if p.Type != elf.PT_LOAD || p.Flags&elf.PF_X == 0 {
+			continue
+		}
+		t.Segments = append(t.Segments, Segment{
+			Offset:   p.Off,
+			Vaddr:    p.Vaddr,
+			Filesize: p.Filesz,
+		})
+
+		code := make([]byte, p.Filesz)
+		if _, err = p.ReadAt(code, 0); err != nil {
+			return nil, fmt.Errorf("failed to read executable segment: %w", err)
+		}
+		t.Funcs = append(t.Funcs, GuessFuncs(f.Machine, code, p.Vaddr)...)
+	}
+
+	return &t, nil
+}
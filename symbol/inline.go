@@ -0,0 +1,236 @@
+package symbol
+
+import (
+	"debug/dwarf"
+	"fmt"
+	"log"
+	"sort"
+)
+
+// dwarfAttrGNUDwoName is DW_AT_GNU_dwo_name of the DWARF 4 skeleton units (the pre-standard debug fission).
+const dwarfAttrGNUDwoName dwarf.Attr = 0x2130
+
+// readInlines returns the inlined functions (DW_TAG_inlined_subroutine) sorted by address and depth,
+// the source files of their call sites are added to the files of the line table.
+// The units of the binaries built with -gsplit-dwarf are read from the .dwo files or the .dwp package,
+// see splitDWARF. The split units which can't be found are skipped.
+func readInlines(d *dwarf.Data, split *splitDWARF, files []string) ([]string, []Inline, error) {
+	fileIndex := make(map[string]uint32, len(files))
+	for i, name := range files {
+		fileIndex[name] = uint32(i)
+	}
+	u := inlineReader{
+		files:     files,
+		fileIndex: fileIndex,
+	}
+
+	var splitErr error
+	r := d.Reader()
+	for {
+		cu, err := r.Next()
+		if err != nil {
+			return nil, nil, err
+		}
+		if cu == nil {
+			break
+		}
+
+		switch {
+		case cu.Tag == dwarf.TagSkeletonUnit:
+			r.SkipChildren()
+			sd, scu, err := split.unit(cu)
+			if err == nil {
+				// The split unit's entry is skipped, it's the first one of its data.
+				sr := sd.Reader()
+				if _, err = sr.Next(); err == nil {
+					err = u.readUnit(sd, sr, withStmtList(scu))
+				}
+			}
+			// The binary is still symbolized without the inlined functions of the missing units.
+			if err != nil && splitErr == nil {
+				splitErr = err
+			}
+		case cu.Tag == dwarf.TagCompileUnit && cu.Val(dwarfAttrGNUDwoName) != nil:
+			r.SkipChildren()
+			if splitErr == nil {
+				splitErr = fmt.Errorf("DWARF 4 split unit %v isn't supported", cu.Val(dwarfAttrGNUDwoName))
+			}
+		case cu.Tag == dwarf.TagCompileUnit:
+			if err = u.readUnit(d, r, cu); err != nil {
+				return nil, nil, err
+			}
+		default:
+			r.SkipChildren()
+		}
+	}
+	if splitErr != nil {
+		log.Printf("%s: inlined functions of some split DWARF units won't be symbolized: %v", split.path, splitErr)
+	}
+
+	sort.SliceStable(u.inlines, func(i, j int) bool {
+		if u.inlines[i].Addr != u.inlines[j].Addr {
+			return u.inlines[i].Addr < u.inlines[j].Addr
+		}
+		return u.inlines[i].Depth < u.inlines[j].Depth
+	})
+	return u.files, u.inlines, nil
+}
+
+// inlineReader collects the inlined functions of the compilation units.
+type inlineReader struct {
+	files     []string
+	fileIndex map[string]uint32
+	inlines   []Inline
+	// names are the function names by the offset of their DIE in the current unit's data, see name.
+	names map[dwarf.Offset]string
+	// data and r read the DIEs the inlined functions refer to.
+	data *dwarf.Data
+	r    *dwarf.Reader
+}
+
+// readUnit collects the inlined functions of the compilation unit,
+// the reader must be positioned right after the unit's entry.
+// The call sites refer to the files of the unit's line table.
+func (u *inlineReader) readUnit(d *dwarf.Data, r *dwarf.Reader, cu *dwarf.Entry) error {
+	if !cu.Children {
+		return nil
+	}
+	if u.data != d {
+		u.data, u.r = d, d.Reader()
+		u.names = make(map[dwarf.Offset]string)
+	}
+	var callFiles []*dwarf.LineFile
+	lr, err := d.LineReader(cu)
+	if err != nil {
+		return err
+	}
+	if lr != nil {
+		callFiles = lr.Files()
+	}
+
+	// depths are the inline depths of the entries whose children are being read.
+	var (
+		depths []uint32
+		depth  uint32
+	)
+	for {
+		e, err := r.Next()
+		if err != nil {
+			return err
+		}
+		if e == nil {
+			return nil
+		}
+		// The end of the siblings, the unit's children end with the last one.
+		if e.Tag == 0 {
+			if len(depths) == 0 {
+				return nil
+			}
+			depth, depths = depths[len(depths)-1], depths[:len(depths)-1]
+			continue
+		}
+
+		childDepth := depth
+		switch e.Tag {
+		case dwarf.TagInlinedSubroutine:
+			childDepth++
+			if err = u.addInline(d, e, childDepth, callFiles); err != nil {
+				return err
+			}
+		case dwarf.TagSubprogram, dwarf.TagLexDwarfBlock, dwarf.TagNamespace, dwarf.TagModule:
+		default:
+			// The other entries (e.g., the types and variables) have no inlined functions.
+			if e.Children {
+				r.SkipChildren()
+			}
+			continue
+		}
+		if e.Children {
+			depths = append(depths, depth)
+			depth = childDepth
+		}
+	}
+}
+
+// addInline adds the address ranges of the inlined function at the depth.
+func (u *inlineReader) addInline(d *dwarf.Data, e *dwarf.Entry, depth uint32, callFiles []*dwarf.LineFile) error {
+	ranges, err := d.Ranges(e)
+	if err != nil {
+		return err
+	}
+	if len(ranges) == 0 {
+		return nil
+	}
+
+	var file string
+	if i, ok := e.Val(dwarf.AttrCallFile).(int64); ok && i >= 0 && int(i) < len(callFiles) && callFiles[i] != nil {
+		file = callFiles[i].Name
+	}
+	fi, ok := u.fileIndex[file]
+	if !ok {
+		fi = uint32(len(u.files))
+		u.fileIndex[file] = fi
+		u.files = append(u.files, file)
+	}
+	line, _ := e.Val(dwarf.AttrCallLine).(int64)
+	name := u.name(e, 0)
+
+	for _, rg := range ranges {
+		if rg[1] <= rg[0] {
+			continue
+		}
+		u.inlines = append(u.inlines, Inline{
+			Addr:     rg[0],
+			Size:     rg[1] - rg[0],
+			Depth:    depth,
+			Name:     name,
+			CallFile: fi,
+			CallLine: uint32(line),
+		})
+	}
+	return nil
+}
+
+// maxOriginDepth limits how many abstract origins and specifications are followed to find a name,
+// so malformed DWARF with cycles doesn't hang the extraction.
+const maxOriginDepth = 8
+
+// name returns the function name of the entry: the linkage name (so the inlined functions are named
+// like the symbols, e.g., the mangled C++ names) of the entry or the one it refers to
+// (DW_AT_abstract_origin or DW_AT_specification), otherwise their plain name.
+// The names are cached by the offset of the referred entry, so the inlines share them.
+func (u *inlineReader) name(e *dwarf.Entry, depth int) string {
+	if name, ok := e.Val(dwarf.AttrLinkageName).(string); ok {
+		return name
+	}
+	if depth < maxOriginDepth {
+		for _, attr := range []dwarf.Attr{dwarf.AttrAbstractOrigin, dwarf.AttrSpecification} {
+			off, ok := e.Val(attr).(dwarf.Offset)
+			if !ok {
+				continue
+			}
+			name, ok := u.names[off]
+			if !ok {
+				u.r.Seek(off)
+				if origin, err := u.r.Next(); err == nil && origin != nil {
+					name = u.name(origin, depth+1)
+				}
+				u.names[off] = name
+			}
+			if name != "" {
+				return name
+			}
+		}
+	}
+	name, _ := e.Val(dwarf.AttrName).(string)
+	return name
+}
+
+// withStmtList returns the split unit's entry referring to its line table (.debug_line.dwo),
+// so its file names can be read, see splitDWARF.unit.
+// The split units have no DW_AT_stmt_list, since the rows of their line tables are in the binary.
+func withStmtList(cu *dwarf.Entry) *dwarf.Entry {
+	e := *cu
+	e.Field = append([]dwarf.Field{{Attr: dwarf.AttrStmtList, Val: int64(0), Class: dwarf.ClassLinePtr}}, cu.Field...)
+	return &e
+}
@@ -0,0 +1,105 @@
+package symbol
+
+import (
+	"debug/elf"
+	"errors"
+	"fmt"
+)
+
+// PLT layouts of the supported architectures:
+// the size of the header (PLT0) which calls the dynamic linker and the size of each stub.
+const (
+	amd64PLTHeaderSize = 16
+	amd64PLTEntrySize  = 16
+	arm64PLTHeaderSize = 32
+	arm64PLTEntrySize  = 16
+)
+
+// pltFuncs returns the procedure linkage table stubs as functions named <target>@plt,
+// so the calls to shared libraries are attributed to the called function
+// rather than a symbol which happens to precede the PLT.
+//
+// The stubs aren't described by symbols, but they follow the order of
+// the jump slot relocations in .rela.plt section: the stub N corresponds to the relocation N.
+// When the binary is built with IBT (x86-64 -fcf-protection),
+// the stubs are in .plt.sec section without the header.
+func pltFuncs(f *elf.File) ([]Func, error) {
+	if f.Class != elf.ELFCLASS64 {
+		return nil, nil
+	}
+	var headerSize, entrySize uint64
+	switch f.Machine {
+	case elf.EM_X86_64:
+		headerSize, entrySize = amd64PLTHeaderSize, amd64PLTEntrySize
+	case elf.EM_AARCH64:
+		headerSize, entrySize = arm64PLTHeaderSize, arm64PLTEntrySize
+	default:
+		return nil, nil
+	}
+
+	plt := f.Section(".plt")
+	rela := f.Section(".rela.plt")
+	if plt == nil || rela == nil {
+		return nil, nil
+	}
+	names, err := pltTargets(f, rela)
+	if err != nil {
+		return nil, err
+	}
+
+	funcs := []Func{{
+		Addr: plt.Addr,
+		Size: headerSize,
+		Name: "[plt]",
+	}}
+	stubs := func(s *elf.Section, start uint64) {
+		for i, name := range names {
+			addr := start + uint64(i)*entrySize
+			if addr+entrySize > s.Addr+s.Size {
+				break
+			}
+			funcs = append(funcs, Func{
+				Addr: addr,
+				Size: entrySize,
+				Name: name + "@plt",
+			})
+		}
+	}
+	// With IBT the stubs in .plt only jump to the ones in .plt.sec.
+	stubs(plt, plt.Addr+headerSize)
+	if sec := f.Section(".plt.sec"); sec != nil {
+		stubs(sec, sec.Addr)
+	}
+
+	return funcs, nil
+}
+
+// pltTargets returns the names of the functions called via PLT in the order of their relocations.
+// Each Elf64_Rela entry consists of offset, info (symbol index and type), and addend.
+func pltTargets(f *elf.File, rela *elf.Section) ([]string, error) {
+	data, err := rela.Data()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read PLT relocations: %w", err)
+	}
+	// Static binaries have no dynamic symbols, their PLT calls IFUNC-resolved functions.
+	syms, err := f.DynamicSymbols()
+	if err != nil && !errors.Is(err, elf.ErrNoSymbols) {
+		return nil, fmt.Errorf("failed to read dynamic symbols: %w", err)
+	}
+
+	const relaSize = 24
+	var names []string
+	for ; len(data) >= relaSize; data = data[relaSize:] {
+		info := f.ByteOrder.Uint64(data[8:16])
+		addend := f.ByteOrder.Uint64(data[16:24])
+		// DynamicSymbols skips the null symbol at index 0.
+		// The IRELATIVE relocations have no symbol, so they are named by the resolver address like objdump does.
+		name := fmt.Sprintf("*ABS*+%#x", addend)
+		if i := int(info >> 32); i > 0 && i <= len(syms) {
+			name = syms[i-1].Name
+		}
+		names = append(names, name)
+	}
+
+	return names, nil
+}
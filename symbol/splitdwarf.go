@@ -0,0 +1,370 @@
+package symbol
+
+import (
+	"debug/dwarf"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// splitDWARF reads the split units of a binary built with -gsplit-dwarf (debug fission, DWARF 5).
+// The binary only has the skeleton units and the line tables,
+// the rest of the debug info (e.g., the inlined functions) is in the .dwo file of each unit
+// named by DW_AT_dwo_name (relative to DW_AT_comp_dir), or in the <binary>.dwp package which combines them.
+type splitDWARF struct {
+	path string
+	// root is the root directory of the mount namespace the binary is read from, e.g., /proc/1234/root,
+	// so the absolute .dwo paths are resolved in it.
+	root  string
+	order binary.ByteOrder
+	// info and addr are .debug_info and .debug_addr of the binary,
+	// the former has the DWO IDs of the skeleton units and the latter the addresses of the split units.
+	info []byte
+	addr []byte
+	// dwp is the package opened on first use, see dwpErr.
+	dwp    *dwoFile
+	dwpErr error
+}
+
+// newSplitDWARF returns a reader of the split units of the binary at path.
+func newSplitDWARF(path string, f *elf.File) *splitDWARF {
+	s := splitDWARF{
+		path:  path,
+		root:  procRoot(path),
+		order: f.ByteOrder,
+	}
+	if sec := f.Section(".debug_info"); sec != nil {
+		s.info, _ = sec.Data()
+	}
+	if sec := f.Section(".debug_addr"); sec != nil {
+		s.addr, _ = sec.Data()
+	}
+	return &s
+}
+
+// procRoot returns the root directory of the process the path is opened via, e.g., /proc/1234/root
+// for /proc/1234/root/usr/bin/app, or an empty string for the other paths.
+func procRoot(path string) string {
+	const prefix = "/proc/"
+	if !strings.HasPrefix(path, prefix) {
+		return ""
+	}
+	i := strings.IndexByte(path[len(prefix):], '/')
+	if i < 0 {
+		return ""
+	}
+	root := path[:len(prefix)+i] + "/root"
+	if !strings.HasPrefix(path, root+"/") {
+		return ""
+	}
+	return root
+}
+
+// unit returns the DWARF data of the split unit of the skeleton unit and the split unit's entry.
+// The .dwo file is looked up first, then the .dwp package next to the binary.
+func (s *splitDWARF) unit(skeleton *dwarf.Entry) (*dwarf.Data, *dwarf.Entry, error) {
+	// The DWO ID of a DWARF 5 skeleton unit ends its header right before the unit's entry.
+	off := int(skeleton.Offset)
+	if off < 8 || off > len(s.info) {
+		return nil, nil, errors.New("skeleton unit has no DWO ID")
+	}
+	id := s.order.Uint64(s.info[off-8:])
+	addrBase, _ := skeleton.Val(dwarf.AttrAddrBase).(int64)
+	if addrBase < 0 || int(addrBase) > len(s.addr) {
+		return nil, nil, fmt.Errorf("invalid address base %d of split unit %#x", addrBase, id)
+	}
+	addr := s.addr[addrBase:]
+
+	name, _ := skeleton.Val(dwarf.AttrDwoName).(string)
+	if name == "" {
+		return nil, nil, errors.New("skeleton unit has no DWO name")
+	}
+	if !filepath.IsAbs(name) {
+		compDir, _ := skeleton.Val(dwarf.AttrCompDir).(string)
+		name = filepath.Join(compDir, name)
+	}
+	if filepath.IsAbs(name) {
+		name = s.root + name
+	} else {
+		name = filepath.Join(filepath.Dir(s.path), name)
+	}
+
+	dwo, dwoErr := openDWO(name)
+	if dwoErr == nil {
+		d, cu, err := dwo.unit(id, addr)
+		if err == nil {
+			return d, cu, nil
+		}
+		dwoErr = fmt.Errorf("%s: %w", name, err)
+	}
+
+	if s.dwp == nil && s.dwpErr == nil {
+		if s.dwp, s.dwpErr = openDWO(s.path + ".dwp"); s.dwpErr == nil && s.dwp.index == nil {
+			s.dwp, s.dwpErr = nil, fmt.Errorf("%s.dwp: package has no .debug_cu_index section", s.path)
+		}
+	}
+	if s.dwpErr != nil {
+		return nil, nil, fmt.Errorf("%v, and %v", dwoErr, s.dwpErr)
+	}
+	d, cu, err := s.dwp.unit(id, addr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%v, and %s.dwp: %v", dwoErr, s.path, err)
+	}
+	return d, cu, nil
+}
+
+// dwoFile is a .dwo file or a .dwp package (a .dwo file with the index of its units).
+type dwoFile struct {
+	order binary.ByteOrder
+	dwoSections
+	str []byte
+	// index are the sections of the package's units by DWO ID, it's nil for a .dwo file.
+	index map[uint64]dwoSections
+}
+
+// dwoSections are the sections of a split unit, in a package they're the unit's contributions.
+type dwoSections struct {
+	info       []byte
+	abbrev     []byte
+	line       []byte
+	strOffsets []byte
+	rnglists   []byte
+}
+
+// openDWO reads the split DWARF sections of the .dwo file or the .dwp package.
+func openDWO(path string) (*dwoFile, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	dwo := dwoFile{order: f.ByteOrder}
+	sections := []struct {
+		name string
+		data *[]byte
+	}{
+		{".debug_info.dwo", &dwo.info},
+		{".debug_abbrev.dwo", &dwo.abbrev},
+		{".debug_line.dwo", &dwo.line},
+		{".debug_str.dwo", &dwo.str},
+		{".debug_str_offsets.dwo", &dwo.strOffsets},
+		{".debug_rnglists.dwo", &dwo.rnglists},
+	}
+	for _, sec := range sections {
+		s := f.Section(sec.name)
+		if s == nil {
+			continue
+		}
+		if *sec.data, err = s.Data(); err != nil {
+			return nil, fmt.Errorf("%s: failed to read %s: %w", path, sec.name, err)
+		}
+	}
+	if dwo.info == nil || dwo.abbrev == nil {
+		return nil, fmt.Errorf("%s: no split DWARF sections", path)
+	}
+
+	if s := f.Section(".debug_cu_index"); s != nil {
+		data, err := s.Data()
+		if err != nil {
+			return nil, fmt.Errorf("%s: failed to read .debug_cu_index: %w", path, err)
+		}
+		if dwo.index, err = dwo.parseIndex(data); err != nil {
+			return nil, fmt.Errorf("%s: invalid .debug_cu_index: %w", path, err)
+		}
+	}
+	return &dwo, nil
+}
+
+// The section identifiers of the package index, see DWARF 5 section 7.3.5.
+// They're the same in the pre-standard version 2 except for DW_SECT_RNGLISTS.
+const (
+	dwSectInfo       = 1
+	dwSectAbbrev     = 3
+	dwSectLine       = 4
+	dwSectStrOffsets = 6
+	dwSectRnglists   = 8
+)
+
+// parseIndex returns the contributions of the package's units by DWO ID.
+// The index is a hash table of the DWO IDs with the offsets and sizes of the units' contributions
+// to the sections.
+func (f *dwoFile) parseIndex(b []byte) (map[uint64]dwoSections, error) {
+	if len(b) < 16 {
+		return nil, errors.New("truncated header")
+	}
+	var version int
+	switch {
+	case f.order.Uint16(b) == 5:
+		version = 5
+	case f.order.Uint32(b) == 2:
+		version = 2
+	default:
+		return nil, fmt.Errorf("unsupported version %d", f.order.Uint16(b))
+	}
+	cols := int(f.order.Uint32(b[4:]))
+	units := int(f.order.Uint32(b[8:]))
+	slots := int(f.order.Uint32(b[12:]))
+
+	hashes := 16
+	rows := hashes + slots*8
+	ids := rows + slots*4
+	offsets := ids + cols*4
+	sizes := offsets + units*cols*4
+	if cols <= 0 || slots < 0 || units < 0 || sizes+units*cols*4 > len(b) || sizes < 0 {
+		return nil, errors.New("truncated tables")
+	}
+
+	index := make(map[uint64]dwoSections, units)
+	for i := 0; i < slots; i++ {
+		row := int(f.order.Uint32(b[rows+i*4:]))
+		if row == 0 {
+			continue
+		}
+		if row > units {
+			return nil, fmt.Errorf("unit %d is out of range", row)
+		}
+		var (
+			c   dwoSections
+			err error
+		)
+		for col := 0; col < cols; col++ {
+			at := ((row-1)*cols + col) * 4
+			off := f.order.Uint32(b[offsets+at:])
+			size := f.order.Uint32(b[sizes+at:])
+			switch f.order.Uint32(b[ids+col*4:]) {
+			case dwSectInfo:
+				c.info, err = contribution(f.info, off, size)
+			case dwSectAbbrev:
+				c.abbrev, err = contribution(f.abbrev, off, size)
+			case dwSectLine:
+				c.line, err = contribution(f.line, off, size)
+			case dwSectStrOffsets:
+				c.strOffsets, err = contribution(f.strOffsets, off, size)
+			case dwSectRnglists:
+				if version == 5 {
+					c.rnglists, err = contribution(f.rnglists, off, size)
+				}
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		index[f.order.Uint64(b[hashes+i*8:])] = c
+	}
+	return index, nil
+}
+
+// contribution returns the part of the section contributed by a unit.
+func contribution(section []byte, off, size uint32) ([]byte, error) {
+	if uint64(off)+uint64(size) > uint64(len(section)) {
+		return nil, fmt.Errorf("contribution [%d, %d) is out of section of %d bytes", off, uint64(off)+uint64(size), len(section))
+	}
+	return section[off : off+size], nil
+}
+
+// unit returns the DWARF data of the split unit with the DWO ID and the unit's entry.
+// The addresses of the unit (DW_FORM_addrx) are read from the binary's .debug_addr starting at the unit's base.
+func (f *dwoFile) unit(id uint64, addr []byte) (*dwarf.Data, *dwarf.Entry, error) {
+	c := f.dwoSections
+	if f.index != nil {
+		var ok bool
+		if c, ok = f.index[id]; !ok {
+			return nil, nil, fmt.Errorf("no split unit %#x", id)
+		}
+	} else {
+		info, err := f.findUnit(id)
+		if err != nil {
+			return nil, nil, err
+		}
+		c.info = info
+	}
+
+	d, err := dwarf.New(c.abbrev, nil, nil, c.info, c.line, nil, nil, f.str)
+	if err != nil {
+		return nil, nil, err
+	}
+	// The split units have no DW_AT_addr_base, DW_AT_str_offsets_base, and DW_AT_rnglists_base,
+	// the bases are the starts of their contributions past the headers,
+	// while debug/dwarf uses zero bases, so the sections are passed from there.
+	if err = d.AddSection(".debug_addr", addr); err != nil {
+		return nil, nil, err
+	}
+	if len(c.strOffsets) > 0 {
+		if err = d.AddSection(".debug_str_offsets", f.skipHeader(c.strOffsets, 2)); err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(c.rnglists) > 0 {
+		if err = d.AddSection(".debug_rnglists", f.skipHeader(c.rnglists, 6)); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	cu, err := d.Reader().Next()
+	if err != nil {
+		return nil, nil, err
+	}
+	if cu == nil || cu.Tag != dwarf.TagCompileUnit {
+		return nil, nil, fmt.Errorf("split unit %#x has no compile unit entry", id)
+	}
+	return d, cu, nil
+}
+
+// dwarfUnitSplitCompile is DW_UT_split_compile, the unit type of the split units.
+const dwarfUnitSplitCompile = 5
+
+// findUnit returns the split unit with the DWO ID of the .dwo file's .debug_info.dwo,
+// so a stale .dwo file (e.g., the binary was rebuilt) isn't used.
+func (f *dwoFile) findUnit(id uint64) ([]byte, error) {
+	b := f.info
+	for len(b) > 0 {
+		length, offSize, hdr := f.unitLength(b)
+		end := hdr + length
+		// The unit_type, address_size, and debug_abbrev_offset fields precede the DWO ID.
+		idOff := hdr + 2 + 2 + offSize
+		if length == 0 || end > uint64(len(b)) || idOff+8 > end {
+			return nil, errors.New("truncated .debug_info.dwo")
+		}
+		version := f.order.Uint16(b[hdr:])
+		if version < 5 {
+			return nil, fmt.Errorf("split DWARF version %d isn't supported", version)
+		}
+		if b[hdr+2] == dwarfUnitSplitCompile && f.order.Uint64(b[idOff:]) == id {
+			return b[:end], nil
+		}
+		b = b[end:]
+	}
+	return nil, fmt.Errorf("no split unit %#x, the .dwo file might be stale", id)
+}
+
+// unitLength returns the length of the unit (or the section contribution) at the start of b,
+// the size of the offsets (4 or 8 in 64-bit DWARF), and the size of the length field.
+func (f *dwoFile) unitLength(b []byte) (length, offSize, hdr uint64) {
+	if len(b) < 4 {
+		return 0, 4, 4
+	}
+	length = uint64(f.order.Uint32(b))
+	if length != 0xffffffff {
+		return length, 4, 4
+	}
+	if len(b) < 12 {
+		return 0, 8, 12
+	}
+	return f.order.Uint64(b[4:]), 8, 12
+}
+
+// skipHeader returns the contribution past its header: the length, version, and the fields of the given size,
+// i.e., the padding of .debug_str_offsets, and the address size, segment selector size,
+// and offset entry count of .debug_rnglists.
+func (f *dwoFile) skipHeader(b []byte, fields uint64) []byte {
+	_, _, hdr := f.unitLength(b)
+	n := hdr + 2 + fields
+	if n > uint64(len(b)) {
+		return nil
+	}
+	return b[n:]
+}
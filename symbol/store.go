@@ -0,0 +1,95 @@
+package symbol
+
+import (
+	"compress/gzip"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// storeVersion is the version of the on-disk format of the symbol tables.
+// It must be incremented whenever Table changes incompatibly,
+// so the outdated tables are ignored.
+const storeVersion = 3
+
+// ErrNotFound indicates that the store doesn't have the symbol table.
+var ErrNotFound = errors.New("symbol table not found")
+
+// Store is an on-disk cache of symbol tables keyed by build ID,
+// so they are extracted from the binaries once and reused by the following runs.
+// A table is stored as a gzip-compressed gob file named after the build ID.
+type Store struct {
+	dir string
+}
+
+// NewStore returns a store which keeps the symbol tables in dir.
+// The directory is created if it doesn't exist.
+func NewStore(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create symbol store: %w", err)
+	}
+	return &Store{dir: dir}, nil
+}
+
+func (s *Store) path(buildID string) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%s.v%d.gob.gz", buildID, storeVersion))
+}
+
+// Load reads the symbol table of the binary with the given build ID.
+// ErrNotFound is returned if the table is not in the store.
+func (s *Store) Load(buildID string) (*Table, error) {
+	f, err := os.Open(s.path(buildID))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to open symbol table: %w", err)
+	}
+	defer f.Close()
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress symbol table: %w", err)
+	}
+	var t Table
+	if err = gob.NewDecoder(zr).Decode(&t); err != nil {
+		return nil, fmt.Errorf("failed to decode symbol table: %w", err)
+	}
+
+	return &t, nil
+}
+
+// Save writes the symbol table to the store.
+// The table is written to a temporary file first and then renamed,
+// so concurrent readers never see a partially written table.
+func (s *Store) Save(t *Table) error {
+	if t.BuildID == "" {
+		return errors.New("symbol table without build ID can't be stored")
+	}
+
+	f, err := os.CreateTemp(s.dir, t.BuildID+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create symbol table file: %w", err)
+	}
+	defer os.Remove(f.Name())
+
+	zw := gzip.NewWriter(f)
+	if err = gob.NewEncoder(zw).Encode(t); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to encode symbol table: %w", err)
+	}
+	if err = zw.Close(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to compress symbol table: %w", err)
+	}
+	if err = f.Close(); err != nil {
+		return fmt.Errorf("failed to write symbol table: %w", err)
+	}
+	if err = os.Rename(f.Name(), s.path(t.BuildID)); err != nil {
+		return fmt.Errorf("failed to save symbol table: %w", err)
+	}
+
+	return nil
+}
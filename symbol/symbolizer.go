@@ -0,0 +1,544 @@
+package symbol
+
+import (
+	"container/list"
+	"debug/elf"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Symbolizer resolves addresses of ELF binaries into symbols.
+// The symbol tables are kept in memory and, if the store is set,
+// persisted on disk, so they aren't extracted from the binaries again,
+// e.g., after the profiler restarts.
+//
+// The memory used by the tables is limited by a budget which they can share with other caches, see Reserve.
+// When it's exceeded, the least recently used tables are evicted
+// (they are loaded from the store again when needed).
+type Symbolizer struct {
+	store    *Store
+	maxBytes int64
+
+	mu sync.Mutex
+	// tables are the elements of lru by build ID.
+	tables map[string]*list.Element
+	// lru is a list of cached tables, the most recently used is at the front.
+	lru   *list.List
+	stats Stats
+	// paths describe the binaries by file path, they're forgotten with their processes, see ForgetRoots.
+	// The binaries without build ID have their tables cached by path.
+	paths map[string]*pathInfo
+	// loading are the tables being read from the binaries or the store by their cache keys,
+	// see loadTable.
+	loading map[string]*tableLoad
+}
+
+// tableLoad is a symbol table being read without holding the mutex,
+// done is closed once the table or the error is set.
+type tableLoad struct {
+	done  chan struct{}
+	table *Table
+	err   error
+}
+
+// pathInfo is what's known about the binary at a path.
+type pathInfo struct {
+	// buildID is the binary's build ID once hasBuildID is set, it's empty if the binary has none.
+	buildID    string
+	hasBuildID bool
+	// file is the file the path pointed to when it was first read,
+	// so the binary replaced at the same path (e.g., during a deploy) isn't symbolized
+	// with the stale table, and checked is when it was last compared, see checkFile.
+	file    os.FileInfo
+	checked time.Time
+	// guessed is the table of the binary without symbols, see GuessFunc.
+	guessed *Table
+	// err remembers why the binary couldn't be read at errTime, e.g., the file is not ELF,
+	// so it isn't retried until errorRetryInterval passes, see failed.
+	err     error
+	errTime time.Time
+	// size is the estimated memory used by the path, see resize.
+	size int64
+}
+
+// fileCheckInterval is how often the binaries are checked for being replaced at their paths, see checkFile.
+const fileCheckInterval = 10 * time.Second
+
+// errorRetryInterval is how long the binaries which couldn't be read aren't retried.
+// The errors aren't kept forever, since some are transient, e.g., too many open files
+// or the binary is still being written.
+const errorRetryInterval = time.Minute
+
+// failed returns the error of the binary's last read unless it's time to retry.
+func (p *pathInfo) failed() error {
+	if p.err != nil && time.Since(p.errTime) >= errorRetryInterval {
+		p.err = nil
+	}
+	return p.err
+}
+
+// pathInfoSize is the estimated memory used by a path besides its strings and guessed table,
+// including the file info and the map entry.
+const pathInfoSize = 256
+
+// cacheEntry is a symbol table cached in memory.
+type cacheEntry struct {
+	key   string
+	table *Table
+	size  int64
+}
+
+// Stats describe the symbol tables cached in memory.
+type Stats struct {
+	// Tables is the number of cached tables.
+	Tables int
+	// Bytes is the estimated memory used by the cached tables.
+	Bytes int64
+	// Hits and Misses count the table lookups which were and weren't served from memory.
+	Hits   uint64
+	Misses uint64
+	// Evictions counts the tables evicted to stay within the memory budget.
+	Evictions uint64
+	// Paths is the number of binary paths known, and PathBytes is their estimated memory
+	// including the guessed tables, see ForgetRoots.
+	Paths     int
+	PathBytes int64
+	// Reserved is the memory used by the other caches sharing the budget, see Reserve.
+	Reserved int64
+	// MaxBytes is the memory budget, zero means no limit.
+	MaxBytes int64
+}
+
+// NewSymbolizer returns a symbolizer which caches the symbol tables in the store.
+// The store can be nil, then the tables are only cached in memory.
+// The tables kept in memory take up to maxBytes (approximately), zero means no limit.
+func NewSymbolizer(store *Store, maxBytes int64) *Symbolizer {
+	return &Symbolizer{
+		store:    store,
+		maxBytes: maxBytes,
+		tables:   make(map[string]*list.Element),
+		lru:      list.New(),
+		paths:    make(map[string]*pathInfo),
+		loading:  make(map[string]*tableLoad),
+		stats:    Stats{MaxBytes: maxBytes},
+	}
+}
+
+// Stats returns the statistics of the in-memory cache.
+func (s *Symbolizer) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.stats
+}
+
+// Table returns the symbol table of the ELF binary at path.
+// The table is extracted from the binary only if it's not cached,
+// the binary's build ID is read again if it was replaced at the path, see checkFile.
+// The binary and the store are read without holding the mutex,
+// so the lookups of the other tables (e.g., Cached) don't wait for a large binary.
+func (s *Symbolizer) Table(path string) (*Table, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := s.checkFile(path)
+	if err := p.failed(); err != nil {
+		return nil, err
+	}
+	if !p.hasBuildID {
+		s.mu.Unlock()
+		id, err := readBuildID(path)
+		s.mu.Lock()
+		if err != nil {
+			p.err, p.errTime = err, time.Now()
+			return nil, err
+		}
+		p.buildID, p.hasBuildID = id, true
+		s.resize(path, p)
+	}
+	buildID := p.buildID
+	// Build IDs are hex strings while paths are absolute,
+	// so they can share the same map.
+	key := buildID
+	if key == "" {
+		key = path
+	}
+	if e, ok := s.tables[key]; ok {
+		s.stats.Hits++
+		s.lru.MoveToFront(e)
+		return e.Value.(*cacheEntry).table, nil
+	}
+	s.stats.Misses++
+
+	t, err := s.loadTable(key, path, func() (*Table, error) {
+		return s.load(path, buildID)
+	})
+	if err != nil {
+		p.err, p.errTime = err, time.Now()
+		return nil, err
+	}
+	return t, nil
+}
+
+// load reads the symbol table of the binary at path from the store,
+// or extracts it from the binary and saves it to the store.
+func (s *Symbolizer) load(path, buildID string) (*Table, error) {
+	if s.store != nil && buildID != "" {
+		t, err := s.store.Load(buildID)
+		switch {
+		case err == nil:
+			return t, nil
+		case !errors.Is(err, ErrNotFound):
+			log.Printf("failed to load symbols of %s from the store: %v", path, err)
+		}
+	}
+
+	t, err := Extract(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.store != nil && buildID != "" {
+		if err = s.store.Save(t); err != nil {
+			log.Printf("failed to save symbols of %s to the store: %v", path, err)
+		}
+	}
+	return t, nil
+}
+
+// loadTable caches the table read by load under the key.
+// The caller must hold the mutex, it's released while the table is read and held again on return.
+// The concurrent loads of the same table wait for the first one instead of reading it again.
+func (s *Symbolizer) loadTable(key, path string, load func() (*Table, error)) (*Table, error) {
+	if l, ok := s.loading[key]; ok {
+		s.mu.Unlock()
+		<-l.done
+		s.mu.Lock()
+		return l.table, l.err
+	}
+
+	l := tableLoad{done: make(chan struct{})}
+	s.loading[key] = &l
+	s.mu.Unlock()
+	l.table, l.err = load()
+	s.mu.Lock()
+
+	delete(s.loading, key)
+	// The table might have been added meanwhile, see Add.
+	if _, ok := s.tables[key]; !ok && l.err == nil {
+		s.cache(key, path, l.table)
+	}
+	close(l.done)
+	return l.table, l.err
+}
+
+// Cached reports whether Table returns without reading the binary or the store,
+// i.e., the symbol table of the binary at path is in memory or the binary is known to be unreadable.
+func (s *Symbolizer) Cached(path string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.paths[path]
+	switch {
+	case !ok:
+		return false
+	case p.failed() != nil:
+		return true
+	case !p.hasBuildID:
+		return false
+	}
+	key := p.buildID
+	if key == "" {
+		key = path
+	}
+	_, ok = s.tables[key]
+	return ok
+}
+
+// CachedBuildID reports whether the symbol table of the binary with the build ID is in memory,
+// see TableByBuildID.
+func (s *Symbolizer) CachedBuildID(buildID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.tables[buildID]
+	return ok
+}
+
+// checkFile returns what's known about the binary at path.
+// It's forgotten if the binary was replaced since it was first read,
+// i.e., the path points to a different file (inode) or the file was modified (size or mtime),
+// so its build ID is read again. The tables cached by build ID are kept,
+// since they still describe the old binary. Nothing is forgotten if the file can't be stat'ed,
+// e.g., the process whose root the path is in has exited.
+//
+// The file is checked at most once per fileCheckInterval, so the symbolized addresses don't cost a syscall each.
+// The caller must hold the mutex, it's released while the file is stat'ed and held again on return.
+func (s *Symbolizer) checkFile(path string) *pathInfo {
+	now := time.Now()
+	p, ok := s.paths[path]
+	if ok && now.Sub(p.checked) < fileCheckInterval {
+		return p
+	}
+	// The concurrent lookups of the path don't stat it again meanwhile.
+	if ok {
+		p.checked = now
+	}
+	s.mu.Unlock()
+	fi, err := os.Stat(path)
+	s.mu.Lock()
+
+	// The path might have been checked or forgotten meanwhile.
+	if p, ok = s.paths[path]; !ok {
+		p = &pathInfo{checked: now}
+		s.paths[path] = p
+		s.stats.Paths++
+		s.resize(path, p)
+	}
+	switch {
+	case err != nil:
+		return p
+	case p.file == nil:
+		p.file = fi
+		return p
+	case os.SameFile(p.file, fi) && p.file.Size() == fi.Size() && p.file.ModTime().Equal(fi.ModTime()):
+		return p
+	}
+
+	s.forget(path)
+	p = &pathInfo{file: fi, checked: now}
+	s.paths[path] = p
+	s.stats.Paths++
+	s.resize(path, p)
+	log.Printf("%s was replaced, its symbols are reloaded", path)
+	return p
+}
+
+// resize updates the estimated memory used by the path's info.
+// The info might have been forgotten while the mutex wasn't held, then it's no longer counted.
+func (s *Symbolizer) resize(path string, p *pathInfo) {
+	if s.paths[path] != p {
+		return
+	}
+	size := pathInfoSize + int64(len(path)+len(p.buildID))
+	if p.guessed != nil {
+		size += p.guessed.size()
+	}
+	s.stats.PathBytes += size - p.size
+	p.size = size
+	s.evict()
+}
+
+// forget forgets the binary at path and evicts its table cached by path.
+func (s *Symbolizer) forget(path string) {
+	p, ok := s.paths[path]
+	if !ok {
+		return
+	}
+	if p.hasBuildID && p.buildID == "" {
+		if e, ok := s.tables[path]; ok {
+			s.remove(e)
+		}
+	}
+	delete(s.paths, path)
+	s.stats.Paths--
+	s.stats.PathBytes -= p.size
+}
+
+// ForgetRoots forgets the binaries read via the root directories of the processes which have exited,
+// e.g., /proc/1234/root, so the paths don't pile up as the processes come and go.
+// The tables cached by build ID are kept, since the binaries might still be run by other processes.
+func (s *Symbolizer) ForgetRoots(roots map[string]bool) {
+	if len(roots) == 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for path := range s.paths {
+		if root := procRoot(path); root != "" && roots[root] {
+			s.forget(path)
+		}
+	}
+}
+
+// remove evicts the cached table from memory.
+func (s *Symbolizer) remove(e *list.Element) {
+	ce := s.lru.Remove(e).(*cacheEntry)
+	delete(s.tables, ce.key)
+	s.stats.Tables--
+	s.stats.Bytes -= ce.size
+}
+
+// cache keeps the table in memory evicting the least recently used tables
+// if the memory budget is exceeded.
+// The table is kept even if it alone exceeds the budget, since it's about to be used.
+// It warns if the binary's stack traces are likely truncated.
+func (s *Symbolizer) cache(key, path string, t *Table) {
+	e := cacheEntry{
+		key:   key,
+		table: t,
+		size:  t.size(),
+	}
+	s.tables[key] = s.lru.PushFront(&e)
+	s.stats.Tables++
+	s.stats.Bytes += e.size
+	s.evict()
+
+	if t.FramePointers == FramePointersOmitted {
+		log.Printf("%s likely omits frame pointers, its stack traces may be truncated", path)
+	}
+}
+
+// evict evicts the least recently used tables until the tables, the paths, and the reserved memory fit the budget.
+// The most recently used table is kept.
+func (s *Symbolizer) evict() {
+	for s.maxBytes > 0 && s.stats.Bytes+s.stats.PathBytes+s.stats.Reserved > s.maxBytes && s.lru.Len() > 1 {
+		s.remove(s.lru.Back())
+		s.stats.Evictions++
+	}
+}
+
+// Reserve charges the memory used by the other caches to the budget, e.g., the mappings of the processes,
+// and evicts the tables if the budget is exceeded. The bytes replace the ones reserved before.
+func (s *Symbolizer) Reserve(bytes int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stats.Reserved = bytes
+	s.evict()
+}
+
+// Symbolize returns the symbol at the runtime address
+// which belongs to a memory mapping of the binary at path.
+// The mapping start address and file offset are used to find
+// the virtual address of the instruction in the binary.
+func (s *Symbolizer) Symbolize(path string, mappingStart, mappingOffset, addr uint64) (Symbol, error) {
+	t, err := s.Table(path)
+	if err != nil {
+		return Symbol{}, err
+	}
+	return lookup(t, mappingStart, mappingOffset, addr)
+}
+
+// SymbolizeBuildID is like Symbolize, but the binary is identified by its build ID,
+// see TableByBuildID.
+func (s *Symbolizer) SymbolizeBuildID(buildID string, mappingStart, mappingOffset, addr uint64) (Symbol, error) {
+	t, err := s.TableByBuildID(buildID)
+	if err != nil {
+		return Symbol{}, err
+	}
+	return lookup(t, mappingStart, mappingOffset, addr)
+}
+
+// TableByBuildID returns the symbol table of the binary with the build ID
+// from memory or the store.
+// Unlike Table, it never reads the binary, e.g., when the samples were recorded on another machine.
+func (s *Symbolizer) TableByBuildID(buildID string) (*Table, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.tables[buildID]; ok {
+		s.stats.Hits++
+		s.lru.MoveToFront(e)
+		return e.Value.(*cacheEntry).table, nil
+	}
+	s.stats.Misses++
+
+	if s.store == nil {
+		return nil, ErrNotFound
+	}
+	return s.loadTable(buildID, buildID, func() (*Table, error) {
+		return s.store.Load(buildID)
+	})
+}
+
+// Add caches the symbol table in memory by its build ID,
+// e.g., the table was extracted on another machine.
+func (s *Symbolizer) Add(t *Table) {
+	if t.BuildID == "" {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.tables[t.BuildID]; !ok {
+		s.cache(t.BuildID, t.BuildID, t)
+	}
+}
+
+// lookup returns the symbol at the runtime address
+// which belongs to a memory mapping of the binary described by the table.
+func lookup(t *Table, mappingStart, mappingOffset, addr uint64) (Symbol, error) {
+	vaddr, ok := t.Addr(addr - mappingStart + mappingOffset)
+	if !ok {
+		return Symbol{}, fmt.Errorf("address %#x is outside of executable segments", addr)
+	}
+	sym, ok := t.Lookup(vaddr)
+	if !ok {
+		return Symbol{}, fmt.Errorf("no symbol at %#x", addr)
+	}
+
+	return sym, nil
+}
+
+// GuessFunc returns a synthesized fn_0x<addr> function (see GuessFuncs)
+// at the runtime address if the binary at path has no function symbols at all,
+// e.g., it was fully stripped including .dynsym.
+// The guessed functions are kept in memory only.
+func (s *Symbolizer) GuessFunc(path string, mappingStart, mappingOffset, addr uint64) (Symbol, error) {
+	t, err := s.Table(path)
+	if err != nil {
+		return Symbol{}, err
+	}
+	if len(t.Funcs) != 0 {
+		return Symbol{}, errors.New("binary has symbols")
+	}
+
+	s.mu.Lock()
+	var g *Table
+	if p, ok := s.paths[path]; ok {
+		g = p.guessed
+	}
+	s.mu.Unlock()
+	// The binary is scanned without holding the mutex, the concurrent scans of the same binary are harmless.
+	if g == nil {
+		if g, err = guessTable(path); err != nil {
+			return Symbol{}, err
+		}
+		s.mu.Lock()
+		if p, ok := s.paths[path]; ok {
+			p.guessed = g
+			s.resize(path, p)
+		}
+		s.mu.Unlock()
+	}
+
+	vaddr, ok := g.Addr(addr - mappingStart + mappingOffset)
+	if !ok {
+		return Symbol{}, fmt.Errorf("address %#x is outside of executable segments", addr)
+	}
+	sym, ok := g.Lookup(vaddr)
+	if !ok {
+		return Symbol{}, fmt.Errorf("no function prologue before %#x", addr)
+	}
+
+	return sym, nil
+}
+
+// readBuildID returns the build ID of the ELF binary at path.
+func readBuildID(path string) (string, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open ELF: %w", err)
+	}
+	defer f.Close()
+
+	return BuildID(f)
+}
@@ -0,0 +1,208 @@
+// Package symbol resolves memory addresses of ELF binaries into function names and source lines.
+package symbol
+
+import (
+	"sort"
+)
+
+// Table is a symbol table of an ELF binary.
+// It contains the function address ranges, the source line table, and the inlined functions
+// (if the binary has DWARF), so that addresses can be symbolized without reading the binary again.
+type Table struct {
+	// BuildID identifies the binary, see BuildID.
+	BuildID string
+	// Segments are the executable loadable segments of the binary.
+	// They are used to translate file offsets into virtual addresses.
+	Segments []Segment
+	// Funcs are function symbols sorted by address.
+	Funcs []Func
+	// Files are source file names referenced by Lines.
+	Files []string
+	// Lines is the line table sorted by address.
+	Lines []Line
+	// Inlines are the address ranges of the inlined functions sorted by address and depth.
+	Inlines []Inline
+	// FramePointers tells whether the binary likely maintains frame pointers.
+	// If they are omitted, the stack traces passing through the binary are truncated.
+	FramePointers FramePointers
+}
+
+// Segment is a PT_LOAD program header of the binary.
+type Segment struct {
+	Offset   uint64
+	Vaddr    uint64
+	Filesize uint64
+}
+
+// Func is a function symbol.
+type Func struct {
+	Addr uint64
+	// Size is the function size in bytes,
+	// zero means the size is unknown, e.g., in hand-written assembly.
+	Size uint64
+	Name string
+}
+
+// Line is a row of the line table which maps an address to a source line.
+// The row covers the addresses up to the next row.
+type Line struct {
+	Addr uint64
+	// File is an index in the Files slice.
+	File uint32
+	// Line is a source line number, zero marks the end of a sequence,
+	// i.e., the addresses from Addr onward have no line information.
+	Line uint32
+}
+
+// Inline is a function inlined into the code at the addresses [Addr, Addr+Size),
+// i.e., a DW_TAG_inlined_subroutine range.
+type Inline struct {
+	Addr uint64
+	Size uint64
+	// Depth is the nesting level of the inlined function,
+	// 1 for the functions inlined into a function which has a symbol.
+	Depth uint32
+	Name  string
+	// CallFile (an index in the Files slice) and CallLine are the call site of the function in its caller.
+	CallFile uint32
+	CallLine uint32
+}
+
+// Symbol describes the code at an address.
+type Symbol struct {
+	// Func is the name of the function which contains the address.
+	Func string
+	// Offset is the distance of the address from the start of the function.
+	Offset uint64
+	// File and Line are the source file name and line number,
+	// they are empty if the binary has no line table.
+	File string
+	Line int
+	// Inlined are the functions inlined at the address, the innermost first.
+	// File and Line are in the innermost one, and each function is called by the next one
+	// (the last one by Func) at its CallFile and CallLine.
+	Inlined []InlinedFunc
+}
+
+// InlinedFunc is a function inlined at an address and its call site in the caller, see Symbol.Inlined.
+type InlinedFunc struct {
+	Func     string
+	CallFile string
+	CallLine int
+}
+
+// size estimates the memory used by the table in bytes.
+func (t *Table) size() int64 {
+	const (
+		stringHeader = 16
+		segmentSize  = 24
+		funcSize     = 16 + stringHeader
+		lineSize     = 16
+		inlineSize   = 32 + stringHeader
+	)
+	// The names of the inlined functions share the memory, see inlineNames.
+	n := int64(len(t.BuildID)) +
+		int64(len(t.Segments))*segmentSize +
+		int64(len(t.Funcs))*funcSize +
+		int64(len(t.Lines))*lineSize +
+		int64(len(t.Inlines))*inlineSize
+	for _, fn := range t.Funcs {
+		n += int64(len(fn.Name))
+	}
+	for _, f := range t.Files {
+		n += stringHeader + int64(len(f))
+	}
+	return n
+}
+
+// Addr translates the file offset into a virtual address of the binary.
+// The runtime address of an instruction can be converted into a file offset
+// using the process memory mapping: addr - mapping start + mapping file offset.
+func (t *Table) Addr(offset uint64) (uint64, bool) {
+	for _, s := range t.Segments {
+		if offset >= s.Offset && offset < s.Offset+s.Filesize {
+			return offset - s.Offset + s.Vaddr, true
+		}
+	}
+	return 0, false
+}
+
+// Func returns the function which contains the virtual address of the binary.
+func (t *Table) Func(addr uint64) (Func, bool) {
+	// Find the function with the greatest address not exceeding addr.
+	i := sort.Search(len(t.Funcs), func(i int) bool {
+		return t.Funcs[i].Addr > addr
+	}) - 1
+	if i < 0 {
+		return Func{}, false
+	}
+	fn := t.Funcs[i]
+	if fn.Size != 0 && addr >= fn.Addr+fn.Size {
+		return Func{}, false
+	}
+	return fn, true
+}
+
+// Lookup returns the symbol at the virtual address of the binary.
+func (t *Table) Lookup(addr uint64) (Symbol, bool) {
+	var sym Symbol
+
+	fn, ok := t.Func(addr)
+	if !ok {
+		return sym, false
+	}
+	sym.Func = fn.Name
+	sym.Offset = addr - fn.Addr
+
+	i := sort.Search(len(t.Lines), func(i int) bool {
+		return t.Lines[i].Addr > addr
+	}) - 1
+	if i >= 0 && t.Lines[i].Line != 0 {
+		sym.File = t.Files[t.Lines[i].File]
+		sym.Line = int(t.Lines[i].Line)
+	}
+	sym.Inlined = t.inlined(fn, addr)
+
+	return sym, true
+}
+
+// inlined returns the functions inlined at the address of the function, the innermost first.
+func (t *Table) inlined(fn Func, addr uint64) []InlinedFunc {
+	// The ranges containing the address start within the function before the address.
+	// They are nested, so there is one range per depth.
+	var byDepth []*Inline
+	i := sort.Search(len(t.Inlines), func(i int) bool {
+		return t.Inlines[i].Addr > addr
+	}) - 1
+	for ; i >= 0 && t.Inlines[i].Addr >= fn.Addr; i-- {
+		in := &t.Inlines[i]
+		if addr >= in.Addr+in.Size || in.Depth == 0 {
+			continue
+		}
+		for len(byDepth) < int(in.Depth) {
+			byDepth = append(byDepth, nil)
+		}
+		if byDepth[in.Depth-1] == nil {
+			byDepth[in.Depth-1] = in
+		}
+	}
+
+	// The functions are only known up to the first missing depth.
+	n := 0
+	for n < len(byDepth) && byDepth[n] != nil {
+		n++
+	}
+	if n == 0 {
+		return nil
+	}
+	funcs := make([]InlinedFunc, n)
+	for d := 0; d < n; d++ {
+		in := byDepth[d]
+		funcs[n-1-d] = InlinedFunc{
+			Func:     in.Name,
+			CallFile: t.Files[in.CallFile],
+			CallLine: int(in.CallLine),
+		}
+	}
+	return funcs
+}